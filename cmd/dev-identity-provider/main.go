@@ -1,34 +1,164 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/seriousben/dev-identity-provider/internal/config"
+	"github.com/seriousben/dev-identity-provider/internal/storage"
 	"github.com/seriousben/dev-identity-provider/server"
 )
 
 const (
 	envServerPort       = "SERVER_PORT"
 	envServerRemoteAddr = "SERVER_REMOTE_ADDR"
+	envSCIMToken        = "SCIM_TOKEN"
+	envAdminToken       = "ADMIN_TOKEN"
+	envConfigSource     = "CONFIG_SOURCE"
+	envConfigWatch      = "CONFIG_WATCH"
+	envStorage          = "STORAGE"
+	envSigningKey       = "SIGNING_KEY_FILE"
+	envSigningKeyRotate = "SIGNING_KEY_ROTATION"
+	envSigningKeyGrace  = "SIGNING_KEY_GRACE_PERIOD"
+	envCryptoKey        = "CRYPTO_KEY"
+	envCryptoKeyFile    = "CRYPTO_KEY_FILE"
+	envSAMLKey          = "SAML_KEY_FILE"
+	envSAMLCert         = "SAML_CERT_FILE"
 )
 
+// envOrDefault returns the value of the environment variable, or def when it is not set.
+func envOrDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// durationEnv returns the duration in the environment variable, or def when it is not set or invalid.
+func durationEnv(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
 	var (
 		serverPort       = os.Getenv(envServerPort)
 		serverRemoteAddr = os.Getenv(envServerRemoteAddr)
+		scimToken        = os.Getenv(envSCIMToken)
+		adminToken       = os.Getenv(envAdminToken)
+		configSource     string
+		configWatch      bool
+		storageSpec      string
+		signingKeyFile   string
+		signingKeyRotate time.Duration
+		signingKeyGrace  time.Duration
+		cryptoKey        string
+		cryptoKeyFile    string
+		samlKeyFile      string
+		samlCertFile     string
 	)
 
+	flag.StringVar(&configSource, "config", envOrDefault(envConfigSource, config.DefaultURL),
+		fmt.Sprintf("configuration source: a local directory or config file, a file:// URL, an http(s):// base URL or %q (env %s)", config.Embedded, envConfigSource))
+	flag.BoolVar(&configWatch, "watch", envOrDefault(envConfigWatch, "false") == "true",
+		fmt.Sprintf("reload the configuration when a local configuration source changes (env %s)", envConfigWatch))
+	flag.StringVar(&storageSpec, "storage", envOrDefault(envStorage, "memory"),
+		fmt.Sprintf("where users, clients, tokens and sessions are stored: memory or bolt:<path> (env %s)", envStorage))
+	flag.StringVar(&signingKeyFile, "signing-key", os.Getenv(envSigningKey),
+		fmt.Sprintf("PEM file of the OIDC signing keys, the last one of each algorithm being its current key (env %s)", envSigningKey))
+	flag.DurationVar(&signingKeyRotate, "signing-key-rotation", durationEnv(envSigningKeyRotate, 0),
+		fmt.Sprintf("rotate the OIDC signing key once it is older than this duration, 0 to disable (env %s)", envSigningKeyRotate))
+	flag.DurationVar(&signingKeyGrace, "signing-key-grace-period", durationEnv(envSigningKeyGrace, storage.DefaultSigningKeyGracePeriod),
+		fmt.Sprintf("how long rotated OIDC signing keys are still published (env %s)", envSigningKeyGrace))
+	flag.StringVar(&cryptoKey, "crypto-key", os.Getenv(envCryptoKey),
+		fmt.Sprintf("32-byte key OIDC codes and opaque access tokens are encrypted with, in hex or base64 (env %s)", envCryptoKey))
+	flag.StringVar(&cryptoKeyFile, "crypto-key-file", os.Getenv(envCryptoKeyFile),
+		fmt.Sprintf("file of the OIDC crypto keys, one per line in hex or base64, the last one being the current key (env %s)", envCryptoKeyFile))
+	flag.StringVar(&samlKeyFile, "saml-key", os.Getenv(envSAMLKey),
+		fmt.Sprintf("PEM file of the RSA key the SAML IdP signs with, requires -saml-cert; defaults to a generated one, which changes on every start with in-memory storage (env %s)", envSAMLKey))
+	flag.StringVar(&samlCertFile, "saml-cert", os.Getenv(envSAMLCert),
+		fmt.Sprintf("PEM file of the certificate of the SAML IdP key (env %s)", envSAMLCert))
+	flag.Parse()
+
 	if serverPort == "" {
 		log.Fatalf("missing %s environment variable", envServerPort)
 	}
 	if serverRemoteAddr == "" {
 		log.Fatalf("missing %s environment variable", envServerRemoteAddr)
 	}
+	if scimToken == "" {
+		log.Printf("%s environment variable not set, SCIM provisioning is disabled", envSCIMToken)
+	}
+	if adminToken == "" {
+		log.Printf("%s environment variable not set, key rotation and consent endpoints are disabled", envAdminToken)
+	}
+
+	src, err := config.NewSource(configSource)
+	if err != nil {
+		log.Fatalf("invalid configuration source %q: %v", configSource, err)
+	}
+
+	backend, err := storage.OpenBackend(storageSpec)
+	if err != nil {
+		log.Fatalf("invalid storage %q: %v", storageSpec, err)
+	}
+	defer backend.Close()
+
+	opts := []server.Option{
+		server.WithSCIMToken(scimToken),
+		server.WithAdminToken(adminToken),
+		server.WithConfigSource(src),
+		server.WithBackend(backend),
+		server.WithSigningKeyRotation(signingKeyRotate, signingKeyGrace),
+	}
+	if signingKeyFile != "" {
+		b, err := os.ReadFile(signingKeyFile)
+		if err != nil {
+			log.Fatalf("cannot read signing keys: %v", err)
+		}
+		keys, err := storage.ParsePrivateKeys(b)
+		if err != nil {
+			log.Fatalf("invalid signing keys %s: %v", signingKeyFile, err)
+		}
+		opts = append(opts, server.WithSigningKeys(keys...))
+	}
+	if cryptoKey != "" || cryptoKeyFile != "" {
+		keys, err := loadCryptoKeys(cryptoKey, cryptoKeyFile)
+		if err != nil {
+			log.Fatalf("invalid crypto keys: %v", err)
+		}
+		opts = append(opts, server.WithCryptoKeys(keys...))
+	}
+	if configWatch {
+		opts = append(opts, server.WithConfigWatch())
+	}
 
-	h := server.New(serverRemoteAddr)
+	if samlKeyFile != "" || samlCertFile != "" {
+		kp, err := loadSAMLKeyPair(samlKeyFile, samlCertFile)
+		if err != nil {
+			log.Fatalf("invalid SAML key pair: %v", err)
+		}
+		opts = append(opts, server.WithSAMLKeyPair(kp))
+	}
+
+	h, err := server.New(serverRemoteAddr, opts...)
+	if err != nil {
+		log.Fatalf("error starting server: %v", err)
+	}
 
 	srv := &http.Server{
 		Handler:      h,
@@ -41,3 +171,51 @@ func main() {
 
 	log.Fatal(srv.ListenAndServe())
 }
+
+// loadSAMLKeyPair reads the PEM encoded private key and certificate files.
+func loadSAMLKeyPair(keyFile, certFile string) (*storage.SAMLKeyPair, error) {
+	if keyFile == "" || certFile == "" {
+		return nil, errors.New("both the key and the certificate are required")
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := storage.ParsePrivateKeys(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("%s: found %d private keys, the SAML IdP signs with a single key", keyFile, len(keys))
+	}
+	b, err = os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certFile, err)
+	}
+	return storage.NewSAMLKeyPair(keys[0], cert)
+}
+
+// loadCryptoKeys returns the keys of the file followed by the key, the last one being the current key.
+func loadCryptoKeys(key, file string) ([][]byte, error) {
+	var data string
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+	keys, err := storage.ParseCryptoKeys(data + "\n" + key)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
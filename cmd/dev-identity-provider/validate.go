@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/seriousben/dev-identity-provider/internal/config"
+)
+
+// validate checks the configuration at the location given as argument, including the
+// SAML service provider metadata it references, and prints one error per line.
+// It returns the process exit code.
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s validate [config]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Validates a configuration directory, config file, URL or %q, defaults to the current directory.\n", config.Embedded)
+	}
+	fs.Parse(args)
+
+	location := "."
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		location = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	src, err := config.NewSource(location)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration source %q: %v\n", location, err)
+		return 1
+	}
+
+	if _, err := config.Load(src); err != nil {
+		var errs config.Errors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, e)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: configuration is valid\n", src)
+	return 0
+}
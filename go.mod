@@ -3,24 +3,25 @@ module github.com/seriousben/dev-identity-provider
 go 1.18
 
 require (
+	github.com/beevik/etree v1.1.0
 	github.com/crewjam/saml v0.4.12
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
 	github.com/mattermost/xml-roundtrip-validator v0.1.0
+	github.com/russellhaering/goxmldsig v1.2.0
 	github.com/zenazn/goji v1.0.1
 	github.com/zitadel/oidc v1.13.4
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/text v0.14.0
 	gopkg.in/square/go-jose.v2 v2.6.0
 )
 
 require (
-	github.com/beevik/etree v1.1.0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/gorilla/schema v1.2.0 // indirect
 	github.com/gorilla/securecookie v1.1.1 // indirect
 	github.com/jonboulle/clockwork v0.2.2 // indirect
 	github.com/rs/cors v1.8.3 // indirect
-	github.com/russellhaering/goxmldsig v1.2.0 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/zitadel/logging v0.3.4 // indirect
 	golang.org/x/crypto v0.7.0 // indirect
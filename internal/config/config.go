@@ -0,0 +1,746 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	_ "embed"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// CurrentVersion is the version of the configuration schema described by Config.
+const CurrentVersion = 1
+
+// Schema is the JSON Schema of Config, which editors can use to validate config.json
+// by referencing it in the "$schema" property.
+//
+//go:embed schema.json
+var Schema []byte
+
+// Config is the content of config.json.
+type Config struct {
+	// Schema is the optional JSON Schema reference used by editors.
+	Schema string `json:"$schema,omitempty"`
+	// Version of the configuration schema, defaults to CurrentVersion.
+	Version          int               `json:"version,omitempty"`
+	Users            []User            `json:"users,omitempty"`
+	Clients          []Client          `json:"clients,omitempty"`
+	Scopes           []Scope           `json:"scopes,omitempty"`
+	ServiceProviders []ServiceProvider `json:"service_providers,omitempty"`
+}
+
+// User is a user able to log in through OIDC and SAML.
+type User struct {
+	ID            string   `json:"id"`
+	Username      string   `json:"username"`
+	Password      string   `json:"password,omitempty"`
+	Firstname     string   `json:"firstname,omitempty"`
+	Lastname      string   `json:"lastname,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"emailVerified,omitempty"`
+	Disabled      bool     `json:"disabled,omitempty"`
+	// Attributes are arbitrary values asserted as claims by the claim mappings of the scopes and clients.
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Scope is a scope clients can request, asserting the claims it maps once granted.
+type Scope struct {
+	Name   string         `json:"name"`
+	Claims []ClaimMapping `json:"claims,omitempty"`
+	// Clients are the clients allowed to request the scope, defaults to all of them.
+	Clients []string `json:"clients,omitempty"`
+	// Consent requires the user to consent to the scope before it is granted.
+	Consent bool `json:"consent,omitempty"`
+}
+
+// ClaimMapping asserts a user attribute as a claim.
+type ClaimMapping struct {
+	Claim string `json:"claim"`
+	// Attribute is the user attribute asserted, defaults to the claim name.
+	Attribute string `json:"attribute,omitempty"`
+	// Value is asserted instead of a user attribute when set.
+	Value interface{} `json:"value,omitempty"`
+	// Targets are id_token, access_token (JWT access tokens and introspection) and userinfo, defaults to all of them.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// GroupsClaim is the claim of the groups scope of a client.
+type GroupsClaim struct {
+	// Name of the claim, like roles or cognito:groups, defaults to groups.
+	Name string `json:"name,omitempty"`
+	// Format is array (default) for an array of group names, or string for a comma separated string.
+	Format string `json:"format,omitempty"`
+}
+
+// reservedClaims are the claims set by the provider, which cannot be mapped from user attributes.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"auth_time": true, "nonce": true, "acr": true, "amr": true, "azp": true, "at_hash": true, "c_hash": true,
+	"sid": true, "act": true, "scope": true, "client_id": true, "active": true,
+	"name": true, "given_name": true, "family_name": true, "preferred_username": true, "email": true, "email_verified": true,
+}
+
+// Client is an OIDC client. Unset properties default to the ones of its application type.
+type Client struct {
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// ApplicationType is web (default), native or user_agent for single page applications.
+	ApplicationType string `json:"applicationType,omitempty"`
+	// AuthMethod is client_secret_basic (default for web clients), client_secret_post,
+	// none (default for native and user_agent clients) or private_key_jwt.
+	AuthMethod             string   `json:"authMethod,omitempty"`
+	RedirectURIs           []string `json:"redirectUris,omitempty"`
+	PostLogoutRedirectURIs []string `json:"postLogoutRedirectUris,omitempty"`
+	// FrontchannelLogoutURI is loaded in an iframe, with the iss and sid of the session,
+	// when the user logs out of the session the client was logged in with.
+	FrontchannelLogoutURI string `json:"frontchannelLogoutUri,omitempty"`
+	// BackchannelLogoutURI receives a logout token when the session the client was logged in with ends.
+	BackchannelLogoutURI string `json:"backchannelLogoutUri,omitempty"`
+	// ResponseTypes are code (default), id_token or "id_token token".
+	ResponseTypes []string `json:"responseTypes,omitempty"`
+	// GrantTypes default to authorization_code and refresh_token.
+	GrantTypes []string `json:"grantTypes,omitempty"`
+	// AccessTokenType is bearer (default) for opaque tokens, or jwt.
+	AccessTokenType string `json:"accessTokenType,omitempty"`
+	// DevMode allows non-compliant redirect URIs, like http ones for user_agent clients.
+	DevMode bool `json:"devMode,omitempty"`
+	// ClockSkew is a duration like 5s applied to the times and expirations of the tokens.
+	ClockSkew string `json:"clockSkew,omitempty"`
+	// IDTokenUserinfoClaimsAssertion asserts the profile, email, phone and address claims
+	// into the id_token even when an access token is issued.
+	IDTokenUserinfoClaimsAssertion bool `json:"idTokenUserinfoClaimsAssertion,omitempty"`
+	// IDTokenSignedResponseAlg is the algorithm the id_tokens and JWT access tokens of the client
+	// are signed with: RS256 (default), PS256, ES256 or EdDSA.
+	IDTokenSignedResponseAlg string `json:"idTokenSignedResponseAlg,omitempty"`
+	// RequirePushedAuthorizationRequests only accepts the authorization requests the client
+	// pushed to the pushed authorization request endpoint first.
+	RequirePushedAuthorizationRequests bool `json:"requirePushedAuthorizationRequests,omitempty"`
+	// RequireConsent requires the user to consent to all the scopes the client requests.
+	RequireConsent bool `json:"requireConsent,omitempty"`
+	// Keys are the public keys the client signs its assertions with, for private_key_jwt.
+	Keys []jose.JSONWebKey `json:"keys,omitempty"`
+	// Claims are asserted for the client on top of the claims of the granted scopes.
+	Claims []ClaimMapping `json:"claims,omitempty"`
+	// GroupsClaim is the claim the groups of the user are asserted in with the groups scope.
+	GroupsClaim *GroupsClaim `json:"groupsClaim,omitempty"`
+	// ClientCredentials configures the tokens of the client_credentials grant.
+	ClientCredentials *ClientCredentials `json:"clientCredentials,omitempty"`
+	// TokenExchange configures what the client may exchange tokens for with the token exchange grant.
+	TokenExchange *TokenExchange `json:"tokenExchange,omitempty"`
+	SCIM          *SCIMTarget    `json:"scim,omitempty"`
+}
+
+// ClientCredentials configures the tokens a client gets with the client_credentials grant.
+type ClientCredentials struct {
+	// Scopes are the scopes the client may request, all of them are granted when it requests none.
+	Scopes []string `json:"scopes,omitempty"`
+	// Audience is the audience of the tokens, the client_id by default.
+	Audience []string `json:"audience,omitempty"`
+}
+
+// TokenExchange configures the token exchange grant (RFC 8693) of a client.
+type TokenExchange struct {
+	// Audience are the audiences and resources the client may exchange tokens for.
+	Audience []string `json:"audience"`
+	// SubjectClients are the clients whose tokens the client may exchange,
+	// besides the tokens issued to it or for it.
+	SubjectClients []string `json:"subjectClients,omitempty"`
+	// Impersonation allows exchanging a token without actor_token, the client then acts as the subject.
+	Impersonation bool `json:"impersonation,omitempty"`
+	// Delegation allows exchanging a token with an actor_token, the new token gets an act claim.
+	Delegation bool `json:"delegation,omitempty"`
+	// ActorSubjects are the subjects whose tokens the client may use as actor_token,
+	// besides the tokens issued to it.
+	ActorSubjects []string `json:"actorSubjects,omitempty"`
+}
+
+// ServiceProvider is a SAML service provider.
+type ServiceProvider struct {
+	ID string `json:"id"`
+	// MetadataURL is the path of the service provider metadata, relative to config.json.
+	MetadataURL string      `json:"metadataUrl"`
+	SCIM        *SCIMTarget `json:"scim,omitempty"`
+	// Attributes are asserted instead of the default attributes when set.
+	Attributes []AttributeMapping `json:"attributes,omitempty"`
+	// AllowUnsignedLogoutRequests accepts the LogoutRequests the service provider does not sign,
+	// they must be signed otherwise.
+	AllowUnsignedLogoutRequests bool `json:"allowUnsignedLogoutRequests,omitempty"`
+}
+
+// AttributeMapping asserts a user field or attribute as a SAML attribute.
+type AttributeMapping struct {
+	Name string `json:"name"`
+	// NameFormat is basic, uri or unspecified, defaults to uri for names with a colon and to basic otherwise.
+	NameFormat   string `json:"nameFormat,omitempty"`
+	FriendlyName string `json:"friendlyName,omitempty"`
+	// Field is the user field asserted: id, username, email, firstname, lastname, name or groups.
+	Field string `json:"field,omitempty"`
+	// Attribute is the user attribute asserted, defaults to the attribute name without field or value.
+	Attribute string `json:"attribute,omitempty"`
+	// Value is asserted instead of a user field or attribute when set.
+	Value interface{} `json:"value,omitempty"`
+	// Join asserts multiple values as a single value joined with this separator.
+	Join string `json:"join,omitempty"`
+}
+
+// attributeNameFormats are the URNs of the NameFormat of the attribute mappings.
+var attributeNameFormats = map[string]string{
+	"basic":       storage.AttributeNameFormatBasic,
+	"uri":         storage.AttributeNameFormatURI,
+	"unspecified": storage.AttributeNameFormatUnspecified,
+}
+
+// SCIMTarget is the SCIM endpoint users are pushed to.
+type SCIMTarget struct {
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+}
+
+// Parse strictly decodes and validates config.json. Unknown fields and invalid values
+// are reported as Errors pointing at their line in file.
+func Parse(file string, data []byte) (*Config, error) {
+	offsets, errs := checkFields(file, data)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			path := fieldPath(typeErr.Field)
+			offset := int(typeErr.Offset)
+			if off, ok := offsets[path]; ok {
+				offset = off
+			}
+			return nil, Errors{newError(file, data, offset, path,
+				fmt.Sprintf("cannot use %s as %s", typeErr.Value, typeErr.Type))}
+		}
+		return nil, Errors{&Error{File: file, Msg: err.Error()}}
+	}
+
+	at := func(path, msg string, args ...interface{}) {
+		errs = append(errs, newError(file, data, offsets.of(path), path, fmt.Sprintf(msg, args...)))
+	}
+	cfg.validate(at)
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			if errs[i].Line != errs[j].Line {
+				return errs[i].Line < errs[j].Line
+			}
+			return errs[i].Column < errs[j].Column
+		})
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate(at func(path, msg string, args ...interface{})) {
+	if cfg.Version < 0 || cfg.Version > CurrentVersion {
+		at("version", "unsupported version %d, the latest supported version is %d", cfg.Version, CurrentVersion)
+	}
+
+	userIDs := map[string]bool{}
+	usernames := map[string]bool{}
+	for i, u := range cfg.Users {
+		path := fmt.Sprintf("users[%d]", i)
+		switch {
+		case u.ID == "":
+			at(path, "id is required")
+		case userIDs[u.ID]:
+			at(path+".id", "duplicate user id %q", u.ID)
+		}
+		userIDs[u.ID] = true
+		switch {
+		case u.Username == "":
+			at(path, "username is required")
+		case usernames[u.Username]:
+			at(path+".username", "duplicate username %q", u.Username)
+		}
+		usernames[u.Username] = true
+		if u.Email != "" && !strings.Contains(u.Email, "@") {
+			at(path+".email", "invalid email %q", u.Email)
+		}
+	}
+
+	clientIDs := map[string]bool{}
+	for i, c := range cfg.Clients {
+		path := fmt.Sprintf("clients[%d]", i)
+		switch {
+		case c.ClientID == "":
+			at(path, "clientId is required")
+		case clientIDs[c.ClientID]:
+			at(path+".clientId", "duplicate client id %q", c.ClientID)
+		}
+		clientIDs[c.ClientID] = true
+		c.validate(path, at)
+	}
+
+	scopeNames := map[string]bool{}
+	for i, scope := range cfg.Scopes {
+		path := fmt.Sprintf("scopes[%d]", i)
+		switch {
+		case scope.Name == "":
+			at(path, "name is required")
+		case strings.ContainsAny(scope.Name, " \t\n\""):
+			at(path+".name", "invalid scope name %q", scope.Name)
+		case scopeNames[scope.Name]:
+			at(path+".name", "duplicate scope %q", scope.Name)
+		}
+		scopeNames[scope.Name] = true
+		validateClaims(path+".claims", scope.Claims, at)
+		for j, id := range scope.Clients {
+			if !clientIDs[id] {
+				at(fmt.Sprintf("%s.clients[%d]", path, j), "unknown client %q", id)
+			}
+		}
+	}
+
+	spIDs := map[string]bool{}
+	for i, sp := range cfg.ServiceProviders {
+		path := fmt.Sprintf("service_providers[%d]", i)
+		switch {
+		case sp.ID == "":
+			at(path, "id is required")
+		case spIDs[sp.ID]:
+			at(path+".id", "duplicate service provider id %q", sp.ID)
+		}
+		spIDs[sp.ID] = true
+		if sp.MetadataURL == "" {
+			at(path, "metadataUrl is required")
+		}
+		sp.SCIM.validate(path+".scim", at)
+		validateAttributes(path+".attributes", sp.Attributes, at)
+	}
+}
+
+func (c *Client) validate(path string, at func(path, msg string, args ...interface{})) {
+	for j, uri := range c.RedirectURIs {
+		if u, err := url.Parse(uri); err != nil || u.Scheme == "" {
+			at(fmt.Sprintf("%s.redirectUris[%d]", path, j), "invalid redirect URI %q, an absolute URI is required", uri)
+		}
+	}
+	for j, uri := range c.PostLogoutRedirectURIs {
+		if u, err := url.Parse(uri); err != nil || u.Scheme == "" {
+			at(fmt.Sprintf("%s.postLogoutRedirectUris[%d]", path, j), "invalid post logout redirect URI %q, an absolute URI is required", uri)
+		}
+	}
+	if c.FrontchannelLogoutURI != "" {
+		if u, err := url.Parse(c.FrontchannelLogoutURI); err != nil || u.Scheme == "" {
+			at(path+".frontchannelLogoutUri", "invalid front-channel logout URI %q, an absolute URI is required", c.FrontchannelLogoutURI)
+		}
+	}
+	if c.BackchannelLogoutURI != "" {
+		if u, err := url.Parse(c.BackchannelLogoutURI); err != nil || u.Scheme == "" {
+			at(path+".backchannelLogoutUri", "invalid back-channel logout URI %q, an absolute URI is required", c.BackchannelLogoutURI)
+		}
+	}
+
+	if c.ApplicationType != "" {
+		if _, err := op.ApplicationTypeString(c.ApplicationType); err != nil {
+			at(path+".applicationType", "invalid application type %q, must be one of %s", c.ApplicationType, strings.Join(op.ApplicationTypeStrings(), ", "))
+		}
+	}
+	if c.AccessTokenType != "" {
+		if _, err := op.AccessTokenTypeString(c.AccessTokenType); err != nil {
+			at(path+".accessTokenType", "invalid access token type %q, must be bearer or jwt", c.AccessTokenType)
+		}
+	}
+	if c.ClockSkew != "" {
+		if d, err := time.ParseDuration(c.ClockSkew); err != nil || d < 0 {
+			at(path+".clockSkew", "invalid clock skew %q, a positive duration like 5s is required", c.ClockSkew)
+		}
+	}
+
+	if c.IDTokenSignedResponseAlg != "" {
+		supported := false
+		for _, alg := range storage.SigningAlgorithms {
+			supported = supported || alg == c.IDTokenSignedResponseAlg
+		}
+		if !supported {
+			at(path+".idTokenSignedResponseAlg", "invalid signing algorithm %q, must be one of %s", c.IDTokenSignedResponseAlg, strings.Join(storage.SigningAlgorithms, ", "))
+		}
+	}
+
+	cl := c.toStorage()
+	switch cl.ClientAuthMethod {
+	case oidc.AuthMethodBasic, oidc.AuthMethodPost:
+		if c.ClientSecret == "" {
+			at(path, "clientSecret is required with authMethod %s", cl.ClientAuthMethod)
+		}
+	case oidc.AuthMethodNone:
+		if c.ClientSecret != "" {
+			at(path+".clientSecret", "clientSecret must not be set with authMethod none")
+		}
+	case oidc.AuthMethodPrivateKeyJWT:
+		if len(c.Keys) == 0 {
+			at(path, "keys are required with authMethod private_key_jwt")
+		}
+	default:
+		at(path+".authMethod", "invalid auth method %q, must be one of client_secret_basic, client_secret_post, none, private_key_jwt", c.AuthMethod)
+	}
+	for j, key := range c.Keys {
+		keyPath := fmt.Sprintf("%s.keys[%d]", path, j)
+		switch {
+		case key.KeyID == "":
+			at(keyPath, "kid is required")
+		case !key.Valid() || !key.IsPublic():
+			at(keyPath, "invalid key %q, a public key is required", key.KeyID)
+		}
+	}
+
+	grants := map[oidc.GrantType]bool{}
+	for j, g := range cl.ClientGrantTypes {
+		switch g {
+		case oidc.GrantTypeCode, oidc.GrantTypeRefreshToken, oidc.GrantTypeImplicit, oidc.GrantTypeClientCredentials,
+			oidc.GrantTypeBearer, oidc.GrantTypeTokenExchange, storage.GrantTypeDeviceCode:
+		default:
+			at(fmt.Sprintf("%s.grantTypes[%d]", path, j), "invalid grant type %q", g)
+		}
+		grants[g] = true
+	}
+	for j, rt := range cl.ClientResponseTypes {
+		rtPath := fmt.Sprintf("%s.responseTypes[%d]", path, j)
+		switch rt {
+		case oidc.ResponseTypeCode:
+			if !grants[oidc.GrantTypeCode] {
+				at(rtPath, "response type code requires the authorization_code grant type")
+			}
+		case oidc.ResponseTypeIDToken, oidc.ResponseTypeIDTokenOnly:
+			if !grants[oidc.GrantTypeImplicit] {
+				at(rtPath, "response type %q requires the implicit grant type", rt)
+			}
+		default:
+			at(rtPath, "invalid response type %q, must be one of code, id_token, id_token token", rt)
+		}
+	}
+	if grants[oidc.GrantTypeClientCredentials] && cl.ClientAuthMethod == oidc.AuthMethodNone {
+		at(path+".grantTypes", "grant type client_credentials requires an authenticated client, authMethod must not be none")
+	}
+	if c.ClientCredentials != nil && !grants[oidc.GrantTypeClientCredentials] {
+		at(path+".clientCredentials", "clientCredentials requires the client_credentials grant type")
+	}
+	if c.ClientCredentials != nil {
+		for j, aud := range c.ClientCredentials.Audience {
+			if aud == "" {
+				at(fmt.Sprintf("%s.clientCredentials.audience[%d]", path, j), "audience must not be empty")
+			}
+		}
+	}
+	if c.TokenExchange != nil {
+		tePath := path + ".tokenExchange"
+		if !grants[oidc.GrantTypeTokenExchange] {
+			at(tePath, "tokenExchange requires the %s grant type", oidc.GrantTypeTokenExchange)
+		}
+		if !c.TokenExchange.Impersonation && !c.TokenExchange.Delegation {
+			at(tePath, "tokenExchange must allow impersonation, delegation or both")
+		}
+		if len(c.TokenExchange.Audience) == 0 {
+			at(tePath+".audience", "audience must not be empty")
+		}
+		for j, aud := range c.TokenExchange.Audience {
+			if aud == "" {
+				at(fmt.Sprintf("%s.audience[%d]", tePath, j), "audience must not be empty")
+			}
+		}
+	} else if grants[oidc.GrantTypeTokenExchange] {
+		at(path+".grantTypes", "grant type %s requires tokenExchange", oidc.GrantTypeTokenExchange)
+	}
+
+	validateClaims(path+".claims", c.Claims, at)
+	if c.GroupsClaim != nil {
+		if reservedClaims[c.GroupsClaim.Name] {
+			at(path+".groupsClaim.name", "claim %q is set by the provider and cannot be used for the groups", c.GroupsClaim.Name)
+		}
+		switch storage.GroupsFormat(c.GroupsClaim.Format) {
+		case "", storage.GroupsFormatArray, storage.GroupsFormatString:
+		default:
+			at(path+".groupsClaim.format", "invalid format %q, must be array or string", c.GroupsClaim.Format)
+		}
+	}
+	c.SCIM.validate(path+".scim", at)
+}
+
+func validateClaims(path string, claims []ClaimMapping, at func(path, msg string, args ...interface{})) {
+	for i, m := range claims {
+		claimPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case m.Claim == "":
+			at(claimPath, "claim is required")
+		case reservedClaims[m.Claim]:
+			at(claimPath+".claim", "claim %q is set by the provider and cannot be mapped", m.Claim)
+		}
+		if m.Attribute != "" && m.Value != nil {
+			at(claimPath, "attribute and value are mutually exclusive")
+		}
+		for j, target := range m.Targets {
+			valid := false
+			for _, t := range storage.ClaimTargets {
+				valid = valid || string(t) == target
+			}
+			if !valid {
+				at(fmt.Sprintf("%s.targets[%d]", claimPath, j), "invalid target %q, must be one of id_token, access_token, userinfo", target)
+			}
+		}
+	}
+}
+
+func validateAttributes(path string, attributes []AttributeMapping, at func(path, msg string, args ...interface{})) {
+	for i, m := range attributes {
+		attributePath := fmt.Sprintf("%s[%d]", path, i)
+		if m.Name == "" {
+			at(attributePath, "name is required")
+		}
+		if _, ok := attributeNameFormats[m.NameFormat]; m.NameFormat != "" && !ok {
+			at(attributePath+".nameFormat", "invalid name format %q, must be basic, uri or unspecified", m.NameFormat)
+		}
+		if m.Field != "" {
+			valid := false
+			for _, f := range storage.UserFields {
+				valid = valid || string(f) == m.Field
+			}
+			if !valid {
+				at(attributePath+".field", "invalid field %q, must be one of id, username, email, firstname, lastname, name, groups", m.Field)
+			}
+		}
+		set := 0
+		for _, isSet := range []bool{m.Field != "", m.Attribute != "", m.Value != nil} {
+			if isSet {
+				set++
+			}
+		}
+		if set > 1 {
+			at(attributePath, "field, attribute and value are mutually exclusive")
+		}
+	}
+}
+
+func attributesToStorage(attributes []AttributeMapping) []storage.AttributeMapping {
+	if len(attributes) == 0 {
+		return nil
+	}
+	mappings := make([]storage.AttributeMapping, 0, len(attributes))
+	for _, m := range attributes {
+		nameFormat := m.NameFormat
+		if nameFormat == "" {
+			nameFormat = "basic"
+			if strings.Contains(m.Name, ":") {
+				nameFormat = "uri"
+			}
+		}
+		mappings = append(mappings, storage.AttributeMapping{
+			Name:         m.Name,
+			NameFormat:   attributeNameFormats[nameFormat],
+			FriendlyName: m.FriendlyName,
+			Field:        storage.UserField(m.Field),
+			Attribute:    m.Attribute,
+			Value:        m.Value,
+			Join:         m.Join,
+		})
+	}
+	return mappings
+}
+
+func claimsToStorage(claims []ClaimMapping) []storage.ClaimMapping {
+	if len(claims) == 0 {
+		return nil
+	}
+	mappings := make([]storage.ClaimMapping, 0, len(claims))
+	for _, m := range claims {
+		mapping := storage.ClaimMapping{Claim: m.Claim, Attribute: m.Attribute, Value: m.Value}
+		for _, t := range m.Targets {
+			mapping.Targets = append(mapping.Targets, storage.ClaimTarget(t))
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// toStorage returns the client, starting from the defaults of its application type.
+// Invalid values are ignored, they are reported by validate.
+func (c *Client) toStorage() *storage.Client {
+	var cl *storage.Client
+	appType, _ := op.ApplicationTypeString(c.ApplicationType)
+	switch appType {
+	case op.ApplicationTypeNative:
+		cl = storage.NativeClient(c.ClientID, c.RedirectURIs...)
+		cl.Secret = c.ClientSecret
+	case op.ApplicationTypeUserAgent:
+		cl = storage.UserAgentClient(c.ClientID, c.RedirectURIs...)
+		cl.Secret = c.ClientSecret
+	default:
+		cl = storage.WebClient(c.ClientID, c.ClientSecret, c.RedirectURIs...)
+	}
+
+	cl.ClientPostLogoutRedirectURIs = c.PostLogoutRedirectURIs
+	cl.FrontChannelLogoutURI = c.FrontchannelLogoutURI
+	cl.BackChannelLogoutURI = c.BackchannelLogoutURI
+	if c.AuthMethod != "" {
+		cl.ClientAuthMethod = oidc.AuthMethod(c.AuthMethod)
+	}
+	if len(c.GrantTypes) > 0 {
+		cl.ClientGrantTypes = make([]oidc.GrantType, len(c.GrantTypes))
+		cl.ClientResponseTypes = nil
+		for i, g := range c.GrantTypes {
+			cl.ClientGrantTypes[i] = oidc.GrantType(g)
+			// without explicit response types, every flow the grant types allow is enabled
+			switch cl.ClientGrantTypes[i] {
+			case oidc.GrantTypeCode:
+				cl.ClientResponseTypes = append(cl.ClientResponseTypes, oidc.ResponseTypeCode)
+			case oidc.GrantTypeImplicit:
+				cl.ClientResponseTypes = append(cl.ClientResponseTypes, oidc.ResponseTypeIDToken, oidc.ResponseTypeIDTokenOnly)
+			}
+		}
+	}
+	if len(c.ResponseTypes) > 0 {
+		cl.ClientResponseTypes = make([]oidc.ResponseType, len(c.ResponseTypes))
+		for i, rt := range c.ResponseTypes {
+			cl.ClientResponseTypes[i] = oidc.ResponseType(rt)
+		}
+	}
+	if c.AccessTokenType != "" {
+		cl.ClientAccessTokenType, _ = op.AccessTokenTypeString(c.AccessTokenType)
+	}
+	cl.ClientDevMode = c.DevMode
+	if c.ClockSkew != "" {
+		cl.ClientClockSkew, _ = time.ParseDuration(c.ClockSkew)
+	}
+	cl.ClientIDTokenUserinfoClaimsAssertion = c.IDTokenUserinfoClaimsAssertion
+	cl.ClientIDTokenSignedResponseAlg = c.IDTokenSignedResponseAlg
+	cl.ClientRequirePushedRequests = c.RequirePushedAuthorizationRequests
+	cl.RequireConsent = c.RequireConsent
+	cl.Keys = c.Keys
+	cl.Claims = claimsToStorage(c.Claims)
+	if c.GroupsClaim != nil {
+		cl.GroupsClaim = &storage.GroupsClaim{
+			Name:   c.GroupsClaim.Name,
+			Format: storage.GroupsFormat(c.GroupsClaim.Format),
+		}
+	}
+	if c.ClientCredentials != nil {
+		cl.ClientCredentials = &storage.ClientCredentials{
+			Scopes:   c.ClientCredentials.Scopes,
+			Audience: c.ClientCredentials.Audience,
+		}
+	}
+	if c.TokenExchange != nil {
+		cl.TokenExchange = &storage.TokenExchange{
+			Audience:       c.TokenExchange.Audience,
+			SubjectClients: c.TokenExchange.SubjectClients,
+			Impersonation:  c.TokenExchange.Impersonation,
+			Delegation:     c.TokenExchange.Delegation,
+			ActorSubjects:  c.TokenExchange.ActorSubjects,
+		}
+	}
+	cl.SCIM = c.SCIM.toStorage()
+	return cl
+}
+
+func (t *SCIMTarget) validate(path string, at func(path, msg string, args ...interface{})) {
+	if t == nil {
+		return
+	}
+	if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		at(path+".url", "invalid SCIM URL %q, an http or https URL is required", t.URL)
+	}
+}
+
+func (t *SCIMTarget) toStorage() *storage.SCIMTarget {
+	if t == nil {
+		return nil
+	}
+	return &storage.SCIMTarget{URL: t.URL, Token: t.Token}
+}
+
+// Load reads, validates and converts the configuration of the source, including the
+// metadata of the SAML service providers, so that it can be applied to the storage at once.
+func Load(src Source) (*storage.ConfigState, error) {
+	data, err := src.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	file := src.ConfigName()
+	cfg, err := Parse(file, data)
+	if err != nil {
+		return nil, err
+	}
+	offsets, _ := checkFields(file, data)
+
+	state := &storage.ConfigState{}
+	for _, u := range cfg.Users {
+		state.Users = append(state.Users, &storage.User{
+			ID:            u.ID,
+			Username:      u.Username,
+			Password:      u.Password,
+			Firstname:     u.Firstname,
+			Lastname:      u.Lastname,
+			Groups:        u.Groups,
+			Email:         u.Email,
+			EmailVerified: u.EmailVerified,
+			Disabled:      u.Disabled,
+			Attributes:    u.Attributes,
+		})
+	}
+
+	for _, c := range cfg.Clients {
+		state.Clients = append(state.Clients, c.toStorage())
+	}
+
+	for _, scope := range cfg.Scopes {
+		state.Scopes = append(state.Scopes, &storage.Scope{
+			Name:    scope.Name,
+			Claims:  claimsToStorage(scope.Claims),
+			Clients: scope.Clients,
+			Consent: scope.Consent,
+		})
+	}
+
+	var errs Errors
+	for i, sp := range cfg.ServiceProviders {
+		path := fmt.Sprintf("service_providers[%d].metadataUrl", i)
+		b, err := src.ReadFile(sp.MetadataURL)
+		if err != nil {
+			errs = append(errs, newError(file, data, offsets.of(path), path, err.Error()))
+			continue
+		}
+
+		meta, err := storage.NewMetadata(b)
+		if err != nil {
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				errs = append(errs, &Error{File: sp.MetadataURL, Line: syntaxErr.Line, Msg: syntaxErr.Msg})
+			} else {
+				errs = append(errs, newError(file, data, offsets.of(path), path, fmt.Sprintf("invalid metadata %s: %v", sp.MetadataURL, err)))
+			}
+			continue
+		}
+
+		state.ServiceProviders = append(state.ServiceProviders, &storage.ServiceProvider{
+			ID:         sp.ID,
+			Metadata:   meta,
+			SCIM:       sp.SCIM.toStorage(),
+			Attributes: attributesToStorage(sp.Attributes),
+
+			AllowUnsignedLogoutRequests: sp.AllowUnsignedLogoutRequests,
+		})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return state, nil
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		file     string
+		wantErrs []string
+	}{
+		{
+			file: "valid.json",
+		},
+		{
+			file: "unknown_field.json",
+			wantErrs: []string{
+				`unknown_field.json:5:7: clients[0]: unknown field "redirectURIs", did you mean "redirectUris"?`,
+				`unknown_field.json:6:7: clients[0]: unknown field "secret"`,
+			},
+		},
+		{
+			file: "syntax_error.json",
+			wantErrs: []string{
+				`syntax_error.json:3:44: invalid character ',' looking for beginning of value`,
+			},
+		},
+		{
+			file: "type_error.json",
+			wantErrs: []string{
+				`type_error.json:4:7: users[0].id: cannot use number as string`,
+			},
+		},
+		{
+			file: "version.json",
+			wantErrs: []string{
+				`version.json:2:3: version: unsupported version 2, the latest supported version is 1`,
+			},
+		},
+		{
+			file: "users.json",
+			wantErrs: []string{
+				`users.json:3:43: users[0].email: invalid email "user1"`,
+				`users.json:4:7: users[1].id: duplicate user id "user1"`,
+				`users.json:4:22: users[1].username: duplicate username "user1"`,
+				`users.json:5:5: users[2]: id is required`,
+			},
+		},
+		{
+			file: "clients.json",
+			wantErrs: []string{
+				`clients.json:3:5: clients[0]: clientSecret is required with authMethod client_secret_basic`,
+				`clients.json:5:24: clients[0].redirectUris[0]: invalid redirect URI "/callback", an absolute URI is required`,
+				`clients.json:6:22: clients[0].grantTypes[0]: invalid grant type "password"`,
+				`clients.json:11:7: clients[1].clientSecret: clientSecret must not be set with authMethod none`,
+				`clients.json:12:25: clients[1].responseTypes[0]: response type "id_token" requires the implicit grant type`,
+				`clients.json:14:5: clients[2]: keys are required with authMethod private_key_jwt`,
+				`clients.json:15:7: clients[2].clientId: duplicate client id "web"`,
+			},
+		},
+		{
+			file: "scopes.json",
+			wantErrs: []string{
+				`scopes.json:5:7: scopes[0].name: invalid scope name "profile extended"`,
+				`scopes.json:6:20: scopes[0].claims[0].claim: claim "sub" is set by the provider and cannot be mapped`,
+				`scopes.json:10:18: scopes[1].claims[0]: attribute and value are mutually exclusive`,
+				`scopes.json:10:100: scopes[1].claims[0].targets[0]: invalid target "token", must be one of id_token, access_token, userinfo`,
+				`scopes.json:11:26: scopes[1].clients[1]: unknown client "mobile"`,
+				`scopes.json:13:7: scopes[2].name: duplicate scope "department"`,
+			},
+		},
+		{
+			file: "attributes.json",
+			wantErrs: []string{
+				`attributes.json:7:27: service_providers[0].attributes[0].field: invalid field "mail", must be one of id, username, email, firstname, lastname, name, groups`,
+				`attributes.json:8:9: service_providers[0].attributes[1]: field, attribute and value are mutually exclusive`,
+				`attributes.json:9:26: service_providers[0].attributes[2].nameFormat: invalid name format "urn", must be basic, uri or unspecified`,
+				`attributes.json:10:9: service_providers[0].attributes[3]: name is required`,
+			},
+		},
+		{
+			file: "scim.json",
+			wantErrs: []string{
+				`scim.json:6:17: clients[0].scim.url: invalid SCIM URL "ftp://app.example.com/scim", an http or https URL is required`,
+				`scim.json:13:17: service_providers[0].scim.url: invalid SCIM URL "/scim/v2", an http or https URL is required`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata/parse", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Parse(tt.file, data)
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				return
+			}
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("Parse() error = %v, want Errors", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.wantErrs, "\n") {
+				t.Errorf("Parse() errors =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.wantErrs, "\n"))
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	src, err := NewSource("testdata/source")
+	if err != nil {
+		t.Fatalf("NewSource() error = %v", err)
+	}
+	state, err := Load(src)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(state.Users) != 1 || state.Users[0].ID != "user1" {
+		t.Errorf("Users = %+v, want user1", state.Users)
+	}
+	if len(state.Clients) != 1 || state.Clients[0].GetID() != "web" {
+		t.Errorf("Clients = %+v, want web", state.Clients)
+	}
+	if len(state.ServiceProviders) != 1 {
+		t.Fatalf("ServiceProviders = %+v, want sp", state.ServiceProviders)
+	}
+	if got, want := state.ServiceProviders[0].Metadata.EntityID, "https://samltest.id/saml/sp"; got != want {
+		t.Errorf("EntityID = %q, want %q", got, want)
+	}
+}
+
+func TestLoadMissingMetadata(t *testing.T) {
+	src, err := NewSource("testdata/missing-metadata")
+	if err != nil {
+		t.Fatalf("NewSource() error = %v", err)
+	}
+	_, err = Load(src)
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Load() error = %v, want one error", err)
+	}
+	got := *errs[0]
+	got.Msg = ""
+	if want := (Error{File: FileName, Line: 5, Column: 7, Path: "service_providers[0].metadataUrl"}); got != want {
+		t.Errorf("Load() error = %+v, want %+v", got, want)
+	}
+}
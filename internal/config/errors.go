@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Error is a configuration error located in a file.
+type Error struct {
+	File string
+	// Line and Column are 1-based, they are 0 when the position is unknown.
+	Line   int
+	Column int
+	// Path is the location of the invalid value in the configuration, like users[1].email.
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&b, ":%d", e.Column)
+		}
+	}
+	b.WriteString(": ")
+	if e.Path != "" {
+		b.WriteString(e.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// Errors are all the errors found in a configuration, one per line.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// newError returns the error located at the byte offset of data.
+func newError(file string, data []byte, offset int, path, msg string) *Error {
+	e := &Error{File: file, Path: path, Msg: msg}
+	if offset < 0 || offset > len(data) {
+		return e
+	}
+	before := data[:offset]
+	e.Line = bytes.Count(before, []byte("\n")) + 1
+	e.Column = offset - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	return e
+}
+
+// offsets maps configuration paths to the byte offset where they are defined.
+type offsets map[string]int
+
+// of returns the offset of the path, or of its closest defined parent.
+func (o offsets) of(path string) int {
+	for {
+		if off, ok := o[path]; ok {
+			return off
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return -1
+		}
+		path = path[:i]
+	}
+}
+
+// fieldPath converts the dotted path of encoding/json errors, like users.0.id, to a
+// configuration path like users[0].id.
+func fieldPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			fmt.Fprintf(&b, "[%s]", part)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// checkFields walks the JSON document and reports the fields Config does not define.
+// Unlike encoding/json, field names are matched case sensitively so that a typo like
+// redirectURIs is not silently accepted. It also returns the offset of every path.
+func checkFields(file string, data []byte) (offsets, Errors) {
+	w := &walker{
+		file:    file,
+		data:    data,
+		dec:     json.NewDecoder(bytes.NewReader(data)),
+		offsets: offsets{},
+	}
+	if err := w.value("", reflect.TypeOf(Config{})); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, Errors{newError(file, data, int(syntaxErr.Offset), "", syntaxErr.Error())}
+		}
+		return nil, Errors{&Error{File: file, Msg: err.Error()}}
+	}
+	if w.dec.More() {
+		return nil, Errors{newError(file, data, w.pos(), "", "unexpected data after the configuration")}
+	}
+	return w.offsets, w.errs
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+type walker struct {
+	file    string
+	data    []byte
+	dec     *json.Decoder
+	offsets offsets
+	errs    Errors
+}
+
+// pos returns the offset of the next token.
+func (w *walker) pos() int {
+	off := int(w.dec.InputOffset())
+	for off < len(w.data) && strings.IndexByte(" \t\r\n,:", w.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// value consumes the next value, t is the type it is decoded into or nil when unknown.
+func (w *walker) value(path string, t reflect.Type) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != nil && reflect.PtrTo(t).Implements(unmarshalerType) {
+		// types decoding themselves, like JSON Web Keys, report their own errors
+		t = nil
+	}
+	if _, ok := w.offsets[path]; !ok {
+		w.offsets[path] = w.pos()
+	}
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for w.dec.More() {
+			start := w.pos()
+			tok, err := w.dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := tok.(string)
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			w.offsets[child] = start
+
+			var ft reflect.Type
+			if t != nil && t.Kind() == reflect.Struct {
+				var suggestion string
+				ft, suggestion = structField(t, key)
+				if ft == nil {
+					msg := fmt.Sprintf("unknown field %q", key)
+					if suggestion != "" {
+						msg += fmt.Sprintf(", did you mean %q?", suggestion)
+					}
+					w.errs = append(w.errs, newError(w.file, w.data, start, path, msg))
+				}
+			}
+			if err := w.value(child, ft); err != nil {
+				return err
+			}
+		}
+		_, err = w.dec.Token()
+		return err
+	case json.Delim('['):
+		var et reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		for i := 0; w.dec.More(); i++ {
+			if err := w.value(fmt.Sprintf("%s[%d]", path, i), et); err != nil {
+				return err
+			}
+		}
+		_, err = w.dec.Token()
+		return err
+	}
+	return nil
+}
+
+// structField returns the type of the field with the JSON name, or nil and the name of
+// the field matching it case insensitively.
+func structField(t reflect.Type, name string) (reflect.Type, string) {
+	var suggestion string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		if tag == name {
+			return f.Type, ""
+		}
+		if strings.EqualFold(tag, name) {
+			suggestion = tag
+		}
+	}
+	return nil, suggestion
+}
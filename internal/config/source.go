@@ -0,0 +1,155 @@
+// Package config loads the identity provider configuration (users, OIDC clients and
+// SAML service providers) from a local directory, an HTTP base URL or the defaults
+// embedded in the binary.
+package config
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// FileName is the name of the configuration file at the root of a source.
+	FileName = "config.json"
+
+	// DefaultURL is the public configuration repository used by the hosted identity provider.
+	DefaultURL = "https://raw.githubusercontent.com/seriousben/dev-identity-provider-config/main/"
+
+	// Embedded is the source location of the configuration embedded in the binary.
+	Embedded = "embedded"
+)
+
+//go:embed default
+var defaultFS embed.FS
+
+// Source gives access to the configuration file and to the files it references,
+// such as SAML service provider metadata.
+type Source interface {
+	// ReadConfig returns the content of the configuration file.
+	ReadConfig() ([]byte, error)
+	// ReadFile returns the content of a file referenced by the configuration,
+	// name is relative to the configuration file.
+	ReadFile(name string) ([]byte, error)
+	// ConfigName is the name of the configuration file, used in error messages.
+	ConfigName() string
+	// String describes the location of the source.
+	String() string
+}
+
+// NewSource returns the source for the location, which is either:
+//   - "embedded" for the configuration embedded in the binary,
+//   - an http:// or https:// base URL serving config.json,
+//   - a file:// URL or a local path to a directory containing config.json,
+//     or to the configuration file itself.
+func NewSource(location string) (Source, error) {
+	switch {
+	case location == Embedded:
+		sub, err := fs.Sub(defaultFS, "default")
+		if err != nil {
+			return nil, err
+		}
+		return &fsSource{fsys: sub, config: FileName, location: Embedded}, nil
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		if _, err := url.Parse(location); err != nil {
+			return nil, fmt.Errorf("invalid config URL: %w", err)
+		}
+		return &httpSource{
+			baseURL: strings.TrimSuffix(location, "/"),
+			client:  &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	case location == "":
+		return nil, fmt.Errorf("empty config location")
+	}
+
+	p := location
+	if strings.HasPrefix(location, "file://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config URL: %w", err)
+		}
+		p = u.Host + u.Path
+	}
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	dir, config := p, FileName
+	if !info.IsDir() {
+		dir, config = filepath.Split(p)
+	}
+	return &fsSource{fsys: os.DirFS(dir), config: config, location: "file://" + filepath.ToSlash(p), local: true}, nil
+}
+
+// fsSource reads the configuration from a file system, either a local directory
+// or the embedded defaults.
+type fsSource struct {
+	fsys     fs.FS
+	config   string
+	location string
+	// local is true for sources read from the local file system, which can be watched.
+	local bool
+}
+
+func (s *fsSource) ReadConfig() ([]byte, error) {
+	return fs.ReadFile(s.fsys, s.config)
+}
+
+func (s *fsSource) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(s.fsys, s.path(name))
+}
+
+// path returns the path in fsys of a file referenced by the configuration.
+func (s *fsSource) path(name string) string {
+	return path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+}
+
+func (s *fsSource) ConfigName() string {
+	return s.config
+}
+
+func (s *fsSource) String() string {
+	return s.location
+}
+
+// httpSource reads the configuration relative to a base URL.
+type httpSource struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (s *httpSource) ReadConfig() ([]byte, error) {
+	return s.ReadFile(FileName)
+}
+
+func (s *httpSource) ReadFile(name string) ([]byte, error) {
+	resp, err := s.client.Get(fmt.Sprintf("%s/%s", s.baseURL, strings.TrimPrefix(name, "/")))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", resp.Request.URL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *httpSource) ConfigName() string {
+	return FileName
+}
+
+func (s *httpSource) String() string {
+	return s.baseURL
+}
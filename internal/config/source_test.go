@@ -0,0 +1,131 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewSource(t *testing.T) {
+	dir, err := filepath.Abs("testdata/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		location     string
+		wantString   string
+		wantConfig   string
+		metadataName string
+	}{
+		{
+			name:         "embedded",
+			location:     Embedded,
+			wantString:   Embedded,
+			wantConfig:   FileName,
+			metadataName: "saml_service_providers/samltest.xml",
+		},
+		{
+			name:         "directory",
+			location:     "testdata/source",
+			wantString:   "file://" + filepath.ToSlash(dir),
+			wantConfig:   FileName,
+			metadataName: "metadata/sp.xml",
+		},
+		{
+			name:         "configuration file",
+			location:     "testdata/source/config.json",
+			wantString:   "file://" + filepath.ToSlash(filepath.Join(dir, FileName)),
+			wantConfig:   FileName,
+			metadataName: "/metadata/sp.xml",
+		},
+		{
+			name:         "file URL",
+			location:     "file://" + filepath.ToSlash(dir),
+			wantString:   "file://" + filepath.ToSlash(dir),
+			wantConfig:   FileName,
+			metadataName: "metadata/sp.xml",
+		},
+		{
+			name:         "HTTP base URL",
+			location:     srv.URL + "/",
+			wantString:   srv.URL,
+			wantConfig:   FileName,
+			metadataName: "metadata/sp.xml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := NewSource(tt.location)
+			if err != nil {
+				t.Fatalf("NewSource() error = %v", err)
+			}
+			if got := src.String(); got != tt.wantString {
+				t.Errorf("String() = %q, want %q", got, tt.wantString)
+			}
+			if got := src.ConfigName(); got != tt.wantConfig {
+				t.Errorf("ConfigName() = %q, want %q", got, tt.wantConfig)
+			}
+			data, err := src.ReadConfig()
+			if err != nil {
+				t.Fatalf("ReadConfig() error = %v", err)
+			}
+			if _, err := Parse(src.ConfigName(), data); err != nil {
+				t.Errorf("Parse() error = %v", err)
+			}
+			metadata, err := src.ReadFile(tt.metadataName)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if !strings.Contains(string(metadata), "EntityDescriptor") {
+				t.Errorf("ReadFile() = %q, want SAML metadata", metadata)
+			}
+		})
+	}
+}
+
+func TestNewSourceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		wantErr  func(error) bool
+	}{
+		{
+			name:     "empty location",
+			location: "",
+			wantErr:  func(err error) bool { return err != nil },
+		},
+		{
+			name:     "missing directory",
+			location: "testdata/missing",
+			wantErr:  os.IsNotExist,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSource(tt.location)
+			if !tt.wantErr(err) {
+				t.Errorf("NewSource() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceReadFileNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	src, err := NewSource(srv.URL)
+	if err != nil {
+		t.Fatalf("NewSource() error = %v", err)
+	}
+	if _, err := src.ReadConfig(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("ReadConfig() error = %v, want the 404 status", err)
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// ErrNotWatchable is returned by Watch for sources which are not on the local file system.
+var ErrNotWatchable = errors.New("config source cannot be watched")
+
+// Watch polls the files of a local source every interval and calls onChange once the
+// files changed, until ctx is done. Bursts of changes, such as an editor writing a file
+// in several steps, are reported once the files stopped changing for an interval.
+func Watch(ctx context.Context, src Source, interval time.Duration, onChange func()) error {
+	fsrc, ok := src.(*fsSource)
+	if !ok || !fsrc.local {
+		return ErrNotWatchable
+	}
+
+	last, err := fingerprint(fsrc)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		pending := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := fingerprint(fsrc)
+			if err != nil {
+				// files can briefly disappear while being replaced, retry on next tick
+				continue
+			}
+			if current != last {
+				last = current
+				pending = true
+				continue
+			}
+			if pending {
+				pending = false
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
+
+// fingerprint summarizes the size and modification time of the configuration file and
+// of the files it references. Referenced files which do not exist are fingerprinted as
+// missing, loading the configuration reports them.
+func fingerprint(src *fsSource) (string, error) {
+	h := sha256.New()
+	data, err := fs.ReadFile(src.fsys, src.config)
+	if err != nil {
+		return "", err
+	}
+	names := []string{src.config}
+	referenced := &struct {
+		ServiceProviders []struct {
+			MetadataURL string `json:"metadataUrl"`
+		} `json:"service_providers"`
+	}{}
+	// an invalid configuration still has a fingerprint, so that fixing it is noticed
+	if err := json.Unmarshal(data, referenced); err == nil {
+		for _, sp := range referenced.ServiceProviders {
+			if sp.MetadataURL != "" {
+				names = append(names, src.path(sp.MetadataURL))
+			}
+		}
+	}
+	for _, name := range names {
+		info, err := fs.Stat(src.fsys, name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Fprintf(h, "%s\x00missing\n", name)
+		case err != nil:
+			return "", err
+		default:
+			fmt.Fprintf(h, "%s\x00%d\x00%d\n", name, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
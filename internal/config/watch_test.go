@@ -0,0 +1,109 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchNotWatchable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	for _, location := range []string{Embedded, srv.URL} {
+		t.Run(location, func(t *testing.T) {
+			src, err := NewSource(location)
+			if err != nil {
+				t.Fatalf("NewSource() error = %v", err)
+			}
+			if err := Watch(context.Background(), src, time.Millisecond, func() {}); !errors.Is(err, ErrNotWatchable) {
+				t.Errorf("Watch() error = %v, want %v", err, ErrNotWatchable)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	const interval = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// file is changed three times in a burst, within an interval
+		file string
+	}{
+		{name: "configuration file", file: FileName},
+		{name: "metadata", file: "metadata/sp.xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := copyDir(t, "testdata/source")
+			src, err := NewSource(dir)
+			if err != nil {
+				t.Fatalf("NewSource() error = %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var changes int32
+			if err := Watch(ctx, src, interval, func() { atomic.AddInt32(&changes, 1) }); err != nil {
+				t.Fatalf("Watch() error = %v", err)
+			}
+
+			time.Sleep(2 * interval)
+			if got := atomic.LoadInt32(&changes); got != 0 {
+				t.Fatalf("changes = %d before any change, want 0", got)
+			}
+			name := filepath.Join(dir, tt.file)
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 3; i++ {
+				// the size changes, so that the change is noticed whatever the modification time resolution
+				if err := os.WriteFile(name, append(data, strings.Repeat("\n", i)...), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(interval / 5)
+			}
+
+			time.Sleep(5 * interval)
+			if got := atomic.LoadInt32(&changes); got != 1 {
+				t.Errorf("changes = %d after a burst of changes, want 1", got)
+			}
+		})
+	}
+}
+
+// copyDir copies the files of the directory to a temporary directory.
+func copyDir(t *testing.T, dir string) string {
+	t.Helper()
+	tmp := t.TempDir()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(tmp, rel), 0o755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(tmp, rel), data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
@@ -0,0 +1,78 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+type cryptoKeys interface {
+	CurrentCryptoKey() (*storage.CryptoKey, error)
+	CryptoKeyByID(id string) (*storage.CryptoKey, error)
+}
+
+//tokenCrypto implements op.Crypto with the crypto keys of the storage
+//the values are prefixed with the id of the key encrypting them, so that they can still be decrypted once the key is rotated
+//AES-GCM is used, so that values encrypted with another key or tampered with are rejected
+type tokenCrypto struct {
+	keys cryptoKeys
+}
+
+var _ op.Crypto = (*tokenCrypto)(nil)
+
+func (c *tokenCrypto) Encrypt(s string) (string, error) {
+	key, err := c.keys.CurrentCryptoKey()
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(s), []byte(key.ID))
+	return key.ID + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *tokenCrypto) Decrypt(s string) (string, error) {
+	if len(s) <= storage.CryptoKeyIDLength {
+		return "", errors.New("invalid encrypted value")
+	}
+	key, err := c.keys.CryptoKeyByID(s[:storage.CryptoKeyIDLength])
+	if err != nil {
+		return "", errors.New("unknown or expired crypto key")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(s[storage.CryptoKeyIDLength:])
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key.ID))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newAEAD(key *storage.CryptoKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
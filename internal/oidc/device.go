@@ -0,0 +1,205 @@
+package oidc
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	httphelper "github.com/zitadel/oidc/pkg/http"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+const (
+	//pathDeviceAuthorization is the Device Authorization Endpoint (RFC 8628), the OP has no support for it
+	pathDeviceAuthorization = "/device_authorization"
+	//pathDeviceVerification is the page of the login UI the user enters the user code on
+	pathDeviceVerification = "/login/device"
+)
+
+type deviceAuthorizations interface {
+	CreateDeviceAuthorization(clientID string, scopes []string) (*storage.DeviceAuthorization, error)
+	DeviceAuthorizationByUserCode(userCode string) (*storage.DeviceAuthorization, error)
+	DeviceAuthRequest(userCode string) (*storage.AuthRequest, error)
+	ApproveDeviceAuthorization(id string) error
+	DenyDeviceAuthorization(userCode string) error
+	PollDeviceAuthorization(deviceCode, clientID string) (*storage.DeviceAuthorization, error)
+}
+
+//deviceAuthorizationResponse is the response of the Device Authorization Endpoint (RFC 8628 3.2)
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+//deviceAuthorization issues the device and user codes of a client allowed to use the device code grant
+func (s *signingRouter) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	if !op.ValidateGrantType(client, storage.GrantTypeDeviceCode) {
+		op.RequestError(w, r, oidc.ErrUnauthorizedClient().WithDescription("the device_code grant is not allowed for this client"))
+		return
+	}
+	scopes := deviceScopes(client, strings.Fields(r.PostForm.Get("scope")))
+	d, err := s.devices.CreateDeviceAuthorization(client.GetID(), scopes)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	verificationURI := s.base.Issuer() + pathDeviceVerification
+	httphelper.MarshalJSON(w, &deviceAuthorizationResponse{
+		DeviceCode:              d.DeviceCode,
+		UserCode:                d.UserCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{queryUserCode: {d.UserCode}}.Encode(),
+		ExpiresIn:               int(storage.DeviceCodeLifetime.Seconds()),
+		Interval:                int(d.Interval.Seconds()),
+	})
+}
+
+//deviceToken handles the token requests of the device polling for the authorization of its user (RFC 8628 3.4)
+func (s *signingRouter) deviceToken(w http.ResponseWriter, r *http.Request, p *provider) {
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	if !op.ValidateGrantType(client, storage.GrantTypeDeviceCode) {
+		op.RequestError(w, r, oidc.ErrUnauthorizedClient())
+		return
+	}
+	deviceCode := r.PostForm.Get("device_code")
+	if deviceCode == "" {
+		op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("device_code missing"))
+		return
+	}
+	d, err := s.devices.PollDeviceAuthorization(deviceCode, client.GetID())
+	if err != nil {
+		op.RequestError(w, r, deviceTokenError(err))
+		return
+	}
+
+	resp, err := deviceTokenResponse(r, d.AuthRequest(), client, p)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	httphelper.MarshalJSON(w, resp)
+}
+
+//deviceTokenResponse returns the tokens of the approved device authorization
+//without the openid scope, the device only gets OAuth tokens
+func deviceTokenResponse(r *http.Request, authReq *storage.AuthRequest, client op.Client, p *provider) (*oidc.AccessTokenResponse, error) {
+	if containsScope(authReq.Scopes, oidc.ScopeOpenID) {
+		return op.CreateTokenResponse(r.Context(), authReq, client, p, true, "", "")
+	}
+	accessToken, refreshToken, validity, err := op.CreateAccessToken(r.Context(), authReq, client.AccessTokenType(), p, client, "")
+	if err != nil {
+		return nil, err
+	}
+	return &oidc.AccessTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    oidc.BearerToken,
+		ExpiresIn:    uint64(validity.Seconds()),
+	}, nil
+}
+
+//deviceTokenError returns the OAuth error of the device code polling error
+func deviceTokenError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrAuthorizationPending):
+		return &oidc.Error{ErrorType: "authorization_pending", Description: err.Error()}
+	case errors.Is(err, storage.ErrSlowDown):
+		return &oidc.Error{ErrorType: "slow_down", Description: err.Error()}
+	case errors.Is(err, storage.ErrAccessDenied):
+		return &oidc.Error{ErrorType: "access_denied", Description: err.Error()}
+	case errors.Is(err, storage.ErrExpiredToken):
+		return &oidc.Error{ErrorType: "expired_token", Description: err.Error()}
+	case errors.Is(err, storage.ErrNotFound):
+		return oidc.ErrInvalidGrant().WithDescription("invalid device_code")
+	}
+	return err
+}
+
+//authenticateClient authenticates the client of the request the way the token endpoint does,
+//public clients only send their client_id
+func (s *signingRouter) authenticateClient(r *http.Request) (op.Client, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, oidc.ErrInvalidRequest().WithDescription("error parsing form").WithParent(err)
+	}
+	ctx := r.Context()
+	if assertion := r.PostForm.Get("client_assertion"); assertion != "" {
+		verifier, ok := s.base.(interface{ JWTProfileVerifier() op.JWTProfileVerifier })
+		if !ok {
+			return nil, oidc.ErrInvalidClient().WithDescription("private_key_jwt not supported")
+		}
+		jwtReq, err := op.VerifyJWTAssertion(ctx, assertion, verifier.JWTProfileVerifier())
+		if err != nil {
+			return nil, oidc.ErrInvalidClient().WithParent(err)
+		}
+		client, err := s.storage.GetClientByClientID(ctx, jwtReq.Issuer)
+		if err != nil || client.AuthMethod() != oidc.AuthMethodPrivateKeyJWT {
+			return nil, oidc.ErrInvalidClient()
+		}
+		return client, nil
+	}
+
+	clientID, clientSecret := r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	if id, secret, ok := r.BasicAuth(); ok {
+		//the OP expects the credentials to be url encoded
+		clientID, _ = url.QueryUnescape(id)
+		clientSecret, _ = url.QueryUnescape(secret)
+	}
+	client, err := s.storage.GetClientByClientID(ctx, clientID)
+	if err != nil {
+		return nil, oidc.ErrInvalidClient().WithParent(err)
+	}
+	if client.AuthMethod() == oidc.AuthMethodNone {
+		return client, nil
+	}
+	if err := op.AuthorizeClientIDSecret(ctx, clientID, clientSecret, s.storage); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+//deviceScopes returns the scopes the client may request, like the OP does for auth requests
+//the openid scope is optional, without it the device only gets OAuth tokens
+func deviceScopes(client op.Client, scopes []string) []string {
+	allowed := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		switch scope {
+		case oidc.ScopeOpenID, oidc.ScopeProfile, oidc.ScopeEmail, oidc.ScopePhone, oidc.ScopeAddress, oidc.ScopeOfflineAccess:
+			allowed = append(allowed, scope)
+		default:
+			if client.IsScopeAllowed(scope) {
+				allowed = append(allowed, scope)
+			}
+		}
+	}
+	return allowed
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package oidc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+//deviceAuthorization starts a device authorization of the device client for the scopes
+func (o *testOP) deviceAuthorization(t *testing.T, scope string) *deviceAuthorizationResponse {
+	t.Helper()
+	resp, err := http.PostForm(o.server.URL+"/oidc"+pathDeviceAuthorization, url.Values{
+		"client_id": {testDeviceID},
+		"scope":     {scope},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	d := &deviceAuthorizationResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || d.UserCode == "" {
+		t.Fatalf("device authorization: %d, no user_code", resp.StatusCode)
+	}
+	return d
+}
+
+//submit posts the form to the login UI and returns the page the user ends on
+func (o *testOP) submit(t *testing.T, browser *http.Client, path string, form url.Values) string {
+	t.Helper()
+	resp, err := browser.PostForm(o.server.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for resp.StatusCode == http.StatusFound {
+		resp.Body.Close()
+		location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err = browser.Get(location.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resp.Body.Close()
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: %d %s", resp.Request.Method, resp.Request.URL, resp.StatusCode, body)
+	}
+	return body.String()
+}
+
+//pollDevice sends the token request of the device, it returns the error or the subject of the ID token
+func (o *testOP) pollDevice(t *testing.T, deviceCode string) string {
+	t.Helper()
+	resp, err := http.PostForm(o.server.URL+"/oidc/oauth/token", url.Values{
+		"grant_type":  {string(storage.GrantTypeDeviceCode)},
+		"device_code": {deviceCode},
+		"client_id":   {testDeviceID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		Error   string `json:"error"`
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Error != "" {
+		return tokens.Error
+	}
+	sub, _ := idTokenClaims(t, tokens.IDToken)["sub"].(string)
+	return sub
+}
+
+func TestDeviceVerification(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope string
+		//session is the user logged in to the IdP before entering the code
+		session  string
+		username string
+		password string
+		//consent is the action on the consent page, when the user is asked for consent
+		consent string
+		//page is a text of the page the user ends on, and want what the device gets
+		page string
+		want string
+	}{
+		{name: "credentials", username: "alice", password: "alice-password", page: "now logged in", want: "alice"},
+		{name: "wrong password", username: "alice", password: "wrong", page: `name="password"`, want: "authorization_pending"},
+		{name: "IdP session", session: "bob", page: "now logged in", want: "bob"},
+		{name: "IdP session ignores the credentials", session: "bob", username: "alice", password: "alice-password", page: "now logged in", want: "bob"},
+		{name: "consent allowed", scope: "calendar", username: "alice", password: "alice-password", consent: "allow", page: "now logged in", want: "alice"},
+		{name: "consent denied", scope: "calendar", username: "alice", password: "alice-password", consent: "deny", page: "Access denied", want: "access_denied"},
+		{name: "consent with IdP session", scope: "calendar", session: "bob", consent: "allow", page: "now logged in", want: "bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//the consents are remembered, each case starts from a new IdP
+			o := newTestOP(t)
+			browser := o.browser(t)
+			if tt.session != "" {
+				browser, _ = o.loginAs(t, tt.session, tt.session+"-password")
+			}
+			d := o.deviceAuthorization(t, strings.TrimSpace(oidc.ScopeOpenID+" "+tt.scope))
+
+			form := url.Values{"user_code": {d.UserCode}, "action": {"approve"}}
+			if tt.username != "" {
+				form.Set("username", tt.username)
+				form.Set("password", tt.password)
+			}
+			page := o.submit(t, browser, "/oidc/login/device", form)
+			if tt.consent != "" {
+				m := authRequestIDPattern.FindStringSubmatch(page)
+				if m == nil || !strings.Contains(page, `action="/oidc/login/consent"`) {
+					t.Fatalf("page = %s, want the consent page", page)
+				}
+				page = o.submit(t, browser, "/oidc/login/consent", url.Values{"id": {m[1]}, "scope": {tt.scope}, "action": {tt.consent}})
+			}
+			if !strings.Contains(page, tt.page) {
+				t.Errorf("page = %s, want %q", page, tt.page)
+			}
+			if got := o.pollDevice(t, d.DeviceCode); got != tt.want {
+				t.Errorf("token request = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceVerificationPageWithSession(t *testing.T) {
+	o := newTestOP(t)
+	browser, _ := o.loginAs(t, "alice", "alice-password")
+
+	resp, err := browser.Get(o.server.URL + "/oidc/login/device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body.String(), `name="password"`) {
+		t.Errorf("the user logged in to the IdP is asked for a password")
+	}
+}
@@ -1,15 +1,23 @@
 package oidc
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 
 	"github.com/gorilla/mux"
+	httphelper "github.com/zitadel/oidc/pkg/http"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
 )
 
 const (
 	queryAuthRequestID = "authRequestID"
+	queryUserCode      = "user_code"
 )
 
 var (
@@ -41,18 +49,92 @@ var (
 			</form>
 		</body>
 	</html>`)
+
+	consentTmpl, _ = template.New("consent").Parse(`
+	<!DOCTYPE html>
+	<html>
+		<head>
+			<meta charset="UTF-8">
+			<title>Consent</title>
+		</head>
+		<body style="display: flex; align-items: center; justify-content: center; height: 100vh;">
+			<form method="POST" action="/oidc/login/consent" style="min-width: 200px;">
+
+				<input type="hidden" name="id" value="{{.ID}}">
+
+				<p><b>{{.ClientID}}</b> is requesting access to:</p>
+
+				{{range .Scopes}}
+				<div>
+					<input type="checkbox" id="scope-{{.}}" name="scope" value="{{.}}" checked>
+					<label for="scope-{{.}}">{{.}}</label>
+				</div>
+				{{end}}
+
+				<p style="color:red; min-height: 1rem;">{{.Error}}</p>
+
+				<button type="submit" name="action" value="allow">Allow</button>
+				<button type="submit" name="action" value="deny">Deny</button>
+			</form>
+		</body>
+	</html>`)
+
+	deviceTmpl, _ = template.New("device").Parse(`
+	<!DOCTYPE html>
+	<html>
+		<head>
+			<meta charset="UTF-8">
+			<title>Device Login</title>
+		</head>
+		<body style="display: flex; align-items: center; justify-content: center; height: 100vh;">
+			{{if .Done}}
+			<p>{{.Done}}</p>
+			{{else}}
+			<form method="POST" action="/oidc/login/device" style="height: 250px; width: 200px;">
+
+				<div>
+					<label for="user_code">Code displayed on your device:</label>
+					<input id="user_code" name="user_code" value="{{.UserCode}}" style="width: 100%">
+				</div>
+
+				{{if not .LoggedIn}}
+				<div>
+					<label for="username">Username:</label>
+					<input id="username" name="username" style="width: 100%">
+				</div>
+
+				<div>
+					<label for="password">Password:</label>
+					<input id="password" name="password" style="width: 100%">
+				</div>
+				{{end}}
+
+				<p style="color:red; min-height: 1rem;">{{.Error}}</p>
+
+				<button type="submit" name="action" value="approve">Allow</button>
+				<button type="submit" name="action" value="deny">Deny</button>
+			</form>
+			{{end}}
+		</body>
+	</html>`)
 )
 
 type login struct {
 	authenticate authenticate
+	devices      deviceAuthorizations
+	consents     consents
 	router       *mux.Router
 	callback     func(string) string
+	encoder      httphelper.Encoder
 }
 
-func NewLogin(authenticate authenticate, callback func(string) string) *login {
+func NewLogin(authenticate authenticate, devices deviceAuthorizations, consents consents, callback func(string) string, encoder httphelper.Encoder) *login {
 	l := &login{
 		authenticate: authenticate,
+		devices:      devices,
+		consents:     consents,
 		callback:     callback,
+		encoder:      encoder,
 	}
 	l.createRouter()
 	return l
@@ -62,10 +144,33 @@ func (l *login) createRouter() {
 	l.router = mux.NewRouter()
 	l.router.Path("/username").Methods("GET").HandlerFunc(l.loginHandler)
 	l.router.Path("/username").Methods("POST").HandlerFunc(l.checkLoginHandler)
+	l.router.Path("/consent").Methods("GET").HandlerFunc(l.consentHandler)
+	l.router.Path("/consent").Methods("POST").HandlerFunc(l.checkConsentHandler)
+	l.router.Path("/device").Methods("GET").HandlerFunc(l.deviceHandler)
+	l.router.Path("/device").Methods("POST").HandlerFunc(l.checkDeviceHandler)
 }
 
 type authenticate interface {
-	CheckUsernamePassword(username, password, id string) error
+	CreateSession(username, password, previousID string) (*storage.Session, error)
+	SessionFromRequest(r *http.Request) (*storage.Session, error)
+	AuthorizeWithSession(id string, session *storage.Session) error
+}
+
+//sessionAuthRequest is implemented by the auth requests that tell when the IdP session can be used
+type sessionAuthRequest interface {
+	PromptNone() bool
+	SessionUsable(session *storage.Session) bool
+}
+
+//deviceAuthRequest is implemented by the auth requests that can approve a device authorization instead of a client redirect
+type deviceAuthRequest interface {
+	DeviceUserCode() string
+}
+
+type consents interface {
+	AuthRequestByID(ctx context.Context, id string) (op.AuthRequest, error)
+	ConsentRequired(id string) (bool, error)
+	GrantConsent(id string, scopes []string) error
 }
 
 func (l *login) loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -76,7 +181,32 @@ func (l *login) loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	//the oidc package will pass the id of the auth request as query parameter
 	//we will use this id through the login process and therefore pass it to the  login page
-	renderLogin(w, r.FormValue(queryAuthRequestID), nil)
+	id := r.FormValue(queryAuthRequestID)
+	authReq, err := l.consents.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, ok := authReq.(sessionAuthRequest)
+	if !ok {
+		renderLogin(w, id, nil)
+		return
+	}
+	//the user logged in to the IdP before, through OIDC or SAML, is not prompted again
+	//unless the client asks for it with prompt=login or max_age
+	if session, err := l.authenticate.SessionFromRequest(r); err == nil && req.SessionUsable(session) {
+		if err := l.authenticate.AuthorizeWithSession(id, session); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.loggedIn(w, r, authReq)
+		return
+	}
+	if req.PromptNone() {
+		op.AuthRequestError(w, r, authReq, oidc.ErrLoginRequired().WithDescription("the user is not logged in"), l.encoder)
+		return
+	}
+	renderLogin(w, id, nil)
 }
 
 func renderLogin(w http.ResponseWriter, id string, err error) {
@@ -106,10 +236,200 @@ func (l *login) checkLoginHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 	id := r.FormValue("id")
-	err = l.authenticate.CheckUsernamePassword(username, password, id)
+	authReq, err := l.consents.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//the session of the browser is carried over to the new session when the same user logs in again, e.g. after prompt=login
+	var previousID string
+	if previous, err := l.authenticate.SessionFromRequest(r); err == nil {
+		previousID = previous.ID
+	}
+	session, err := l.authenticate.CreateSession(username, password, previousID)
 	if err != nil {
 		renderLogin(w, id, err)
 		return
 	}
-	http.Redirect(w, r, l.callback(id), http.StatusFound)
+	http.SetCookie(w, session.Cookie(r.TLS != nil))
+	if err := l.authenticate.AuthorizeWithSession(id, session); err != nil {
+		renderLogin(w, id, err)
+		return
+	}
+	l.loggedIn(w, r, authReq)
+}
+
+//loggedIn sends the logged in user to the consent page when the client requires it, and back to the OP otherwise
+func (l *login) loggedIn(w http.ResponseWriter, r *http.Request, authReq op.AuthRequest) {
+	id := authReq.GetID()
+	required, err := l.consents.ConsentRequired(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if required {
+		if req, ok := authReq.(sessionAuthRequest); ok && req.PromptNone() {
+			op.AuthRequestError(w, r, authReq, &oidc.Error{ErrorType: "consent_required", Description: "the user must consent to the request"}, l.encoder)
+			return
+		}
+		http.Redirect(w, r, "/oidc/login/consent?"+url.Values{queryAuthRequestID: {id}}.Encode(), http.StatusFound)
+		return
+	}
+	l.authorized(w, r, authReq)
+}
+
+//authorized completes the auth request the user logged in and consented to, by approving the device
+//of a device authorization, and otherwise by sending the user back to the OP
+func (l *login) authorized(w http.ResponseWriter, r *http.Request, authReq op.AuthRequest) {
+	if req, ok := authReq.(deviceAuthRequest); ok && req.DeviceUserCode() != "" {
+		if err := l.devices.ApproveDeviceAuthorization(authReq.GetID()); err != nil {
+			renderDevice(w, req.DeviceUserCode(), true, "", err)
+			return
+		}
+		renderDevice(w, req.DeviceUserCode(), true, "Your device is now logged in, you can close this page.", nil)
+		return
+	}
+	http.Redirect(w, r, l.callback(authReq.GetID()), http.StatusFound)
+}
+
+func (l *login) consentHandler(w http.ResponseWriter, r *http.Request) {
+	l.renderConsent(w, r, r.URL.Query().Get(queryAuthRequestID), nil)
+}
+
+//renderConsent lists the scopes of the auth request the user can grant, the openid scope cannot be declined
+func (l *login) renderConsent(w http.ResponseWriter, r *http.Request, id string, err error) {
+	authReq, reqErr := l.consents.AuthRequestByID(r.Context(), id)
+	if reqErr != nil {
+		http.Error(w, reqErr.Error(), http.StatusBadRequest)
+		return
+	}
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+	data := &struct {
+		ID       string
+		ClientID string
+		Scopes   []string
+		Error    string
+	}{
+		ID:       id,
+		ClientID: authReq.GetClientID(),
+		Error:    errMsg,
+	}
+	for _, scope := range authReq.GetScopes() {
+		if scope != oidc.ScopeOpenID {
+			data.Scopes = append(data.Scopes, scope)
+		}
+	}
+	err = consentTmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//checkConsentHandler grants the checked scopes, or returns access_denied to the client when the user denies the request
+func (l *login) checkConsentHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot parse form:%s", err), http.StatusInternalServerError)
+		return
+	}
+	id := r.FormValue("id")
+	authReq, err := l.consents.AuthRequestByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("action") == "deny" {
+		if req, ok := authReq.(deviceAuthRequest); ok && req.DeviceUserCode() != "" {
+			l.denyDevice(w, req.DeviceUserCode(), true)
+			return
+		}
+		op.AuthRequestError(w, r, authReq, &oidc.Error{ErrorType: "access_denied", Description: "the user denied the request"}, l.encoder)
+		return
+	}
+	if err := l.consents.GrantConsent(id, r.Form["scope"]); err != nil {
+		l.renderConsent(w, r, id, err)
+		return
+	}
+	l.authorized(w, r, authReq)
+}
+
+func (l *login) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	//the verification_uri_complete passes the user code, so that the user only has to log in
+	_, err := l.authenticate.SessionFromRequest(r)
+	renderDevice(w, r.URL.Query().Get(queryUserCode), err == nil, "", nil)
+}
+
+//renderDevice renders the page the user enters the user code on, with the credentials when not logged in to the IdP yet
+func renderDevice(w http.ResponseWriter, userCode string, loggedIn bool, done string, err error) {
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+	data := &struct {
+		UserCode string
+		LoggedIn bool
+		Done     string
+		Error    string
+	}{
+		UserCode: userCode,
+		LoggedIn: loggedIn,
+		Done:     done,
+		Error:    errMsg,
+	}
+	err = deviceTmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//checkDeviceHandler logs the user in with the IdP session, or the credentials when there is none,
+//and then asks for consent like for the auth requests of clients before approving the device
+func (l *login) checkDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot parse form:%s", err), http.StatusInternalServerError)
+		return
+	}
+	userCode := r.FormValue("user_code")
+	session, sessionErr := l.authenticate.SessionFromRequest(r)
+	loggedIn := sessionErr == nil
+	if _, err := l.devices.DeviceAuthorizationByUserCode(userCode); err != nil {
+		renderDevice(w, userCode, loggedIn, "", fmt.Errorf("invalid or expired code"))
+		return
+	}
+	if r.FormValue("action") == "deny" {
+		l.denyDevice(w, userCode, loggedIn)
+		return
+	}
+	//the user logged in to the IdP before, through OIDC or SAML, only enters the code
+	if !loggedIn {
+		session, err = l.authenticate.CreateSession(r.FormValue("username"), r.FormValue("password"), "")
+		if err != nil {
+			renderDevice(w, userCode, false, "", err)
+			return
+		}
+		http.SetCookie(w, session.Cookie(r.TLS != nil))
+	}
+	authReq, err := l.devices.DeviceAuthRequest(userCode)
+	if err != nil {
+		renderDevice(w, userCode, true, "", err)
+		return
+	}
+	if err := l.authenticate.AuthorizeWithSession(authReq.GetID(), session); err != nil {
+		renderDevice(w, userCode, true, "", err)
+		return
+	}
+	l.loggedIn(w, r, authReq)
+}
+
+//denyDevice rejects the device authorization of the user code
+func (l *login) denyDevice(w http.ResponseWriter, userCode string, loggedIn bool) {
+	if err := l.devices.DenyDeviceAuthorization(userCode); err != nil {
+		renderDevice(w, userCode, loggedIn, "", err)
+		return
+	}
+	renderDevice(w, userCode, loggedIn, "Access denied, the device will not be logged in.", nil)
 }
@@ -0,0 +1,398 @@
+package oidc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+const (
+	testClientID     = "web"
+	testClientSecret = "secret"
+	testRedirectURI  = "http://localhost:9999/auth/callback"
+	testDeviceID     = "tv"
+)
+
+//agedStorage makes the IdP session look older than it is, to test max_age without waiting
+type agedStorage struct {
+	*storage.Storage
+	age time.Duration
+}
+
+func (s *agedStorage) SessionFromRequest(r *http.Request) (*storage.Session, error) {
+	session, err := s.Storage.SessionFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	session.AuthTime = session.AuthTime.Add(-s.age)
+	return session, nil
+}
+
+type testOP struct {
+	server *httptest.Server
+	stor   *agedStorage
+}
+
+func newTestOP(t *testing.T) *testOP {
+	t.Helper()
+	t.Setenv(op.OidcDevMode, "true")
+
+	stor := &agedStorage{Storage: storage.NewStorage()}
+	if err := stor.EnsureSigningKeys(); err != nil {
+		t.Fatalf("EnsureSigningKeys() error = %v", err)
+	}
+	if err := stor.EnsureCryptoKey(); err != nil {
+		t.Fatalf("EnsureCryptoKey() error = %v", err)
+	}
+	client := storage.WebClient(testClientID, testClientSecret, testRedirectURI)
+	client.ClientDevMode = true
+	device := storage.NativeClient(testDeviceID)
+	device.ClientGrantTypes = append(device.ClientGrantTypes, storage.GrantTypeDeviceCode)
+	_, err := stor.ReplaceConfig(&storage.ConfigState{
+		Users: []*storage.User{
+			{ID: "alice", Username: "alice", Password: "alice-password", Email: "alice@example.com"},
+			{ID: "bob", Username: "bob", Password: "bob-password", Email: "bob@example.com"},
+		},
+		Clients: []*storage.Client{client, device},
+		Scopes:  []*storage.Scope{{Name: "calendar", Consent: true}},
+	})
+	if err != nil {
+		t.Fatalf("ReplaceConfig() error = %v", err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.Handle("/oidc/", http.StripPrefix("/oidc", New(server.URL+"/oidc", stor)))
+	return &testOP{server: server, stor: stor}
+}
+
+//browser returns a client keeping the cookies of the IdP, which does not follow redirects
+func (o *testOP) browser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+//authResult is where an authorization request ended
+type authResult struct {
+	//outcome is the error returned to the client, "code" when it got a code,
+	//or the page the user is prompted with, "login" or "consent"
+	outcome string
+	code    string
+	//authRequestID is the auth request of the page the user is prompted with
+	authRequestID string
+}
+
+var authRequestIDPattern = regexp.MustCompile(`name="id" value="([^"]+)"`)
+
+//authorize sends an authorization request of the client and follows the redirects of the IdP
+func (o *testOP) authorize(t *testing.T, browser *http.Client, params url.Values) authResult {
+	t.Helper()
+	query := url.Values{
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"response_type": {"code"},
+		"scope":         {oidc.ScopeOpenID},
+		"state":         {"state"},
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	return o.follow(t, browser, o.server.URL+"/oidc/authorize?"+query.Encode())
+}
+
+//login submits the credentials on the login page of the auth request
+func (o *testOP) login(t *testing.T, browser *http.Client, authRequestID, username, password string) authResult {
+	t.Helper()
+	resp, err := browser.PostForm(o.server.URL+"/oidc/login/username", url.Values{
+		"id":       {authRequestID},
+		"username": {username},
+		"password": {password},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.result(t, browser, resp)
+}
+
+func (o *testOP) follow(t *testing.T, browser *http.Client, location string) authResult {
+	t.Helper()
+	resp, err := browser.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.result(t, browser, resp)
+}
+
+func (o *testOP) result(t *testing.T, browser *http.Client, resp *http.Response) authResult {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusFound {
+		location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(location.String(), testRedirectURI) {
+			if e := location.Query().Get("error"); e != "" {
+				return authResult{outcome: e}
+			}
+			return authResult{outcome: "code", code: location.Query().Get("code")}
+		}
+		return o.follow(t, browser, location.String())
+	}
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: %d %s", resp.Request.Method, resp.Request.URL, resp.StatusCode, body)
+	}
+	m := authRequestIDPattern.FindStringSubmatch(body.String())
+	if m == nil {
+		t.Fatalf("%s %s: unexpected page %s", resp.Request.Method, resp.Request.URL, body)
+	}
+	switch {
+	case strings.Contains(body.String(), `action="/oidc/login/username"`):
+		return authResult{outcome: "login", authRequestID: m[1]}
+	case strings.Contains(body.String(), `action="/oidc/login/consent"`):
+		return authResult{outcome: "consent", authRequestID: m[1]}
+	}
+	t.Fatalf("%s %s: unexpected page %s", resp.Request.Method, resp.Request.URL, body)
+	return authResult{}
+}
+
+//tokenResponse is the part of the token response the tests look at
+type tokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (o *testOP) token(t *testing.T, params url.Values) tokenResponse {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, o.server.URL+"/oidc/oauth/token", strings.NewReader(params.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testClientID, testClientSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	tokens := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		t.Fatalf("token request %s: %d, no id_token", params.Get("grant_type"), resp.StatusCode)
+	}
+	return tokens
+}
+
+//loginAs logs the user in with a new browser and returns the browser and the ID token of the login
+func (o *testOP) loginAs(t *testing.T, username, password string) (*http.Client, string) {
+	t.Helper()
+	browser := o.browser(t)
+	result := o.authorize(t, browser, nil)
+	if result.outcome != "login" {
+		t.Fatalf("authorize() = %q, want the login page", result.outcome)
+	}
+	result = o.login(t, browser, result.authRequestID, username, password)
+	if result.outcome != "code" {
+		t.Fatalf("login() = %q, want a code", result.outcome)
+	}
+	tokens := o.token(t, url.Values{
+		"grant_type":   {string(oidc.GrantTypeCode)},
+		"code":         {result.code},
+		"redirect_uri": {testRedirectURI},
+	})
+	return browser, tokens.IDToken
+}
+
+//session returns the IdP session of the browser
+func (o *testOP) session(t *testing.T, browser *http.Client) *storage.Session {
+	t.Helper()
+	u, err := url.Parse(o.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range browser.Jar.Cookies(u) {
+		if cookie.Name == storage.SessionCookieName {
+			session, err := o.stor.SessionByID(cookie.Value)
+			if err != nil {
+				t.Fatalf("SessionByID() error = %v", err)
+			}
+			return session
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+//idTokenClaims returns the claims of the ID token, without verifying it
+func idTokenClaims(t *testing.T, idToken string) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed id_token %q", idToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestSessionUsable(t *testing.T) {
+	o := newTestOP(t)
+	_, aliceHint := o.loginAs(t, "alice", "alice-password")
+	_, bobHint := o.loginAs(t, "bob", "bob-password")
+
+	tests := []struct {
+		name   string
+		prompt string
+		maxAge string
+		scope  string
+		//session is whether alice is logged in to the IdP, and age how long ago
+		session bool
+		age     time.Duration
+		hint    string
+		//want is the error returned to the client, "code" when the session was used,
+		//or the page the user is prompted with again
+		want string
+	}{
+		{name: "no session", want: "login"},
+		{name: "session", session: true, want: "code"},
+		{name: "prompt none without session", prompt: oidc.PromptNone, want: "login_required"},
+		{name: "prompt none with session", prompt: oidc.PromptNone, session: true, want: "code"},
+		{name: "prompt none requiring consent", prompt: oidc.PromptNone, scope: "calendar", session: true, want: "consent_required"},
+		{name: "prompt login", prompt: oidc.PromptLogin, session: true, want: "login"},
+		{name: "prompt select_account", prompt: oidc.PromptSelectAccount, session: true, want: "login"},
+		{name: "prompt consent with session", prompt: oidc.PromptConsent, session: true, want: "consent"},
+		{name: "prompt consent without session", prompt: oidc.PromptConsent, want: "login"},
+		{name: "max_age 0", maxAge: "0", session: true, want: "login"},
+		{name: "max_age 0 with prompt none", prompt: oidc.PromptNone, maxAge: "0", session: true, want: "login_required"},
+		{name: "max_age fresh", maxAge: "60", session: true, want: "code"},
+		{name: "max_age exceeded", maxAge: "60", session: true, age: 2 * time.Minute, want: "login"},
+		{name: "max_age exceeded with prompt none", prompt: oidc.PromptNone, maxAge: "60", session: true, age: 2 * time.Minute, want: "login_required"},
+		{name: "max_age fresh with prompt none", prompt: oidc.PromptNone, maxAge: "60", session: true, want: "code"},
+		{name: "id_token_hint of the session user", hint: aliceHint, session: true, want: "code"},
+		{name: "id_token_hint of another user", hint: bobHint, session: true, want: "login"},
+		{name: "id_token_hint of another user with prompt none", prompt: oidc.PromptNone, hint: bobHint, session: true, want: "login_required"},
+		{name: "id_token_hint without session with prompt none", prompt: oidc.PromptNone, hint: aliceHint, want: "login_required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			browser := o.browser(t)
+			if tt.session {
+				browser, _ = o.loginAs(t, "alice", "alice-password")
+			}
+			o.stor.age = tt.age
+			defer func() { o.stor.age = 0 }()
+
+			params := url.Values{}
+			if tt.prompt != "" {
+				params.Set("prompt", tt.prompt)
+			}
+			if tt.maxAge != "" {
+				params.Set("max_age", tt.maxAge)
+			}
+			if tt.scope != "" {
+				params.Set("scope", oidc.ScopeOpenID+" "+tt.scope)
+			}
+			if tt.hint != "" {
+				params.Set("id_token_hint", tt.hint)
+			}
+			if got := o.authorize(t, browser, params); got.outcome != tt.want {
+				t.Errorf("authorize() = %q, want %q", got.outcome, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthTime(t *testing.T) {
+	o := newTestOP(t)
+	browser := o.browser(t)
+	result := o.authorize(t, browser, url.Values{"scope": {oidc.ScopeOpenID + " " + oidc.ScopeOfflineAccess}})
+	if result.outcome != "login" {
+		t.Fatalf("authorize() = %q, want the login page", result.outcome)
+	}
+	loginTime := time.Now().Unix()
+	result = o.login(t, browser, result.authRequestID, "alice", "alice-password")
+	if result.outcome != "code" {
+		t.Fatalf("login() = %q, want a code", result.outcome)
+	}
+	tokens := o.token(t, url.Values{
+		"grant_type":   {string(oidc.GrantTypeCode)},
+		"code":         {result.code},
+		"redirect_uri": {testRedirectURI},
+	})
+	authTime, ok := idTokenClaims(t, tokens.IDToken)["auth_time"].(float64)
+	if !ok {
+		t.Fatal("id_token without auth_time")
+	}
+	if d := int64(authTime) - loginTime; d < 0 || d > 1 {
+		t.Errorf("auth_time = %d, want the login time %d", int64(authTime), loginTime)
+	}
+	if tokens.RefreshToken == "" {
+		t.Fatal("no refresh_token")
+	}
+	session := o.session(t, browser)
+	if got := idTokenClaims(t, tokens.IDToken)["sid"]; got != session.SID {
+		t.Errorf("sid = %v, want the SID %q of the session", got, session.SID)
+	}
+
+	//the auth_time stays the time of the login, not the time of the token requests
+	time.Sleep(1100 * time.Millisecond)
+	refreshed := o.token(t, url.Values{
+		"grant_type":    {string(oidc.GrantTypeRefreshToken)},
+		"refresh_token": {tokens.RefreshToken},
+	})
+	if got := idTokenClaims(t, refreshed.IDToken)["auth_time"]; got != authTime {
+		t.Errorf("auth_time after refresh = %v, want %v", got, authTime)
+	}
+	if got := idTokenClaims(t, refreshed.IDToken)["sid"]; got != session.SID {
+		t.Errorf("sid after refresh = %v, want %q", got, session.SID)
+	}
+
+	//logging in with the session does not authenticate the user again
+	result = o.authorize(t, browser, nil)
+	if result.outcome != "code" {
+		t.Fatalf("authorize() with the session = %q, want a code", result.outcome)
+	}
+	sso := o.token(t, url.Values{
+		"grant_type":   {string(oidc.GrantTypeCode)},
+		"code":         {result.code},
+		"redirect_uri": {testRedirectURI},
+	})
+	if got := idTokenClaims(t, sso.IDToken)["auth_time"]; got != authTime {
+		t.Errorf("auth_time with the session = %v, want %v", got, authTime)
+	}
+}
@@ -0,0 +1,240 @@
+package oidc
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/square/go-jose.v2"
+	"github.com/zitadel/oidc/pkg/crypto"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+//backChannelLogoutEvent is the event of the logout tokens (OpenID Connect Back-Channel Logout 1.0 2.4)
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+//backChannelLogoutTimeout is how long a client has to acknowledge its logout token
+const backChannelLogoutTimeout = 5 * time.Second
+
+//logoutTokenType is the typ header of the logout tokens, so that they cannot be mistaken for ID tokens (OpenID Connect Back-Channel Logout 1.0 2.4)
+const logoutTokenType jose.ContentType = "logout+jwt"
+
+var (
+	//logoutTmpl loads the front-channel logout URIs of the clients before going on to the post logout redirect URI
+	logoutTmpl, _ = template.New("logout").Parse(`
+	<!DOCTYPE html>
+	<html>
+		<head>
+			<meta charset="UTF-8">
+			<title>Signing out</title>
+		</head>
+		<body style="display: flex; align-items: center; justify-content: center; height: 100vh;" onload="window.location.replace({{.RedirectURI}})">
+			<p>Signing out...</p>
+			{{range .FrontChannelLogoutURIs}}
+			<iframe src="{{.}}" style="display: none;"></iframe>
+			{{end}}
+		</body>
+	</html>`)
+
+	loggedOutTmpl, _ = template.New("logged-out").Parse(`
+	<!DOCTYPE html>
+	<html>
+		<head>
+			<meta charset="UTF-8">
+			<title>Signed out</title>
+		</head>
+		<body style="display: flex; align-items: center; justify-content: center; height: 100vh;">
+			<div style="text-align: center;">
+				<p>You are signed out.</p>
+				{{if .State}}<p style="color: gray;">state: {{.State}}</p>{{end}}
+			</div>
+		</body>
+	</html>`)
+)
+
+type sessions interface {
+	SessionFromRequest(r *http.Request) (*storage.Session, error)
+	EndSession(id string) (*storage.Session, []*storage.Client, error)
+	OnSessionEnd(storage.SessionListener)
+}
+
+//sessionTokenRequest is implemented by the token requests of a user logged in with an IdP session
+type sessionTokenRequest interface {
+	GetSessionID() string
+}
+
+//logoutToken is the JWT sent to the back-channel logout URI of the clients (OpenID Connect Back-Channel Logout 1.0 2.4)
+type logoutToken struct {
+	Issuer     string                 `json:"iss"`
+	Subject    string                 `json:"sub"`
+	Audience   string                 `json:"aud"`
+	IssuedAt   int64                  `json:"iat"`
+	Expiration int64                  `json:"exp"`
+	ID         string                 `json:"jti"`
+	Events     map[string]interface{} `json:"events"`
+	SessionID  string                 `json:"sid"`
+}
+
+//loggedOut is the page the users are sent to after signing out, when the client has no post logout redirect URI
+func loggedOut(w http.ResponseWriter, r *http.Request) {
+	err := loggedOutTmpl.Execute(w, &struct{ State string }{State: r.URL.Query().Get("state")})
+	if err != nil {
+		log.Printf("error serving logged out page: %v", err)
+	}
+}
+
+//endSession ends the IdP session of the browser (OpenID Connect RP-Initiated Logout 1.0), unless the id_token_hint is of another user,
+//the clients the user logged in to with it are notified through their back-channel logout URI by the session listener
+//and through their front-channel logout URI by the page loading them before the post logout redirect URI
+func (s *signingRouter) endSession(w http.ResponseWriter, r *http.Request) {
+	req, err := op.ParseEndSessionRequest(r, s.base.Decoder())
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	ended, err := op.ValidateEndSessionRequest(r.Context(), req, s.base)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	var frontChannelLogoutURIs []string
+	if session, err := s.sessions.SessionFromRequest(r); err == nil && (ended.UserID == "" || ended.UserID == session.UserID) {
+		session, clients, err := s.sessions.EndSession(session.ID)
+		if err != nil {
+			op.RequestError(w, r, oidc.DefaultToServerError(err, "error ending session"))
+			return
+		}
+		http.SetCookie(w, storage.ExpiredSessionCookie(r.TLS != nil))
+		for _, client := range clients {
+			if client.FrontChannelLogoutURI != "" {
+				frontChannelLogoutURIs = append(frontChannelLogoutURIs, s.frontChannelLogoutURI(client, session))
+			}
+		}
+	}
+	//the tokens of the client of the id_token_hint are deleted, even when the user logged in to it without the IdP session
+	if ended.UserID != "" && ended.ClientID != "" {
+		if err := s.storage.TerminateSession(r.Context(), ended.UserID, ended.ClientID); err != nil {
+			op.RequestError(w, r, oidc.DefaultToServerError(err, "error terminating session"))
+			return
+		}
+	}
+	if len(frontChannelLogoutURIs) == 0 {
+		http.Redirect(w, r, ended.RedirectURI, http.StatusFound)
+		return
+	}
+	err = logoutTmpl.Execute(w, &struct {
+		RedirectURI            string
+		FrontChannelLogoutURIs []string
+	}{
+		RedirectURI:            ended.RedirectURI,
+		FrontChannelLogoutURIs: frontChannelLogoutURIs,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//frontChannelLogoutURI returns the front-channel logout URI of the client with the iss and sid of the session
+//(OpenID Connect Front-Channel Logout 1.0 2)
+func (s *signingRouter) frontChannelLogoutURI(client *storage.Client, session *storage.Session) string {
+	u, err := url.Parse(client.FrontChannelLogoutURI)
+	if err != nil {
+		return client.FrontChannelLogoutURI
+	}
+	query := u.Query()
+	query.Set("iss", s.base.Issuer())
+	query.Set("sid", session.SID)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+//backChannelLogout posts a logout token to the back-channel logout URI of each client of the ended session
+//the clients are notified in the background, so that the request ending the session does not wait for them,
+//their failures are only logged
+func (s *signingRouter) backChannelLogout(session *storage.Session, clients []*storage.Client) {
+	httpClient := &http.Client{Timeout: backChannelLogoutTimeout}
+	for _, client := range clients {
+		if client.BackChannelLogoutURI == "" {
+			continue
+		}
+		go func(client *storage.Client) {
+			token, err := s.logoutToken(client, session)
+			if err != nil {
+				log.Printf("error creating logout token of client %s: %v", client.ID, err)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), backChannelLogoutTimeout)
+			defer cancel()
+			body := url.Values{"logout_token": {token}}.Encode()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.BackChannelLogoutURI, strings.NewReader(body))
+			if err != nil {
+				log.Printf("error notifying the logout of client %s: %v", client.ID, err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				log.Printf("error notifying the logout of client %s: %v", client.ID, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+				log.Printf("client %s answered its logout token with status %d", client.ID, resp.StatusCode)
+				return
+			}
+			log.Printf("Notified the logout of session %s to client %s", session.SID, client.ID)
+		}(client)
+	}
+}
+
+//logoutToken returns the logout token of the session for the client, signed with the algorithm of its ID tokens
+func (s *signingRouter) logoutToken(client *storage.Client, session *storage.Session) (string, error) {
+	p, ok := s.providers[client.IDTokenSignedResponseAlg()]
+	if !ok {
+		p = s.providers[storage.DefaultSigningAlgorithm]
+	}
+	js, err := p.signer.typedSigner(logoutTokenType)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return crypto.Sign(&logoutToken{
+		Issuer:     s.base.Issuer(),
+		Subject:    session.UserID,
+		Audience:   client.ID,
+		IssuedAt:   now.Unix(),
+		Expiration: now.Add(2 * time.Minute).Unix(),
+		ID:         uuid.NewString(),
+		Events:     map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}},
+		SessionID:  session.SID,
+	}, js)
+}
+
+//withSessionID returns the request of the authorization callback or of the token endpoint
+//with the SID of the IdP session the user logged in with, so that the ID tokens assert it in their sid claim
+func (s *signingRouter) withSessionID(r *http.Request) *http.Request {
+	var request interface{}
+	switch r.URL.Path {
+	case s.callback:
+		request, _ = s.storage.AuthRequestByID(r.Context(), r.FormValue("id"))
+	case s.token:
+		switch oidc.GrantType(r.FormValue("grant_type")) {
+		case oidc.GrantTypeCode:
+			request, _ = s.storage.AuthRequestByCode(r.Context(), r.FormValue("code"))
+		case oidc.GrantTypeRefreshToken:
+			request, _ = s.storage.TokenRequestByRefreshToken(r.Context(), r.FormValue("refresh_token"))
+		}
+	}
+	if req, ok := request.(sessionTokenRequest); ok && req.GetSessionID() != "" {
+		return r.WithContext(storage.ContextWithSessionID(r.Context(), req.GetSessionID()))
+	}
+	return r
+}
@@ -0,0 +1,67 @@
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+func TestBackChannelLogoutInBackground(t *testing.T) {
+	o := newTestOP(t)
+	release := make(chan struct{})
+	notified := make(chan string, 1)
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		notified <- r.FormValue("logout_token")
+	}))
+	defer rp.Close()
+	var releaseOnce sync.Once
+	releaseClient := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseClient()
+
+	client := storage.WebClient(testClientID, testClientSecret, testRedirectURI)
+	client.ClientDevMode = true
+	client.BackChannelLogoutURI = rp.URL
+	if err := o.stor.RegisterClient(client.ID, client); err != nil {
+		t.Fatalf("RegisterClient() error = %v", err)
+	}
+	browser, _ := o.loginAs(t, "alice", "alice-password")
+	session := o.session(t, browser)
+
+	//the client does not answer before the session ended
+	ended := make(chan error, 1)
+	go func() {
+		_, _, err := o.stor.EndSession(session.ID)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatalf("EndSession() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("EndSession() waited for the back-channel logout of the client")
+	}
+	releaseClient()
+	select {
+	case token := <-notified:
+		if got := idTokenClaims(t, token)["sid"]; got != session.SID {
+			t.Errorf("logout token sid = %v, want %q", got, session.SID)
+		}
+		jws, err := jose.ParseSigned(token)
+		if err != nil {
+			t.Fatalf("ParseSigned() error = %v", err)
+		}
+		if got := jws.Signatures[0].Header.ExtraHeaders[jose.HeaderType]; got != string(logoutTokenType) {
+			t.Errorf("logout token typ = %v, want %s", got, logoutTokenType)
+		}
+	case <-time.After(backChannelLogoutTimeout):
+		t.Fatal("the client was not sent a logout token")
+	}
+}
@@ -0,0 +1,132 @@
+package oidc
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	httphelper "github.com/zitadel/oidc/pkg/http"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+//pathPushedAuthorization is the Pushed Authorization Request Endpoint (RFC 9126), the OP has no support for it
+const pathPushedAuthorization = "/par"
+
+type pushedRequests interface {
+	CreatePushedRequest(clientID string, params url.Values) (*storage.PushedRequest, error)
+	UsePushedRequest(requestURI, clientID string) (url.Values, error)
+}
+
+//pushedRequestClient is implemented by the clients that can be required to push their authorization requests
+type pushedRequestClient interface {
+	RequirePushedAuthorizationRequests() bool
+}
+
+//pushedAuthorizationResponse is the response of the Pushed Authorization Request Endpoint (RFC 9126 2.2)
+type pushedAuthorizationResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+//pushedAuthorization validates and stores the authorization request of an authenticated client,
+//which then only sends the returned request_uri to the authorization endpoint
+func (s *signingRouter) pushedAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	params := url.Values{}
+	for name, values := range r.PostForm {
+		switch name {
+		case "client_secret", "client_assertion", "client_assertion_type":
+		case "request_uri":
+			op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("request_uri must not be pushed"))
+			return
+		default:
+			params[name] = values
+		}
+	}
+	if clientID := params.Get("client_id"); clientID != "" && clientID != client.GetID() {
+		op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("client_id does not match the authenticated client"))
+		return
+	}
+	params.Set("client_id", client.GetID())
+
+	//the request is validated now, so that the client gets the errors instead of the user
+	authReq := new(oidc.AuthRequest)
+	if err := s.base.Decoder().Decode(authReq, params); err != nil {
+		op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("cannot parse auth request").WithParent(err))
+		return
+	}
+	if authReq.RedirectURI == "" {
+		op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("auth request is missing redirect_uri"))
+		return
+	}
+	if _, err := op.ValidateAuthRequest(r.Context(), authReq, s.storage, s.base.IDTokenHintVerifier()); err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+
+	p, err := s.pushed.CreatePushedRequest(client.GetID(), params)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	httphelper.MarshalJSONWithStatus(w, &pushedAuthorizationResponse{
+		RequestURI: p.RequestURI,
+		ExpiresIn:  int(storage.PushedRequestLifetime.Seconds()),
+	}, http.StatusCreated)
+}
+
+//pushedAuthorizeRequest replaces the request_uri of an authorization request with the parameters pushed by the client
+//it returns false, after writing the error, when the request_uri is invalid or when the client must push its requests
+func (s *signingRouter) pushedAuthorizeRequest(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "cannot parse form", http.StatusBadRequest)
+		return false
+	}
+	clientID, requestURI := r.Form.Get("client_id"), r.Form.Get("request_uri")
+	if requestURI == "" {
+		client, err := s.storage.GetClientByClientID(r.Context(), clientID)
+		if err != nil {
+			//the OP reports the unknown clients
+			return true
+		}
+		if c, ok := client.(pushedRequestClient); ok && c.RequirePushedAuthorizationRequests() {
+			//the error is sent to the redirect_uri, as the OP does for the other invalid requests, once it is one of the client
+			authReq, err := op.ParseAuthorizeRequest(r, s.base.Decoder())
+			if err != nil {
+				op.AuthRequestError(w, r, nil, err, s.base.Encoder())
+				return false
+			}
+			if err := op.ValidateAuthReqRedirectURI(client, authReq.RedirectURI, authReq.ResponseType); err != nil {
+				op.AuthRequestError(w, r, authReq, err, s.base.Encoder())
+				return false
+			}
+			op.AuthRequestError(w, r, authReq, oidc.ErrInvalidRequest().WithDescription("the client must use pushed authorization requests"), s.base.Encoder())
+			return false
+		}
+		return true
+	}
+
+	params, err := s.pushed.UsePushedRequest(requestURI, clientID)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidRequestURI) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return false
+	}
+	r.Form = params
+	r.URL.RawQuery = params.Encode()
+	return true
+}
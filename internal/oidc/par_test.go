@@ -0,0 +1,102 @@
+package oidc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+func TestRequirePushedAuthorizationRequests(t *testing.T) {
+	o := newTestOP(t)
+	client := storage.WebClient(testClientID, testClientSecret, testRedirectURI)
+	client.ClientDevMode = true
+	client.ClientRequirePushedRequests = true
+	if err := o.stor.RegisterClient(testClientID, client); err != nil {
+		t.Fatalf("RegisterClient() error = %v", err)
+	}
+
+	t.Run("not pushed", func(t *testing.T) {
+		query := url.Values{
+			"client_id":     {testClientID},
+			"redirect_uri":  {testRedirectURI},
+			"response_type": {"code"},
+			"scope":         {oidc.ScopeOpenID},
+			"state":         {"state"},
+		}
+		resp, err := o.browser(t).Get(o.server.URL + "/oidc/authorize?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("GET /authorize = %d, want %d", resp.StatusCode, http.StatusFound)
+		}
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(location.String(), testRedirectURI) {
+			t.Fatalf("Location = %s, want the redirect_uri", location)
+		}
+		if got := location.Query().Get("error"); got != "invalid_request" {
+			t.Errorf("error = %q, want invalid_request", got)
+		}
+		if got := location.Query().Get("state"); got != "state" {
+			t.Errorf("state = %q, want state", got)
+		}
+	})
+
+	t.Run("not pushed with an unknown redirect_uri", func(t *testing.T) {
+		query := url.Values{
+			"client_id":     {testClientID},
+			"redirect_uri":  {"https://attacker.example.com/callback"},
+			"response_type": {"code"},
+			"scope":         {oidc.ScopeOpenID},
+		}
+		resp, err := o.browser(t).Get(o.server.URL + "/oidc/authorize?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /authorize = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("pushed", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, o.server.URL+"/oidc/par", strings.NewReader(url.Values{
+			"redirect_uri":  {testRedirectURI},
+			"response_type": {"code"},
+			"scope":         {oidc.ScopeOpenID},
+			"state":         {"state"},
+		}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(testClientID, testClientSecret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /par = %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+		pushed := pushedAuthorizationResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&pushed); err != nil {
+			t.Fatal(err)
+		}
+
+		query := url.Values{"client_id": {testClientID}, "request_uri": {pushed.RequestURI}}
+		if got := o.follow(t, o.browser(t), o.server.URL+"/oidc/authorize?"+query.Encode()); got.outcome != "login" {
+			t.Errorf("authorize outcome = %q, want login", got.outcome)
+		}
+	})
+}
@@ -2,7 +2,6 @@ package oidc
 
 import (
 	"context"
-	"crypto/sha256"
 	"log"
 	"net/http"
 
@@ -21,6 +20,14 @@ const (
 type Storage interface {
 	op.Storage
 	authenticate
+	signingKeys
+	cryptoKeys
+	deviceAuthorizations
+	accessTokens
+	pushedRequests
+	configScopes
+	consents
+	sessions
 }
 
 func New(remoteAddr string, storage Storage) http.Handler {
@@ -30,18 +37,18 @@ func New(remoteAddr string, storage Storage) http.Handler {
 	// os.Setenv(op.OidcDevMode, "true")
 
 	//the OpenID Provider requires a 32-byte key for (token) encryption
-	//be sure to create a proper crypto random key and manage it securely!
-	key := sha256.Sum256([]byte("test"))
+	//the key is managed by the storage, the tokenCrypto of the routers also decrypts with the rotated keys
+	current, err := storage.CurrentCryptoKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var key [32]byte
+	copy(key[:], current.Key)
 
 	router := mux.NewRouter()
 
 	//for simplicity, we provide a very small default page for users who have signed out
-	router.HandleFunc(pathLoggedOut, func(w http.ResponseWriter, req *http.Request) {
-		_, err := w.Write([]byte("signed out successfully"))
-		if err != nil {
-			log.Printf("error serving logged out page: %v", err)
-		}
-	})
+	router.HandleFunc(pathLoggedOut, loggedOut)
 
 	//creation of the OpenIDProvider with the just created in-memory Storage
 	provider, err := newOP(ctx, storage, remoteAddr, key)
@@ -51,7 +58,7 @@ func New(remoteAddr string, storage Storage) http.Handler {
 
 	//the provider will only take care of the OpenID Protocol, so there must be some sort of UI for the login process
 	//for the simplicity of the example this means a simple page with username and password field
-	l := NewLogin(storage, op.AuthCallbackURL(provider))
+	l := NewLogin(storage, storage, storage, op.AuthCallbackURL(provider), provider.Encoder())
 
 	//regardless of how many pages / steps there are in the process, the UI must be registered in the router,
 	//so we will direct all calls to /login to the login UI
@@ -62,7 +69,9 @@ func New(remoteAddr string, storage Storage) http.Handler {
 	//
 	//if your issuer ends with a path (e.g. http://localhost:9998/custom/path/),
 	//then you would have to set the path prefix (/custom/path/)
-	router.PathPrefix("/").Handler(provider.HttpHandler())
+	//
+	//the requests are served by the handler of the signing algorithm of their client
+	router.PathPrefix("/").Handler(newSigningRouter(provider, storage))
 
 	return router
 }
@@ -76,7 +85,8 @@ func newOP(ctx context.Context, storage op.Storage, publicHost string, key [32]b
 		CryptoKey: key,
 
 		//will be used if the end_session endpoint is called without a post_logout_redirect_uri
-		DefaultLogoutRedirectURI: pathLoggedOut,
+		//it is absolute since the OP is served under the path of the issuer
+		DefaultLogoutRedirectURI: publicHost + pathLoggedOut,
 
 		//enables code_challenge_method S256 for PKCE (and therefore PKCE in general)
 		CodeMethodS256: true,
@@ -96,7 +106,11 @@ func newOP(ctx context.Context, storage op.Storage, publicHost string, key [32]b
 		//this example has only static texts (in English), so we'll set the here accordingly
 		SupportedUILocales: []language.Tag{language.English},
 	}
-	handler, err := op.NewOpenIDProvider(ctx, config, storage)
+	handler, err := op.NewOpenIDProvider(ctx, config, storage,
+		//the id_token_hint and JWT access tokens are signed with the algorithm of their client
+		op.WithIDTokenHintVerifierOpts(op.WithSupportedIDTokenHintSigningAlgorithms(signingAlgorithms...)),
+		op.WithAccessTokenVerifierOpts(op.WithSupportedAccessTokenSigningAlgorithms(signingAlgorithms...)),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,311 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gopkg.in/square/go-jose.v2"
+
+	httphelper "github.com/zitadel/oidc/pkg/http"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+//signingAlgorithms are the algorithms tokens can be signed with
+var signingAlgorithms = storage.SigningAlgorithms
+
+type signingKeys interface {
+	CurrentSigningKey(alg string) (*storage.SigningKey, error)
+}
+
+//signingAlgorithmClient is implemented by the clients choosing the algorithm of their tokens
+type signingAlgorithmClient interface {
+	IDTokenSignedResponseAlg() string
+}
+
+//signer implements op.Signer with the current key of its algorithm,
+//so that it picks up the rotated keys by itself
+type signer struct {
+	keys signingKeys
+	alg  string
+
+	mu     sync.Mutex
+	kid    string
+	signer jose.Signer
+}
+
+func newSigner(keys signingKeys, alg string) *signer {
+	return &signer{keys: keys, alg: alg}
+}
+
+func (s *signer) Health(ctx context.Context) error {
+	if s.Signer() == nil {
+		return errors.New("no signer")
+	}
+	return nil
+}
+
+//Signer returns the signer of the current key, or the last one if the current key cannot be read
+func (s *signer) Signer() jose.Signer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, err := s.keys.CurrentSigningKey(s.alg)
+	if err != nil {
+		log.Printf("error reading %s signing key: %v", s.alg, err)
+		return s.signer
+	}
+	if key.ID == s.kid {
+		return s.signer
+	}
+	js, err := jose.NewSigner(signingKey(key), &jose.SignerOptions{})
+	if err != nil {
+		log.Printf("error creating %s signer: %v", s.alg, err)
+		return s.signer
+	}
+	s.kid, s.signer = key.ID, js
+	return s.signer
+}
+
+//typedSigner returns a signer of the current key setting the typ header of the JWTs,
+//unlike the signer of the OP tokens which has none
+func (s *signer) typedSigner(typ jose.ContentType) (jose.Signer, error) {
+	key, err := s.keys.CurrentSigningKey(s.alg)
+	if err != nil {
+		return nil, err
+	}
+	return jose.NewSigner(signingKey(key), (&jose.SignerOptions{}).WithType(typ))
+}
+
+func signingKey(key *storage.SigningKey) jose.SigningKey {
+	return jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(key.Algorithm),
+		Key:       jose.JSONWebKey{KeyID: key.ID, Key: key.Key.Key},
+	}
+}
+
+//SignatureAlgorithm is used by the OP to hash the at_hash and c_hash claims
+func (s *signer) SignatureAlgorithm() jose.SignatureAlgorithm {
+	if s.alg == string(jose.EdDSA) {
+		//EdDSA has no hash of its own, Ed25519 signs with SHA-512 which is therefore used for the claims
+		return jose.RS512
+	}
+	return jose.SignatureAlgorithm(s.alg)
+}
+
+//provider is the OP signing its tokens with the signer of a single algorithm
+//and encrypting its codes and opaque access tokens with the managed crypto keys
+type provider struct {
+	op.OpenIDProvider
+	signer *signer
+	crypto op.Crypto
+}
+
+func (p *provider) Signer() op.Signer {
+	return p.signer
+}
+
+func (p *provider) Crypto() op.Crypto {
+	return p.crypto
+}
+
+//signingRouter serves the OP requests with the router of the algorithm the client asked for
+//it also serves the endpoints and grants the OP has no support for, like pushed authorization requests, the device authorization and token exchange grants
+//and the front-channel and back-channel logouts
+type signingRouter struct {
+	storage   op.Storage
+	devices   deviceAuthorizations
+	tokens    accessTokens
+	pushed    pushedRequests
+	scopes    configScopes
+	sessions  sessions
+	base      op.OpenIDProvider
+	providers map[string]*provider
+	routers   map[string]http.Handler
+	authorize string
+	callback  string
+	token     string
+	logout    string
+}
+
+func newSigningRouter(base op.OpenIDProvider, stor Storage) *signingRouter {
+	r := &signingRouter{
+		storage:   base.Storage(),
+		devices:   stor,
+		tokens:    stor,
+		pushed:    stor,
+		scopes:    stor,
+		sessions:  stor,
+		base:      base,
+		providers: make(map[string]*provider, len(signingAlgorithms)),
+		routers:   make(map[string]http.Handler, len(signingAlgorithms)),
+		authorize: base.AuthorizationEndpoint().Relative(),
+		callback:  base.AuthorizationEndpoint().Relative() + "/callback",
+		token:     base.TokenEndpoint().Relative(),
+		logout:    base.EndSessionEndpoint().Relative(),
+	}
+	crypto := &tokenCrypto{keys: stor}
+	for _, alg := range signingAlgorithms {
+		r.providers[alg] = &provider{OpenIDProvider: base, signer: newSigner(stor, alg), crypto: crypto}
+		r.routers[alg] = op.CreateRouter(r.providers[alg])
+	}
+	stor.OnSessionEnd(r.backChannelLogout)
+	return r
+}
+
+func (s *signingRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case oidc.DiscoveryEndpoint:
+		s.discovery(w, r)
+		return
+	case pathDeviceAuthorization:
+		s.deviceAuthorization(w, r)
+		return
+	case pathPushedAuthorization:
+		s.pushedAuthorization(w, r)
+		return
+	case s.authorize:
+		if !s.pushedAuthorizeRequest(w, r) {
+			return
+		}
+	case s.logout:
+		s.endSession(w, r)
+		return
+	case s.callback, s.token:
+		r = s.withSessionID(r)
+	}
+	alg := s.clientAlgorithm(r)
+	if _, ok := s.providers[alg]; !ok {
+		alg = storage.DefaultSigningAlgorithm
+	}
+	if r.URL.Path == s.token {
+		switch oidc.GrantType(r.FormValue("grant_type")) {
+		case storage.GrantTypeDeviceCode:
+			s.deviceToken(w, r, s.providers[alg])
+			return
+		case oidc.GrantTypeTokenExchange:
+			s.tokenExchange(w, r, s.providers[alg])
+			return
+		}
+	}
+	s.routers[alg].ServeHTTP(w, r)
+}
+
+type configScopes interface {
+	Scopes() ([]*storage.Scope, error)
+}
+
+//discoveryConfiguration adds the metadata of the endpoints served next to the OP
+type discoveryConfiguration struct {
+	*oidc.DiscoveryConfiguration
+	DeviceAuthorizationEndpoint        string `json:"device_authorization_endpoint,omitempty"`
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint,omitempty"`
+	//RequirePushedAuthorizationRequests is false since PAR is not required globally, only the clients with RequirePushedAuthorizationRequests must use it
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests"`
+	FrontChannelLogoutSupported        bool `json:"frontchannel_logout_supported"`
+	FrontChannelLogoutSessionSupported bool `json:"frontchannel_logout_session_supported"`
+	BackChannelLogoutSupported         bool `json:"backchannel_logout_supported"`
+	BackChannelLogoutSessionSupported  bool `json:"backchannel_logout_session_supported"`
+}
+
+//discovery advertises all the algorithms id_tokens can be signed with, the scopes of the configuration and their claims,
+//and the grants and logouts served next to the OP
+func (s *signingRouter) discovery(w http.ResponseWriter, r *http.Request) {
+	config := op.CreateDiscoveryConfig(s.base, s.providers[storage.DefaultSigningAlgorithm].signer)
+	config.IDTokenSigningAlgValuesSupported = signingAlgorithms
+	config.ScopesSupported = append(config.ScopesSupported, storage.ScopeGroups)
+	scopes, err := s.scopes.Scopes()
+	if err != nil {
+		httphelper.MarshalJSONWithStatus(w, oidc.ErrServerError().WithParent(err), http.StatusInternalServerError)
+		return
+	}
+	for _, scope := range scopes {
+		if !containsScope(config.ScopesSupported, scope.Name) {
+			config.ScopesSupported = append(config.ScopesSupported, scope.Name)
+		}
+		for _, m := range scope.Claims {
+			if !containsScope(config.ClaimsSupported, m.Claim) {
+				config.ClaimsSupported = append(config.ClaimsSupported, m.Claim)
+			}
+		}
+	}
+	config.ClaimsSupported = append(config.ClaimsSupported, "sid")
+	config.GrantTypesSupported = append(config.GrantTypesSupported, storage.GrantTypeDeviceCode, oidc.GrantTypeTokenExchange)
+	httphelper.MarshalJSON(w, &discoveryConfiguration{
+		DiscoveryConfiguration:             config,
+		DeviceAuthorizationEndpoint:        s.base.Issuer() + pathDeviceAuthorization,
+		PushedAuthorizationRequestEndpoint: s.base.Issuer() + pathPushedAuthorization,
+		FrontChannelLogoutSupported:        true,
+		FrontChannelLogoutSessionSupported: true,
+		BackChannelLogoutSupported:         true,
+		BackChannelLogoutSessionSupported:  true,
+	})
+}
+
+//clientAlgorithm returns the signing algorithm of the client of the requests issuing tokens
+func (s *signingRouter) clientAlgorithm(r *http.Request) string {
+	var clientID string
+	switch r.URL.Path {
+	case s.callback:
+		authReq, err := s.storage.AuthRequestByID(r.Context(), r.URL.Query().Get("id"))
+		if err != nil {
+			return ""
+		}
+		clientID = authReq.GetClientID()
+	case s.token:
+		clientID = tokenRequestClientID(r)
+	default:
+		return ""
+	}
+	client, err := s.storage.GetClientByClientID(r.Context(), clientID)
+	if err != nil {
+		return ""
+	}
+	if c, ok := client.(signingAlgorithmClient); ok {
+		return c.IDTokenSignedResponseAlg()
+	}
+	return ""
+}
+
+//tokenRequestClientID returns the client_id of a token request, whichever way the client authenticates
+//the request is not authenticated yet, the OP does it once the router is picked
+func tokenRequestClientID(r *http.Request) string {
+	if err := r.ParseForm(); err != nil {
+		return ""
+	}
+	if clientID := r.PostForm.Get("client_id"); clientID != "" {
+		return clientID
+	}
+	if clientID, _, ok := r.BasicAuth(); ok {
+		//the OP expects the credentials to be url encoded
+		if id, err := url.QueryUnescape(clientID); err == nil {
+			return id
+		}
+		return clientID
+	}
+	//private_key_jwt: the client is the issuer of the assertion
+	parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
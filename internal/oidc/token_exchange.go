@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zitadel/oidc/pkg/crypto"
+	httphelper "github.com/zitadel/oidc/pkg/http"
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+//the token types of the token exchange grant (RFC 8693 3)
+const (
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+type accessTokens interface {
+	AccessTokenByID(id string) (*storage.Token, error)
+}
+
+//tokenExchangeClient is implemented by the clients allowed to exchange tokens
+type tokenExchangeClient interface {
+	TokenExchangePolicy() *storage.TokenExchange
+}
+
+//tokenExchangeResponse is the response of a token exchange (RFC 8693 2.2.1)
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       uint64 `json:"expires_in,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+//tokenExchange exchanges the subject token, and the actor token if any, for an access token of the audience (RFC 8693)
+//without actor token the client impersonates the subject, with one it acts on behalf of the subject and the token gets an act claim
+func (s *signingRouter) tokenExchange(w http.ResponseWriter, r *http.Request, p *provider) {
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	policyClient, ok := client.(tokenExchangeClient)
+	if !ok || !op.ValidateGrantType(client, oidc.GrantTypeTokenExchange) || policyClient.TokenExchangePolicy() == nil {
+		op.RequestError(w, r, oidc.ErrUnauthorizedClient().WithDescription("the token exchange grant is not allowed for this client"))
+		return
+	}
+	policy := policyClient.TokenExchangePolicy()
+	form := r.PostForm
+
+	issuedTokenType := form.Get("requested_token_type")
+	accessTokenType := client.AccessTokenType()
+	switch issuedTokenType {
+	case "", tokenTypeAccessToken:
+		issuedTokenType = tokenTypeAccessToken
+	case tokenTypeJWT:
+		accessTokenType = op.AccessTokenTypeJWT
+	default:
+		op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("unsupported requested_token_type %q", issuedTokenType))
+		return
+	}
+
+	subject, err := s.exchangedToken(r.Context(), p, form.Get("subject_token"), form.Get("subject_token_type"))
+	if err != nil {
+		op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("invalid subject_token: %v", err))
+		return
+	}
+	//a client can only exchange the tokens issued to or for it, or to the clients of its policy
+	if subject.ApplicationID != client.GetID() && !containsScope(subject.Audience, client.GetID()) && !containsScope(policy.SubjectClients, subject.ApplicationID) {
+		op.RequestError(w, r, oidc.ErrInvalidGrant().WithDescription("the subject_token was not issued for this client"))
+		return
+	}
+
+	actor := subject.Actor
+	if actorToken := form.Get("actor_token"); actorToken != "" {
+		if !policy.Delegation {
+			op.RequestError(w, r, oidc.ErrUnauthorizedClient().WithDescription("delegation is not allowed for this client"))
+			return
+		}
+		act, err := s.exchangedToken(r.Context(), p, actorToken, form.Get("actor_token_type"))
+		if err != nil {
+			op.RequestError(w, r, oidc.ErrInvalidRequest().WithDescription("invalid actor_token: %v", err))
+			return
+		}
+		//the actor must be the client itself, or one of the subjects of its policy, not whoever's token it got hold of
+		if act.ApplicationID != client.GetID() && !containsScope(policy.ActorSubjects, act.Subject) {
+			op.RequestError(w, r, oidc.ErrInvalidGrant().WithDescription("the actor_token was not issued to this client"))
+			return
+		}
+		//the actor of the subject token becomes a prior actor
+		actor = &storage.TokenActor{Subject: act.Subject, Actor: subject.Actor}
+	} else if !policy.Impersonation {
+		op.RequestError(w, r, oidc.ErrUnauthorizedClient().WithDescription("impersonation is not allowed for this client, an actor_token is required"))
+		return
+	}
+
+	audience, err := exchangeAudience(policy, append(form["audience"], form["resource"]...))
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	scopes, err := exchangeScopes(subject.Scopes, strings.Fields(form.Get("scope")))
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+
+	req := &storage.TokenExchangeRequest{
+		ClientID: client.GetID(),
+		Subject:  subject.Subject,
+		Audience: audience,
+		Scopes:   scopes,
+		Actor:    actor,
+	}
+	accessToken, exp, err := createExchangedToken(r.Context(), p, client, req, accessTokenType)
+	if err != nil {
+		op.RequestError(w, r, err)
+		return
+	}
+	httphelper.MarshalJSON(w, &tokenExchangeResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: issuedTokenType,
+		TokenType:       oidc.BearerToken,
+		ExpiresIn:       uint64(time.Until(exp).Seconds()),
+		Scope:           strings.Join(scopes, " "),
+	})
+}
+
+//exchangedToken returns the access token issued by the OP, opaque or JWT
+func (s *signingRouter) exchangedToken(ctx context.Context, p *provider, token, tokenType string) (*storage.Token, error) {
+	if token == "" {
+		return nil, oidc.ErrInvalidRequest().WithDescription("token missing")
+	}
+	if tokenType != tokenTypeAccessToken && tokenType != tokenTypeJWT {
+		return nil, oidc.ErrInvalidRequest().WithDescription("unsupported token type %q, must be %s or %s", tokenType, tokenTypeAccessToken, tokenTypeJWT)
+	}
+	var tokenID string
+	if tokenIDSubject, err := p.Crypto().Decrypt(token); err == nil {
+		tokenID, _, _ = strings.Cut(tokenIDSubject, ":")
+	} else {
+		claims, err := op.VerifyAccessToken(ctx, token, p.AccessTokenVerifier())
+		if err != nil {
+			return nil, err
+		}
+		tokenID = claims.GetTokenID()
+	}
+	return s.tokens.AccessTokenByID(tokenID)
+}
+
+//exchangeAudience returns the requested audience, which must be allowed by the policy, or all of the allowed audience
+func exchangeAudience(policy *storage.TokenExchange, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		if len(policy.Audience) == 0 {
+			return nil, oidc.ErrInvalidRequest().WithDescription("audience or resource missing")
+		}
+		return policy.Audience, nil
+	}
+	for _, aud := range requested {
+		if !containsScope(policy.Audience, aud) {
+			return nil, &oidc.Error{ErrorType: "invalid_target", Description: "the audience " + aud + " is not allowed for this client"}
+		}
+	}
+	return requested, nil
+}
+
+//exchangeScopes narrows the scopes of the subject token down to the requested ones
+func exchangeScopes(subjectScopes, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return subjectScopes, nil
+	}
+	for _, scope := range requested {
+		if !containsScope(subjectScopes, scope) {
+			return nil, oidc.ErrInvalidScope().WithDescription("scope %q is not granted to the subject_token", scope)
+		}
+	}
+	return requested, nil
+}
+
+//createExchangedToken stores the token of the exchange and returns it opaque or as a JWT with its act claim
+func createExchangedToken(ctx context.Context, p *provider, client op.Client, req *storage.TokenExchangeRequest, tokenType op.AccessTokenType) (string, time.Time, error) {
+	id, exp, err := p.Storage().CreateAccessToken(ctx, req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if tokenType != op.AccessTokenTypeJWT {
+		token, err := op.CreateBearerToken(id, req.Subject, p.Crypto())
+		return token, exp, err
+	}
+	claims := oidc.NewAccessTokenClaims(p.Issuer(), req.Subject, req.Audience, exp, id, client.GetID(), client.ClockSkew())
+	privateClaims, err := p.Storage().GetPrivateClaimsFromScopes(ctx, req.Subject, client.GetID(), req.Scopes)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if req.Actor != nil {
+		if privateClaims == nil {
+			privateClaims = map[string]interface{}{}
+		}
+		privateClaims["act"] = req.Actor
+	}
+	claims.SetPrivateClaims(privateClaims)
+	token, err := crypto.Sign(claims, p.Signer().Signer())
+	return token, exp, err
+}
@@ -0,0 +1,130 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+//bearerToken returns an opaque access token of the request, as issued by the OP
+func (o *testOP) bearerToken(t *testing.T, request op.TokenRequest) string {
+	t.Helper()
+	id, _, err := o.stor.CreateAccessToken(context.Background(), request)
+	if err != nil {
+		t.Fatalf("CreateAccessToken() error = %v", err)
+	}
+	token, err := op.CreateBearerToken(id, request.GetSubject(), &tokenCrypto{keys: o.stor})
+	if err != nil {
+		t.Fatalf("CreateBearerToken() error = %v", err)
+	}
+	return token
+}
+
+func TestTokenExchangeActorToken(t *testing.T) {
+	o := newTestOP(t)
+	client := storage.WebClient(testClientID, testClientSecret, testRedirectURI)
+	client.ClientDevMode = true
+	client.ClientGrantTypes = append(client.ClientGrantTypes, oidc.GrantTypeTokenExchange)
+	client.TokenExchange = &storage.TokenExchange{
+		Audience:      []string{"https://api.example.com"},
+		Delegation:    true,
+		ActorSubjects: []string{"worker"},
+	}
+	if err := o.stor.RegisterClient(client.ID, client); err != nil {
+		t.Fatalf("RegisterClient() error = %v", err)
+	}
+	subjectToken := o.bearerToken(t, &storage.AuthRequest{ApplicationID: testClientID, UserID: "alice", Scopes: []string{oidc.ScopeOpenID}})
+
+	tests := []struct {
+		name       string
+		actor      op.TokenRequest
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "issued to the client",
+			actor:      &storage.ClientCredentialsRequest{ClientID: testClientID},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "issued to the client for another user",
+			actor:      &storage.AuthRequest{ApplicationID: testClientID, UserID: "bob"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "subject of the policy",
+			actor:      &storage.ClientCredentialsRequest{ClientID: "worker"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "issued to another client",
+			actor:      &storage.ClientCredentialsRequest{ClientID: "other"},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "user of another client",
+			actor:      &storage.AuthRequest{ApplicationID: "other", UserID: "bob"},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actorToken := o.bearerToken(t, tt.actor)
+			params := url.Values{
+				"grant_type":         {string(oidc.GrantTypeTokenExchange)},
+				"subject_token":      {subjectToken},
+				"subject_token_type": {tokenTypeAccessToken},
+				"actor_token":        {actorToken},
+				"actor_token_type":   {tokenTypeAccessToken},
+			}
+			req, err := http.NewRequest(http.MethodPost, o.server.URL+"/oidc/oauth/token", strings.NewReader(params.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(testClientID, testClientSecret)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var body struct {
+				AccessToken string `json:"access_token"`
+				Error       string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus || body.Error != tt.wantError {
+				t.Fatalf("token exchange = %d %q, want %d %q", resp.StatusCode, body.Error, tt.wantStatus, tt.wantError)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			//the exchanged token is issued to alice, acting through the actor
+			tokenIDSubject, err := (&tokenCrypto{keys: o.stor}).Decrypt(body.AccessToken)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			tokenID, _, _ := strings.Cut(tokenIDSubject, ":")
+			token, err := o.stor.AccessTokenByID(tokenID)
+			if err != nil {
+				t.Fatalf("AccessTokenByID() error = %v", err)
+			}
+			if token.Subject != "alice" || token.Actor == nil || token.Actor.Subject != tt.actor.GetSubject() {
+				t.Errorf("exchanged token subject %q, actor %+v, want alice acting through %q", token.Subject, token.Actor, tt.actor.GetSubject())
+			}
+		})
+	}
+}
@@ -5,6 +5,8 @@ package samlidp
 import (
 	"crypto"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
 	"net/http"
 	"net/url"
 	"sync"
@@ -21,13 +23,18 @@ type Options struct {
 	Key         crypto.PrivateKey
 	Logger      logger.Interface
 	Certificate *x509.Certificate
-	Store       Store
+	// NextCertificate is published in the metadata ahead of a rollover, it may be nil.
+	NextCertificate *x509.Certificate
+	Store           Store
+	// Sessions are the IdP sessions shared with the OIDC login.
+	Sessions Sessions
 }
 
 // Server represents an IDP server. The server provides the following URLs:
 //
 //     /metadata     - the SAML metadata
 //     /sso          - the SAML endpoint to initiate an authentication flow
+//     /slo          - the SAML endpoint of single logout
 //     /login        - prompt for a username and password if no session established
 //     /login/:shortcut - kick off an IDP-initiated authentication flow
 //     /services     - RESTful interface to Service objects
@@ -40,6 +47,9 @@ type Server struct {
 	logger      logger.Interface
 	IDP         saml.IdentityProvider // the underlying IDP
 	Store       Store                 // the data store
+	Sessions    Sessions              // the IdP sessions
+
+	nextCertificate *x509.Certificate // published in the metadata, protected by idpConfigMu
 }
 
 // New returns a new Server
@@ -48,6 +58,8 @@ func New(opts Options) (*Server, error) {
 	metadataURL.Path = metadataURL.Path + "/metadata"
 	ssoURL := opts.URL
 	ssoURL.Path = ssoURL.Path + "/sso"
+	sloURL := opts.URL
+	sloURL.Path = sloURL.Path + "/slo"
 	logr := opts.Logger
 	if logr == nil {
 		logr = logger.DefaultLogger
@@ -60,18 +72,63 @@ func New(opts Options) (*Server, error) {
 			Certificate: opts.Certificate,
 			MetadataURL: metadataURL,
 			SSOURL:      ssoURL,
+			LogoutURL:   sloURL,
 		},
-		logger: logr,
-		Store:  opts.Store,
+		logger:          logr,
+		Store:           opts.Store,
+		Sessions:        opts.Sessions,
+		nextCertificate: opts.NextCertificate,
 	}
 
 	s.IDP.SessionProvider = s
 	s.IDP.ServiceProviderProvider = s
+	s.IDP.AssertionMaker = sessionAssertionMaker{
+		AssertionMaker: attributeAssertionMaker{AssertionMaker: saml.DefaultAssertionMaker{}, server: s},
+		sessions:       opts.Sessions,
+	}
 
 	s.InitializeHTTP()
 	return s, nil
 }
 
+// SetKeyPair replaces the key and certificate the IDP signs with, as well as the
+// next certificate published in the metadata, which may be nil.
+func (s *Server) SetKeyPair(key crypto.PrivateKey, cert, next *x509.Certificate) {
+	s.idpConfigMu.Lock()
+	defer s.idpConfigMu.Unlock()
+	s.IDP.Key = key
+	s.IDP.Certificate = cert
+	s.nextCertificate = next
+}
+
+// serveMetadata serves the metadata of the IDP, with the next certificate as an
+// additional signing key during a rollover, and the single logout service with
+// both the HTTP-Redirect and HTTP-POST bindings.
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	md := s.IDP.Metadata()
+	ssoDescriptor := &md.IDPSSODescriptors[0].SSODescriptor
+	ssoDescriptor.SingleLogoutServices = append(ssoDescriptor.SingleLogoutServices, saml.Endpoint{
+		Binding:  saml.HTTPPostBinding,
+		Location: s.IDP.LogoutURL.String(),
+	})
+	if s.nextCertificate != nil {
+		descriptor := &md.IDPSSODescriptors[0].SSODescriptor.RoleDescriptor
+		descriptor.KeyDescriptors = append(descriptor.KeyDescriptors, saml.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: saml.KeyInfo{
+				X509Data: saml.X509Data{
+					X509Certificates: []saml.X509Certificate{
+						{Data: base64.StdEncoding.EncodeToString(s.nextCertificate.Raw)},
+					},
+				},
+			},
+		})
+	}
+	buf, _ := xml.MarshalIndent(md, "", "  ")
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(buf)
+}
+
 // InitializeHTTP sets up the HTTP handler for the server. (This function
 // is called automatically for you by New, but you may need to call it
 // yourself if you don't create the object using New.)
@@ -82,13 +139,18 @@ func (s *Server) InitializeHTTP() {
 	mux.Get("/metadata", func(w http.ResponseWriter, r *http.Request) {
 		s.idpConfigMu.RLock()
 		defer s.idpConfigMu.RUnlock()
-		s.IDP.ServeMetadata(w, r)
+		s.serveMetadata(w, r)
 	})
 	mux.Handle("/sso", func(w http.ResponseWriter, r *http.Request) {
 		s.idpConfigMu.RLock()
 		defer s.idpConfigMu.RUnlock()
 		s.IDP.ServeSSO(w, r)
 	})
+	mux.Handle("/slo", func(w http.ResponseWriter, r *http.Request) {
+		s.idpConfigMu.RLock()
+		defer s.idpConfigMu.RUnlock()
+		s.HandleSLO(w, r)
+	})
 
 	mux.Handle("/login", s.HandleLogin)
 	mux.Handle("/login/:shortcut", s.HandleIDPInitiated)
@@ -106,8 +168,8 @@ func (s *Server) InitializeHTTP() {
 	mux.Delete("/users/:id", s.HandleDeleteUser)
 
 	mux.Get("/sessions/", s.HandleListSessions)
-	mux.Get("/sessions/:id", s.HandleGetSession)
-	mux.Delete("/sessions/:id", s.HandleDeleteSession)
+	mux.Get("/sessions/:sid", s.HandleGetSession)
+	mux.Delete("/sessions/:sid", s.HandleDeleteSession)
 
 	mux.Get("/shortcuts/", s.HandleListShortcuts)
 	mux.Get("/shortcuts/:id", s.HandleGetShortcut)
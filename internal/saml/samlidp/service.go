@@ -25,6 +25,41 @@ func (s *Server) GetServiceProvider(r *http.Request, serviceProviderID string) (
 	return service.Metadata, nil
 }
 
+// attributeAssertionMaker asserts the attributes mapped by the service provider
+// instead of the default ones, for the service providers that map them.
+type attributeAssertionMaker struct {
+	saml.AssertionMaker
+	server *Server
+}
+
+// MakeAssertion makes the assertion, and then replaces its attributes with the
+// ones the service provider maps from the user of the session.
+func (m attributeAssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	if err := m.AssertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+	service := storage.ServiceProvider{}
+	if err := m.server.Store.Get(fmt.Sprintf("/services-by-entity-id/%s", req.ServiceProviderMetadata.EntityID), &service); err != nil {
+		return err
+	}
+	if len(service.Attributes) == 0 {
+		return nil
+	}
+	idpSession, err := m.server.Sessions.SessionByID(session.ID)
+	if err != nil {
+		return err
+	}
+	user := storage.User{}
+	if err := m.server.Store.Get(fmt.Sprintf("/users/%s", idpSession.UserID), &user); err != nil {
+		return err
+	}
+	req.Assertion.AttributeStatements = nil
+	if attributes := service.SAMLAttributes(&user); len(attributes) > 0 {
+		req.Assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: attributes}}
+	}
+	return nil
+}
+
 // HandleListServices handles the `GET /services/` request and responds with a JSON formatted list
 // of service names.
 func (s *Server) HandleListServices(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -53,11 +88,11 @@ func (s *Server) HandleGetService(c web.C, w http.ResponseWriter, r *http.Reques
 	xml.NewEncoder(w).Encode(service.Metadata)
 }
 
-// HandlePutService handles the `PUT /shortcuts/:id` request. It accepts the XML-formatted
-// service metadata in the request body and stores it.
+// HandlePutService handles the `PUT /services/:id` request. It accepts the XML-formatted
+// service metadata in the request body and stores it, keeping the SCIM target and the
+// attribute mappings of the service provider when it already exists.
 func (s *Server) HandlePutService(c web.C, w http.ResponseWriter, r *http.Request) {
-	service := storage.ServiceProvider{}
-
+	id := c.URLParams["id"]
 	metadata, err := GetSPMetadata(r.Body)
 	if err != nil {
 		s.logger.Printf("ERROR: %s", err)
@@ -65,9 +100,17 @@ func (s *Server) HandlePutService(c web.C, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	service := storage.ServiceProvider{}
+	err = s.Store.Get(fmt.Sprintf("/services/%s", id), &service)
+	if err != nil && err != ErrNotFound {
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	service.ID = id
 	service.Metadata = metadata
 
-	err = s.Store.Put(fmt.Sprintf("/services/%s", c.URLParams["id"]), &service)
+	err = s.Store.Put(fmt.Sprintf("/services/%s", id), &service)
 	if err != nil {
 		s.logger.Printf("ERROR: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
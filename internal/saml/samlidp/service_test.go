@@ -0,0 +1,87 @@
+package samlidp_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/seriousben/dev-identity-provider/internal/saml"
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+const idpURL = "https://idp.example.com/saml2"
+
+// newIDP returns the handler of the IDP, and its storage.
+func newIDP(t *testing.T) (http.Handler, *storage.Storage) {
+	t.Helper()
+	stor := storage.NewStorage()
+	if err := stor.EnsureSAMLKeyPair("idp.example.com"); err != nil {
+		t.Fatalf("EnsureSAMLKeyPair() error = %v", err)
+	}
+	return saml.New(idpURL, stor), stor
+}
+
+// spMetadata returns the metadata of a service provider with the entity ID.
+func spMetadata(entityID string) string {
+	return fmt.Sprintf(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+	<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+		<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="%s/acs" index="1"/>
+	</SPSSODescriptor>
+</EntityDescriptor>`, entityID, entityID)
+}
+
+func TestHandlePutService(t *testing.T) {
+	scim := &storage.SCIMTarget{URL: "https://sp.example.com/scim/v2", Token: "token"}
+	attributes := []storage.AttributeMapping{{Name: "mail", Field: storage.UserFieldEmail}}
+
+	tests := []struct {
+		name     string
+		existing *storage.ServiceProvider
+		want     *storage.ServiceProvider
+	}{
+		{
+			name: "new service provider",
+			want: &storage.ServiceProvider{ID: "sp"},
+		},
+		{
+			name:     "keeps the SCIM target and attributes",
+			existing: &storage.ServiceProvider{ID: "sp", SCIM: scim, Attributes: attributes},
+			want:     &storage.ServiceProvider{ID: "sp", SCIM: scim, Attributes: attributes},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, stor := newIDP(t)
+			if tt.existing != nil {
+				if err := stor.PutServiceProvider(tt.existing.ID, tt.existing); err != nil {
+					t.Fatalf("PutServiceProvider() error = %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/services/sp", strings.NewReader(spMetadata("https://sp.example.com")))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("PUT /services/sp = %d %s, want %d", rec.Code, rec.Body, http.StatusNoContent)
+			}
+
+			got, err := stor.GetServiceProviderByID("sp")
+			if err != nil {
+				t.Fatalf("GetServiceProviderByID() error = %v", err)
+			}
+			if got.Metadata == nil || got.Metadata.EntityID != "https://sp.example.com" {
+				t.Errorf("metadata = %+v, want the metadata of https://sp.example.com", got.Metadata)
+			}
+			got.Metadata = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("service provider = %+v, want %+v", got, tt.want)
+			}
+			if _, err := stor.GetServiceProviderByEntityID("https://sp.example.com"); err != nil {
+				t.Errorf("GetServiceProviderByEntityID() error = %v", err)
+			}
+		})
+	}
+}
@@ -2,12 +2,11 @@ package samlidp
 
 import (
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"text/template"
-	"time"
 
 	"github.com/seriousben/dev-identity-provider/internal/storage"
 	"github.com/zenazn/goji/web"
@@ -15,7 +14,34 @@ import (
 	"github.com/crewjam/saml"
 )
 
-var sessionMaxAge = time.Hour
+// Sessions keeps the sessions of the IdP, they are shared with the OIDC login so
+// that logging in once covers both protocols.
+type Sessions interface {
+	CreateSession(username, password, previousID string) (*storage.Session, error)
+	SessionFromRequest(r *http.Request) (*storage.Session, error)
+	SessionByID(id string) (*storage.Session, error)
+	SessionBySID(sid string) (*storage.Session, error)
+	Sessions() ([]*storage.Session, error)
+	DeleteSession(id string) error
+	EndSession(id string) (*storage.Session, []*storage.Client, error)
+	AddSessionServiceProvider(id, entityID string) error
+}
+
+// sessionAssertionMaker records the service providers the users log in to with
+// their session, so that they are logged out of them with single logout.
+type sessionAssertionMaker struct {
+	saml.AssertionMaker
+	sessions Sessions
+}
+
+// MakeAssertion records the service provider of the request in the session before
+// making the assertion.
+func (m sessionAssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	if err := m.sessions.AddSessionServiceProvider(session.ID, req.ServiceProviderMetadata.EntityID); err != nil {
+		return err
+	}
+	return m.AssertionMaker.MakeAssertion(req, session)
+}
 
 // GetSession returns the *Session for this request.
 //
@@ -28,75 +54,63 @@ var sessionMaxAge = time.Hour
 // password was invalid.
 //
 // If a session cookie already exists and represents a valid session,
-// then the session is returned
+// then the session is returned, unless the service provider forces the
+// user to authenticate again with ForceAuthn. The session may have been
+// established by the OIDC login.
 //
 // If neither credentials nor a valid session cookie exist, this function
 // sends a login form and returns nil.
 func (s *Server) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
 	// if we received login credentials then maybe we can create a session
 	if r.Method == "POST" && r.PostForm.Get("user") != "" {
-		user := storage.User{}
-		if err := s.Store.Get(fmt.Sprintf("/users/%s", r.PostForm.Get("user")), &user); err != nil {
-			s.sendLoginForm(w, r, req, "Invalid username or password")
-			return nil
+		// the session of the browser is carried over to the new session when the same user logs in again, e.g. after ForceAuthn
+		var previousID string
+		if previous, err := s.Sessions.SessionFromRequest(r); err == nil {
+			previousID = previous.ID
 		}
-
-		// No password encryption in our dev identity provider.
-		if user.Password != r.PostForm.Get("password") {
+		session, err := s.Sessions.CreateSession(r.PostForm.Get("user"), r.PostForm.Get("password"), previousID)
+		if err != nil {
 			s.sendLoginForm(w, r, req, "Invalid username or password")
 			return nil
 		}
+		http.SetCookie(w, session.Cookie(r.TLS != nil))
+		return s.samlSession(w, session)
+	}
 
-		session := &saml.Session{
-			ID:             base64.StdEncoding.EncodeToString(randomBytes(32)),
-			NameID:         user.Email,
-			CreateTime:     saml.TimeNow(),
-			ExpireTime:     saml.TimeNow().Add(sessionMaxAge),
-			Index:          hex.EncodeToString(randomBytes(32)),
-			UserName:       user.Username,
-			Groups:         user.Groups[:],
-			UserEmail:      user.Email,
-			UserCommonName: user.Firstname + " " + user.Lastname,
-			UserSurname:    user.Lastname,
-			UserGivenName:  user.Firstname,
-			// UserScopedAffiliation: user.ScopedAffiliation,
-		}
-		if err := s.Store.Put(fmt.Sprintf("/sessions/%s", session.ID), &session); err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return nil
-		}
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    session.ID,
-			MaxAge:   int(sessionMaxAge.Seconds()),
-			HttpOnly: true,
-			Secure:   r.URL.Scheme == "https",
-			Path:     "/",
-		})
-		return session
-	}
-
-	if sessionCookie, err := r.Cookie("session"); err == nil {
-		session := &saml.Session{}
-		if err := s.Store.Get(fmt.Sprintf("/sessions/%s", sessionCookie.Value), session); err != nil {
-			if err == ErrNotFound {
-				s.sendLoginForm(w, r, req, "")
-				return nil
-			}
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return nil
-		}
-
-		if saml.TimeNow().After(session.ExpireTime) {
-			s.sendLoginForm(w, r, req, "")
-			return nil
-		}
-		return session
+	if req.Request.ForceAuthn != nil && *req.Request.ForceAuthn {
+		s.sendLoginForm(w, r, req, "")
+		return nil
 	}
+	session, err := s.Sessions.SessionFromRequest(r)
+	if err != nil {
+		s.sendLoginForm(w, r, req, "")
+		return nil
+	}
+	return s.samlSession(w, session)
+}
 
-	s.sendLoginForm(w, r, req, "")
-	return nil
+// samlSession returns the SAML session of the IdP session, asserting the current
+// attributes of its user.
+func (s *Server) samlSession(w http.ResponseWriter, session *storage.Session) *saml.Session {
+	user := storage.User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", session.UserID), &user); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+	return &saml.Session{
+		ID:             session.ID,
+		NameID:         user.Email,
+		CreateTime:     session.AuthTime,
+		ExpireTime:     session.Expiration,
+		Index:          session.Index,
+		UserName:       user.Username,
+		Groups:         user.Groups[:],
+		UserEmail:      user.Email,
+		UserCommonName: user.Firstname + " " + user.Lastname,
+		UserSurname:    user.Lastname,
+		UserGivenName:  user.Firstname,
+		// UserScopedAffiliation: user.ScopedAffiliation,
+	}
 }
 
 // sendLoginForm produces a form which requests a username and password and directs the user
@@ -107,7 +121,7 @@ func (s *Server) sendLoginForm(w http.ResponseWriter, r *http.Request, req *saml
 		`<html>` +
 		`<p>{{.Toast}}</p>` +
 		`<form method="post" action="{{.URL}}">` +
-		`<input type="text" name="user" placeholder="user" value="" />` +
+		`<input type="text" name="user" placeholder="username" value="" />` +
 		`<input type="password" name="password" placeholder="password" value="" />` +
 		`<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />` +
 		`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
@@ -148,35 +162,54 @@ func (s *Server) HandleLogin(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleListSessions handles the `GET /sessions/` request and responds with a JSON formatted list
-// of session names.
+// of session SIDs. The session IDs are the values of the session cookies, they are never listed.
 func (s *Server) HandleListSessions(c web.C, w http.ResponseWriter, r *http.Request) {
-	sessions, err := s.Store.List("/sessions/")
+	sessions, err := s.Sessions.Sessions()
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	sids := make([]string, len(sessions))
+	for i, session := range sessions {
+		sids[i] = session.SID
+	}
 
 	json.NewEncoder(w).Encode(struct {
 		Sessions []string `json:"sessions"`
-	}{Sessions: sessions})
+	}{Sessions: sids})
 }
 
-// HandleGetSession handles the `GET /sessions/:id` request and responds with the session
-// object in JSON format.
+// HandleGetSession handles the `GET /sessions/:sid` request and responds with the session
+// object in JSON format, identified by its SID instead of its ID.
 func (s *Server) HandleGetSession(c web.C, w http.ResponseWriter, r *http.Request) {
-	session := saml.Session{}
-	err := s.Store.Get(fmt.Sprintf("/sessions/%s", c.URLParams["id"]), &session)
+	session, err := s.Sessions.SessionBySID(c.URLParams["sid"])
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(session)
+	samlSession := s.samlSession(w, session)
+	if samlSession == nil {
+		return
+	}
+	samlSession.ID = session.SID
+	json.NewEncoder(w).Encode(samlSession)
 }
 
-// HandleDeleteSession handles the `DELETE /sessions/:id` request. It invalidates the
-// specified session.
+// HandleDeleteSession handles the `DELETE /sessions/:sid` request. It invalidates the
+// specified session, for both protocols.
 func (s *Server) HandleDeleteSession(c web.C, w http.ResponseWriter, r *http.Request) {
-	err := s.Store.Delete(fmt.Sprintf("/sessions/%s", c.URLParams["id"]))
+	session, err := s.Sessions.SessionBySID(c.URLParams["sid"])
+	if err == nil {
+		err = s.Sessions.DeleteSession(session.ID)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
@@ -0,0 +1,59 @@
+package samlidp_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+
+	"github.com/crewjam/saml"
+)
+
+func TestHandleLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		wantUser string // the UserName of the session, empty when the login form is sent again
+	}{
+		{name: "username", user: "alice", password: "secret", wantUser: "alice"},
+		// the login takes the username, like the OIDC login, and no longer the user ID
+		{name: "user ID", user: "user-1", password: "secret"},
+		{name: "wrong password", user: "alice", password: "wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, stor := newIDP(t)
+			if err := stor.PutUser("user-1", &storage.User{ID: "user-1", Username: "alice", Password: "secret", Email: "alice@example.com"}); err != nil {
+				t.Fatalf("PutUser() error = %v", err)
+			}
+
+			form := url.Values{"user": {tt.user}, "password": {tt.password}}
+			req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("POST /login = %d %s, want %d", rec.Code, rec.Body, http.StatusOK)
+			}
+
+			if tt.wantUser == "" {
+				if !strings.Contains(rec.Body.String(), "Invalid username or password") {
+					t.Errorf("POST /login = %s, want the login form", rec.Body)
+				}
+				return
+			}
+			session := saml.Session{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil {
+				t.Fatalf("POST /login = %s, want a session: %v", rec.Body, err)
+			}
+			if session.UserName != tt.wantUser {
+				t.Errorf("UserName = %q, want %q", session.UserName, tt.wantUser)
+			}
+		})
+	}
+}
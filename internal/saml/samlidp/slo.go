@@ -0,0 +1,618 @@
+package samlidp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+
+	"github.com/crewjam/saml"
+)
+
+// errUnknownPrincipal is returned when the NameID of a LogoutRequest is not the
+// user of the session it ends, or when its issuer is not a service provider the
+// user logged in to with the session.
+var errUnknownPrincipal = errors.New("unknown principal")
+
+// querySignatureAlgorithms are the SigAlg accepted in the messages received with
+// the HTTP-Redirect binding.
+var querySignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	dsig.RSASHA1SignatureMethod:   x509.SHA1WithRSA,
+	dsig.RSASHA256SignatureMethod: x509.SHA256WithRSA,
+	dsig.RSASHA512SignatureMethod: x509.SHA512WithRSA,
+}
+
+var (
+	// logoutTmpl sends the LogoutRequests of the other service providers of the
+	// session in hidden iframes, and then the LogoutResponse once they loaded.
+	logoutTmpl = template.Must(template.New("saml-logout").Parse(`` +
+		`<!DOCTYPE html>` +
+		`<html>` +
+		`<head><meta charset="UTF-8"><title>Signing out</title></head>` +
+		`<body onload="{{if .RedirectURL}}window.location.replace({{.RedirectURL}}){{else if .Form}}document.forms[0].submit(){{end}}">` +
+		`<p>{{if or .RedirectURL .Form}}Signing out...{{else}}You are signed out.{{end}}</p>` +
+		`{{range .Frames}}` +
+		`{{if .URL}}<iframe src="{{.URL}}" style="display: none;"></iframe>` +
+		`{{else}}<iframe srcdoc="{{.Document}}" style="display: none;"></iframe>{{end}}` +
+		`{{end}}` +
+		`{{with .Form}}` +
+		`<form method="post" action="{{.URL}}">` +
+		`<input type="hidden" name="{{.Param}}" value="{{.Value}}" />` +
+		`{{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}" />{{end}}` +
+		`</form>` +
+		`{{end}}` +
+		`</body>` +
+		`</html>`))
+
+	// logoutFormTmpl is the document of the iframes sending a LogoutRequest with the
+	// HTTP-POST binding.
+	logoutFormTmpl = template.Must(template.New("saml-logout-form").Parse(`` +
+		`<html>` +
+		`<body onload="document.forms[0].submit()">` +
+		`<form method="post" action="{{.URL}}">` +
+		`<input type="hidden" name="{{.Param}}" value="{{.Value}}" />` +
+		`</form>` +
+		`</body>` +
+		`</html>`))
+)
+
+// logoutMessage is a LogoutRequest or a LogoutResponse received by the `/slo`
+// endpoint.
+type logoutMessage struct {
+	Binding    string
+	Param      string // SAMLRequest or SAMLResponse
+	XML        []byte
+	RelayState string
+}
+
+// logoutForm is a message sent with the HTTP-POST binding.
+type logoutForm struct {
+	URL        string
+	Param      string
+	Value      string
+	RelayState string
+}
+
+// logoutFrame sends a LogoutRequest to a service provider, either by loading its
+// URL with the HTTP-Redirect binding or by submitting the form of its document
+// with the HTTP-POST binding.
+type logoutFrame struct {
+	URL      string
+	Document string
+}
+
+// HandleSLO handles the `/slo` endpoint of single logout, with the HTTP-Redirect and
+// HTTP-POST bindings.
+//
+// A LogoutRequest of a service provider ends the session of its user, in both
+// protocols. The other service providers the user logged in to with the session
+// are sent a LogoutRequest from hidden iframes, and the service provider then gets
+// a signed LogoutResponse. The LogoutResponses of the other service providers are
+// only logged.
+func (s *Server) HandleSLO(w http.ResponseWriter, r *http.Request) {
+	msg, err := parseLogoutMessage(r)
+	if err != nil {
+		s.logger.Printf("ERROR: invalid logout message: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if msg.Param == "SAMLResponse" {
+		s.handleLogoutResponse(w, msg)
+		return
+	}
+
+	req := &saml.LogoutRequest{}
+	if err := xml.Unmarshal(msg.XML, req); err != nil {
+		s.logger.Printf("ERROR: invalid logout request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	sp, err := s.validateLogoutRequest(r, msg, req)
+	if err != nil {
+		s.logger.Printf("ERROR: invalid logout request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	status := saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}}
+	var frames []logoutFrame
+	session, err := s.logoutSession(r, req, sp)
+	switch {
+	case errors.Is(err, errUnknownPrincipal):
+		status.StatusCode.StatusCode = &saml.StatusCode{Value: saml.StatusUnknownPrincipal}
+		status.StatusCode.Value = saml.StatusRequester
+	case err != nil:
+		s.logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case session != nil:
+		ended, _, err := s.Sessions.EndSession(session.ID)
+		if err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, storage.ExpiredSessionCookie(r.TLS != nil))
+		frames = s.logoutFrames(r, ended, sp.EntityID)
+	}
+
+	data := struct {
+		RedirectURL string
+		Form        *logoutForm
+		Frames      []logoutFrame
+	}{Frames: frames}
+	if endpoint := sloEndpoint(sp, msg.Binding); endpoint != nil {
+		location := endpoint.Location
+		if endpoint.ResponseLocation != "" {
+			location = endpoint.ResponseLocation
+		}
+		resp := &saml.LogoutResponse{
+			ID:           newID(),
+			InResponseTo: req.ID,
+			Version:      "2.0",
+			IssueInstant: saml.TimeNow(),
+			Destination:  location,
+			Issuer: &saml.Issuer{
+				Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+				Value:  s.IDP.Metadata().EntityID,
+			},
+			Status: status,
+		}
+		if endpoint.Binding == saml.HTTPRedirectBinding {
+			data.RedirectURL, err = s.redirectURL(location, "SAMLResponse", resp.Element(), msg.RelayState)
+		} else {
+			data.Form, err = s.postForm(location, "SAMLResponse", resp, msg.RelayState)
+		}
+		if err != nil {
+			s.logger.Printf("ERROR: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if data.RedirectURL != "" && len(frames) == 0 {
+		http.Redirect(w, r, data.RedirectURL, http.StatusFound)
+		return
+	}
+	if err := logoutTmpl.Execute(w, data); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+	}
+}
+
+// handleLogoutResponse logs the LogoutResponse of a service provider sent a
+// LogoutRequest by the logout page.
+func (s *Server) handleLogoutResponse(w http.ResponseWriter, msg *logoutMessage) {
+	resp := &saml.LogoutResponse{}
+	if err := xml.Unmarshal(msg.XML, resp); err != nil {
+		s.logger.Printf("ERROR: invalid logout response: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	issuer := ""
+	if resp.Issuer != nil {
+		issuer = resp.Issuer.Value
+	}
+	s.logger.Printf("service provider %s answered logout request %s with status %s", issuer, resp.InResponseTo, resp.Status.StatusCode.Value)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateLogoutRequest returns the service provider of the LogoutRequest, once its
+// destination, its validity and its signature are checked.
+func (s *Server) validateLogoutRequest(r *http.Request, msg *logoutMessage, req *saml.LogoutRequest) (*saml.EntityDescriptor, error) {
+	if req.Issuer == nil || req.Issuer.Value == "" {
+		return nil, errors.New("missing issuer")
+	}
+	service := storage.ServiceProvider{}
+	if err := s.Store.Get(fmt.Sprintf("/services-by-entity-id/%s", req.Issuer.Value), &service); err != nil {
+		return nil, fmt.Errorf("unknown service provider %s: %w", req.Issuer.Value, err)
+	}
+	sp := service.Metadata
+	if req.Destination != "" && req.Destination != s.IDP.LogoutURL.String() {
+		return nil, fmt.Errorf("expected destination to be %q, not %q", s.IDP.LogoutURL.String(), req.Destination)
+	}
+	now := saml.TimeNow()
+	if req.IssueInstant.Add(saml.MaxIssueDelay).Before(now) {
+		return nil, fmt.Errorf("request expired at %s", req.IssueInstant.Add(saml.MaxIssueDelay))
+	}
+	if req.NotOnOrAfter != nil && req.NotOnOrAfter.Add(saml.MaxClockSkew).Before(now) {
+		return nil, fmt.Errorf("request expired at %s", req.NotOnOrAfter)
+	}
+	if err := verifyLogoutMessage(r, msg, sp, service.AllowUnsignedLogoutRequests); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return sp, nil
+}
+
+// logoutSession returns the session ended by the LogoutRequest of the service
+// provider, the session of its SessionIndex or else the session of the browser,
+// which does not send its cookie with the HTTP-POST binding. It is nil when the
+// user is already logged out. Only the service providers the user logged in to
+// with the session can end it.
+func (s *Server) logoutSession(r *http.Request, req *saml.LogoutRequest, sp *saml.EntityDescriptor) (*storage.Session, error) {
+	var session *storage.Session
+	if req.SessionIndex != nil && req.SessionIndex.Value != "" {
+		sessions, err := s.Sessions.Sessions()
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range sessions {
+			if candidate.Index == req.SessionIndex.Value {
+				session = candidate
+				break
+			}
+		}
+	} else if cookieSession, err := s.Sessions.SessionFromRequest(r); err == nil {
+		session = cookieSession
+	}
+	if session == nil {
+		return nil, nil
+	}
+
+	user := storage.User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", session.UserID), &user); err != nil {
+		return nil, err
+	}
+	if req.NameID == nil || req.NameID.Value != user.Email {
+		return nil, errUnknownPrincipal
+	}
+	if !loggedInTo(session, sp.EntityID) {
+		return nil, errUnknownPrincipal
+	}
+	return session, nil
+}
+
+// loggedInTo reports whether the user logged in to the service provider with the session.
+func loggedInTo(session *storage.Session, entityID string) bool {
+	for _, id := range session.ServiceProviders {
+		if id == entityID {
+			return true
+		}
+	}
+	return false
+}
+
+// logoutFrames returns the frames sending a LogoutRequest to the service providers
+// the user logged in to with the ended session, except to the one that initiated
+// the logout. Service providers without a single logout service are skipped.
+func (s *Server) logoutFrames(r *http.Request, session *storage.Session, initiator string) []logoutFrame {
+	user := storage.User{}
+	if err := s.Store.Get(fmt.Sprintf("/users/%s", session.UserID), &user); err != nil {
+		s.logger.Printf("ERROR: %s", err)
+		return nil
+	}
+	var frames []logoutFrame
+	for _, entityID := range session.ServiceProviders {
+		if entityID == initiator {
+			continue
+		}
+		sp, err := s.GetServiceProvider(r, entityID)
+		if err != nil {
+			continue
+		}
+		endpoint := sloEndpoint(sp, saml.HTTPRedirectBinding)
+		if endpoint == nil {
+			continue
+		}
+		// the NameID is the one of the assertions of the session
+		req := &saml.LogoutRequest{
+			ID:           newID(),
+			Version:      "2.0",
+			IssueInstant: saml.TimeNow(),
+			Destination:  endpoint.Location,
+			Issuer: &saml.Issuer{
+				Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+				Value:  s.IDP.Metadata().EntityID,
+			},
+			NameID: &saml.NameID{
+				Format:          "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
+				NameQualifier:   s.IDP.Metadata().EntityID,
+				SPNameQualifier: sp.EntityID,
+				Value:           user.Email,
+			},
+			SessionIndex: &saml.SessionIndex{Value: session.Index},
+		}
+		var frame logoutFrame
+		if endpoint.Binding == saml.HTTPRedirectBinding {
+			frame.URL, err = s.redirectURL(endpoint.Location, "SAMLRequest", req.Element(), "")
+		} else {
+			frame.Document, err = s.postDocument(endpoint.Location, req)
+		}
+		if err != nil {
+			s.logger.Printf("ERROR: logout request of service provider %s: %s", entityID, err)
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// postDocument returns the document of a frame sending the LogoutRequest with the
+// HTTP-POST binding.
+func (s *Server) postDocument(location string, req *saml.LogoutRequest) (string, error) {
+	signature, err := s.signEnveloped(req.Element())
+	if err != nil {
+		return "", err
+	}
+	req.Signature = signature
+	form, err := encodeForm(location, "SAMLRequest", req.Element(), "")
+	if err != nil {
+		return "", err
+	}
+	var document strings.Builder
+	if err := logoutFormTmpl.Execute(&document, form); err != nil {
+		return "", err
+	}
+	return document.String(), nil
+}
+
+// postForm returns the form sending the LogoutResponse with the HTTP-POST binding.
+func (s *Server) postForm(location, param string, resp *saml.LogoutResponse, relayState string) (*logoutForm, error) {
+	signature, err := s.signEnveloped(resp.Element())
+	if err != nil {
+		return nil, err
+	}
+	resp.Signature = signature
+	return encodeForm(location, param, resp.Element(), relayState)
+}
+
+func encodeForm(location, param string, el *etree.Element, relayState string) (*logoutForm, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	return &logoutForm{
+		URL:        location,
+		Param:      param,
+		Value:      base64.StdEncoding.EncodeToString(buf),
+		RelayState: relayState,
+	}, nil
+}
+
+// signEnveloped returns the enveloped signature of the element by the IDP, which
+// the LogoutRequest and LogoutResponse place after their issuer.
+func (s *Server) signEnveloped(el *etree.Element) (*etree.Element, error) {
+	keyPair := tls.Certificate{
+		Certificate: [][]byte{s.IDP.Certificate.Raw},
+		PrivateKey:  s.IDP.Key,
+		Leaf:        s.IDP.Certificate,
+	}
+	signingContext := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(keyPair))
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := signingContext.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		return nil, err
+	}
+	signed, err := signingContext.SignEnveloped(el)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Child[len(signed.Child)-1].(*etree.Element), nil
+}
+
+// redirectURL returns the URL sending the message with the HTTP-Redirect binding,
+// signed by the IDP in its query (SAML Bindings 3.4.4.1).
+func (s *Server) redirectURL(location, param string, el *etree.Element, relayState string) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	deflated := &bytes.Buffer{}
+	fw, err := flate.NewWriter(deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := doc.WriteTo(fw); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+
+	query := param + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(dsig.RSASHA256SignatureMethod)
+	signer, ok := s.IDP.Key.(crypto.Signer)
+	if !ok {
+		return "", errors.New("the IDP key cannot sign")
+	}
+	digest := sha256.Sum256([]byte(query))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += query
+	return u.String(), nil
+}
+
+// parseLogoutMessage returns the LogoutRequest or LogoutResponse of the request,
+// deflated in the query with the HTTP-Redirect binding and in the form with the
+// HTTP-POST binding.
+func parseLogoutMessage(r *http.Request) (*logoutMessage, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	msg := &logoutMessage{Binding: saml.HTTPPostBinding, Param: "SAMLRequest"}
+	values := r.PostForm
+	if r.Method == http.MethodGet {
+		msg.Binding = saml.HTTPRedirectBinding
+		values = r.URL.Query()
+	}
+	if values.Get(msg.Param) == "" {
+		msg.Param = "SAMLResponse"
+	}
+	encoded := values.Get(msg.Param)
+	if encoded == "" {
+		return nil, errors.New("missing SAMLRequest or SAMLResponse")
+	}
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode base64: %w", err)
+	}
+	if msg.Binding == saml.HTTPRedirectBinding {
+		if buf, err = io.ReadAll(flate.NewReader(bytes.NewReader(buf))); err != nil {
+			return nil, fmt.Errorf("cannot inflate: %w", err)
+		}
+	}
+	if err := xrv.Validate(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	msg.XML = buf
+	msg.RelayState = values.Get("RelayState")
+	return msg, nil
+}
+
+// verifyLogoutMessage checks the signature of the message, either in the query with
+// the HTTP-Redirect binding or enveloped in the message, with the signing
+// certificates of the service provider. Messages must be signed, unless the service
+// provider allows unsigned ones, whose signature is then only checked when its
+// metadata has signing certificates.
+func verifyLogoutMessage(r *http.Request, msg *logoutMessage, sp *saml.EntityDescriptor, allowUnsigned bool) error {
+	certs, err := spSigningCerts(sp)
+	if err != nil {
+		return err
+	}
+	querySigned := msg.Binding == saml.HTTPRedirectBinding && r.URL.Query().Get("Signature") != ""
+	doc := etree.NewDocument()
+	if !querySigned {
+		if err := doc.ReadFromBytes(msg.XML); err != nil {
+			return err
+		}
+		if doc.Root() == nil || doc.Root().SelectElement("Signature") == nil {
+			if allowUnsigned {
+				return nil
+			}
+			return errors.New("the message is not signed")
+		}
+	}
+	if len(certs) == 0 {
+		if allowUnsigned {
+			return nil
+		}
+		return errors.New("the metadata of the service provider has no signing certificate")
+	}
+	if querySigned {
+		return verifyQuerySignature(r.URL.RawQuery, msg.Param, certs)
+	}
+
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	_, err = validationContext.Validate(doc.Root())
+	return err
+}
+
+// verifyQuerySignature checks the signature of the query of the HTTP-Redirect
+// binding, computed over its parameters as they were encoded by the service
+// provider (SAML Bindings 3.4.4.1).
+func verifyQuerySignature(rawQuery, param string, certs []*x509.Certificate) error {
+	values := map[string]string{}
+	for _, part := range strings.Split(rawQuery, "&") {
+		name, value, _ := strings.Cut(part, "=")
+		values[name] = value
+	}
+	signed := param + "=" + values[param]
+	if relayState, ok := values["RelayState"]; ok {
+		signed += "&RelayState=" + relayState
+	}
+	signed += "&SigAlg=" + values["SigAlg"]
+
+	sigAlg, err := url.QueryUnescape(values["SigAlg"])
+	if err != nil {
+		return err
+	}
+	algorithm, ok := querySignatureAlgorithms[sigAlg]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %q", sigAlg)
+	}
+	encoded, err := url.QueryUnescape(values["Signature"])
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		if cert.CheckSignature(algorithm, []byte(signed), signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("the signature does not match the certificates of the service provider")
+}
+
+// spSigningCerts returns the signing certificates of the service provider metadata.
+func spSigningCerts(sp *saml.EntityDescriptor) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, spSSODescriptor := range sp.SPSSODescriptors {
+		for _, keyDescriptor := range spSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+				continue
+			}
+			for _, x509Certificate := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+				der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(x509Certificate.Data), ""))
+				if err != nil {
+					return nil, err
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, err
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs, nil
+}
+
+// sloEndpoint returns the single logout service of the service provider with the
+// binding, or else with the other binding. It is nil when the service provider has
+// none.
+func sloEndpoint(sp *saml.EntityDescriptor, binding string) *saml.Endpoint {
+	var other *saml.Endpoint
+	for _, spSSODescriptor := range sp.SPSSODescriptors {
+		for i, endpoint := range spSSODescriptor.SingleLogoutServices {
+			switch {
+			case endpoint.Binding == binding:
+				return &spSSODescriptor.SingleLogoutServices[i]
+			case other == nil && (endpoint.Binding == saml.HTTPRedirectBinding || endpoint.Binding == saml.HTTPPostBinding):
+				other = &spSSODescriptor.SingleLogoutServices[i]
+			}
+		}
+	}
+	return other
+}
+
+// newID returns the ID of a message of the IDP.
+func newID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("id-%x", id)
+}
@@ -0,0 +1,362 @@
+package samlidp_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+
+	"github.com/crewjam/saml"
+)
+
+const spEntityID = "https://sp.example.com"
+
+// spKeyPair returns a private key of the service provider and its self-signed certificate.
+func spKeyPair(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return key, cert
+}
+
+// sloMetadata returns the metadata of the service provider, with its signing
+// certificate and single logout services.
+func sloMetadata(cert *x509.Certificate) string {
+	return fmt.Sprintf(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%[1]s">
+	<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+		<KeyDescriptor use="signing">
+			<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">
+				<X509Data><X509Certificate>%[2]s</X509Certificate></X509Data>
+			</KeyInfo>
+		</KeyDescriptor>
+		<SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="%[1]s/slo"/>
+		<SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="%[1]s/slo"/>
+		<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="%[1]s/acs" index="1"/>
+	</SPSSODescriptor>
+</EntityDescriptor>`, spEntityID, base64.StdEncoding.EncodeToString(cert.Raw))
+}
+
+func TestHandleSLO(t *testing.T) {
+	spKey, spCert := spKeyPair(t)
+	otherKey, _ := spKeyPair(t)
+
+	tests := []struct {
+		name          string
+		binding       string
+		key           *rsa.PrivateKey // signs the LogoutRequest when set
+		allowUnsigned bool
+		nameID        string
+		notLoggedIn   bool // the user did not log in to the service provider with the session
+		wantCode      int
+		wantStatus    string // the StatusCode of the LogoutResponse, with its second-level one
+		wantEnded     bool
+	}{
+		{
+			name:       "redirect binding",
+			binding:    saml.HTTPRedirectBinding,
+			key:        spKey,
+			nameID:     "alice@example.com",
+			wantCode:   http.StatusFound,
+			wantStatus: saml.StatusSuccess,
+			wantEnded:  true,
+		},
+		{
+			name:       "post binding",
+			binding:    saml.HTTPPostBinding,
+			key:        spKey,
+			nameID:     "alice@example.com",
+			wantCode:   http.StatusOK,
+			wantStatus: saml.StatusSuccess,
+			wantEnded:  true,
+		},
+		{
+			name:       "NameID of another user",
+			binding:    saml.HTTPRedirectBinding,
+			key:        spKey,
+			nameID:     "bob@example.com",
+			wantCode:   http.StatusFound,
+			wantStatus: saml.StatusRequester + " " + saml.StatusUnknownPrincipal,
+		},
+		{
+			name:        "service provider not in the session",
+			binding:     saml.HTTPPostBinding,
+			key:         spKey,
+			nameID:      "alice@example.com",
+			notLoggedIn: true,
+			wantCode:    http.StatusOK,
+			wantStatus:  saml.StatusRequester + " " + saml.StatusUnknownPrincipal,
+		},
+		{
+			name:     "unsigned redirect binding",
+			binding:  saml.HTTPRedirectBinding,
+			nameID:   "alice@example.com",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unsigned post binding",
+			binding:  saml.HTTPPostBinding,
+			nameID:   "alice@example.com",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "signed by another key",
+			binding:  saml.HTTPRedirectBinding,
+			key:      otherKey,
+			nameID:   "alice@example.com",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:          "unsigned with unsigned logout requests allowed",
+			binding:       saml.HTTPPostBinding,
+			allowUnsigned: true,
+			nameID:        "alice@example.com",
+			wantCode:      http.StatusOK,
+			wantStatus:    saml.StatusSuccess,
+			wantEnded:     true,
+		},
+		{
+			name:          "signed by another key with unsigned logout requests allowed",
+			binding:       saml.HTTPPostBinding,
+			key:           otherKey,
+			allowUnsigned: true,
+			nameID:        "alice@example.com",
+			wantCode:      http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, stor := newIDP(t)
+			meta, err := storage.NewMetadata([]byte(sloMetadata(spCert)))
+			if err != nil {
+				t.Fatalf("NewMetadata() error = %v", err)
+			}
+			sp := &storage.ServiceProvider{ID: "sp", Metadata: meta, AllowUnsignedLogoutRequests: tt.allowUnsigned}
+			if err := stor.PutServiceProvider(sp.ID, sp); err != nil {
+				t.Fatalf("PutServiceProvider() error = %v", err)
+			}
+			if err := stor.PutUser("alice", &storage.User{ID: "alice", Username: "alice", Password: "secret", Email: "alice@example.com"}); err != nil {
+				t.Fatalf("PutUser() error = %v", err)
+			}
+			session, err := stor.CreateSession("alice", "secret", "")
+			if err != nil {
+				t.Fatalf("CreateSession() error = %v", err)
+			}
+			if !tt.notLoggedIn {
+				if err := stor.AddSessionServiceProvider(session.ID, spEntityID); err != nil {
+					t.Fatalf("AddSessionServiceProvider() error = %v", err)
+				}
+			}
+
+			logoutReq := &saml.LogoutRequest{
+				ID:           "id-logout-request",
+				Version:      "2.0",
+				IssueInstant: saml.TimeNow(),
+				Destination:  idpURL + "/slo",
+				Issuer:       &saml.Issuer{Value: spEntityID},
+				NameID:       &saml.NameID{Value: tt.nameID},
+				SessionIndex: &saml.SessionIndex{Value: session.Index},
+			}
+			var req *http.Request
+			if tt.binding == saml.HTTPRedirectBinding {
+				req = httptest.NewRequest(http.MethodGet, "/slo?"+redirectQuery(t, logoutReq.Element(), tt.key), nil)
+			} else {
+				el := logoutReq.Element()
+				if tt.key != nil {
+					el = signEnveloped(t, el, tt.key, spCert)
+				}
+				form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(xmlBytes(t, el))}}
+				req = httptest.NewRequest(http.MethodPost, "/slo", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("%s /slo = %d %s, want %d", req.Method, rec.Code, rec.Body, tt.wantCode)
+			}
+
+			_, err = stor.SessionByID(session.ID)
+			if ended := err != nil; ended != tt.wantEnded {
+				t.Errorf("session ended = %v, want %v", ended, tt.wantEnded)
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+
+			resp := logoutResponse(t, rec, tt.binding, idpCertificate(t, stor))
+			if resp.InResponseTo != logoutReq.ID {
+				t.Errorf("InResponseTo = %q, want %q", resp.InResponseTo, logoutReq.ID)
+			}
+			status := resp.Status.StatusCode.Value
+			if resp.Status.StatusCode.StatusCode != nil {
+				status += " " + resp.Status.StatusCode.StatusCode.Value
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// redirectQuery returns the query sending the LogoutRequest with the HTTP-Redirect
+// binding, signed with the key when set.
+func redirectQuery(t *testing.T, el *etree.Element, key *rsa.PrivateKey) string {
+	t.Helper()
+	deflated := &bytes.Buffer{}
+	fw, err := flate.NewWriter(deflated, flate.BestCompression)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	if _, err := fw.Write(xmlBytes(t, el)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if key == nil {
+		return query
+	}
+	query += "&SigAlg=" + url.QueryEscape(dsig.RSASHA256SignatureMethod)
+	digest := sha256.Sum256([]byte(query))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+}
+
+// signEnveloped returns the element with its enveloped signature, for the HTTP-POST binding.
+func signEnveloped(t *testing.T, el *etree.Element, key *rsa.PrivateKey, cert *x509.Certificate) *etree.Element {
+	t.Helper()
+	keyPair := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	signingContext := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(keyPair))
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := signingContext.SignEnveloped(el)
+	if err != nil {
+		t.Fatalf("SignEnveloped() error = %v", err)
+	}
+	return signed
+}
+
+func xmlBytes(t *testing.T, el *etree.Element) []byte {
+	t.Helper()
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("WriteToBytes() error = %v", err)
+	}
+	return buf
+}
+
+// idpCertificate returns the certificate the IDP signs with.
+func idpCertificate(t *testing.T, stor *storage.Storage) *x509.Certificate {
+	t.Helper()
+	current, _, err := stor.SAMLKeyPairs()
+	if err != nil {
+		t.Fatalf("SAMLKeyPairs() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(current.Certificate)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return cert
+}
+
+var samlResponseInput = regexp.MustCompile(`name="SAMLResponse" value="([^"]*)"`)
+
+// logoutResponse returns the LogoutResponse sent to the service provider, once its
+// signature by the IDP is checked: in the query of the redirect with the
+// HTTP-Redirect binding, enveloped in the form with the HTTP-POST binding.
+func logoutResponse(t *testing.T, rec *httptest.ResponseRecorder, binding string, idpCert *x509.Certificate) *saml.LogoutResponse {
+	t.Helper()
+	var buf []byte
+	if binding == saml.HTTPRedirectBinding {
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Location error = %v", err)
+		}
+		values := map[string]string{}
+		for _, part := range strings.Split(location.RawQuery, "&") {
+			name, value, _ := strings.Cut(part, "=")
+			values[name] = value
+		}
+		signed := "SAMLResponse=" + values["SAMLResponse"] + "&SigAlg=" + values["SigAlg"]
+		signature, err := base64.StdEncoding.DecodeString(location.Query().Get("Signature"))
+		if err != nil {
+			t.Fatalf("Signature error = %v", err)
+		}
+		if err := idpCert.CheckSignature(x509.SHA256WithRSA, []byte(signed), signature); err != nil {
+			t.Fatalf("CheckSignature() error = %v", err)
+		}
+		deflated, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLResponse"))
+		if err != nil {
+			t.Fatalf("SAMLResponse error = %v", err)
+		}
+		if buf, err = io.ReadAll(flate.NewReader(bytes.NewReader(deflated))); err != nil {
+			t.Fatalf("inflate error = %v", err)
+		}
+	} else {
+		match := samlResponseInput.FindStringSubmatch(rec.Body.String())
+		if match == nil {
+			t.Fatalf("no SAMLResponse in %s", rec.Body)
+		}
+		var err error
+		if buf, err = base64.StdEncoding.DecodeString(html.UnescapeString(match[1])); err != nil {
+			t.Fatalf("SAMLResponse error = %v", err)
+		}
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(buf); err != nil {
+			t.Fatalf("ReadFromBytes() error = %v", err)
+		}
+		validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{idpCert}})
+		if _, err := validationContext.Validate(doc.Root()); err != nil {
+			t.Fatalf("Validate() error = %v", err)
+		}
+	}
+
+	resp := &saml.LogoutResponse{}
+	if err := xml.Unmarshal(buf, resp); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	return resp
+}
@@ -11,14 +11,6 @@ import (
 	"github.com/crewjam/saml"
 )
 
-func randomBytes(n int) []byte {
-	rv := make([]byte, n)
-	if _, err := saml.RandReader.Read(rv); err != nil {
-		panic(err)
-	}
-	return rv
-}
-
 func GetSPMetadata(r io.Reader) (spMetadata *saml.EntityDescriptor, err error) {
 	var data []byte
 	if data, err = io.ReadAll(r); err != nil {
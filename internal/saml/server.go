@@ -2,10 +2,9 @@ package saml
 
 import (
 	"crypto"
-	"crypto/rsa"
 	"crypto/x509"
-	_ "embed"
-	"encoding/pem"
+	"errors"
+	"log"
 	"net/http"
 	"net/url"
 
@@ -14,12 +13,6 @@ import (
 	"github.com/seriousben/dev-identity-provider/internal/storage"
 )
 
-//go:embed idp_key.pem
-var idpKey []byte
-
-//go:embed idp_cert.pem
-var idpCert []byte
-
 func mustParseURL(s string) url.URL {
 	rv, err := url.Parse(s)
 	if err != nil {
@@ -28,28 +21,26 @@ func mustParseURL(s string) url.URL {
 	return *rv
 }
 
-func mustParsePrivateKey(pemStr []byte) crypto.PrivateKey {
-	b, _ := pem.Decode(pemStr)
-	if b == nil {
-		panic("cannot parse PEM")
+// parseKeyPairs returns the key and certificate of the current key pair, and the next certificate if any.
+func parseKeyPairs(current, next *storage.SAMLKeyPair) (crypto.PrivateKey, *x509.Certificate, *x509.Certificate, error) {
+	if current == nil {
+		return nil, nil, nil, errors.New("no SAML key pair")
 	}
-	k, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+	key, err := current.PrivateKey()
 	if err != nil {
-		panic(err)
-	}
-	return k
-}
-
-func mustParseCertificate(pemStr []byte) *x509.Certificate {
-	b, _ := pem.Decode(pemStr)
-	if b == nil {
-		panic("cannot parse PEM")
+		return nil, nil, nil, err
 	}
-	cert, err := x509.ParseCertificate(b.Bytes)
+	cert, err := current.X509Certificate()
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
+	}
+	var nextCert *x509.Certificate
+	if next != nil {
+		if nextCert, err = next.X509Certificate(); err != nil {
+			return nil, nil, nil, err
+		}
 	}
-	return cert
+	return key, cert, nextCert, nil
 }
 
 type Storage interface {
@@ -63,27 +54,51 @@ type Storage interface {
 	GetServiceProviderByEntityID(string) (*storage.ServiceProvider, error)
 	DeleteServiceProvider(string) error
 	PutServiceProvider(string, *storage.ServiceProvider) error
+
+	Backend() storage.Backend
+
+	SAMLKeyPairs() (current, next *storage.SAMLKeyPair, err error)
+	OnSAMLKeyPairChange(storage.SAMLKeyPairListener)
+
+	samlidp.Sessions
 }
 
 func New(remoteAddr string, stor Storage) http.Handler {
-	key := mustParsePrivateKey(idpKey).(*rsa.PrivateKey)
-	certificate := mustParseCertificate(idpCert)
+	current, next, err := stor.SAMLKeyPairs()
+	if err != nil {
+		panic(err)
+	}
+	key, certificate, nextCertificate, err := parseKeyPairs(current, next)
+	if err != nil {
+		panic(err)
+	}
 
-	store := MemoryStore{
+	store := BackendStore{
 		storage: stor,
 	}
 
 	server, err := samlidp.New(samlidp.Options{
-		Certificate: certificate,
-		Key:         key,
-		Logger:      logger.DefaultLogger,
-		Store:       &store,
-		URL:         mustParseURL(remoteAddr),
+		Certificate:     certificate,
+		NextCertificate: nextCertificate,
+		Key:             key,
+		Logger:          logger.DefaultLogger,
+		Store:           &store,
+		Sessions:        stor,
+		URL:             mustParseURL(remoteAddr),
 	})
 	if err != nil {
 		panic(err)
 	}
 
+	stor.OnSAMLKeyPairChange(func(current, next *storage.SAMLKeyPair) {
+		key, certificate, nextCertificate, err := parseKeyPairs(current, next)
+		if err != nil {
+			log.Println("error loading SAML key pair, keeping the previous one:", err)
+			return
+		}
+		server.SetKeyPair(key, certificate, nextCertificate)
+	})
+
 	server.InitializeHTTP()
 
 	return server
@@ -2,6 +2,7 @@ package saml
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"strings"
 	"sync"
@@ -10,29 +11,31 @@ import (
 	"github.com/seriousben/dev-identity-provider/internal/storage"
 )
 
-// MemoryStore is an implementation of Store that resides completely
-// in memory.
-type MemoryStore struct {
+// backendPrefix namespaces the shortcuts of the IDP in the storage backend.
+const backendPrefix = "/saml/idp"
+
+// BackendStore is an implementation of Store keeping users and service
+// providers in the storage, and everything else in its backend.
+type BackendStore struct {
 	storage Storage
 	mu      sync.RWMutex
-	data    map[string]string
 }
 
 // Get fetches the data stored in `key` and unmarshals it into `value`.
-func (s *MemoryStore) Get(key string, value interface{}) error {
+func (s *BackendStore) Get(key string, value interface{}) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var (
-		v  string
-		ok bool
-	)
+	var v string
 
 	if ks := strings.Split(key, "/users/"); len(ks) == 2 {
 		u, err := s.storage.GetUserByID(ks[1])
 		if err == os.ErrNotExist {
 			return samlidp.ErrNotFound
 		}
+		if err != nil {
+			return err
+		}
 		b, err := json.Marshal(u)
 		if err != nil {
 			return err
@@ -43,6 +46,9 @@ func (s *MemoryStore) Get(key string, value interface{}) error {
 		if err == os.ErrNotExist {
 			return samlidp.ErrNotFound
 		}
+		if err != nil {
+			return err
+		}
 		b, err := json.Marshal(u)
 		if err != nil {
 			return err
@@ -53,27 +59,32 @@ func (s *MemoryStore) Get(key string, value interface{}) error {
 		if err == os.ErrNotExist {
 			return samlidp.ErrNotFound
 		}
+		if err != nil {
+			return err
+		}
 		b, err := json.Marshal(u)
 		if err != nil {
 			return err
 		}
 		v = string(b)
 	} else {
-		v, ok = s.data[key]
-		if !ok {
+		var raw json.RawMessage
+		err := s.storage.Backend().Get(backendPrefix+key, &raw)
+		if errors.Is(err, storage.ErrNotFound) {
 			return samlidp.ErrNotFound
 		}
+		if err != nil {
+			return err
+		}
+		v = string(raw)
 	}
 	return json.Unmarshal([]byte(v), value)
 }
 
 // Put marshals `value` and stores it in `key`.
-func (s *MemoryStore) Put(key string, value interface{}) error {
+func (s *BackendStore) Put(key string, value interface{}) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.data == nil {
-		s.data = map[string]string{}
-	}
 
 	if ks := strings.Split(key, "/users/"); len(ks) == 2 {
 		su := value.(*storage.User)
@@ -97,17 +108,11 @@ func (s *MemoryStore) Put(key string, value interface{}) error {
 		}
 		return nil
 	}
-	buf, err := json.Marshal(value)
-	if err != nil {
-		return err
-	}
-
-	s.data[key] = string(buf)
-	return nil
+	return s.storage.Backend().Put(backendPrefix+key, value)
 }
 
 // Delete removes `key`
-func (s *MemoryStore) Delete(key string) error {
+func (s *BackendStore) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if ks := strings.Split(key, "/users/"); len(ks) == 2 {
@@ -115,14 +120,13 @@ func (s *MemoryStore) Delete(key string) error {
 	} else if ks := strings.Split(key, "/services/"); len(ks) == 2 {
 		return s.storage.DeleteServiceProvider(ks[1])
 	}
-	delete(s.data, key)
-	return nil
+	return s.storage.Backend().Delete(backendPrefix + key)
 }
 
 // List returns all the keys that start with `prefix`. The prefix is
 // stripped from each returned value. So if keys are ["aa", "ab", "cd"]
 // then List("a") would produce []string{"a", "b"}
-func (s *MemoryStore) List(prefix string) ([]string, error) {
+func (s *BackendStore) List(prefix string) ([]string, error) {
 	switch prefix {
 	case "/users/":
 		us, err := s.storage.ListUsers()
@@ -145,11 +149,5 @@ func (s *MemoryStore) List(prefix string) ([]string, error) {
 		}
 		return rv, nil
 	}
-	rv := []string{}
-	for k := range s.data {
-		if strings.HasPrefix(k, prefix) {
-			rv = append(rv, strings.TrimPrefix(k, prefix))
-		}
-	}
-	return rv, nil
+	return s.storage.Backend().List(backendPrefix + prefix)
 }
@@ -0,0 +1,425 @@
+package scim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2) evaluated
+// against the generic JSON form of a resource.
+type filter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type logicalExpr struct {
+	and         bool
+	left, right filter
+}
+
+func (e *logicalExpr) match(resource map[string]interface{}) bool {
+	if e.and {
+		return e.left.match(resource) && e.right.match(resource)
+	}
+	return e.left.match(resource) || e.right.match(resource)
+}
+
+type notExpr struct {
+	f filter
+}
+
+func (e *notExpr) match(resource map[string]interface{}) bool {
+	return !e.f.match(resource)
+}
+
+// valuePathExpr matches when one of the values of a multi-valued attribute matches
+// the inner filter, e.g. emails[type eq "work" and value co "@example.com"].
+type valuePathExpr struct {
+	attr string
+	f    filter
+}
+
+func (e *valuePathExpr) match(resource map[string]interface{}) bool {
+	for _, v := range values(resource, e.attr, "") {
+		if m, ok := v.(map[string]interface{}); ok && e.f.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+type attrExpr struct {
+	attr  string
+	sub   string
+	op    string
+	value interface{}
+}
+
+func (e *attrExpr) match(resource map[string]interface{}) bool {
+	vs := values(resource, e.attr, e.sub)
+	switch e.op {
+	case "pr":
+		for _, v := range vs {
+			if v != nil && v != "" {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		for _, v := range vs {
+			if compare("eq", v, e.value) {
+				return false
+			}
+		}
+		return e.value != nil || len(vs) > 0
+	}
+	if e.value == nil && e.op == "eq" {
+		return len(vs) == 0
+	}
+	for _, v := range vs {
+		if compare(e.op, v, e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the value of the attribute, matching its name case-insensitively as
+// required by SCIM.
+func lookup(m map[string]interface{}, attr string) (string, interface{}, bool) {
+	if v, ok := m[attr]; ok {
+		return attr, v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, attr) {
+			return k, v, true
+		}
+	}
+	return "", nil, false
+}
+
+// values returns all the values of attr (and sub-attribute sub if given), flattening
+// multi-valued attributes.
+func values(resource map[string]interface{}, attr, sub string) []interface{} {
+	_, v, ok := lookup(resource, attr)
+	if !ok || v == nil {
+		return nil
+	}
+	var vs []interface{}
+	if arr, ok := v.([]interface{}); ok {
+		vs = arr
+	} else {
+		vs = []interface{}{v}
+	}
+	if sub == "" {
+		return vs
+	}
+	var rv []interface{}
+	for _, v := range vs {
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, sv, ok := lookup(m, sub); ok && sv != nil {
+				rv = append(rv, sv)
+			}
+		}
+	}
+	return rv
+}
+
+func compare(op string, actual, expected interface{}) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return false
+		}
+		a, e = strings.ToLower(a), strings.ToLower(e)
+		switch op {
+		case "eq":
+			return a == e
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case bool:
+		e, ok := expected.(bool)
+		return ok && op == "eq" && a == e
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	}
+	return false
+}
+
+// splitAttrPath removes the optional schema URN prefix of an attribute path and splits
+// it into the attribute and its sub-attribute.
+func splitAttrPath(path string) (attr, sub string) {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			path = path[i+1:]
+		}
+	}
+	if i := strings.Index(path, "."); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOpenParen
+	tokenCloseParen
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpenParen, text: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenCloseParen, text: ")"})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{kind: tokenOpenBracket, text: "["})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{kind: tokenCloseBracket, text: "]"})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: str})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(s); j++ {
+				r := rune(s[j])
+				if !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(".:$_-+", r)) {
+					break
+				}
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseFilter parses a SCIM filter expression.
+func parseFilter(s string) (filter, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+func (p *filterParser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *filterParser) peekWord(word string) bool {
+	t := p.peek()
+	return t != nil && t.kind == tokenWord && strings.EqualFold(t.text, word)
+}
+
+func (p *filterParser) expect(kind tokenKind, text string) error {
+	t := p.peek()
+	if t == nil || t.kind != kind {
+		return fmt.Errorf("expected %q", text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) parseOr() (filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpr{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filter, error) {
+	if p.peekWord("not") {
+		p.pos++
+		f, err := p.parseParens()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{f: f}, nil
+	}
+	if t := p.peek(); t != nil && t.kind == tokenOpenParen {
+		return p.parseParens()
+	}
+	return p.parseAttrExpr()
+}
+
+func (p *filterParser) parseParens() (filter, error) {
+	if err := p.expect(tokenOpenParen, "("); err != nil {
+		return nil, err
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenCloseParen, ")"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *filterParser) parseAttrExpr() (filter, error) {
+	t := p.peek()
+	if t == nil || t.kind != tokenWord {
+		return nil, fmt.Errorf("expected attribute path")
+	}
+	p.pos++
+	attr, sub := splitAttrPath(t.text)
+
+	if next := p.peek(); next != nil && next.kind == tokenOpenBracket {
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, err
+		}
+		return &valuePathExpr{attr: attr, f: f}, nil
+	}
+
+	opToken := p.peek()
+	if opToken == nil || opToken.kind != tokenWord {
+		return nil, fmt.Errorf("expected operator after %q", t.text)
+	}
+	p.pos++
+	op := strings.ToLower(opToken.text)
+	switch op {
+	case "pr":
+		return &attrExpr{attr: attr, sub: sub, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("unsupported operator %q", opToken.text)
+	}
+
+	valueToken := p.peek()
+	if valueToken == nil {
+		return nil, fmt.Errorf("expected value after %q", opToken.text)
+	}
+	p.pos++
+	var value interface{}
+	switch {
+	case valueToken.kind == tokenString:
+		value = valueToken.text
+	case valueToken.kind != tokenWord:
+		return nil, fmt.Errorf("unexpected %q", valueToken.text)
+	case strings.EqualFold(valueToken.text, "true"):
+		value = true
+	case strings.EqualFold(valueToken.text, "false"):
+		value = false
+	case strings.EqualFold(valueToken.text, "null"):
+		value = nil
+	default:
+		n, err := strconv.ParseFloat(valueToken.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", valueToken.text)
+		}
+		value = n
+	}
+	return &attrExpr{attr: attr, sub: sub, op: op, value: value}, nil
+}
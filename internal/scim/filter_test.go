@@ -0,0 +1,120 @@
+package scim
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const filterResource = `{
+	"userName": "alice",
+	"displayName": "Alice \"Al\" Liddell",
+	"nickName": "",
+	"title": "C:\\Users\\alice",
+	"active": true,
+	"age": 30,
+	"manager": null,
+	"name": {"givenName": "Alice", "familyName": "Liddell"},
+	"emails": [
+		{"type": "work", "value": "alice@example.com", "primary": true},
+		{"type": "home", "value": "alice@home.example.org"}
+	]
+}`
+
+func TestParseFilter(t *testing.T) {
+	resource := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(filterResource), &resource); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{filter: `userName eq "alice"`, want: true},
+		{filter: `userName eq "bob"`, want: false},
+		{filter: `USERNAME EQ "ALICE"`, want: true},
+		{filter: `urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, want: true},
+		{filter: `userName ne "bob"`, want: true},
+		{filter: `userName co "lic"`, want: true},
+		{filter: `userName sw "al"`, want: true},
+		{filter: `userName ew "ce"`, want: true},
+		{filter: `userName gt "a"`, want: true},
+		{filter: `userName lt "a"`, want: false},
+		{filter: `age ge 30`, want: true},
+		{filter: `age gt 30`, want: false},
+		{filter: `age le 29.5`, want: false},
+		{filter: `active eq true`, want: true},
+		{filter: `active eq false`, want: false},
+		{filter: `manager eq null`, want: true},
+		{filter: `name.givenName eq "Alice"`, want: true},
+		{filter: `name.middleName eq null`, want: true},
+
+		// pr is false for missing, null and empty attributes
+		{filter: `userName pr`, want: true},
+		{filter: `nickName pr`, want: false},
+		{filter: `manager pr`, want: false},
+		{filter: `locale pr`, want: false},
+		{filter: `emails.value pr`, want: true},
+		{filter: `not (locale pr)`, want: true},
+
+		// and binds tighter than or
+		{filter: `userName eq "bob" or userName eq "alice" and active eq true`, want: true},
+		{filter: `userName eq "alice" or userName eq "bob" and active eq false`, want: true},
+		{filter: `(userName eq "alice" or userName eq "bob") and active eq false`, want: false},
+		{filter: `userName eq "bob" or userName eq "carol" or age eq 30`, want: true},
+		{filter: `not (userName eq "alice") or active eq true`, want: true},
+		{filter: `not (userName eq "alice" or active eq false)`, want: false},
+
+		// string escapes
+		{filter: `displayName eq "Alice \"Al\" Liddell"`, want: true},
+		{filter: `displayName co "\"Al\""`, want: true},
+		{filter: `title eq "C:\\Users\\alice"`, want: true},
+		{filter: `title eq "C:\u005cUsers\u005calice"`, want: true},
+		{filter: `userName eq "and"`, want: false},
+
+		// multi-valued attributes
+		{filter: `emails.type eq "home"`, want: true},
+		{filter: `emails[type eq "work" and value co "@example.com"]`, want: true},
+		{filter: `emails[type eq "home" and value co "@example.com"]`, want: false},
+		{filter: `emails[type eq "home"] and emails[primary eq true]`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := parseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("parseFilter() error = %v", err)
+			}
+			if got := f.match(resource); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName xx "alice"`,
+		`userName eq alice`,
+		`userName eq "alice`,
+		`userName eq "\q"`,
+		`userName eq "alice" and`,
+		`userName eq "alice" userName eq "bob"`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`not userName eq "alice"`,
+		`emails[type eq "work"`,
+		`emails[type eq "work"]]`,
+		`userName eq (`,
+		`userName @ "alice"`,
+		`"alice" eq userName`,
+	}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			if f, err := parseFilter(tt); err == nil {
+				t.Errorf("parseFilter() = %#v, want an error", f)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package scim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PatchRequest is the body of a SCIM PATCH request (RFC 7644 section 3.5.2).
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation is a single add, replace or remove operation of a PatchRequest.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchPath is a parsed PATCH path: attr[filter].sub, where filter and sub are optional.
+type patchPath struct {
+	attr   string
+	filter filter
+	sub    string
+}
+
+func parsePatchPath(path string) (*patchPath, error) {
+	bracket := strings.Index(path, "[")
+	if bracket < 0 {
+		attr, sub := splitAttrPath(path)
+		if attr == "" {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		return &patchPath{attr: attr, sub: sub}, nil
+	}
+	end := strings.LastIndex(path, "]")
+	if end < bracket {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+	attr, _ := splitAttrPath(path[:bracket])
+	f, err := parseFilter(path[bracket+1 : end])
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	pp := &patchPath{attr: attr, filter: f}
+	if rest := path[end+1:]; rest != "" {
+		if !strings.HasPrefix(rest, ".") {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		pp.sub = rest[1:]
+	}
+	return pp, nil
+}
+
+// applyPatch applies the operations to the generic JSON form of a resource.
+func applyPatch(resource map[string]interface{}, ops []PatchOperation) error {
+	for _, op := range ops {
+		if err := applyOperation(resource, strings.ToLower(op.Op), op.Path, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOperation(resource map[string]interface{}, op, path string, value interface{}) error {
+	switch op {
+	case "add", "replace", "remove":
+	default:
+		return fmt.Errorf("unsupported operation %q", op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return fmt.Errorf("remove operation requires a path")
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s operation without path requires an object value", op)
+		}
+		for k, v := range m {
+			if err := applyOperation(resource, op, k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pp, err := parsePatchPath(path)
+	if err != nil {
+		return err
+	}
+	key, current, _ := lookup(resource, pp.attr)
+	if key == "" {
+		key = pp.attr
+	}
+
+	if pp.filter != nil {
+		return applyFilteredOperation(resource, key, current, op, pp, value)
+	}
+
+	if pp.sub != "" {
+		m, _ := current.(map[string]interface{})
+		if m == nil {
+			if op == "remove" {
+				return nil
+			}
+			m = map[string]interface{}{}
+			resource[key] = m
+		}
+		subKey, _, ok := lookup(m, pp.sub)
+		if !ok {
+			subKey = pp.sub
+		}
+		if op == "remove" {
+			delete(m, subKey)
+		} else {
+			m[subKey] = value
+		}
+		return nil
+	}
+
+	switch op {
+	case "remove":
+		arr, isArr := current.([]interface{})
+		removed, hasValues := value.([]interface{})
+		if !isArr || !hasValues {
+			delete(resource, key)
+			return nil
+		}
+		// removing specific values from a multi-valued attribute, e.g. group members
+		kept := arr[:0]
+		for _, v := range arr {
+			if !containsValue(removed, v) {
+				kept = append(kept, v)
+			}
+		}
+		resource[key] = kept
+	case "add":
+		switch cur := current.(type) {
+		case []interface{}:
+			added, ok := value.([]interface{})
+			if !ok {
+				added = []interface{}{value}
+			}
+			for _, v := range added {
+				if !containsValue(cur, v) {
+					cur = append(cur, v)
+				}
+			}
+			resource[key] = cur
+		case map[string]interface{}:
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				resource[key] = value
+				return nil
+			}
+			for k, v := range m {
+				subKey, _, ok := lookup(cur, k)
+				if !ok {
+					subKey = k
+				}
+				cur[subKey] = v
+			}
+		default:
+			resource[key] = value
+		}
+	case "replace":
+		resource[key] = value
+	}
+	return nil
+}
+
+// applyFilteredOperation applies an operation to the values of a multi-valued attribute
+// selected by a filter, e.g. emails[type eq "work"].value.
+func applyFilteredOperation(resource map[string]interface{}, key string, current interface{}, op string, pp *patchPath, value interface{}) error {
+	arr, _ := current.([]interface{})
+	matched := false
+	result := make([]interface{}, 0, len(arr))
+	for _, v := range arr {
+		m, ok := v.(map[string]interface{})
+		if !ok || !pp.filter.match(m) {
+			result = append(result, v)
+			continue
+		}
+		matched = true
+		switch {
+		case op == "remove" && pp.sub == "":
+			continue
+		case op == "remove":
+			if subKey, _, ok := lookup(m, pp.sub); ok {
+				delete(m, subKey)
+			}
+		case pp.sub != "":
+			subKey, _, ok := lookup(m, pp.sub)
+			if !ok {
+				subKey = pp.sub
+			}
+			m[subKey] = value
+		default:
+			nv, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("value of %q must be an object", pp.attr)
+			}
+			if op == "replace" {
+				m = map[string]interface{}{}
+			}
+			for k, v := range nv {
+				m[k] = v
+			}
+		}
+		result = append(result, m)
+	}
+
+	if !matched && op != "remove" {
+		// Provisioning clients commonly set a value through a filter on an attribute that
+		// does not exist yet, e.g. emails[type eq "work"].value, so the value is created.
+		eq, ok := pp.filter.(*attrExpr)
+		if !ok || eq.op != "eq" || eq.sub != "" {
+			return fmt.Errorf("no value matches path filter of %q", pp.attr)
+		}
+		m := map[string]interface{}{eq.attr: eq.value}
+		if pp.sub != "" {
+			m[pp.sub] = value
+		} else if nv, ok := value.(map[string]interface{}); ok {
+			for k, v := range nv {
+				m[k] = v
+			}
+		}
+		result = append(result, m)
+	}
+	resource[key] = result
+	return nil
+}
+
+// containsValue reports whether values contains v, comparing complex values by their "value" sub-attribute.
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, existing := range values {
+		if valueOf(existing) == valueOf(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func valueOf(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		if _, mv, ok := lookup(m, "value"); ok {
+			return fmt.Sprint(mv)
+		}
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,219 @@
+package scim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const patchResource = `{
+	"userName": "alice",
+	"displayName": "Alice",
+	"name": {"givenName": "Alice"},
+	"emails": [
+		{"type": "work", "value": "alice@example.com", "primary": true},
+		{"type": "home", "value": "alice@home.example.org"}
+	],
+	"members": [{"value": "alice"}, {"value": "bob"}]
+}`
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ops     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "add attribute",
+			ops:  `[{"op": "add", "path": "title", "value": "Engineer"}]`,
+			want: `{"title": "Engineer"}`,
+		},
+		{
+			name: "add without path",
+			ops:  `[{"op": "add", "value": {"title": "Engineer", "displayName": "Alice L."}}]`,
+			want: `{"title": "Engineer", "displayName": "Alice L."}`,
+		},
+		{
+			name: "add sub-attribute",
+			ops:  `[{"op": "add", "path": "name.familyName", "value": "Liddell"}]`,
+			want: `{"name": {"givenName": "Alice", "familyName": "Liddell"}}`,
+		},
+		{
+			name: "add merges complex attribute",
+			ops:  `[{"op": "add", "path": "name", "value": {"familyName": "Liddell"}}]`,
+			want: `{"name": {"givenName": "Alice", "familyName": "Liddell"}}`,
+		},
+		{
+			name: "add appends new values",
+			ops:  `[{"op": "add", "path": "members", "value": [{"value": "bob"}, {"value": "carol"}]}]`,
+			want: `{"members": [{"value": "alice"}, {"value": "bob"}, {"value": "carol"}]}`,
+		},
+		{
+			name: "op and attribute are case insensitive",
+			ops:  `[{"op": "Replace", "path": "DisplayName", "value": "Alice L."}]`,
+			want: `{"displayName": "Alice L."}`,
+		},
+		{
+			name: "replace with schema prefix",
+			ops:  `[{"op": "replace", "path": "urn:ietf:params:scim:schemas:core:2.0:User:userName", "value": "alice2"}]`,
+			want: `{"userName": "alice2"}`,
+		},
+		{
+			name: "replace multi-valued attribute",
+			ops:  `[{"op": "replace", "path": "members", "value": [{"value": "carol"}]}]`,
+			want: `{"members": [{"value": "carol"}]}`,
+		},
+		{
+			name: "replace sub-attribute of value path",
+			ops:  `[{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "alice@example.net"}]`,
+			want: `{"emails": [
+				{"type": "work", "value": "alice@example.net", "primary": true},
+				{"type": "home", "value": "alice@home.example.org"}
+			]}`,
+		},
+		{
+			name: "replace value path",
+			ops:  `[{"op": "replace", "path": "emails[type eq \"work\"]", "value": {"type": "work", "value": "alice@example.net"}}]`,
+			want: `{"emails": [
+				{"type": "work", "value": "alice@example.net"},
+				{"type": "home", "value": "alice@home.example.org"}
+			]}`,
+		},
+		{
+			name: "add value path merges the matching values",
+			ops:  `[{"op": "add", "path": "emails[value ew \"example.com\"]", "value": {"display": "Work"}}]`,
+			want: `{"emails": [
+				{"type": "work", "value": "alice@example.com", "primary": true, "display": "Work"},
+				{"type": "home", "value": "alice@home.example.org"}
+			]}`,
+		},
+		{
+			name: "add value path without match creates the value",
+			ops:  `[{"op": "add", "path": "emails[type eq \"other\"].value", "value": "alice@other.example.org"}]`,
+			want: `{"emails": [
+				{"type": "work", "value": "alice@example.com", "primary": true},
+				{"type": "home", "value": "alice@home.example.org"},
+				{"type": "other", "value": "alice@other.example.org"}
+			]}`,
+		},
+		{
+			name:    "replace value path without match and non eq filter",
+			ops:     `[{"op": "replace", "path": "emails[value co \"other\"].type", "value": "other"}]`,
+			wantErr: true,
+		},
+		{
+			name: "remove attribute",
+			ops:  `[{"op": "remove", "path": "displayName"}]`,
+			want: `{"displayName": null}`,
+		},
+		{
+			name: "remove sub-attribute",
+			ops:  `[{"op": "remove", "path": "name.givenName"}]`,
+			want: `{"name": {}}`,
+		},
+		{
+			name: "remove values",
+			ops:  `[{"op": "remove", "path": "members", "value": [{"value": "alice"}]}]`,
+			want: `{"members": [{"value": "bob"}]}`,
+		},
+		{
+			name: "remove value path",
+			ops:  `[{"op": "remove", "path": "emails[type eq \"home\"]"}]`,
+			want: `{"emails": [{"type": "work", "value": "alice@example.com", "primary": true}]}`,
+		},
+		{
+			name: "remove sub-attribute of value path",
+			ops:  `[{"op": "remove", "path": "emails[primary eq true].primary"}]`,
+			want: `{"emails": [
+				{"type": "work", "value": "alice@example.com"},
+				{"type": "home", "value": "alice@home.example.org"}
+			]}`,
+		},
+		{
+			name: "remove value path without match",
+			ops:  `[{"op": "remove", "path": "members[value eq \"carol\"]"}]`,
+			want: `{}`,
+		},
+		{
+			name: "operations apply in order",
+			ops: `[
+				{"op": "remove", "path": "members"},
+				{"op": "add", "path": "members", "value": [{"value": "carol"}]}
+			]`,
+			want: `{"members": [{"value": "carol"}]}`,
+		},
+		{
+			name:    "remove without path",
+			ops:     `[{"op": "remove"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "add without path and object value",
+			ops:     `[{"op": "add", "value": "Engineer"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported operation",
+			ops:     `[{"op": "move", "path": "title"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid value path filter",
+			ops:     `[{"op": "replace", "path": "emails[type eq].value", "value": "x"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated value path",
+			ops:     `[{"op": "replace", "path": "emails[type eq \"work\"", "value": "x"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid text after value path",
+			ops:     `[{"op": "replace", "path": "emails[type eq \"work\"]value", "value": "x"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resource := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(patchResource), &resource); err != nil {
+				t.Fatal(err)
+			}
+			var ops []PatchOperation
+			if err := json.Unmarshal([]byte(tt.ops), &ops); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyPatch(resource, ops)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyPatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// want lists the attributes differing from patchResource, null for the removed ones
+			want := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(patchResource), &want); err != nil {
+				t.Fatal(err)
+			}
+			changes := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(tt.want), &changes); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range changes {
+				if v == nil {
+					delete(want, k)
+				} else {
+					want[k] = v
+				}
+			}
+			if !reflect.DeepEqual(resource, want) {
+				got, _ := json.Marshal(resource)
+				wantJSON, _ := json.Marshal(want)
+				t.Errorf("applyPatch() = %s, want %s", got, wantJSON)
+			}
+		})
+	}
+}
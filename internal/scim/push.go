@@ -0,0 +1,467 @@
+package scim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+// PushStorage is the storage the Pusher provisions users from.
+type PushStorage interface {
+	ListUsers() ([]*storage.User, error)
+	GetUserByID(string) (*storage.User, error)
+	ListServiceProviders() ([]*storage.ServiceProvider, error)
+	ListClients() ([]*storage.Client, error)
+	Backend() storage.Backend
+}
+
+// keyRemoteUsers prefixes the users provisioned into the targets in the storage backend, followed by
+// the target name and the local user id, so that they are still deprovisioned after a restart.
+const keyRemoteUsers = "/scim/push/"
+
+// TargetStatus is the synchronization status of a SCIM push target.
+type TargetStatus struct {
+	Target   string    `json:"target"`
+	URL      string    `json:"url"`
+	Users    int       `json:"users"`
+	LastSync time.Time `json:"lastSync,omitempty"`
+	LastErr  string    `json:"lastError,omitempty"`
+}
+
+type pushTarget struct {
+	name string
+	*storage.SCIMTarget
+}
+
+// remoteUser is what is known about a user provisioned into a target.
+type remoteUser struct {
+	ID      string `json:"id"`
+	Payload string `json:"payload"`
+}
+
+type pushJob struct {
+	userID string
+	sync   bool
+}
+
+// Pusher provisions users into the SCIM endpoints of the registered service providers
+// and clients, acting as a SCIM client the way Okta or Azure AD do.
+type Pusher struct {
+	storage PushStorage
+	client  *http.Client
+	jobs    chan pushJob
+
+	mu     sync.RWMutex
+	status map[string]*TargetStatus
+	// pendingSync is set when a job did not fit in the queue, it is coalesced into a full sync
+	pendingSync bool
+}
+
+// NewPusher returns a Pusher and starts its worker. Pushes are processed one at a time
+// and in order.
+func NewPusher(stor PushStorage) *Pusher {
+	p := newPusher(stor, 256)
+	go p.run()
+	return p
+}
+
+func newPusher(stor PushStorage, queueSize int) *Pusher {
+	return &Pusher{
+		storage: stor,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jobs:    make(chan pushJob, queueSize),
+		status:  map[string]*TargetStatus{},
+	}
+}
+
+// UserChanged queues the provisioning of the user into every target. It matches the
+// storage.UserListener signature, u is nil when the user was deleted.
+func (p *Pusher) UserChanged(id string, u *storage.User) {
+	p.enqueue(pushJob{userID: id})
+}
+
+// Sync queues a full synchronization of all users into every target, deprovisioning
+// users which do not exist anymore.
+func (p *Pusher) Sync() {
+	p.enqueue(pushJob{sync: true})
+}
+
+// enqueue queues the job without blocking, since it is called from the storage
+// listeners while users are written. When the queue is full because of slow targets,
+// the job is coalesced into a full sync run by the worker after its current job.
+func (p *Pusher) enqueue(job pushJob) {
+	select {
+	case p.jobs <- job:
+	default:
+		p.mu.Lock()
+		p.pendingSync = true
+		p.mu.Unlock()
+	}
+}
+
+// takePendingSync reports whether a full sync is pending, and clears it.
+func (p *Pusher) takePendingSync() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := p.pendingSync
+	p.pendingSync = false
+	return pending
+}
+
+// Status returns the synchronization status of every target, sorted by target name.
+func (p *Pusher) Status() []TargetStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	rv := make([]TargetStatus, 0, len(p.status))
+	for _, st := range p.status {
+		rv = append(rv, *st)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Target < rv[j].Target })
+	return rv
+}
+
+func (p *Pusher) run() {
+	for job := range p.jobs {
+		p.process(job)
+		if p.takePendingSync() {
+			p.process(pushJob{sync: true})
+		}
+	}
+}
+
+func (p *Pusher) process(job pushJob) {
+	targets, err := p.targets()
+	if err != nil {
+		log.Println("scim push: error listing targets", err)
+		return
+	}
+	for _, t := range targets {
+		var err error
+		if job.sync {
+			err = p.syncTarget(t)
+		} else {
+			err = p.pushUser(t, job.userID)
+		}
+		p.recordStatus(t, err)
+	}
+}
+
+// targets returns the SCIM targets of all service providers and clients and forgets
+// about targets which were removed, and the users provisioned into them.
+func (p *Pusher) targets() ([]*pushTarget, error) {
+	var targets []*pushTarget
+	sps, err := p.storage.ListServiceProviders()
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range sps {
+		if sp.SCIM != nil && sp.SCIM.URL != "" {
+			targets = append(targets, &pushTarget{name: "saml:" + sp.ID, SCIMTarget: sp.SCIM})
+		}
+	}
+	clients, err := p.storage.ListClients()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clients {
+		if c.SCIM != nil && c.SCIM.URL != "" {
+			targets = append(targets, &pushTarget{name: "oidc:" + c.ID, SCIMTarget: c.SCIM})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+
+	known := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		known[url.PathEscape(t.name)] = true
+	}
+	b := p.storage.Backend()
+	keys, err := b.List(keyRemoteUsers)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if target := strings.SplitN(k, "/", 2)[0]; !known[target] {
+			if err := b.Delete(keyRemoteUsers + k); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name := range p.status {
+		if !known[url.PathEscape(name)] {
+			delete(p.status, name)
+		}
+	}
+	return targets, nil
+}
+
+func (p *Pusher) recordStatus(t *pushTarget, err error) {
+	ids, listErr := p.remoteIDs(t)
+	if err == nil {
+		err = listErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := &TargetStatus{
+		Target:   t.name,
+		URL:      t.URL,
+		Users:    len(ids),
+		LastSync: time.Now(),
+	}
+	if err != nil {
+		log.Printf("scim push: %s: %v", t.name, err)
+		st.LastErr = err.Error()
+	}
+	p.status[t.name] = st
+}
+
+func (p *Pusher) syncTarget(t *pushTarget) error {
+	users, err := p.storage.ListUsers()
+	if err != nil {
+		return err
+	}
+	local := make(map[string]bool, len(users))
+	var errs []string
+	for _, u := range users {
+		local[u.ID] = true
+		if err := p.upsert(t, u); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	ids, err := p.remoteIDs(t)
+	if err != nil {
+		return err
+	}
+	var gone []string
+	for _, id := range ids {
+		if !local[id] {
+			gone = append(gone, id)
+		}
+	}
+	for _, id := range gone {
+		if err := p.delete(t, id); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *Pusher) pushUser(t *pushTarget, id string) error {
+	u, err := p.storage.GetUserByID(id)
+	if err != nil {
+		return p.delete(t, id)
+	}
+	return p.upsert(t, u)
+}
+
+func remoteKey(t *pushTarget, id string) string {
+	return keyRemoteUsers + url.PathEscape(t.name) + "/" + url.PathEscape(id)
+}
+
+// lookupRemote returns the user provisioned into the target for the local user id, nil if there is none.
+func (p *Pusher) lookupRemote(t *pushTarget, id string) (*remoteUser, error) {
+	ru := &remoteUser{}
+	if err := p.storage.Backend().Get(remoteKey(t, id), ru); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ru, nil
+}
+
+// setRemote records the user provisioned into the target for the local user id, ru is nil once it was deprovisioned.
+func (p *Pusher) setRemote(t *pushTarget, id string, ru *remoteUser) error {
+	if ru == nil {
+		return p.storage.Backend().Delete(remoteKey(t, id))
+	}
+	return p.storage.Backend().Put(remoteKey(t, id), ru)
+}
+
+// remoteIDs returns the local ids of the users provisioned into the target.
+func (p *Pusher) remoteIDs(t *pushTarget) ([]string, error) {
+	keys, err := p.storage.Backend().List(keyRemoteUsers + url.PathEscape(t.name) + "/")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		id, err := url.PathUnescape(k)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// upsert creates or updates the user in the target. Users are matched by userName when
+// they were not provisioned by this process before.
+func (p *Pusher) upsert(t *pushTarget, u *storage.User) error {
+	su := toPushUser(u)
+	b, err := json.Marshal(su)
+	if err != nil {
+		return err
+	}
+	payload := string(b)
+
+	ru, err := p.lookupRemote(t, u.ID)
+	if err != nil {
+		return err
+	}
+	if ru != nil && ru.Payload == payload {
+		return nil
+	}
+	if ru == nil {
+		found, err := p.find(t, u.Username)
+		if err != nil {
+			return err
+		}
+		if found != "" {
+			ru = &remoteUser{ID: found}
+		}
+	}
+
+	if ru != nil {
+		patch := &PatchRequest{
+			Schemas: []string{schemaPatchOp},
+			Operations: []PatchOperation{
+				{Op: "replace", Value: map[string]interface{}{
+					"userName":    su.UserName,
+					"externalId":  su.ExternalID,
+					"name":        su.Name,
+					"displayName": su.DisplayName,
+					"emails":      su.Emails,
+					"active":      su.Active,
+				}},
+			},
+		}
+		status, _, err := p.do(t, http.MethodPatch, "/Users/"+url.PathEscape(ru.ID), patch)
+		if err != nil && status != http.StatusNotFound {
+			return fmt.Errorf("updating user %s: %w", u.ID, err)
+		}
+		if err == nil {
+			return p.setRemote(t, u.ID, &remoteUser{ID: ru.ID, Payload: payload})
+		}
+	}
+
+	created := &User{}
+	_, body, err := p.do(t, http.MethodPost, "/Users", su)
+	if err != nil {
+		return fmt.Errorf("creating user %s: %w", u.ID, err)
+	}
+	if err := json.Unmarshal(body, created); err != nil || created.ID == "" {
+		return fmt.Errorf("creating user %s: response has no id", u.ID)
+	}
+	return p.setRemote(t, u.ID, &remoteUser{ID: created.ID, Payload: payload})
+}
+
+// delete deprovisions the user from the target, if it was provisioned into it.
+func (p *Pusher) delete(t *pushTarget, id string) error {
+	ru, err := p.lookupRemote(t, id)
+	if err != nil || ru == nil {
+		return err
+	}
+	status, _, err := p.do(t, http.MethodDelete, "/Users/"+url.PathEscape(ru.ID), nil)
+	if err != nil && status != http.StatusNotFound {
+		return fmt.Errorf("deleting user %s: %w", id, err)
+	}
+	return p.setRemote(t, id, nil)
+}
+
+// find returns the id of the user with the userName in the target, or "" if there is none.
+func (p *Pusher) find(t *pushTarget, userName string) (string, error) {
+	q := url.Values{"filter": {fmt.Sprintf("userName eq %q", userName)}}
+	_, body, err := p.do(t, http.MethodGet, "/Users?"+q.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("searching user %s: %w", userName, err)
+	}
+	var resp struct {
+		Resources []User `json:"Resources"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("searching user %s: %w", userName, err)
+	}
+	if len(resp.Resources) == 0 {
+		return "", nil
+	}
+	return resp.Resources[0].ID, nil
+}
+
+func (p *Pusher) do(t *pushTarget, method, path string, body interface{}) (int, []byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(t.URL, "/")+path, reqBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, b, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(b))
+	}
+	return resp.StatusCode, b, nil
+}
+
+// toPushUser returns the SCIM user sent to targets. The local user id is sent as externalId.
+func toPushUser(u *storage.User) *User {
+	active := Bool(!u.Disabled)
+	su := &User{
+		Schemas:     []string{schemaUser},
+		ExternalID:  u.ID,
+		UserName:    u.Username,
+		DisplayName: strings.TrimSpace(u.Firstname + " " + u.Lastname),
+		Active:      &active,
+		Name: &Name{
+			Formatted:  strings.TrimSpace(u.Firstname + " " + u.Lastname),
+			GivenName:  u.Firstname,
+			FamilyName: u.Lastname,
+		},
+	}
+	if u.Email != "" {
+		su.Emails = []MultiValued{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	return su
+}
@@ -0,0 +1,214 @@
+package scim
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+// pushToken is the bearer token of the SCIM endpoint users are pushed to.
+const pushToken = "push-token"
+
+// receiver is a SCIM endpoint users are pushed to, recording the requests it receives.
+type receiver struct {
+	*httptest.Server
+	stor *storage.Storage
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+	rcv := &receiver{stor: storage.NewStorage()}
+	h := New("http://receiver", rcv.stor, pushToken)
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.mu.Lock()
+		rcv.requests = append(rcv.requests, r.Method+" "+r.URL.Path)
+		rcv.mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// takeRequests returns the requests received since the last call.
+func (rcv *receiver) takeRequests() []string {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	requests := rcv.requests
+	rcv.requests = nil
+	return requests
+}
+
+// remoteUsers returns the users provisioned into the receiver, by userName.
+func (rcv *receiver) remoteUsers(t *testing.T) map[string]*storage.User {
+	t.Helper()
+	users, err := rcv.stor.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers() error = %v", err)
+	}
+	byName := make(map[string]*storage.User, len(users))
+	for _, u := range users {
+		byName[u.Username] = u
+	}
+	return byName
+}
+
+// newPushStorage returns a storage with a client pushing its users to the receiver.
+func newPushStorage(t *testing.T, rcv *receiver) *storage.Storage {
+	t.Helper()
+	stor := storage.NewStorage()
+	err := stor.RegisterClient("app", &storage.Client{ID: "app", SCIM: &storage.SCIMTarget{URL: rcv.URL, Token: pushToken}})
+	if err != nil {
+		t.Fatalf("RegisterClient() error = %v", err)
+	}
+	return stor
+}
+
+func putUser(t *testing.T, stor *storage.Storage, u *storage.User) {
+	t.Helper()
+	if err := stor.PutUser(u.ID, u); err != nil {
+		t.Fatalf("PutUser() error = %v", err)
+	}
+}
+
+func TestPushUpsert(t *testing.T) {
+	rcv := newReceiver(t)
+	stor := newPushStorage(t, rcv)
+	p := newPusher(stor, 1)
+
+	putUser(t, stor, &storage.User{ID: "alice", Username: "alice", Firstname: "Alice", Email: "alice@example.com"})
+	p.process(pushJob{userID: "alice"})
+	remote := rcv.remoteUsers(t)["alice"]
+	if remote == nil || remote.ExternalID != "alice" || remote.Firstname != "Alice" || remote.Email != "alice@example.com" {
+		t.Fatalf("remote user = %+v, want alice created with externalId alice", remote)
+	}
+	if got := rcv.takeRequests(); len(got) != 2 || got[0] != "GET /Users" || got[1] != "POST /Users" {
+		t.Errorf("requests = %v, want a search and then a creation", got)
+	}
+
+	p.process(pushJob{userID: "alice"})
+	if got := rcv.takeRequests(); len(got) != 0 {
+		t.Errorf("requests for an unchanged user = %v, want none", got)
+	}
+
+	putUser(t, stor, &storage.User{ID: "alice", Username: "alice", Firstname: "Alicia", Email: "alice@example.com"})
+	p.process(pushJob{userID: "alice"})
+	if got := rcv.takeRequests(); len(got) != 1 || got[0] != "PATCH /Users/"+remote.ID {
+		t.Errorf("requests for an updated user = %v, want a single PATCH", got)
+	}
+	if updated := rcv.remoteUsers(t)["alice"]; updated == nil || updated.Firstname != "Alicia" {
+		t.Errorf("remote user after update = %+v, want its first name updated", updated)
+	}
+
+	if st := p.Status(); len(st) != 1 || st[0].Users != 1 || st[0].LastErr != "" {
+		t.Errorf("Status() = %+v, want one user pushed without error", st)
+	}
+}
+
+func TestPushMatchesExistingUserByUserName(t *testing.T) {
+	rcv := newReceiver(t)
+	putUser(t, rcv.stor, &storage.User{ID: "remote-alice", Username: "alice"})
+	stor := newPushStorage(t, rcv)
+	p := newPusher(stor, 1)
+
+	putUser(t, stor, &storage.User{ID: "alice", Username: "alice", Firstname: "Alice"})
+	p.process(pushJob{userID: "alice"})
+
+	users := rcv.remoteUsers(t)
+	if len(users) != 1 || users["alice"].ID != "remote-alice" || users["alice"].Firstname != "Alice" {
+		t.Errorf("remote users = %+v, want the existing user updated", users)
+	}
+}
+
+func TestPushDeleteAfterRestart(t *testing.T) {
+	tests := []struct {
+		name string
+		job  pushJob
+	}{
+		{name: "user deleted", job: pushJob{userID: "alice"}},
+		{name: "full sync", job: pushJob{sync: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newReceiver(t)
+			stor := newPushStorage(t, rcv)
+			putUser(t, stor, &storage.User{ID: "alice", Username: "alice"})
+			putUser(t, stor, &storage.User{ID: "bob", Username: "bob"})
+			newPusher(stor, 1).process(pushJob{sync: true})
+			if users := rcv.remoteUsers(t); len(users) != 2 {
+				t.Fatalf("remote users = %v, want alice and bob", users)
+			}
+
+			// the users provisioned before the restart are known from the storage backend
+			p := newPusher(stor, 1)
+			if err := stor.DeleteUser("alice"); err != nil {
+				t.Fatalf("DeleteUser() error = %v", err)
+			}
+			p.process(tt.job)
+
+			users := rcv.remoteUsers(t)
+			if _, ok := users["alice"]; ok || users["bob"] == nil {
+				t.Errorf("remote users = %v, want only bob", users)
+			}
+			if st := p.Status(); len(st) != 1 || st[0].Users != 1 {
+				t.Errorf("Status() = %+v, want one user left", st)
+			}
+		})
+	}
+}
+
+func TestPushForgetsRemovedTargets(t *testing.T) {
+	rcv := newReceiver(t)
+	stor := newPushStorage(t, rcv)
+	putUser(t, stor, &storage.User{ID: "alice", Username: "alice"})
+	p := newPusher(stor, 1)
+	p.process(pushJob{sync: true})
+
+	if err := stor.RegisterClient("app", &storage.Client{ID: "app"}); err != nil {
+		t.Fatalf("RegisterClient() error = %v", err)
+	}
+	p.process(pushJob{sync: true})
+
+	if st := p.Status(); len(st) != 0 {
+		t.Errorf("Status() = %+v, want no target", st)
+	}
+	keys, err := stor.Backend().List(keyRemoteUsers)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("remote users of removed targets = %v, want none", keys)
+	}
+}
+
+func TestPushCoalescesIntoSync(t *testing.T) {
+	rcv := newReceiver(t)
+	stor := newPushStorage(t, rcv)
+	putUser(t, stor, &storage.User{ID: "alice", Username: "alice"})
+	putUser(t, stor, &storage.User{ID: "bob", Username: "bob"})
+	putUser(t, stor, &storage.User{ID: "carol", Username: "carol"})
+	p := newPusher(stor, 1)
+
+	// the queue holds a single job, the next ones are coalesced into a full sync
+	p.UserChanged("alice", nil)
+	p.UserChanged("bob", nil)
+	p.UserChanged("carol", nil)
+	if len(p.jobs) != 1 {
+		t.Fatalf("queued jobs = %d, want 1", len(p.jobs))
+	}
+
+	close(p.jobs)
+	p.run()
+
+	if users := rcv.remoteUsers(t); len(users) != 3 {
+		t.Errorf("remote users = %v, want alice, bob and carol", users)
+	}
+	if p.takePendingSync() {
+		t.Errorf("pending sync was not run")
+	}
+}
@@ -0,0 +1,226 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+const (
+	schemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	schemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	schemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	schemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	schemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	schemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	schemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// Meta is the SCIM "meta" complex attribute common to all resources.
+type Meta struct {
+	ResourceType string `json:"resourceType,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+// Name is the SCIM "name" complex attribute of a User.
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// MultiValued is a SCIM multi-valued attribute entry such as an email, a group or a member.
+type MultiValued struct {
+	Value   string `json:"value,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// Bool is a SCIM boolean. Some provisioning clients (e.g. Azure AD) send booleans
+// as the strings "True" and "False", so both forms are accepted.
+type Bool bool
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseBool(strings.Trim(string(data), `"`))
+	if err != nil {
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	*b = Bool(v)
+	return nil
+}
+
+// User is the SCIM representation of a storage.User.
+type User struct {
+	Schemas     []string      `json:"schemas"`
+	ID          string        `json:"id,omitempty"`
+	ExternalID  string        `json:"externalId,omitempty"`
+	UserName    string        `json:"userName"`
+	Name        *Name         `json:"name,omitempty"`
+	DisplayName string        `json:"displayName,omitempty"`
+	Emails      []MultiValued `json:"emails,omitempty"`
+	Active      *Bool         `json:"active,omitempty"`
+	Password    string        `json:"password,omitempty"`
+	Groups      []MultiValued `json:"groups,omitempty"`
+	Meta        *Meta         `json:"meta,omitempty"`
+}
+
+// Group is the SCIM representation of a storage.Group and its members.
+type Group struct {
+	Schemas     []string      `json:"schemas"`
+	ID          string        `json:"id,omitempty"`
+	ExternalID  string        `json:"externalId,omitempty"`
+	DisplayName string        `json:"displayName"`
+	Members     []MultiValued `json:"members,omitempty"`
+	Meta        *Meta         `json:"meta,omitempty"`
+}
+
+// ListResponse is the SCIM envelope of query results.
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+func (s *server) userFromStorage(u *storage.User, groupsByName map[string]*storage.Group) *User {
+	active := Bool(!u.Disabled)
+	su := &User{
+		Schemas:     []string{schemaUser},
+		ID:          u.ID,
+		ExternalID:  u.ExternalID,
+		UserName:    u.Username,
+		DisplayName: strings.TrimSpace(u.Firstname + " " + u.Lastname),
+		Active:      &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Location:     fmt.Sprintf("%s/Users/%s", s.baseURL, u.ID),
+		},
+	}
+	if u.Firstname != "" || u.Lastname != "" {
+		su.Name = &Name{
+			Formatted:  su.DisplayName,
+			GivenName:  u.Firstname,
+			FamilyName: u.Lastname,
+		}
+	}
+	if u.Email != "" {
+		su.Emails = []MultiValued{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	for _, name := range u.Groups {
+		id := name
+		if g, ok := groupsByName[name]; ok {
+			id = g.ID
+		}
+		su.Groups = append(su.Groups, MultiValued{
+			Value:   id,
+			Display: name,
+			Ref:     fmt.Sprintf("%s/Groups/%s", s.baseURL, id),
+		})
+	}
+	return su
+}
+
+// nameDisplayName returns the displayName of the user made of its given and family names.
+func (su *User) nameDisplayName() string {
+	if su.Name == nil {
+		return ""
+	}
+	return strings.TrimSpace(su.Name.GivenName + " " + su.Name.FamilyName)
+}
+
+// toStorage applies the SCIM user on top of the existing storage user, if any.
+// Groups are read-only on users and are managed through the Groups resource.
+func (su *User) toStorage(id string, existing *storage.User) *storage.User {
+	u := &storage.User{EmailVerified: true}
+	if existing != nil {
+		*u = *existing
+	}
+	u.ID = id
+	u.Username = su.UserName
+	u.ExternalID = su.ExternalID
+	u.Firstname, u.Lastname = "", ""
+	if su.Name != nil {
+		u.Firstname = su.Name.GivenName
+		u.Lastname = su.Name.FamilyName
+	}
+	u.Email = ""
+	for i, e := range su.Emails {
+		if i == 0 || e.Primary {
+			u.Email = e.Value
+		}
+	}
+	if su.Active != nil {
+		u.Disabled = !bool(*su.Active)
+	}
+	if su.Password != "" {
+		u.Password = su.Password
+	}
+	return u
+}
+
+func (s *server) groupFromStorage(g *storage.Group, users []*storage.User) *Group {
+	sg := &Group{
+		Schemas:     []string{schemaGroup},
+		ID:          g.ID,
+		ExternalID:  g.ExternalID,
+		DisplayName: g.DisplayName,
+		Meta: &Meta{
+			ResourceType: "Group",
+			Location:     fmt.Sprintf("%s/Groups/%s", s.baseURL, g.ID),
+		},
+	}
+	for _, u := range users {
+		if u.HasGroup(g.DisplayName) {
+			sg.Members = append(sg.Members, MultiValued{
+				Value:   u.ID,
+				Display: u.Username,
+				Ref:     fmt.Sprintf("%s/Users/%s", s.baseURL, u.ID),
+			})
+		}
+	}
+	sort.Slice(sg.Members, func(i, j int) bool { return sg.Members[i].Value < sg.Members[j].Value })
+	return sg
+}
+
+// memberIDs returns the distinct user ids referenced by the group members.
+func (sg *Group) memberIDs() []string {
+	ids := make([]string, 0, len(sg.Members))
+	seen := make(map[string]bool, len(sg.Members))
+	for _, m := range sg.Members {
+		if m.Value != "" && !seen[m.Value] {
+			seen[m.Value] = true
+			ids = append(ids, m.Value)
+		}
+	}
+	return ids
+}
+
+// toMap converts a resource to its generic JSON form, used for filtering and patching.
+func toMap(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fromMap converts a resource from its generic JSON form.
+func fromMap(m map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,623 @@
+// Package scim implements a SCIM 2.0 (RFC 7643/7644) provisioning server for the
+// users and groups of the identity provider storage.
+package scim
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+const (
+	contentType     = "application/scim+json"
+	defaultCount    = 100
+	maxCount        = 200
+	maxPayloadBytes = 1 << 20
+)
+
+type Storage interface {
+	ListUsers() ([]*storage.User, error)
+	GetUserByID(string) (*storage.User, error)
+	DeleteUser(string) error
+	PutUser(string, *storage.User) error
+
+	ListGroups() ([]*storage.Group, error)
+	GetGroupByID(string) (*storage.Group, error)
+	DeleteGroup(string) error
+	PutGroup(string, *storage.Group, []string) error
+}
+
+type server struct {
+	// mu serializes writes, so that read-modify-write requests such as PATCH do not race.
+	mu      sync.Mutex
+	storage Storage
+	baseURL string
+	token   string
+}
+
+// New returns the SCIM handler serving the Users and Groups resources of the storage.
+// Every request must carry the given bearer token; if token is empty all requests are rejected.
+func New(remoteAddr string, stor Storage, token string) http.Handler {
+	s := &server{
+		storage: stor,
+		baseURL: remoteAddr,
+		token:   token,
+	}
+
+	router := mux.NewRouter()
+	router.Use(s.authenticate)
+
+	router.Path("/ServiceProviderConfig").Methods("GET").HandlerFunc(s.serviceProviderConfigHandler)
+	router.Path("/ResourceTypes").Methods("GET").HandlerFunc(s.resourceTypesHandler)
+
+	router.Path("/Users").Methods("GET").HandlerFunc(s.listUsersHandler)
+	router.Path("/Users").Methods("POST").HandlerFunc(s.createUserHandler)
+	router.Path("/Users/{id}").Methods("GET").HandlerFunc(s.getUserHandler)
+	router.Path("/Users/{id}").Methods("PUT").HandlerFunc(s.replaceUserHandler)
+	router.Path("/Users/{id}").Methods("PATCH").HandlerFunc(s.patchUserHandler)
+	router.Path("/Users/{id}").Methods("DELETE").HandlerFunc(s.deleteUserHandler)
+
+	router.Path("/Groups").Methods("GET").HandlerFunc(s.listGroupsHandler)
+	router.Path("/Groups").Methods("POST").HandlerFunc(s.createGroupHandler)
+	router.Path("/Groups/{id}").Methods("GET").HandlerFunc(s.getGroupHandler)
+	router.Path("/Groups/{id}").Methods("PUT").HandlerFunc(s.replaceGroupHandler)
+	router.Path("/Groups/{id}").Methods("PATCH").HandlerFunc(s.patchGroupHandler)
+	router.Path("/Groups/{id}").Methods("DELETE").HandlerFunc(s.deleteGroupHandler)
+
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "", "resource endpoint not found")
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+	})
+
+	return router
+}
+
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeError(w, http.StatusUnauthorized, "", "invalid or missing bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scimError is the SCIM error response body (RFC 7644 section 3.12).
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeJSON(w, status, &scimError{
+		Schemas:  []string{schemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "", "resource not found")
+		return
+	}
+	log.Println("scim: storage error", err)
+	writeError(w, http.StatusInternalServerError, "", err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(v); err != nil {
+		log.Println("scim: error encoding response", err)
+	}
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPayloadBytes)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *server) serviceProviderConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"schemas":          []string{schemaServiceProviderConfig},
+		"patch":            map[string]bool{"supported": true},
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": maxCount},
+		"changePassword":   map[string]bool{"supported": true},
+		"sort":             map[string]bool{"supported": false},
+		"etag":             map[string]bool{"supported": false},
+		"documentationUri": "https://github.com/seriousben/dev-identity-provider",
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication using the SCIM bearer token configured on the identity provider",
+			"primary":     true,
+		}},
+		"meta": &Meta{ResourceType: "ServiceProviderConfig", Location: s.baseURL + "/ServiceProviderConfig"},
+	})
+}
+
+func (s *server) resourceTypesHandler(w http.ResponseWriter, r *http.Request) {
+	resourceTypes := []interface{}{
+		map[string]interface{}{
+			"schemas":  []string{schemaResourceType},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   schemaUser,
+			"meta":     &Meta{ResourceType: "ResourceType", Location: s.baseURL + "/ResourceTypes/User"},
+		},
+		map[string]interface{}{
+			"schemas":  []string{schemaResourceType},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   schemaGroup,
+			"meta":     &Meta{ResourceType: "ResourceType", Location: s.baseURL + "/ResourceTypes/Group"},
+		},
+	}
+	writeJSON(w, http.StatusOK, &ListResponse{
+		Schemas:      []string{schemaListResponse},
+		TotalResults: len(resourceTypes),
+		StartIndex:   1,
+		ItemsPerPage: len(resourceTypes),
+		Resources:    resourceTypes,
+	})
+}
+
+// list filters and paginates resources according to the filter, startIndex and count query parameters.
+func list(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	q := r.URL.Query()
+
+	if fs := q.Get("filter"); fs != "" {
+		f, err := parseFilter(fs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		filtered := resources[:0]
+		for _, res := range resources {
+			m, err := toMap(res)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+			if f.match(m) {
+				filtered = append(filtered, res)
+			}
+		}
+		resources = filtered
+	}
+
+	startIndex := 1
+	if v := q.Get("startIndex"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", "invalid startIndex")
+			return
+		}
+		if i > 1 {
+			startIndex = i
+		}
+	}
+	count := defaultCount
+	if v := q.Get("count"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", "invalid count")
+			return
+		}
+		count = i
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > maxCount {
+		count = maxCount
+	}
+
+	page := []interface{}{}
+	if start := startIndex - 1; start < len(resources) {
+		end := start + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		page = resources[start:end]
+	}
+
+	writeJSON(w, http.StatusOK, &ListResponse{
+		Schemas:      []string{schemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+func (s *server) groupsByName() (map[string]*storage.Group, error) {
+	groups, err := s.storage.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*storage.Group, len(groups))
+	for _, g := range groups {
+		byName[g.DisplayName] = g
+	}
+	return byName, nil
+}
+
+func (s *server) getUser(id string) (*User, *storage.User, error) {
+	u, err := s.storage.GetUserByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	byName, err := s.groupsByName()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.userFromStorage(u, byName), u, nil
+}
+
+// checkUserName ensures that no other user than id already uses the userName.
+func (s *server) checkUserName(w http.ResponseWriter, su *User, id string) bool {
+	if su.UserName == "" {
+		writeError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+		return false
+	}
+	users, err := s.storage.ListUsers()
+	if err != nil {
+		writeStorageError(w, err)
+		return false
+	}
+	for _, u := range users {
+		if u.ID != id && strings.EqualFold(u.Username, su.UserName) {
+			writeError(w, http.StatusConflict, "uniqueness", fmt.Sprintf("userName %q is already taken", su.UserName))
+			return false
+		}
+	}
+	return true
+}
+
+func (s *server) writeUser(w http.ResponseWriter, status int, id string) {
+	su, _, err := s.getUser(id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", su.Meta.Location)
+	}
+	writeJSON(w, status, su)
+}
+
+func (s *server) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := s.storage.ListUsers()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	byName, err := s.groupsByName()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	resources := make([]interface{}, len(users))
+	for i, u := range users {
+		resources[i] = s.userFromStorage(u, byName)
+	}
+	list(w, r, resources)
+}
+
+func (s *server) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeUser(w, http.StatusOK, mux.Vars(r)["id"])
+}
+
+func (s *server) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	su := &User{}
+	if !decodeBody(w, r, su) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.checkUserName(w, su, "") {
+		return
+	}
+	id := uuid.NewString()
+	if err := s.storage.PutUser(id, su.toStorage(id, nil)); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	s.writeUser(w, http.StatusCreated, id)
+}
+
+func (s *server) replaceUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	su := &User{}
+	if !decodeBody(w, r, su) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.storage.GetUserByID(id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if !s.checkUserName(w, su, id) {
+		return
+	}
+	if err := s.storage.PutUser(id, su.toStorage(id, existing)); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	s.writeUser(w, http.StatusOK, id)
+}
+
+func (s *server) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	req := &PatchRequest{}
+	if !decodeBody(w, r, req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	su, existing, err := s.getUser(id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	m, err := toMap(su)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if err := applyPatch(m, req.Operations); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidPath", err.Error())
+		return
+	}
+	patched := &User{}
+	if err := fromMap(m, patched); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	// displayName is derived from name, it can only change along with it
+	if patched.DisplayName != su.DisplayName && patched.DisplayName != patched.nameDisplayName() {
+		writeError(w, http.StatusBadRequest, "mutability", "displayName is made of name.givenName and name.familyName, patch them instead")
+		return
+	}
+	if !s.checkUserName(w, patched, id) {
+		return
+	}
+	if err := s.storage.PutUser(id, patched.toStorage(id, existing)); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	s.writeUser(w, http.StatusOK, id)
+}
+
+func (s *server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.storage.GetUserByID(id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := s.storage.DeleteUser(id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getGroup(id string) (*Group, error) {
+	g, err := s.storage.GetGroupByID(id)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.storage.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	return s.groupFromStorage(g, users), nil
+}
+
+// checkDisplayName ensures that no other group than id already uses the displayName.
+func (s *server) checkDisplayName(w http.ResponseWriter, sg *Group, id string) bool {
+	if sg.DisplayName == "" {
+		writeError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return false
+	}
+	groups, err := s.storage.ListGroups()
+	if err != nil {
+		writeStorageError(w, err)
+		return false
+	}
+	for _, g := range groups {
+		if g.ID != id && g.DisplayName == sg.DisplayName {
+			writeError(w, http.StatusConflict, "uniqueness", fmt.Sprintf("displayName %q is already taken", sg.DisplayName))
+			return false
+		}
+	}
+	return true
+}
+
+// putGroup stores the group and its members.
+func (s *server) putGroup(w http.ResponseWriter, id string, sg *Group) bool {
+	if !s.checkDisplayName(w, sg, id) {
+		return false
+	}
+	for _, memberID := range sg.memberIDs() {
+		if _, err := s.storage.GetUserByID(memberID); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("member %q is not a known user", memberID))
+			return false
+		}
+	}
+	err := s.storage.PutGroup(id, &storage.Group{
+		ID:          id,
+		DisplayName: sg.DisplayName,
+		ExternalID:  sg.ExternalID,
+	}, sg.memberIDs())
+	if err != nil {
+		writeStorageError(w, err)
+		return false
+	}
+	return true
+}
+
+func (s *server) writeGroup(w http.ResponseWriter, status int, id string) {
+	sg, err := s.getGroup(id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", sg.Meta.Location)
+	}
+	writeJSON(w, status, sg)
+}
+
+func (s *server) listGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.storage.ListGroups()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	users, err := s.storage.ListUsers()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	resources := make([]interface{}, len(groups))
+	for i, g := range groups {
+		resources[i] = s.groupFromStorage(g, users)
+	}
+	list(w, r, resources)
+}
+
+func (s *server) getGroupHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeGroup(w, http.StatusOK, mux.Vars(r)["id"])
+}
+
+func (s *server) createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	sg := &Group{}
+	if !decodeBody(w, r, sg) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := uuid.NewString()
+	if !s.putGroup(w, id, sg) {
+		return
+	}
+	s.writeGroup(w, http.StatusCreated, id)
+}
+
+func (s *server) replaceGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	sg := &Group{}
+	if !decodeBody(w, r, sg) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.storage.GetGroupByID(id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if !s.putGroup(w, id, sg) {
+		return
+	}
+	s.writeGroup(w, http.StatusOK, id)
+}
+
+func (s *server) patchGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	req := &PatchRequest{}
+	if !decodeBody(w, r, req) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sg, err := s.getGroup(id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	m, err := toMap(sg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if err := applyPatch(m, req.Operations); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidPath", err.Error())
+		return
+	}
+	patched := &Group{}
+	if err := fromMap(m, patched); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	if !s.putGroup(w, id, patched) {
+		return
+	}
+	s.writeGroup(w, http.StatusOK, id)
+}
+
+func (s *server) deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.storage.GetGroupByID(id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := s.storage.DeleteGroup(id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,370 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+const testToken = "scim-token"
+
+func newTestServer(t *testing.T) (http.Handler, *storage.Storage) {
+	t.Helper()
+	stor := storage.NewStorage()
+	return New("http://localhost/scim/v2", stor, testToken), stor
+}
+
+// do sends the SCIM request with the test bearer token and decodes the JSON response into v, when not nil.
+func do(t *testing.T, h http.Handler, method, target, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: cannot decode response %q: %v", method, target, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestProvisionedUserLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		wantErr  bool
+	}{
+		{
+			name:     "user without password cannot log in with an empty password",
+			user:     `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "alice"}`,
+			password: "",
+			wantErr:  true,
+		},
+		{
+			name:     "user without password cannot log in with any password",
+			user:     `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "alice"}`,
+			password: "alice-password",
+			wantErr:  true,
+		},
+		{
+			name:     "user with password logs in",
+			user:     `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "alice", "password": "alice-password"}`,
+			password: "alice-password",
+		},
+		{
+			name:     "inactive user cannot log in",
+			user:     `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "alice", "password": "alice-password", "active": false}`,
+			password: "alice-password",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, stor := newTestServer(t)
+			if w := do(t, h, "POST", "/Users", tt.user, nil); w.Code != http.StatusCreated {
+				t.Fatalf("POST /Users status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+			}
+
+			session, err := stor.CreateSession("alice", tt.password, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateSession() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && session.UserID == "" {
+				t.Errorf("CreateSession() session has no user")
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{name: "valid token", token: testToken, authorization: "Bearer " + testToken, want: http.StatusOK},
+		{name: "missing header", token: testToken, authorization: "", want: http.StatusUnauthorized},
+		{name: "wrong token", token: testToken, authorization: "Bearer other-token", want: http.StatusUnauthorized},
+		{name: "token prefix", token: testToken, authorization: "Bearer " + testToken[:4], want: http.StatusUnauthorized},
+		{name: "basic credentials", token: testToken, authorization: "Basic " + testToken, want: http.StatusUnauthorized},
+		{name: "no token configured", token: "", authorization: "Bearer ", want: http.StatusUnauthorized},
+		{name: "no token configured and no header", token: "", authorization: "", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New("http://localhost/scim/v2", storage.NewStorage(), tt.token)
+			for _, target := range []string{"/Users", "/Groups", "/ServiceProviderConfig", "/Users/unknown"} {
+				r := httptest.NewRequest("GET", target, nil)
+				if tt.authorization != "" {
+					r.Header.Set("Authorization", tt.authorization)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				want := tt.want
+				if want == http.StatusOK && target == "/Users/unknown" {
+					want = http.StatusNotFound
+				}
+				if w.Code != want {
+					t.Errorf("GET %s status = %d, want %d", target, w.Code, want)
+				}
+				if want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("GET %s has no WWW-Authenticate header", target)
+				}
+			}
+		})
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	h, _ := newTestServer(t)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		body := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "` + name + `"}`
+		if w := do(t, h, "POST", "/Users", body, nil); w.Code != http.StatusCreated {
+			t.Fatalf("POST /Users status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+	}
+	var all struct {
+		Resources []User `json:"Resources"`
+	}
+	do(t, h, "GET", "/Users", "", &all)
+	if len(all.Resources) != 5 {
+		t.Fatalf("GET /Users returned %d users, want 5", len(all.Resources))
+	}
+	userNames := func(users []User) []string {
+		names := []string{}
+		for _, u := range users {
+			names = append(names, u.UserName)
+		}
+		return names
+	}
+	// the users are listed by id, which is random
+	allNames := userNames(all.Resources)
+	var cdNames []string
+	for _, name := range allNames {
+		if name == "carol" || name == "dave" {
+			cdNames = append(cdNames, name)
+		}
+	}
+
+	tests := []struct {
+		query          string
+		wantTotal      int
+		wantStartIndex int
+		wantNames      []string
+		wantStatus     int
+	}{
+		{query: "", wantTotal: 5, wantStartIndex: 1, wantNames: allNames},
+		{query: "?count=2", wantTotal: 5, wantStartIndex: 1, wantNames: allNames[:2]},
+		{query: "?startIndex=2&count=2", wantTotal: 5, wantStartIndex: 2, wantNames: allNames[1:3]},
+		{query: "?startIndex=4", wantTotal: 5, wantStartIndex: 4, wantNames: allNames[3:]},
+		{query: "?startIndex=5&count=10", wantTotal: 5, wantStartIndex: 5, wantNames: allNames[4:]},
+		{query: "?startIndex=6", wantTotal: 5, wantStartIndex: 6, wantNames: []string{}},
+		{query: "?startIndex=0&count=1", wantTotal: 5, wantStartIndex: 1, wantNames: allNames[:1]},
+		{query: "?startIndex=-3&count=1", wantTotal: 5, wantStartIndex: 1, wantNames: allNames[:1]},
+		{query: "?count=0", wantTotal: 5, wantStartIndex: 1, wantNames: []string{}},
+		{query: "?count=-1", wantTotal: 5, wantStartIndex: 1, wantNames: []string{}},
+		{query: `?filter=userName+sw+"c"+or+userName+sw+"d"&count=1`, wantTotal: 2, wantStartIndex: 1, wantNames: cdNames[:1]},
+		{query: `?filter=userName+sw+"c"+or+userName+sw+"d"&startIndex=2`, wantTotal: 2, wantStartIndex: 2, wantNames: cdNames[1:]},
+		{query: "?count=two", wantStatus: http.StatusBadRequest},
+		{query: "?startIndex=first", wantStatus: http.StatusBadRequest},
+		{query: `?filter=userName+eq`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			wantStatus := tt.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusOK
+			}
+			w := do(t, h, "GET", "/Users"+tt.query, "", nil)
+			if w.Code != wantStatus {
+				t.Fatalf("GET /Users%s status = %d, want %d: %s", tt.query, w.Code, wantStatus, w.Body)
+			}
+			if wantStatus != http.StatusOK {
+				return
+			}
+			var resp struct {
+				ListResponse
+				Resources []User `json:"Resources"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("cannot decode response %q: %v", w.Body.String(), err)
+			}
+			if resp.TotalResults != tt.wantTotal || resp.StartIndex != tt.wantStartIndex || resp.ItemsPerPage != len(tt.wantNames) {
+				t.Errorf("totalResults, startIndex, itemsPerPage = %d, %d, %d, want %d, %d, %d",
+					resp.TotalResults, resp.StartIndex, resp.ItemsPerPage, tt.wantTotal, tt.wantStartIndex, len(tt.wantNames))
+			}
+			if got := userNames(resp.Resources); !reflect.DeepEqual(got, tt.wantNames) {
+				t.Errorf("userNames = %v, want %v", got, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestPatchedPasswordLogin(t *testing.T) {
+	h, stor := newTestServer(t)
+	created := &User{}
+	if w := do(t, h, "POST", "/Users", `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "alice"}`, created); w.Code != http.StatusCreated {
+		t.Fatalf("POST /Users status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if _, err := stor.CreateSession("alice", "", ""); err == nil {
+		t.Fatalf("CreateSession() before setting a password succeeded")
+	}
+
+	patch := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "password", "value": "alice-password"}]}`
+	if w := do(t, h, "PATCH", "/Users/"+created.ID, patch, nil); w.Code != http.StatusOK {
+		t.Fatalf("PATCH /Users/%s status = %d, want %d: %s", created.ID, w.Code, http.StatusOK, w.Body)
+	}
+	if _, err := stor.CreateSession("alice", "alice-password", ""); err != nil {
+		t.Errorf("CreateSession() after setting the password error = %v", err)
+	}
+
+	// a later PATCH without password keeps it
+	patch = `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "name.givenName", "value": "Alice"}]}`
+	if w := do(t, h, "PATCH", "/Users/"+created.ID, patch, nil); w.Code != http.StatusOK {
+		t.Fatalf("PATCH /Users/%s status = %d, want %d: %s", created.ID, w.Code, http.StatusOK, w.Body)
+	}
+	if _, err := stor.CreateSession("alice", "alice-password", ""); err != nil {
+		t.Errorf("CreateSession() after another PATCH error = %v", err)
+	}
+	if _, err := stor.CreateSession("alice", "wrong-password", ""); err == nil {
+		t.Errorf("CreateSession() with a wrong password succeeded")
+	}
+}
+
+func TestPatchUserDisplayName(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations string
+		wantStatus int
+		wantName   string
+	}{
+		{
+			name:       "displayName alone",
+			operations: `[{"op": "replace", "path": "displayName", "value": "Al"}]`,
+			wantStatus: http.StatusBadRequest,
+			wantName:   "Alice Smith",
+		},
+		{
+			name:       "displayName matching the new name",
+			operations: `[{"op": "replace", "value": {"name": {"givenName": "Alicia", "familyName": "Smith"}, "displayName": "Alicia Smith"}}]`,
+			wantStatus: http.StatusOK,
+			wantName:   "Alicia Smith",
+		},
+		{
+			name:       "name without displayName",
+			operations: `[{"op": "replace", "path": "name.givenName", "value": "Alicia"}]`,
+			wantStatus: http.StatusOK,
+			wantName:   "Alicia Smith",
+		},
+		{
+			name:       "unchanged displayName",
+			operations: `[{"op": "replace", "value": {"displayName": "Alice Smith", "active": false}}]`,
+			wantStatus: http.StatusOK,
+			wantName:   "Alice Smith",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestServer(t)
+			created := &User{}
+			body := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "alice", "name": {"givenName": "Alice", "familyName": "Smith"}}`
+			if w := do(t, h, "POST", "/Users", body, created); w.Code != http.StatusCreated {
+				t.Fatalf("POST /Users status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+			}
+
+			patch := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": ` + tt.operations + `}`
+			var scimErr struct {
+				ScimType string `json:"scimType"`
+			}
+			w := do(t, h, "PATCH", "/Users/"+created.ID, patch, &scimErr)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("PATCH /Users/%s status = %d, want %d: %s", created.ID, w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusBadRequest && scimErr.ScimType != "mutability" {
+				t.Errorf("scimType = %q, want mutability", scimErr.ScimType)
+			}
+
+			got := &User{}
+			do(t, h, "GET", "/Users/"+created.ID, "", got)
+			if got.DisplayName != tt.wantName {
+				t.Errorf("displayName = %q, want %q", got.DisplayName, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestPutGroup(t *testing.T) {
+	h, stor := newTestServer(t)
+	ids := map[string]string{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		created := &User{}
+		body := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "` + name + `"}`
+		if w := do(t, h, "POST", "/Users", body, created); w.Code != http.StatusCreated {
+			t.Fatalf("POST /Users status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+		ids[name] = created.ID
+	}
+	group := func(displayName string, members ...string) string {
+		values := make([]string, len(members))
+		for i, m := range members {
+			values[i] = `{"value": "` + ids[m] + `"}`
+		}
+		return `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"], "displayName": "` + displayName + `", "members": [` + strings.Join(values, ",") + `]}`
+	}
+	created := &Group{}
+	if w := do(t, h, "POST", "/Groups", group("eng", "alice", "bob"), created); w.Code != http.StatusCreated {
+		t.Fatalf("POST /Groups status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		// wantGroups are the groups of each user after the request
+		wantGroups map[string][]string
+	}{
+		{
+			name:       "replace members",
+			body:       group("eng", "bob", "carol"),
+			wantStatus: http.StatusOK,
+			wantGroups: map[string][]string{"alice": nil, "bob": {"eng"}, "carol": {"eng"}},
+		},
+		{
+			name:       "rename and replace members",
+			body:       group("engineering", "alice"),
+			wantStatus: http.StatusOK,
+			wantGroups: map[string][]string{"alice": {"engineering"}, "bob": nil, "carol": nil},
+		},
+		{
+			name:       "unknown member",
+			body:       `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"], "displayName": "other", "members": [{"value": "unknown"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantGroups: map[string][]string{"alice": {"engineering"}, "bob": nil, "carol": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(t, h, "PUT", "/Groups/"+created.ID, tt.body, nil); w.Code != tt.wantStatus {
+				t.Fatalf("PUT /Groups/%s status = %d, want %d: %s", created.ID, w.Code, tt.wantStatus, w.Body)
+			}
+			for name, want := range tt.wantGroups {
+				u, err := stor.GetUserByID(ids[name])
+				if err != nil {
+					t.Fatalf("GetUserByID() error = %v", err)
+				}
+				if !reflect.DeepEqual(u.Groups, want) {
+					t.Errorf("groups of %s = %v, want %v", name, u.Groups, want)
+				}
+			}
+		})
+	}
+}
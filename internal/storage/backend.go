@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//ErrNotFound is returned from Backend.Get when there is no value for the key
+var ErrNotFound = errors.New("not found")
+
+//Backend is the key-value store the Storage keeps its entities in
+//values are JSON encoded and keys are slash separated paths (e.g. /users/<id>)
+type Backend interface {
+	//Get fetches the value stored in key and unmarshals it into value
+	Get(key string, value interface{}) error
+	//Put marshals value and stores it in key
+	Put(key string, value interface{}) error
+	//Delete removes key, deleting a missing key is not an error
+	Delete(key string) error
+	//List returns all the keys that start with prefix, sorted and with the prefix stripped
+	List(prefix string) ([]string, error)
+	//Batch calls fn with a Backend whose changes are applied at once, or not at all if fn fails
+	Batch(fn func(b Backend) error) error
+	//Close releases the resources of the backend
+	Close() error
+}
+
+//OpenBackend returns the backend described by spec, which is either:
+//  - "memory" (or empty) for a backend losing everything on restart,
+//  - "bolt:<path>" for a BoltDB file, created if it does not exist.
+func OpenBackend(spec string) (Backend, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return NewMemoryBackend(), nil
+	case strings.HasPrefix(spec, "bolt:"):
+		return OpenBoltBackend(strings.TrimPrefix(spec, "bolt:"))
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, must be memory or bolt:<path>", spec)
+}
+
+//MemoryBackend is a Backend keeping everything in memory
+type MemoryBackend struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{data: map[string][]byte{}}
+}
+
+func (m *MemoryBackend) Get(key string, value interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.data[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(b, value)
+}
+
+func (m *MemoryBackend) Put(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = b
+	return nil
+}
+
+func (m *MemoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, key)
+	return nil
+}
+
+func (m *MemoryBackend) List(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rv := []string{}
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			rv = append(rv, strings.TrimPrefix(k, prefix))
+		}
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+//Batch runs fn against a journal of its changes, which are applied to the data when fn succeeds
+func (m *MemoryBackend) Batch(fn func(b Backend) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryTx{data: m.data, journal: map[string][]byte{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for k, v := range tx.journal {
+		if v == nil {
+			delete(m.data, k)
+		} else {
+			m.data[k] = v
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+//memoryTx is the Backend of a MemoryBackend batch, reading through its journal to the data of the backend
+type memoryTx struct {
+	data map[string][]byte
+	//journal has the values written by the batch, nil for the deleted keys
+	journal map[string][]byte
+}
+
+func (t *memoryTx) Get(key string, value interface{}) error {
+	b, journaled := t.journal[key]
+	if !journaled {
+		b = t.data[key]
+	}
+	if b == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(b, value)
+}
+
+func (t *memoryTx) Put(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	t.journal[key] = b
+	return nil
+}
+
+func (t *memoryTx) Delete(key string) error {
+	t.journal[key] = nil
+	return nil
+}
+
+func (t *memoryTx) List(prefix string) ([]string, error) {
+	rv := []string{}
+	for k := range t.data {
+		if _, journaled := t.journal[k]; !journaled && strings.HasPrefix(k, prefix) {
+			rv = append(rv, strings.TrimPrefix(k, prefix))
+		}
+	}
+	for k, v := range t.journal {
+		if v != nil && strings.HasPrefix(k, prefix) {
+			rv = append(rv, strings.TrimPrefix(k, prefix))
+		}
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+func (t *memoryTx) Batch(fn func(b Backend) error) error {
+	return fn(t)
+}
+
+func (t *memoryTx) Close() error {
+	return nil
+}
+
+//getAll returns the values of all the keys starting with prefix
+func getAll[T any](b Backend, prefix string) ([]*T, error) {
+	keys, err := b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*T, 0, len(keys))
+	for _, k := range keys {
+		v := new(T)
+		if err := b.Get(prefix+k, v); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		rv = append(rv, v)
+	}
+	return rv, nil
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//boltBucket is the single bucket all keys are stored in, keys already carry their namespace
+var boltBucket = []byte("dev-identity-provider")
+
+//BoltBackend is a Backend persisting everything in a BoltDB file
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+//OpenBoltBackend opens the BoltDB file at path, creating it if it does not exist
+//the file is locked, so only one process can use it at a time
+func OpenBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+func (b *BoltBackend) Get(key string, value interface{}) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return (&boltTx{tx: tx}).Get(key, value)
+	})
+}
+
+func (b *BoltBackend) Put(key string, value interface{}) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx: tx}).Put(key, value)
+	})
+}
+
+func (b *BoltBackend) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return (&boltTx{tx: tx}).Delete(key)
+	})
+}
+
+func (b *BoltBackend) List(prefix string) ([]string, error) {
+	var rv []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rv, err = (&boltTx{tx: tx}).List(prefix)
+		return err
+	})
+	return rv, err
+}
+
+//Batch runs fn in a single read-write transaction
+func (b *BoltBackend) Batch(fn func(b Backend) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+//boltTx is the Backend used within a transaction
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Get(key string, value interface{}) error {
+	v := t.tx.Bucket(boltBucket).Get([]byte(key))
+	if v == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(v, value)
+}
+
+func (t *boltTx) Put(key string, value interface{}) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return t.tx.Bucket(boltBucket).Put([]byte(key), v)
+}
+
+func (t *boltTx) Delete(key string) error {
+	return t.tx.Bucket(boltBucket).Delete([]byte(key))
+}
+
+func (t *boltTx) List(prefix string) ([]string, error) {
+	rv := []string{}
+	c := t.tx.Bucket(boltBucket).Cursor()
+	p := []byte(prefix)
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+		rv = append(rv, string(k[len(p):]))
+	}
+	return rv, nil
+}
+
+//Batch runs fn in the current transaction
+func (t *boltTx) Batch(fn func(b Backend) error) error {
+	return fn(t)
+}
+
+func (t *boltTx) Close() error {
+	return nil
+}
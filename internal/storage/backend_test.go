@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type backendValue struct {
+	Name  string
+	Count int
+}
+
+//backendFactory opens a new empty backend, and reopens it when the backend persists its data
+type backendFactory struct {
+	name   string
+	open   func(t *testing.T) (Backend, func() Backend)
+	reopen bool
+}
+
+var backendFactories = []backendFactory{
+	{
+		name: "memory",
+		open: func(t *testing.T) (Backend, func() Backend) {
+			return NewMemoryBackend(), nil
+		},
+	},
+	{
+		name:   "bolt",
+		reopen: true,
+		open: func(t *testing.T) (Backend, func() Backend) {
+			path := filepath.Join(t.TempDir(), "idp.db")
+			b, err := OpenBoltBackend(path)
+			if err != nil {
+				t.Fatalf("opening bolt backend: %v", err)
+			}
+			return b, func() Backend {
+				reopened, err := OpenBoltBackend(path)
+				if err != nil {
+					t.Fatalf("reopening bolt backend: %v", err)
+				}
+				return reopened
+			}
+		},
+	},
+}
+
+//TestBackendConformance runs the same behaviors against every Backend implementation
+func TestBackendConformance(t *testing.T) {
+	errBatch := errors.New("batch failed")
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, b Backend)
+	}{
+		{
+			name: "get missing key",
+			run: func(t *testing.T, b Backend) {
+				err := b.Get("/users/missing", &backendValue{})
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Get() error = %v, want ErrNotFound", err)
+				}
+			},
+		},
+		{
+			name: "put then get",
+			run: func(t *testing.T, b Backend) {
+				want := backendValue{Name: "alice", Count: 2}
+				mustPut(t, b, "/users/alice", want)
+				got := backendValue{}
+				if err := b.Get("/users/alice", &got); err != nil {
+					t.Fatalf("Get() error = %v", err)
+				}
+				if got != want {
+					t.Fatalf("Get() = %+v, want %+v", got, want)
+				}
+			},
+		},
+		{
+			name: "put overwrites",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/users/alice", backendValue{Name: "alice", Count: 1})
+				mustPut(t, b, "/users/alice", backendValue{Name: "alice", Count: 2})
+				got := backendValue{}
+				if err := b.Get("/users/alice", &got); err != nil {
+					t.Fatalf("Get() error = %v", err)
+				}
+				if got.Count != 2 {
+					t.Fatalf("Get().Count = %d, want 2", got.Count)
+				}
+			},
+		},
+		{
+			name: "delete",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/users/alice", backendValue{Name: "alice"})
+				if err := b.Delete("/users/alice"); err != nil {
+					t.Fatalf("Delete() error = %v", err)
+				}
+				if err := b.Get("/users/alice", &backendValue{}); !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Get() after Delete() error = %v, want ErrNotFound", err)
+				}
+			},
+		},
+		{
+			name: "delete missing key",
+			run: func(t *testing.T, b Backend) {
+				if err := b.Delete("/users/missing"); err != nil {
+					t.Fatalf("Delete() error = %v, want nil", err)
+				}
+			},
+		},
+		{
+			name: "list by prefix",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/users/bob", backendValue{Name: "bob"})
+				mustPut(t, b, "/users/alice", backendValue{Name: "alice"})
+				mustPut(t, b, "/users-by-username/alice", backendValue{Name: "alice"})
+				mustPut(t, b, "/clients/app", backendValue{Name: "app"})
+				assertList(t, b, "/users/", []string{"alice", "bob"})
+				assertList(t, b, "/clients/", []string{"app"})
+			},
+		},
+		{
+			name: "list empty prefix",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/clients/app", backendValue{Name: "app"})
+				keys, err := b.List("/users/")
+				if err != nil {
+					t.Fatalf("List() error = %v", err)
+				}
+				if len(keys) != 0 {
+					t.Fatalf("List() = %v, want no keys", keys)
+				}
+			},
+		},
+		{
+			name: "batch commits",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/users/old", backendValue{Name: "old"})
+				err := b.Batch(func(tx Backend) error {
+					if err := tx.Put("/users/alice", backendValue{Name: "alice"}); err != nil {
+						return err
+					}
+					if err := tx.Delete("/users/old"); err != nil {
+						return err
+					}
+					//the changes of the batch are visible within it
+					return tx.Get("/users/alice", &backendValue{})
+				})
+				if err != nil {
+					t.Fatalf("Batch() error = %v", err)
+				}
+				assertList(t, b, "/users/", []string{"alice"})
+			},
+		},
+		{
+			name: "batch lists its changes",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/users/old", backendValue{Name: "old"})
+				mustPut(t, b, "/users/kept", backendValue{Name: "kept"})
+				err := b.Batch(func(tx Backend) error {
+					if err := tx.Put("/users/alice", backendValue{Name: "alice"}); err != nil {
+						return err
+					}
+					if err := tx.Delete("/users/old"); err != nil {
+						return err
+					}
+					assertList(t, tx, "/users/", []string{"alice", "kept"})
+					//a key deleted then put again within the batch is kept
+					if err := tx.Put("/users/old", backendValue{Name: "new"}); err != nil {
+						return err
+					}
+					assertList(t, tx, "/users/", []string{"alice", "kept", "old"})
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("Batch() error = %v", err)
+				}
+				got := backendValue{}
+				if err := b.Get("/users/old", &got); err != nil || got.Name != "new" {
+					t.Fatalf("Get() = %+v, %v, want the value put by the batch", got, err)
+				}
+			},
+		},
+		{
+			name: "batch rolls back on error",
+			run: func(t *testing.T, b Backend) {
+				mustPut(t, b, "/users/old", backendValue{Name: "old"})
+				err := b.Batch(func(tx Backend) error {
+					if err := tx.Put("/users/alice", backendValue{Name: "alice"}); err != nil {
+						return err
+					}
+					if err := tx.Delete("/users/old"); err != nil {
+						return err
+					}
+					return errBatch
+				})
+				if !errors.Is(err, errBatch) {
+					t.Fatalf("Batch() error = %v, want %v", err, errBatch)
+				}
+				assertList(t, b, "/users/", []string{"old"})
+			},
+		},
+	}
+
+	for _, factory := range backendFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					b, _ := factory.open(t)
+					defer b.Close()
+					tt.run(t, b)
+				})
+			}
+		})
+	}
+}
+
+func TestBackendReopen(t *testing.T) {
+	for _, factory := range backendFactories {
+		if !factory.reopen {
+			continue
+		}
+		t.Run(factory.name, func(t *testing.T) {
+			b, reopen := factory.open(t)
+			mustPut(t, b, "/users/alice", backendValue{Name: "alice", Count: 1})
+			mustPut(t, b, "/users/bob", backendValue{Name: "bob"})
+			if err := b.Batch(func(tx Backend) error { return tx.Delete("/users/bob") }); err != nil {
+				t.Fatalf("Batch() error = %v", err)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			b = reopen()
+			defer b.Close()
+			got := backendValue{}
+			if err := b.Get("/users/alice", &got); err != nil {
+				t.Fatalf("Get() after reopening error = %v", err)
+			}
+			if got != (backendValue{Name: "alice", Count: 1}) {
+				t.Fatalf("Get() after reopening = %+v", got)
+			}
+			assertList(t, b, "/users/", []string{"alice"})
+		})
+	}
+}
+
+func mustPut(t *testing.T, b Backend, key string, value interface{}) {
+	t.Helper()
+	if err := b.Put(key, value); err != nil {
+		t.Fatalf("Put(%q) error = %v", key, err)
+	}
+}
+
+func assertList(t *testing.T, b Backend, prefix string, want []string) {
+	t.Helper()
+	got, err := b.List(prefix)
+	if err != nil {
+		t.Fatalf("List(%q) error = %v", prefix, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("List(%q) = %v, want %v", prefix, got, want)
+	}
+}
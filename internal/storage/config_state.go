@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+//ConfigState is the set of users, clients, scopes and service providers defined by the configuration
+type ConfigState struct {
+	Users            []*User
+	Clients          []*Client
+	Scopes           []*Scope
+	ServiceProviders []*ServiceProvider
+}
+
+//configIDs tracks which entities were created from the configuration,
+//so that they can be told apart from the ones created at runtime (e.g. through SCIM)
+//it is stored in the backend, so that a restart with a persistent backend still prunes them
+type configIDs struct {
+	Users            map[string]bool `json:"users"`
+	Clients          map[string]bool `json:"clients"`
+	Scopes           map[string]bool `json:"scopes"`
+	ServiceProviders map[string]bool `json:"serviceProviders"`
+	//UserDigests are the digests of the users as the configuration defined them,
+	//a stored user with another digest was changed at runtime
+	UserDigests map[string]string `json:"userDigests,omitempty"`
+}
+
+//ReplaceConfig atomically replaces the entities of the previously applied configuration by the given ones
+//entities removed from the configuration are deleted, while entities created at runtime are kept
+//tokens, refresh tokens, auth requests and consents are kept unless their user or client was removed
+//the configuration overrides the changes made at runtime (e.g. through SCIM) to the users it defines,
+//the IDs of those users are returned so that the override can be reported
+func (s *Storage) ReplaceConfig(state *ConfigState) ([]string, error) {
+	ids := configIDs{
+		Users:            make(map[string]bool, len(state.Users)),
+		UserDigests:      make(map[string]string, len(state.Users)),
+		Clients:          make(map[string]bool, len(state.Clients)),
+		Scopes:           make(map[string]bool, len(state.Scopes)),
+		ServiceProviders: make(map[string]bool, len(state.ServiceProviders)),
+	}
+	for _, u := range state.Users {
+		ids.Users[u.ID] = true
+	}
+	for _, c := range state.Clients {
+		ids.Clients[c.ID] = true
+	}
+	for _, scope := range state.Scopes {
+		ids.Scopes[scope.Name] = true
+	}
+	for _, sp := range state.ServiceProviders {
+		ids.ServiceProviders[sp.ID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var overridden []string
+	err := s.backend.Batch(func(b Backend) error {
+		overridden = nil
+		previous := configIDs{}
+		if err := b.Get(keyConfigIDs, &previous); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		removedUsers := map[string]bool{}
+		for id := range previous.Users {
+			if !ids.Users[id] {
+				removedUsers[id] = true
+				if err := deleteUser(b, id); err != nil {
+					return err
+				}
+			}
+		}
+		removedClients := map[string]bool{}
+		for id := range previous.Clients {
+			if !ids.Clients[id] {
+				removedClients[id] = true
+				if err := b.Delete(keyClients + id); err != nil {
+					return err
+				}
+			}
+		}
+		for name := range previous.Scopes {
+			if !ids.Scopes[name] {
+				if err := b.Delete(keyScopes + name); err != nil {
+					return err
+				}
+			}
+		}
+		for id := range previous.ServiceProviders {
+			if !ids.ServiceProviders[id] {
+				if err := deleteServiceProvider(b, id); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, u := range state.Users {
+			if digest, ok := previous.UserDigests[u.ID]; ok {
+				changed, err := userChanged(b, u.ID, digest)
+				if err != nil {
+					return err
+				}
+				if changed {
+					overridden = append(overridden, u.ID)
+				}
+			}
+			if err := putUser(b, u.ID, u); err != nil {
+				return err
+			}
+			digest, err := userDigest(u)
+			if err != nil {
+				return err
+			}
+			ids.UserDigests[u.ID] = digest
+		}
+		for _, c := range state.Clients {
+			if err := b.Put(keyClients+c.ID, c); err != nil {
+				return err
+			}
+		}
+		for _, scope := range state.Scopes {
+			if err := b.Put(keyScopes+scope.Name, scope); err != nil {
+				return err
+			}
+		}
+		for _, sp := range state.ServiceProviders {
+			if err := putServiceProvider(b, sp.ID, sp); err != nil {
+				return err
+			}
+		}
+
+		if err := pruneOrphans(b, removedUsers, removedClients); err != nil {
+			return err
+		}
+		return b.Put(keyConfigIDs, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(overridden)
+	return overridden, nil
+}
+
+//userChanged reports whether the stored user no longer has the digest the configuration defined it with,
+//deleting it counts as a change
+func userChanged(b Backend, id, digest string) (bool, error) {
+	u := &User{}
+	if err := b.Get(keyUsers+id, u); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	stored, err := userDigest(u)
+	if err != nil {
+		return false, err
+	}
+	return stored != digest, nil
+}
+
+//userDigest is the SHA-256 digest of the JSON encoding of the user
+func userDigest(u *User) (string, error) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//pruneOrphans deletes the runtime objects whose owner disappeared
+func pruneOrphans(b Backend, removedUsers, removedClients map[string]bool) error {
+	if len(removedUsers) == 0 && len(removedClients) == 0 {
+		return nil
+	}
+	orphaned := func(userID, clientID string) bool {
+		return removedUsers[userID] || removedClients[clientID]
+	}
+
+	tokens, err := getAll[Token](b, keyTokens)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if orphaned(t.Subject, t.ApplicationID) {
+			if err := deleteToken(b, t); err != nil {
+				return err
+			}
+		}
+	}
+	refreshTokens, err := getAll[RefreshToken](b, keyRefreshTokens)
+	if err != nil {
+		return err
+	}
+	for _, t := range refreshTokens {
+		if orphaned(t.UserID, t.ApplicationID) {
+			if err := deleteRefreshToken(b, t); err != nil {
+				return err
+			}
+		}
+	}
+	authRequests, err := getAll[AuthRequest](b, keyAuthRequests)
+	if err != nil {
+		return err
+	}
+	for _, r := range authRequests {
+		if orphaned(r.UserID, r.ApplicationID) {
+			if err := deleteAuthRequest(b, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	sessions, err := getAll[Session](b, keySessions)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if removedUsers[session.UserID] {
+			if err := b.Delete(keySessions + session.ID); err != nil {
+				return err
+			}
+		}
+	}
+	consents, err := getAll[Consent](b, keyConsents)
+	if err != nil {
+		return err
+	}
+	for _, c := range consents {
+		if orphaned(c.UserID, c.ClientID) {
+			if err := b.Delete(consentKey(c.UserID, c.ClientID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplaceConfigOverriddenUsers(t *testing.T) {
+	config := func() *ConfigState {
+		return &ConfigState{Users: []*User{
+			{ID: "user1", Username: "user1", Email: "user1@example.com"},
+			{ID: "user2", Username: "user2", Email: "user2@example.com"},
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *Storage) error
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(s *Storage) error { return nil },
+		},
+		{
+			name: "changed at runtime",
+			change: func(s *Storage) error {
+				return s.PutUser("user2", &User{ID: "user2", Username: "user2", Email: "changed@example.com"})
+			},
+			want: []string{"user2"},
+		},
+		{
+			name:   "deleted at runtime",
+			change: func(s *Storage) error { return s.DeleteUser("user1") },
+			want:   []string{"user1"},
+		},
+		{
+			name: "created at runtime",
+			change: func(s *Storage) error {
+				return s.PutUser("user3", &User{ID: "user3", Username: "user3"})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStorage()
+			overridden, err := s.ReplaceConfig(config())
+			if err != nil {
+				t.Fatalf("ReplaceConfig() error = %v", err)
+			}
+			if len(overridden) != 0 {
+				t.Fatalf("ReplaceConfig() = %v on the first load, want none", overridden)
+			}
+			if err := tt.change(s); err != nil {
+				t.Fatalf("change error = %v", err)
+			}
+
+			overridden, err = s.ReplaceConfig(config())
+			if err != nil {
+				t.Fatalf("ReplaceConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(overridden, tt.want) {
+				t.Errorf("ReplaceConfig() = %v, want %v", overridden, tt.want)
+			}
+			for _, u := range config().Users {
+				got, err := s.GetUserByID(u.ID)
+				if err != nil {
+					t.Fatalf("GetUserByID() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, u) {
+					t.Errorf("GetUserByID() = %+v, want the configured %+v", got, u)
+				}
+			}
+		})
+	}
+}
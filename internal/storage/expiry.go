@@ -0,0 +1,88 @@
+package storage
+
+import "time"
+
+//AuthRequestLifetime is how long an auth request waits for the user to log in and the client to exchange its code
+const AuthRequestLifetime = time.Hour
+
+//DeleteExpired deletes the access tokens, refresh tokens, auth requests and their codes, sessions,
+//device codes and pushed authorization requests that expired, so that the backend does not grow without bound
+//the ended sessions are deleted without calling the session listeners, their tokens expire on their own
+func (s *Storage) DeleteExpired() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	return s.backend.Batch(func(b Backend) error {
+		tokens, err := getAll[Token](b, keyTokens)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if now.After(t.Expiration) {
+				if err := deleteToken(b, t); err != nil {
+					return err
+				}
+			}
+		}
+		refreshTokens, err := getAll[RefreshToken](b, keyRefreshTokens)
+		if err != nil {
+			return err
+		}
+		for _, t := range refreshTokens {
+			if now.After(t.Expiration) {
+				if err := deleteRefreshToken(b, t); err != nil {
+					return err
+				}
+				if err := deleteAccessTokensOf(b, t.ID); err != nil {
+					return err
+				}
+			}
+		}
+		authRequests, err := getAll[AuthRequest](b, keyAuthRequests)
+		if err != nil {
+			return err
+		}
+		for _, r := range authRequests {
+			if now.After(r.CreationDate.Add(AuthRequestLifetime)) {
+				if err := deleteAuthRequest(b, r.ID); err != nil {
+					return err
+				}
+			}
+		}
+		sessions, err := getAll[Session](b, keySessions)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if now.After(session.Expiration) {
+				if err := b.Delete(keySessions + session.ID); err != nil {
+					return err
+				}
+			}
+		}
+		ds, err := getAll[DeviceAuthorization](b, keyDeviceCodes)
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			if now.After(d.Expiration) {
+				if err := deleteDeviceAuthorization(b, d); err != nil {
+					return err
+				}
+			}
+		}
+		ps, err := getAll[PushedRequest](b, keyPushedRequests)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			if now.After(p.Expiration) {
+				if err := b.Delete(keyPushedRequests + p.RequestURI); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeleteExpired(t *testing.T) {
+	s := newSessionStorage(t)
+	past := time.Now().Add(-time.Minute)
+
+	expired, err := accessToken(s.backend, "app", "", "alice", nil, nil)
+	if err != nil {
+		t.Fatalf("accessToken() error = %v", err)
+	}
+	expired.Expiration = past
+	if err := putToken(s.backend, expired); err != nil {
+		t.Fatalf("putToken() error = %v", err)
+	}
+	valid, err := accessToken(s.backend, "app", "", "alice", nil, nil)
+	if err != nil {
+		t.Fatalf("accessToken() error = %v", err)
+	}
+
+	refreshed, err := accessToken(s.backend, "app", "refresh-1", "alice", nil, nil)
+	if err != nil {
+		t.Fatalf("accessToken() error = %v", err)
+	}
+	if _, err := createRefreshToken(s.backend, refreshed, nil, past, ""); err != nil {
+		t.Fatalf("createRefreshToken() error = %v", err)
+	}
+	refreshToken, err := refreshTokenByID(s.backend, "refresh-1")
+	if err != nil {
+		t.Fatalf("refreshTokenByID() error = %v", err)
+	}
+	refreshToken.Expiration = past
+	if err := putRefreshToken(s.backend, refreshToken); err != nil {
+		t.Fatalf("putRefreshToken() error = %v", err)
+	}
+
+	abandoned := &AuthRequest{ID: "abandoned", ApplicationID: "app", CreationDate: time.Now().Add(-AuthRequestLifetime - time.Minute)}
+	pending := &AuthRequest{ID: "pending", ApplicationID: "app", CreationDate: time.Now()}
+	for _, r := range []*AuthRequest{abandoned, pending} {
+		if err := s.backend.Put(keyAuthRequests+r.ID, r); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+		if err := s.SaveAuthCode(context.Background(), r.ID, "code-"+r.ID); err != nil {
+			t.Fatalf("SaveAuthCode() error = %v", err)
+		}
+	}
+
+	if err := s.DeleteExpired(); err != nil {
+		t.Fatalf("DeleteExpired() error = %v", err)
+	}
+
+	for _, id := range []string{expired.ID, refreshed.ID} {
+		if err := s.backend.Get(keyTokens+id, &Token{}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("access token %s error = %v, want ErrNotFound", id, err)
+		}
+	}
+	if err := s.backend.Get(keyTokens+valid.ID, &Token{}); err != nil {
+		t.Errorf("access token %s error = %v, want it kept", valid.ID, err)
+	}
+	if _, err := refreshTokenByID(s.backend, "refresh-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("refresh token error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.AuthRequestByCode(context.Background(), "code-abandoned"); err == nil {
+		t.Errorf("AuthRequestByCode() of the abandoned auth request succeeded")
+	}
+	if _, err := s.AuthRequestByCode(context.Background(), "code-pending"); err != nil {
+		t.Errorf("AuthRequestByCode() of the pending auth request error = %v", err)
+	}
+	//the index entries are deleted along with the tokens
+	assertList(t, s.backend, indexKey(keyTokensByGrant, "app", "alice")+"/", []string{valid.ID})
+	assertList(t, s.backend, keyRefreshTokensByID, []string{})
+}
+
+func TestTerminateSessionOnlyDeletesTheTokensOfTheGrant(t *testing.T) {
+	s := newSessionStorage(t)
+	grants := []struct{ clientID, userID string }{
+		{"app", "alice"},
+		{"app", "bob"},
+		{"other", "alice"},
+	}
+	ids := make([]string, len(grants))
+	for i, g := range grants {
+		token, err := accessToken(s.backend, g.clientID, "refresh-"+g.clientID+"-"+g.userID, g.userID, nil, nil)
+		if err != nil {
+			t.Fatalf("accessToken() error = %v", err)
+		}
+		if _, err := createRefreshToken(s.backend, token, nil, time.Now(), ""); err != nil {
+			t.Fatalf("createRefreshToken() error = %v", err)
+		}
+		ids[i] = token.ID
+	}
+
+	if err := s.TerminateSession(context.Background(), "alice", "app"); err != nil {
+		t.Fatalf("TerminateSession() error = %v", err)
+	}
+
+	for i, g := range grants {
+		terminated := g.clientID == "app" && g.userID == "alice"
+		err := s.backend.Get(keyTokens+ids[i], &Token{})
+		if terminated != errors.Is(err, ErrNotFound) {
+			t.Errorf("access token of %s to %s error = %v, terminated %v", g.userID, g.clientID, err, terminated)
+		}
+		_, err = refreshTokenByID(s.backend, "refresh-"+g.clientID+"-"+g.userID)
+		if terminated != errors.Is(err, ErrNotFound) {
+			t.Errorf("refresh token of %s to %s error = %v, terminated %v", g.userID, g.clientID, err, terminated)
+		}
+	}
+}
+
+func TestLoginAfterUsernameChange(t *testing.T) {
+	s := newSessionStorage(t)
+	u, err := s.GetUserByID("alice")
+	if err != nil {
+		t.Fatalf("GetUserByID() error = %v", err)
+	}
+	u.Username = "alice2"
+	if err := s.PutUser(u.ID, u); err != nil {
+		t.Fatalf("PutUser() error = %v", err)
+	}
+
+	if _, err := s.CreateSession("alice", "alice-password", ""); err == nil {
+		t.Errorf("CreateSession() with the previous username succeeded")
+	}
+	if _, err := s.CreateSession("alice2", "alice-password", ""); err != nil {
+		t.Errorf("CreateSession() with the new username error = %v", err)
+	}
+	if err := s.DeleteUser(u.ID); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	if _, err := s.CreateSession("alice2", "alice-password", ""); err == nil {
+		t.Errorf("CreateSession() of a deleted user succeeded")
+	}
+}
@@ -0,0 +1,10 @@
+package storage
+
+//Group represents a named set of users
+//membership is kept on the user itself (see User.Groups) so that SAML sessions and OIDC claims
+//keep working with plain group names
+type Group struct {
+	ID          string `json:"id,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	ExternalID  string `json:"externalId,omitempty"`
+}
@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+//keys of the indexes in the Backend, they are kept along the entities they point to,
+//so that finding the entities of a user or a client does not scan all of them
+const (
+	keyUsersByUsername            = "/index/users-by-username/"
+	keyServiceProvidersByEntityID = "/index/services-by-entity-id/"
+	keyTokensByGrant              = "/index/tokens-by-grant/"
+	keyTokensByRefreshToken       = "/index/tokens-by-refresh-token/"
+	keyRefreshTokensByGrant       = "/index/refresh-tokens-by-grant/"
+	keyRefreshTokensByID          = "/index/refresh-tokens-by-id/"
+	keyCodesByAuthRequest         = "/index/codes-by-auth-request/"
+	keyDeviceCodesByUserCode      = "/index/device-codes-by-user-code/"
+	keyIndexVersion               = "/index/version"
+)
+
+//indexVersion is bumped when the indexes change, so that EnsureIndexes rebuilds them
+const indexVersion = 2
+
+//indexKey returns the key of the index entry made of parts, which are escaped so that
+//one part can never be the prefix of another
+func indexKey(prefix string, parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = url.PathEscape(part)
+	}
+	return prefix + strings.Join(escaped, "/")
+}
+
+//EnsureIndexes rebuilds the indexes of a backend written before they existed, or by another version of them
+func (s *Storage) EnsureIndexes() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var version int
+	if err := s.backend.Get(keyIndexVersion, &version); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if version == indexVersion {
+		return nil
+	}
+	return s.backend.Batch(func(b Backend) error {
+		users, err := getAll[User](b, keyUsers)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err := putUser(b, u.ID, u); err != nil {
+				return err
+			}
+		}
+		sps, err := getAll[ServiceProvider](b, keyServiceProviders)
+		if err != nil {
+			return err
+		}
+		for _, sp := range sps {
+			if err := putServiceProvider(b, sp.ID, sp); err != nil {
+				return err
+			}
+		}
+		tokens, err := getAll[Token](b, keyTokens)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if err := putToken(b, t); err != nil {
+				return err
+			}
+		}
+		refreshTokens, err := getAll[RefreshToken](b, keyRefreshTokens)
+		if err != nil {
+			return err
+		}
+		for _, t := range refreshTokens {
+			if err := putRefreshToken(b, t); err != nil {
+				return err
+			}
+		}
+		codes, err := b.List(keyCodes)
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			var requestID string
+			if err := b.Get(keyCodes+code, &requestID); err != nil {
+				continue
+			}
+			if err := putCode(b, code, requestID); err != nil {
+				return err
+			}
+		}
+		ds, err := getAll[DeviceAuthorization](b, keyDeviceCodes)
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			if err := putDeviceAuthorization(b, d); err != nil {
+				return err
+			}
+		}
+		return b.Put(keyIndexVersion, indexVersion)
+	})
+}
+
+//putUser stores the user in id and indexes it by username
+func putUser(b Backend, id string, u *User) error {
+	old := &User{}
+	if err := b.Get(keyUsers+id, old); err == nil && old.Username != u.Username {
+		if err := deleteUsernameIndex(b, id, old.Username); err != nil {
+			return err
+		}
+	}
+	if err := b.Put(keyUsers+id, u); err != nil {
+		return err
+	}
+	return b.Put(indexKey(keyUsersByUsername, u.Username), id)
+}
+
+//deleteUser deletes the user and its username from the index
+func deleteUser(b Backend, id string) error {
+	u := &User{}
+	if err := b.Get(keyUsers+id, u); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := deleteUsernameIndex(b, id, u.Username); err != nil {
+		return err
+	}
+	return b.Delete(keyUsers + id)
+}
+
+//deleteUsernameIndex deletes the username of the user id from the index, unless another user took it over
+func deleteUsernameIndex(b Backend, id, username string) error {
+	key := indexKey(keyUsersByUsername, username)
+	var indexed string
+	if err := b.Get(key, &indexed); err != nil || indexed != id {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+//userByUsername returns the user with the username
+func userByUsername(b Backend, username string) (*User, error) {
+	var id string
+	if err := b.Get(indexKey(keyUsersByUsername, username), &id); err != nil {
+		return nil, err
+	}
+	u := &User{}
+	if err := b.Get(keyUsers+id, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+//putServiceProvider stores the service provider in id and indexes it by entity ID
+func putServiceProvider(b Backend, id string, sp *ServiceProvider) error {
+	old := &ServiceProvider{}
+	if err := b.Get(keyServiceProviders+id, old); err == nil && old.entityID() != sp.entityID() {
+		if err := deleteEntityIDIndex(b, id, old.entityID()); err != nil {
+			return err
+		}
+	}
+	if err := b.Put(keyServiceProviders+id, sp); err != nil {
+		return err
+	}
+	if sp.entityID() == "" {
+		return nil
+	}
+	return b.Put(indexKey(keyServiceProvidersByEntityID, sp.entityID()), id)
+}
+
+//deleteServiceProvider deletes the service provider and its entity ID from the index
+func deleteServiceProvider(b Backend, id string) error {
+	sp := &ServiceProvider{}
+	if err := b.Get(keyServiceProviders+id, sp); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := deleteEntityIDIndex(b, id, sp.entityID()); err != nil {
+		return err
+	}
+	return b.Delete(keyServiceProviders + id)
+}
+
+//deleteEntityIDIndex deletes the entity ID of the service provider id from the index, unless another one took it over
+func deleteEntityIDIndex(b Backend, id, entityID string) error {
+	if entityID == "" {
+		return nil
+	}
+	key := indexKey(keyServiceProvidersByEntityID, entityID)
+	var indexed string
+	if err := b.Get(key, &indexed); err != nil || indexed != id {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func (sp *ServiceProvider) entityID() string {
+	if sp.Metadata == nil {
+		return ""
+	}
+	return sp.Metadata.EntityID
+}
+
+//putToken stores the access token and indexes it by client and user, and by refresh token
+func putToken(b Backend, t *Token) error {
+	if err := b.Put(keyTokens+t.ID, t); err != nil {
+		return err
+	}
+	if err := b.Put(indexKey(keyTokensByGrant, t.ApplicationID, t.Subject, t.ID), t.ID); err != nil {
+		return err
+	}
+	if t.RefreshTokenID == "" {
+		return nil
+	}
+	return b.Put(indexKey(keyTokensByRefreshToken, t.RefreshTokenID, t.ID), t.ID)
+}
+
+//deleteToken deletes the access token and its index entries
+func deleteToken(b Backend, t *Token) error {
+	if err := b.Delete(indexKey(keyTokensByGrant, t.ApplicationID, t.Subject, t.ID)); err != nil {
+		return err
+	}
+	if t.RefreshTokenID != "" {
+		if err := b.Delete(indexKey(keyTokensByRefreshToken, t.RefreshTokenID, t.ID)); err != nil {
+			return err
+		}
+	}
+	return b.Delete(keyTokens + t.ID)
+}
+
+//indexedTokens returns the access tokens of the index entries starting with prefix
+func indexedTokens(b Backend, prefix string) ([]*Token, error) {
+	keys, err := b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]*Token, 0, len(keys))
+	for _, k := range keys {
+		var id string
+		if err := b.Get(prefix+k, &id); err != nil {
+			continue
+		}
+		t := &Token{}
+		if err := b.Get(keyTokens+id, t); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				//the token is gone, only its index entry was left behind
+				if err := b.Delete(prefix + k); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+//putRefreshToken stores the refresh token under its current token, and indexes it by client and user, and by ID
+func putRefreshToken(b Backend, t *RefreshToken) error {
+	if err := b.Put(keyRefreshTokens+t.Token, t); err != nil {
+		return err
+	}
+	if err := b.Put(indexKey(keyRefreshTokensByGrant, t.ApplicationID, t.UserID, t.ID), t.ID); err != nil {
+		return err
+	}
+	return b.Put(indexKey(keyRefreshTokensByID, t.ID), t.Token)
+}
+
+//deleteRefreshToken deletes the refresh token and its index entries
+func deleteRefreshToken(b Backend, t *RefreshToken) error {
+	if err := b.Delete(indexKey(keyRefreshTokensByGrant, t.ApplicationID, t.UserID, t.ID)); err != nil {
+		return err
+	}
+	if err := b.Delete(indexKey(keyRefreshTokensByID, t.ID)); err != nil {
+		return err
+	}
+	return b.Delete(keyRefreshTokens + t.Token)
+}
+
+//refreshTokenByID returns the refresh token with the id, whatever its current token is
+func refreshTokenByID(b Backend, id string) (*RefreshToken, error) {
+	var token string
+	if err := b.Get(indexKey(keyRefreshTokensByID, id), &token); err != nil {
+		return nil, err
+	}
+	t := &RefreshToken{}
+	if err := b.Get(keyRefreshTokens+token, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//putCode stores the code of the auth request and indexes it by auth request
+func putCode(b Backend, code, requestID string) error {
+	if err := b.Put(keyCodes+code, requestID); err != nil {
+		return err
+	}
+	return b.Put(indexKey(keyCodesByAuthRequest, requestID), code)
+}
+
+//deleteAuthRequest deletes the auth request and its code
+func deleteAuthRequest(b Backend, id string) error {
+	if err := b.Delete(keyAuthRequests + id); err != nil {
+		return err
+	}
+	key := indexKey(keyCodesByAuthRequest, id)
+	var code string
+	if err := b.Get(key, &code); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := b.Delete(keyCodes + code); err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+//putDeviceAuthorization stores the device authorization in its device code and indexes it by user code
+func putDeviceAuthorization(b Backend, d *DeviceAuthorization) error {
+	if err := b.Put(keyDeviceCodes+d.DeviceCode, d); err != nil {
+		return err
+	}
+	return b.Put(indexKey(keyDeviceCodesByUserCode, normalizeUserCode(d.UserCode)), d.DeviceCode)
+}
+
+//deleteDeviceAuthorization deletes the device authorization and its user code from the index
+func deleteDeviceAuthorization(b Backend, d *DeviceAuthorization) error {
+	key := indexKey(keyDeviceCodesByUserCode, normalizeUserCode(d.UserCode))
+	var indexed string
+	if err := b.Get(key, &indexed); err == nil && indexed == d.DeviceCode {
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+	return b.Delete(keyDeviceCodes + d.DeviceCode)
+}
@@ -10,15 +10,6 @@ import (
 	"github.com/zitadel/oidc/pkg/oidc"
 )
 
-const (
-	//CustomScope is an example for how to use custom scopes in this library
-	//(in this scenario, when requested, it will return a custom claim)
-	CustomScope = "custom_scope"
-
-	//CustomClaim is an example for how to return custom claims with this library
-	CustomClaim = "custom_claim"
-)
-
 type AuthRequest struct {
 	ID            string
 	CreationDate  time.Time
@@ -35,8 +26,12 @@ type AuthRequest struct {
 	Nonce         string
 	CodeChallenge *OIDCCodeChallenge
 
-	passwordChecked bool
-	authTime        time.Time
+	PasswordChecked bool
+	AuthTime        time.Time
+	//SessionID is the SID of the IdP session the user logged in with
+	SessionID string
+	//UserCode is set on the auth requests approving a device authorization, see DeviceAuthRequest
+	UserCode string
 }
 
 func (a *AuthRequest) GetID() string {
@@ -49,7 +44,7 @@ func (a *AuthRequest) GetACR() string {
 
 func (a *AuthRequest) GetAMR() []string {
 	//this example only uses password for authentication
-	if a.passwordChecked {
+	if a.PasswordChecked {
 		return []string{"pwd"}
 	}
 	return nil
@@ -60,7 +55,7 @@ func (a *AuthRequest) GetAudience() []string {
 }
 
 func (a *AuthRequest) GetAuthTime() time.Time {
-	return a.authTime
+	return a.AuthTime
 }
 
 func (a *AuthRequest) GetClientID() string {
@@ -99,12 +94,51 @@ func (a *AuthRequest) GetSubject() string {
 	return a.UserID
 }
 
+//GetSessionID returns the SID of the IdP session the user logged in with
+func (a *AuthRequest) GetSessionID() string {
+	return a.SessionID
+}
+
 func (a *AuthRequest) Done() bool {
-	return a.passwordChecked //this example only uses password for authentication
+	return a.PasswordChecked //this example only uses password for authentication
+}
+
+//PromptNone reports whether the user must not be prompted, the request can then only be completed with the IdP session
+func (a *AuthRequest) PromptNone() bool {
+	for _, prompt := range a.Prompt {
+		if prompt == oidc.PromptNone {
+			return true
+		}
+	}
+	return false
+}
+
+//SessionUsable reports whether the user can be logged in with the IdP session,
+//it cannot with prompt=login (max_age=0) nor when the user authenticated longer than max_age ago,
+//with prompt=select_account, since the login page is where the user picks the account,
+//and when the session is of another user than the id_token_hint
+func (a *AuthRequest) SessionUsable(session *Session) bool {
+	for _, prompt := range a.Prompt {
+		if prompt == oidc.PromptLogin || prompt == oidc.PromptSelectAccount {
+			return false
+		}
+	}
+	if a.MaxAuthAge != nil && time.Since(session.AuthTime) > *a.MaxAuthAge {
+		return false
+	}
+	if a.UserID != "" && a.UserID != session.UserID {
+		return false
+	}
+	return true
+}
+
+//DeviceUserCode returns the user code of the device authorization the auth request approves, "" for the auth requests of clients
+func (a *AuthRequest) DeviceUserCode() string {
+	return a.UserCode
 }
 
 func PromptToInternal(oidcPrompt oidc.SpaceDelimitedArray) []string {
-	prompts := make([]string, len(oidcPrompt))
+	prompts := make([]string, 0, len(oidcPrompt))
 	for _, oidcPrompt := range oidcPrompt {
 		switch oidcPrompt {
 		case oidc.PromptNone,
@@ -198,6 +232,11 @@ func (r *RefreshTokenRequest) GetSubject() string {
 	return r.UserID
 }
 
+//GetSessionID returns the SID of the IdP session the user logged in with
+func (r *RefreshTokenRequest) GetSessionID() string {
+	return r.SessionID
+}
+
 func (r *RefreshTokenRequest) SetCurrentScopes(scopes []string) {
 	r.Scopes = scopes
 }
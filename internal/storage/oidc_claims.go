@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+//ScopeGroups asserts the groups of the user, in the claim and format of the client
+const ScopeGroups = "groups"
+
+//GroupsFormat is how the groups of the user are asserted
+type GroupsFormat string
+
+const (
+	//GroupsFormatArray asserts the group names as an array
+	GroupsFormatArray GroupsFormat = "array"
+	//GroupsFormatString asserts the group names as a single comma separated string
+	GroupsFormatString GroupsFormat = "string"
+)
+
+//DefaultGroupsClaim is the name of the claim of the groups scope
+const DefaultGroupsClaim = "groups"
+
+//GroupsClaim is the claim a client gets the groups of the user in
+type GroupsClaim struct {
+	//Name is the name of the claim, DefaultGroupsClaim by default
+	Name string `json:"name,omitempty"`
+	//Format is GroupsFormatArray by default
+	Format GroupsFormat `json:"format,omitempty"`
+}
+
+//ClaimTarget is a token or response a mapped claim is asserted into
+type ClaimTarget string
+
+const (
+	ClaimTargetIDToken     ClaimTarget = "id_token"
+	ClaimTargetAccessToken ClaimTarget = "access_token"
+	ClaimTargetUserinfo    ClaimTarget = "userinfo"
+)
+
+//ClaimTargets are all the targets of a claim mapping, in the order of the configuration
+var ClaimTargets = []ClaimTarget{ClaimTargetIDToken, ClaimTargetAccessToken, ClaimTargetUserinfo}
+
+//ClaimMapping asserts an attribute of the user as a claim
+//the access token target covers the JWT access tokens and the introspection responses
+type ClaimMapping struct {
+	Claim string `json:"claim"`
+	//Attribute is the key of the attribute in User.Attributes, the claim name by default
+	Attribute string `json:"attribute,omitempty"`
+	//Value is asserted instead of an attribute when set
+	Value interface{} `json:"value,omitempty"`
+	//Targets are where the claim is asserted, everywhere by default
+	Targets []ClaimTarget `json:"targets,omitempty"`
+}
+
+func (m ClaimMapping) asserted(target ClaimTarget) bool {
+	if len(m.Targets) == 0 {
+		return true
+	}
+	for _, t := range m.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+//Scope is a scope of the configuration, asserting the claims it maps once granted
+type Scope struct {
+	Name   string         `json:"name"`
+	Claims []ClaimMapping `json:"claims,omitempty"`
+	//Clients are the clients allowed to request the scope, all of them when empty
+	Clients []string `json:"clients,omitempty"`
+	//Consent requires the user to consent to the scope before it is granted
+	Consent bool `json:"consent,omitempty"`
+}
+
+//allowed reports whether the client may request the scope
+func (s *Scope) allowed(clientID string) bool {
+	if len(s.Clients) == 0 {
+		return true
+	}
+	for _, id := range s.Clients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+//Scopes returns the scopes of the configuration
+func (s *Storage) Scopes() ([]*Scope, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return getAll[Scope](s.backend, keyScopes)
+}
+
+//allowedScopes returns the names of the scopes of the configuration the client may request
+func (s *Storage) allowedScopes(clientID string) (map[string]bool, error) {
+	scopes, err := getAll[Scope](s.backend, keyScopes)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		if scope.allowed(clientID) {
+			allowed[scope.Name] = true
+		}
+	}
+	return allowed, nil
+}
+
+//mappedClaims returns the groups of the user and the claims mapped from the user attributes by the granted scopes and then by the client for the target
+//the groups are only asserted with the groups scope, the attributes the user does not have are left out
+func (s *Storage) mappedClaims(user *User, clientID string, scopes []string, target ClaimTarget) (map[string]interface{}, error) {
+	var mappings []ClaimMapping
+	for _, name := range scopes {
+		scope := &Scope{}
+		if err := s.backend.Get(keyScopes+name, scope); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if scope.allowed(clientID) {
+			mappings = append(mappings, scope.Claims...)
+		}
+	}
+	var groupsClaim *GroupsClaim
+	if client, err := s.getClient(clientID); err == nil {
+		mappings = append(mappings, client.Claims...)
+		groupsClaim = client.GroupsClaim
+	}
+
+	var claims map[string]interface{}
+	for _, scope := range scopes {
+		if scope == ScopeGroups && len(user.Groups) > 0 {
+			name, value := groupsClaim.claim(user.Groups)
+			claims = appendClaim(claims, name, value)
+		}
+	}
+	for _, m := range mappings {
+		if !m.asserted(target) {
+			continue
+		}
+		if m.Value != nil {
+			claims = appendClaim(claims, m.Claim, m.Value)
+			continue
+		}
+		attribute := m.Attribute
+		if attribute == "" {
+			attribute = m.Claim
+		}
+		if value, ok := user.Attributes[attribute]; ok {
+			claims = appendClaim(claims, m.Claim, value)
+		}
+	}
+	return claims, nil
+}
+
+//claim returns the name and value of the claim of the groups, the client may have no GroupsClaim
+func (g *GroupsClaim) claim(groups []string) (string, interface{}) {
+	name, format := DefaultGroupsClaim, GroupsFormatArray
+	if g != nil && g.Name != "" {
+		name = g.Name
+	}
+	if g != nil && g.Format != "" {
+		format = g.Format
+	}
+	if format == GroupsFormatString {
+		return name, strings.Join(groups, ",")
+	}
+	return name, groups
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/zitadel/oidc/pkg/oidc"
 	"github.com/zitadel/oidc/pkg/op"
+	"gopkg.in/square/go-jose.v2"
 )
 
 var (
@@ -17,18 +18,40 @@ var (
 //Client represents the internal model of an OAuth/OIDC client
 //this could also be your database model
 type Client struct {
-	ID                             string             `json:"clientId,omitempty"`
-	Secret                         string             `json:"clientSecret,omitempty"`
-	ClientRedirectURIs             []string           `json:"redirectURIs,omitempty"`
-	ClientApplicationType          op.ApplicationType `json:"applicationType,omitempty"`
-	ClientAuthMethod               oidc.AuthMethod    `json:"authMethod,omitempty"`
-	loginURL                       func(string) string
-	ClientResponseTypes            []oidc.ResponseType `json:"responseTypes,omitempty"`
-	ClientGrantTypes               []oidc.GrantType    `json:"grantTypes,omitempty"`
-	ClientAccessTokenType          op.AccessTokenType  `json:"accessTokenType,omitempty"`
-	devMode                        bool
-	idTokenUserinfoClaimsAssertion bool
-	clockSkew                      time.Duration
+	ID                                   string             `json:"clientId,omitempty"`
+	Secret                               string             `json:"clientSecret,omitempty"`
+	ClientRedirectURIs                   []string           `json:"redirectURIs,omitempty"`
+	ClientPostLogoutRedirectURIs         []string           `json:"postLogoutRedirectURIs,omitempty"`
+	ClientApplicationType                op.ApplicationType `json:"applicationType,omitempty"`
+	ClientAuthMethod                     oidc.AuthMethod    `json:"authMethod,omitempty"`
+	loginURL                             func(string) string
+	ClientResponseTypes                  []oidc.ResponseType `json:"responseTypes,omitempty"`
+	ClientGrantTypes                     []oidc.GrantType    `json:"grantTypes,omitempty"`
+	ClientAccessTokenType                op.AccessTokenType  `json:"accessTokenType,omitempty"`
+	ClientDevMode                        bool                `json:"devMode,omitempty"`
+	ClientIDTokenUserinfoClaimsAssertion bool                `json:"idTokenUserinfoClaimsAssertion,omitempty"`
+	ClientClockSkew                      time.Duration       `json:"clockSkew,omitempty"`
+	ClientIDTokenSignedResponseAlg       string              `json:"idTokenSignedResponseAlg,omitempty"`
+	ClientRequirePushedRequests          bool                `json:"requirePushedAuthorizationRequests,omitempty"`
+	//FrontChannelLogoutURI is loaded by the browser of the user when the IdP session ends
+	FrontChannelLogoutURI string `json:"frontchannelLogoutURI,omitempty"`
+	//BackChannelLogoutURI receives a logout token when the IdP session of the user ends
+	BackChannelLogoutURI string `json:"backchannelLogoutURI,omitempty"`
+	//RequireConsent requires the user to consent to all the scopes requested by the client
+	RequireConsent bool `json:"requireConsent,omitempty"`
+	//Keys are the public keys of the client, used to verify its assertions (private_key_jwt)
+	Keys []jose.JSONWebKey `json:"keys,omitempty"`
+	//Claims are asserted for the client from the user attributes, on top of the claims of the granted scopes
+	Claims []ClaimMapping `json:"claims,omitempty"`
+	//GroupsClaim is the claim of the groups scope
+	GroupsClaim *GroupsClaim `json:"groupsClaim,omitempty"`
+	//ClientCredentials restricts the scopes and sets the audience of the client_credentials grant
+	ClientCredentials *ClientCredentials `json:"clientCredentials,omitempty"`
+	//TokenExchange is the policy of the client exchanging tokens
+	TokenExchange *TokenExchange `json:"tokenExchange,omitempty"`
+	SCIM          *SCIMTarget    `json:"scim,omitempty"`
+	//scopes are the scopes of the configuration the client may request, set when the client is read from the storage
+	scopes map[string]bool
 }
 
 //GetID must return the client_id
@@ -43,7 +66,7 @@ func (c *Client) RedirectURIs() []string {
 
 //PostLogoutRedirectURIs must return the registered post_logout_redirect_uris for sign-outs
 func (c *Client) PostLogoutRedirectURIs() []string {
-	return []string{}
+	return c.ClientPostLogoutRedirectURIs
 }
 
 //ApplicationType must return the type of the client (app, native, user agent)
@@ -70,6 +93,9 @@ func (c *Client) GrantTypes() []oidc.GrantType {
 //LoginURL will be called to redirect the user (agent) to the login UI
 //you could implement some logic here to redirect the users to different login UIs depending on the client
 func (c *Client) LoginURL(id string) string {
+	if c.loginURL == nil {
+		return defaultLoginURL(id)
+	}
 	return c.loginURL(id)
 }
 
@@ -85,7 +111,7 @@ func (c *Client) IDTokenLifetime() time.Duration {
 
 //DevMode enables the use of non-compliant configs such as redirect_uris (e.g. http schema for user agent client)
 func (c *Client) DevMode() bool {
-	return c.devMode
+	return c.ClientDevMode
 }
 
 //RestrictAdditionalIdTokenScopes allows specifying which custom scopes shall be asserted into the id_token
@@ -103,9 +129,9 @@ func (c *Client) RestrictAdditionalAccessTokenScopes() func(scopes []string) []s
 }
 
 //IsScopeAllowed enables Client specific custom scopes validation
-//in this example we allow the CustomScope for all clients
+//the groups scope is allowed for all clients, the scopes of the configuration for the clients they list
 func (c *Client) IsScopeAllowed(scope string) bool {
-	return scope == CustomScope
+	return scope == ScopeGroups || c.scopes[scope]
 }
 
 //IDTokenUserinfoClaimsAssertion allows specifying if claims of scope profile, email, phone and address are asserted into the id_token
@@ -113,13 +139,31 @@ func (c *Client) IsScopeAllowed(scope string) bool {
 //(5.4. Requesting Claims using Scope Values: https://openid.net/specs/openid-connect-core-1_0.html#ScopeClaims)
 //some clients though require that e.g. email is always in the id_token when requested even if an access_token is issued
 func (c *Client) IDTokenUserinfoClaimsAssertion() bool {
-	return c.idTokenUserinfoClaimsAssertion
+	return c.ClientIDTokenUserinfoClaimsAssertion
 }
 
 //ClockSkew enables clients to instruct the OP to apply a clock skew on the various times and expirations
 //(subtract from issued_at, add to expiration, ...)
 func (c *Client) ClockSkew() time.Duration {
-	return c.clockSkew
+	return c.ClientClockSkew
+}
+
+//IDTokenSignedResponseAlg returns the algorithm the client's id_tokens (and JWT access_tokens) are signed with
+func (c *Client) IDTokenSignedResponseAlg() string {
+	if c.ClientIDTokenSignedResponseAlg == "" {
+		return DefaultSigningAlgorithm
+	}
+	return c.ClientIDTokenSignedResponseAlg
+}
+
+//RequirePushedAuthorizationRequests is true when the client must push its authorization requests (RFC 9126)
+func (c *Client) RequirePushedAuthorizationRequests() bool {
+	return c.ClientRequirePushedRequests
+}
+
+//TokenExchangePolicy returns what the client may exchange tokens for, nil when it may not
+func (c *Client) TokenExchangePolicy() *TokenExchange {
+	return c.TokenExchange
 }
 
 //NativeClient will create a client of type native, which will always use PKCE and allow the use of refresh tokens
@@ -135,18 +179,18 @@ func NativeClient(id string, redirectURIs ...string) *Client {
 		}
 	}
 	return &Client{
-		ID:                             id,
-		Secret:                         "", //no secret needed (due to PKCE)
-		ClientRedirectURIs:             redirectURIs,
-		ClientApplicationType:          op.ApplicationTypeNative,
-		ClientAuthMethod:               oidc.AuthMethodNone,
-		loginURL:                       defaultLoginURL,
-		ClientResponseTypes:            []oidc.ResponseType{oidc.ResponseTypeCode},
-		ClientGrantTypes:               []oidc.GrantType{oidc.GrantTypeCode, oidc.GrantTypeRefreshToken},
-		ClientAccessTokenType:          op.AccessTokenTypeBearer,
-		devMode:                        false,
-		idTokenUserinfoClaimsAssertion: false,
-		clockSkew:                      0,
+		ID:                                   id,
+		Secret:                               "", //no secret needed (due to PKCE)
+		ClientRedirectURIs:                   redirectURIs,
+		ClientApplicationType:                op.ApplicationTypeNative,
+		ClientAuthMethod:                     oidc.AuthMethodNone,
+		loginURL:                             defaultLoginURL,
+		ClientResponseTypes:                  []oidc.ResponseType{oidc.ResponseTypeCode},
+		ClientGrantTypes:                     []oidc.GrantType{oidc.GrantTypeCode, oidc.GrantTypeRefreshToken},
+		ClientAccessTokenType:                op.AccessTokenTypeBearer,
+		ClientDevMode:                        false,
+		ClientIDTokenUserinfoClaimsAssertion: false,
+		ClientClockSkew:                      0,
 	}
 }
 
@@ -161,17 +205,44 @@ func WebClient(id, secret string, redirectURIs ...string) *Client {
 		}
 	}
 	return &Client{
-		ID:                             id,
-		Secret:                         secret,
-		ClientRedirectURIs:             redirectURIs,
-		ClientApplicationType:          op.ApplicationTypeWeb,
-		ClientAuthMethod:               oidc.AuthMethodBasic,
-		loginURL:                       defaultLoginURL,
-		ClientResponseTypes:            []oidc.ResponseType{oidc.ResponseTypeCode},
-		ClientGrantTypes:               []oidc.GrantType{oidc.GrantTypeCode, oidc.GrantTypeRefreshToken},
-		ClientAccessTokenType:          op.AccessTokenTypeBearer,
-		devMode:                        false,
-		idTokenUserinfoClaimsAssertion: false,
-		clockSkew:                      0,
+		ID:                                   id,
+		Secret:                               secret,
+		ClientRedirectURIs:                   redirectURIs,
+		ClientApplicationType:                op.ApplicationTypeWeb,
+		ClientAuthMethod:                     oidc.AuthMethodBasic,
+		loginURL:                             defaultLoginURL,
+		ClientResponseTypes:                  []oidc.ResponseType{oidc.ResponseTypeCode},
+		ClientGrantTypes:                     []oidc.GrantType{oidc.GrantTypeCode, oidc.GrantTypeRefreshToken},
+		ClientAccessTokenType:                op.AccessTokenTypeBearer,
+		ClientDevMode:                        false,
+		ClientIDTokenUserinfoClaimsAssertion: false,
+		ClientClockSkew:                      0,
+	}
+}
+
+//UserAgentClient will create a client of type user agent (single page application), which has no secret
+//and therefore must use PKCE
+//user-defined redirectURIs may include:
+// - http://localhost with port specification (e.g. http://localhost:3000/auth/callback)
+//(the example will be used as default, if none is provided)
+func UserAgentClient(id string, redirectURIs ...string) *Client {
+	if len(redirectURIs) == 0 {
+		redirectURIs = []string{
+			"http://localhost:3000/auth/callback",
+		}
+	}
+	return &Client{
+		ID:                                   id,
+		Secret:                               "", //no secret possible in the browser (due to PKCE)
+		ClientRedirectURIs:                   redirectURIs,
+		ClientApplicationType:                op.ApplicationTypeUserAgent,
+		ClientAuthMethod:                     oidc.AuthMethodNone,
+		loginURL:                             defaultLoginURL,
+		ClientResponseTypes:                  []oidc.ResponseType{oidc.ResponseTypeCode},
+		ClientGrantTypes:                     []oidc.GrantType{oidc.GrantTypeCode, oidc.GrantTypeRefreshToken},
+		ClientAccessTokenType:                op.AccessTokenTypeBearer,
+		ClientDevMode:                        false,
+		ClientIDTokenUserinfoClaimsAssertion: false,
+		ClientClockSkew:                      0,
 	}
 }
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+	"github.com/zitadel/oidc/pkg/op"
+)
+
+//ClientCredentials configures the tokens a client gets with the client_credentials grant
+type ClientCredentials struct {
+	//Scopes are the scopes the client may request, all of them are granted when it requests none
+	Scopes []string `json:"scopes,omitempty"`
+	//Audience is the audience of the tokens, the client_id by default
+	Audience []string `json:"audience,omitempty"`
+}
+
+//ClientCredentialsRequest implements the op.TokenRequest interface for the client_credentials grant
+//the client is the subject of its tokens
+type ClientCredentialsRequest struct {
+	ClientID string
+	Audience []string
+	Scopes   []string
+}
+
+func (r *ClientCredentialsRequest) GetSubject() string {
+	return r.ClientID
+}
+
+func (r *ClientCredentialsRequest) GetAudience() []string {
+	return r.Audience
+}
+
+func (r *ClientCredentialsRequest) GetScopes() []string {
+	return r.Scopes
+}
+
+//ClientCredentialsTokenRequest implements the op.ClientCredentialsStorage interface
+//it will be called for the client_credentials grant, once the client is authenticated
+func (s *Storage) ClientCredentialsTokenRequest(ctx context.Context, clientID string, scopes []string) (op.TokenRequest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, err := s.getClient(clientID)
+	if err != nil {
+		return nil, oidc.ErrInvalidClient().WithParent(err)
+	}
+	cc := client.ClientCredentials
+	if cc == nil {
+		cc = &ClientCredentials{}
+	}
+	allowed := make(map[string]bool, len(cc.Scopes))
+	for _, scope := range cc.Scopes {
+		allowed[scope] = true
+	}
+	if len(scopes) == 0 {
+		scopes = cc.Scopes
+	}
+	for _, scope := range scopes {
+		if !allowed[scope] {
+			return nil, oidc.ErrInvalidScope().WithDescription("scope %q is not allowed for client %s", scope, clientID)
+		}
+	}
+	audience := cc.Audience
+	if len(audience) == 0 {
+		audience = []string{clientID}
+	}
+	return &ClientCredentialsRequest{
+		ClientID: clientID,
+		Audience: audience,
+		Scopes:   scopes,
+	}, nil
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+)
+
+//Consent is the scopes a user granted to a client, remembered for the next authorization requests
+type Consent struct {
+	UserID    string    `json:"userId"`
+	ClientID  string    `json:"clientId"`
+	Scopes    []string  `json:"scopes"`
+	GrantedAt time.Time `json:"grantedAt"`
+}
+
+func consentKey(userID, clientID string) string {
+	return keyConsents + userID + "/" + clientID
+}
+
+//ConsentRequired reports whether the user of the auth request must consent to its scopes:
+//with prompt=consent, or when a scope requiring consent was not granted to the client yet
+//scopes of the configuration with consent require it, and all the scopes of the clients requiring consent
+func (s *Storage) ConsentRequired(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	request, err := s.getAuthRequest(id)
+	if err != nil {
+		return false, err
+	}
+	for _, prompt := range request.Prompt {
+		if prompt == oidc.PromptConsent {
+			return true, nil
+		}
+	}
+	client, err := s.getClient(request.ApplicationID)
+	if err != nil {
+		return false, err
+	}
+	consent := &Consent{}
+	if err := s.backend.Get(consentKey(request.UserID, request.ApplicationID), consent); err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	for _, name := range request.Scopes {
+		if name == oidc.ScopeOpenID || containsString(consent.Scopes, name) {
+			continue
+		}
+		if client.RequireConsent {
+			return true, nil
+		}
+		scope := &Scope{}
+		if err := s.backend.Get(keyScopes+name, scope); err == nil && scope.Consent {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//GrantConsent restricts the scopes of the auth request to the ones the user granted and remembers them for the client
+//the openid scope cannot be declined, it is kept when requested
+func (s *Storage) GrantConsent(id string, scopes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, err := s.getAuthRequest(id)
+	if err != nil {
+		return err
+	}
+	if !request.PasswordChecked {
+		return fmt.Errorf("the user is not logged in")
+	}
+	granted := make([]string, 0, len(request.Scopes))
+	for _, scope := range request.Scopes {
+		if scope == oidc.ScopeOpenID || containsString(scopes, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	request.Scopes = granted
+
+	key := consentKey(request.UserID, request.ApplicationID)
+	consent := &Consent{}
+	if err := s.backend.Get(key, consent); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	consent.UserID = request.UserID
+	consent.ClientID = request.ApplicationID
+	consent.GrantedAt = time.Now()
+	for _, scope := range granted {
+		if scope != oidc.ScopeOpenID && !containsString(consent.Scopes, scope) {
+			consent.Scopes = append(consent.Scopes, scope)
+		}
+	}
+	sort.Strings(consent.Scopes)
+
+	return s.backend.Batch(func(b Backend) error {
+		if err := b.Put(keyAuthRequests+request.ID, request); err != nil {
+			return err
+		}
+		return b.Put(key, consent)
+	})
+}
+
+//Consents returns the consents of the user, or of all users when userID is empty
+func (s *Storage) Consents(userID string) ([]*Consent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := keyConsents
+	if userID != "" {
+		prefix += userID + "/"
+	}
+	return getAll[Consent](s.backend, prefix)
+}
+
+//RevokeConsent forgets the scopes the user granted to the client, or to all clients when clientID is empty
+//it returns the revoked consents
+func (s *Storage) RevokeConsent(userID, clientID string) ([]*Consent, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("user is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revoked []*Consent
+	err := s.backend.Batch(func(b Backend) error {
+		consents, err := getAll[Consent](b, keyConsents+userID+"/")
+		if err != nil {
+			return err
+		}
+		for _, consent := range consents {
+			if clientID != "" && consent.ClientID != clientID {
+				continue
+			}
+			if err := b.Delete(consentKey(consent.UserID, consent.ClientID)); err != nil {
+				return err
+			}
+			revoked = append(revoked, consent)
+		}
+		return nil
+	})
+	return revoked, err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
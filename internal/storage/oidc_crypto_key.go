@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const keyCryptoKeys = "/oidc/crypto-keys/"
+
+//CryptoKeyGracePeriod is how long a replaced crypto key is still used to decrypt,
+//it outlives the codes and opaque access tokens it encrypted
+const CryptoKeyGracePeriod = 24 * time.Hour
+
+//CryptoKey is a 32-byte AES key the OP encrypts its codes and opaque access tokens with
+type CryptoKey struct {
+	//ID is derived from the key, it prefixes what the key encrypted so that the key can be found back
+	ID        string    `json:"id"`
+	Key       []byte    `json:"key"`
+	CreatedAt time.Time `json:"createdAt"`
+	//RetiredAt is set once the key was replaced, it is then only used to decrypt until the grace period ends
+	//retired keys are kept, so that a key configured again is not made current again
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+}
+
+//CryptoKeyIDLength is the length of CryptoKey.ID
+const CryptoKeyIDLength = 8
+
+//NewCryptoKey returns the crypto key of the 32 bytes
+func NewCryptoKey(key []byte) (*CryptoKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid crypto key of %d bytes, 32 are required", len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &CryptoKey{
+		ID:        hex.EncodeToString(sum[:])[:CryptoKeyIDLength],
+		Key:       key,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+//ParseCryptoKeys returns the keys of data, one per line, each encoded in hex or base64
+func ParseCryptoKeys(data string) ([][]byte, error) {
+	var keys [][]byte
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil {
+			key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(line, "="))
+		}
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("invalid crypto key, 32 bytes encoded in hex or base64 are required")
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no crypto key found")
+	}
+	return keys, nil
+}
+
+//ImportCryptoKey makes the key the current crypto key, unless it is already known
+//known keys are left untouched, so that a key rotated since a previous start is not replaced again
+func (s *Storage) ImportCryptoKey(key []byte) error {
+	ck, err := NewCryptoKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backend.Batch(func(b Backend) error {
+		if err := b.Get(keyCryptoKeys+ck.ID, &CryptoKey{}); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return replaceCryptoKey(b, ck)
+	})
+}
+
+//EnsureCryptoKey generates a crypto key when there is none yet
+func (s *Storage) EnsureCryptoKey() error {
+	if _, err := s.CurrentCryptoKey(); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err := s.RotateCryptoKey()
+	return err
+}
+
+//RotateCryptoKey generates a new crypto key, the current one is still used to decrypt during the grace period
+func (s *Storage) RotateCryptoKey() (*CryptoKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	ck, err := NewCryptoKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.backend.Batch(func(b Backend) error {
+		return replaceCryptoKey(b, ck)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ck, nil
+}
+
+//CurrentCryptoKey returns the key to encrypt with
+func (s *Storage) CurrentCryptoKey() (*CryptoKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys, err := getAll[CryptoKey](s.backend, keyCryptoKeys)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.RetiredAt == nil {
+			return k, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+//CryptoKeyByID returns the key to decrypt with, retired keys are only returned during their grace period
+func (s *Storage) CryptoKeyByID(id string) (*CryptoKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k := &CryptoKey{}
+	if err := s.backend.Get(keyCryptoKeys+id, k); err != nil {
+		return nil, err
+	}
+	if k.RetiredAt != nil && time.Since(*k.RetiredAt) > CryptoKeyGracePeriod {
+		return nil, ErrNotFound
+	}
+	return k, nil
+}
+
+//replaceCryptoKey makes ck the current crypto key and retires the previous one
+func replaceCryptoKey(b Backend, ck *CryptoKey) error {
+	keys, err := getAll[CryptoKey](b, keyCryptoKeys)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, k := range keys {
+		if k.RetiredAt == nil {
+			k.RetiredAt = &now
+			if err := b.Put(keyCryptoKeys+k.ID, k); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Put(keyCryptoKeys+ck.ID, ck)
+}
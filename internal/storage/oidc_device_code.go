@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zitadel/oidc/pkg/oidc"
+)
+
+//GrantTypeDeviceCode is the grant_type of the token requests of the Device Authorization Grant (RFC 8628)
+const GrantTypeDeviceCode oidc.GrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	//DeviceCodeLifetime is how long the user has to enter the user code
+	DeviceCodeLifetime = 10 * time.Minute
+	//DeviceCodeInterval is how long the device waits between two token requests
+	DeviceCodeInterval = 5 * time.Second
+
+	//userCodeAlphabet has no vowels, so that user codes do not spell words, and no lookalike characters
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+//the errors of a token request polling for a device code, the OP returns them as their RFC 8628 error codes
+var (
+	ErrAuthorizationPending = errors.New("the user has not completed the authorization yet")
+	ErrSlowDown             = errors.New("the device is polling too often")
+	ErrAccessDenied         = errors.New("the user denied the authorization")
+	ErrExpiredToken         = errors.New("the device code has expired")
+)
+
+//DeviceAuthorizationState is the state of a DeviceAuthorization
+type DeviceAuthorizationState string
+
+const (
+	DeviceAuthorizationPending  DeviceAuthorizationState = "pending"
+	DeviceAuthorizationApproved DeviceAuthorizationState = "approved"
+	DeviceAuthorizationDenied   DeviceAuthorizationState = "denied"
+)
+
+//DeviceAuthorization is a device code waiting for the user to enter its user code
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ClientID   string
+	Scopes     []string
+	Expiration time.Time
+	//Interval is how long the device must wait between two token requests, it grows each time the device polls too often
+	Interval time.Duration
+	LastPoll time.Time
+	State    DeviceAuthorizationState
+	UserID   string
+	AuthTime time.Time
+	//SessionID is the SID of the IdP session the user approved the device with
+	SessionID string
+}
+
+//AuthRequest returns the auth request the tokens of the approved device authorization are created from
+func (d *DeviceAuthorization) AuthRequest() *AuthRequest {
+	return &AuthRequest{
+		ID:              uuid.NewString(),
+		CreationDate:    time.Now(),
+		ApplicationID:   d.ClientID,
+		UserID:          d.UserID,
+		Scopes:          d.Scopes,
+		ResponseType:    oidc.ResponseTypeCode,
+		PasswordChecked: true,
+		AuthTime:        d.AuthTime,
+		SessionID:       d.SessionID,
+	}
+}
+
+//CreateDeviceAuthorization creates the device and user codes of a Device Authorization Request of the client
+func (s *Storage) CreateDeviceAuthorization(clientID string, scopes []string) (*DeviceAuthorization, error) {
+	deviceCode := make([]byte, 32)
+	if _, err := rand.Read(deviceCode); err != nil {
+		return nil, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+	d := &DeviceAuthorization{
+		DeviceCode: base64.RawURLEncoding.EncodeToString(deviceCode),
+		UserCode:   userCode,
+		ClientID:   clientID,
+		Scopes:     scopes,
+		Expiration: time.Now().Add(DeviceCodeLifetime),
+		Interval:   DeviceCodeInterval,
+		State:      DeviceAuthorizationPending,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//the device codes that were never polled again are deleted by DeleteExpired
+	if err := s.backend.Batch(func(b Backend) error {
+		return putDeviceAuthorization(b, d)
+	}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//DeviceAuthorizationByUserCode returns the pending device authorization of the user code, which is case and dash insensitive
+func (s *Storage) DeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return deviceAuthorizationByUserCode(s.backend, userCode)
+}
+
+//DeviceAuthRequest creates the auth request the user logs in and consents to the scopes of the device authorization with,
+//it is completed with ApproveDeviceAuthorization instead of redirecting to the client
+func (s *Storage) DeviceAuthRequest(userCode string) (*AuthRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := deviceAuthorizationByUserCode(s.backend, userCode)
+	if err != nil {
+		return nil, err
+	}
+	request := &AuthRequest{
+		ID:            uuid.NewString(),
+		CreationDate:  time.Now(),
+		ApplicationID: d.ClientID,
+		Scopes:        d.Scopes,
+		ResponseType:  oidc.ResponseTypeCode,
+		UserCode:      d.UserCode,
+	}
+	if err := s.backend.Put(keyAuthRequests+request.ID, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+//ApproveDeviceAuthorization authorizes the device of the auth request once the user is logged in and consented,
+//the device gets the scopes the user granted
+func (s *Storage) ApproveDeviceAuthorization(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, err := s.getAuthRequest(id)
+	if err != nil {
+		return err
+	}
+	if !request.PasswordChecked {
+		return fmt.Errorf("the user is not logged in")
+	}
+	d, err := deviceAuthorizationByUserCode(s.backend, request.UserCode)
+	if err != nil {
+		return err
+	}
+	d.State = DeviceAuthorizationApproved
+	d.UserID = request.UserID
+	d.AuthTime = request.AuthTime
+	d.SessionID = request.SessionID
+	d.Scopes = request.Scopes
+	return s.backend.Batch(func(b Backend) error {
+		if err := deleteAuthRequest(b, request.ID); err != nil {
+			return err
+		}
+		return putDeviceAuthorization(b, d)
+	})
+}
+
+//DenyDeviceAuthorization rejects the device of the user code
+func (s *Storage) DenyDeviceAuthorization(userCode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := deviceAuthorizationByUserCode(s.backend, userCode)
+	if err != nil {
+		return err
+	}
+	d.State = DeviceAuthorizationDenied
+	return s.backend.Batch(func(b Backend) error {
+		return putDeviceAuthorization(b, d)
+	})
+}
+
+//PollDeviceAuthorization is called by the token requests of the device, it returns the device authorization once approved
+//otherwise it returns ErrAuthorizationPending, ErrSlowDown, ErrAccessDenied or ErrExpiredToken
+//the device code can only be exchanged once, it is deleted once approved, denied or expired
+func (s *Storage) PollDeviceAuthorization(deviceCode, clientID string) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := &DeviceAuthorization{}
+	if err := s.backend.Get(keyDeviceCodes+deviceCode, d); err != nil || d.ClientID != clientID {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	now := time.Now()
+	switch {
+	case now.After(d.Expiration):
+		return nil, deleteDeviceCode(s.backend, d, ErrExpiredToken)
+	case d.State == DeviceAuthorizationApproved:
+		if err := deleteDeviceCode(s.backend, d, nil); err != nil {
+			return nil, err
+		}
+		return d, nil
+	case d.State == DeviceAuthorizationDenied:
+		return nil, deleteDeviceCode(s.backend, d, ErrAccessDenied)
+	}
+	tooSoon := !d.LastPoll.IsZero() && now.Sub(d.LastPoll) < d.Interval
+	d.LastPoll = now
+	if tooSoon {
+		//RFC 8628 3.5: the interval is increased by 5 seconds for this and all subsequent requests
+		d.Interval += 5 * time.Second
+	}
+	if err := s.backend.Put(keyDeviceCodes+deviceCode, d); err != nil {
+		return nil, err
+	}
+	if tooSoon {
+		return nil, ErrSlowDown
+	}
+	return nil, ErrAuthorizationPending
+}
+
+//deleteDeviceCode deletes the device code which can no longer be exchanged and returns the reason why
+func deleteDeviceCode(b Backend, d *DeviceAuthorization, reason error) error {
+	if err := b.Batch(func(b Backend) error {
+		return deleteDeviceAuthorization(b, d)
+	}); err != nil {
+		return err
+	}
+	return reason
+}
+
+//deviceAuthorizationByUserCode returns the pending device authorization of the user code
+func deviceAuthorizationByUserCode(b Backend, userCode string) (*DeviceAuthorization, error) {
+	var deviceCode string
+	if err := b.Get(indexKey(keyDeviceCodesByUserCode, normalizeUserCode(userCode)), &deviceCode); err != nil {
+		return nil, err
+	}
+	d := &DeviceAuthorization{}
+	if err := b.Get(keyDeviceCodes+deviceCode, d); err != nil {
+		return nil, err
+	}
+	if d.State != DeviceAuthorizationPending || !time.Now().Before(d.Expiration) {
+		return nil, ErrNotFound
+	}
+	return d, nil
+}
+
+//generateUserCode returns a code like BCDF-GHJK
+func generateUserCode() (string, error) {
+	var sb strings.Builder
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < userCodeLength; i++ {
+		if i == userCodeLength/2 {
+			sb.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zitadel/oidc/pkg/oidc"
+)
+
+func TestDeviceAuthorizationByUserCode(t *testing.T) {
+	s := newSessionStorage(t)
+	d, err := s.CreateDeviceAuthorization("tv", []string{oidc.ScopeOpenID, "calendar"})
+	if err != nil {
+		t.Fatalf("CreateDeviceAuthorization() error = %v", err)
+	}
+	if _, err := s.CreateDeviceAuthorization("tv", []string{oidc.ScopeOpenID}); err != nil {
+		t.Fatalf("CreateDeviceAuthorization() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		userCode string
+		wantErr  error
+	}{
+		{name: "as displayed", userCode: d.UserCode},
+		{name: "lower case", userCode: strings.ToLower(d.UserCode)},
+		{name: "without dash", userCode: strings.ReplaceAll(d.UserCode, "-", "")},
+		{name: "with spaces", userCode: strings.ReplaceAll(d.UserCode, "-", " ")},
+		{name: "unknown", userCode: "AAAA-AAAA", wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.DeviceAuthorizationByUserCode(tt.userCode)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DeviceAuthorizationByUserCode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.DeviceCode != d.DeviceCode {
+				t.Errorf("DeviceAuthorizationByUserCode() = %s, want %s", got.DeviceCode, d.DeviceCode)
+			}
+		})
+	}
+}
+
+func TestApproveDeviceAuthorization(t *testing.T) {
+	s := newSessionStorage(t)
+	d, err := s.CreateDeviceAuthorization("tv", []string{oidc.ScopeOpenID, "calendar", "contacts"})
+	if err != nil {
+		t.Fatalf("CreateDeviceAuthorization() error = %v", err)
+	}
+	request, err := s.DeviceAuthRequest(d.UserCode)
+	if err != nil {
+		t.Fatalf("DeviceAuthRequest() error = %v", err)
+	}
+	if err := s.ApproveDeviceAuthorization(request.ID); err == nil {
+		t.Fatalf("ApproveDeviceAuthorization() before the login succeeded")
+	}
+
+	session, err := s.CreateSession("alice", "alice-password", "")
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	if err := s.AuthorizeWithSession(request.ID, session); err != nil {
+		t.Fatalf("AuthorizeWithSession() error = %v", err)
+	}
+	if err := s.GrantConsent(request.ID, []string{"calendar"}); err != nil {
+		t.Fatalf("GrantConsent() error = %v", err)
+	}
+	if err := s.ApproveDeviceAuthorization(request.ID); err != nil {
+		t.Fatalf("ApproveDeviceAuthorization() error = %v", err)
+	}
+
+	//the user code cannot be entered again once the device is approved
+	if _, err := s.DeviceAuthorizationByUserCode(d.UserCode); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeviceAuthorizationByUserCode() after approval error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.getAuthRequest(request.ID); err == nil {
+		t.Errorf("the auth request of the device is kept after approval")
+	}
+
+	got, err := s.PollDeviceAuthorization(d.DeviceCode, "tv")
+	if err != nil {
+		t.Fatalf("PollDeviceAuthorization() error = %v", err)
+	}
+	if got.UserID != "alice" || got.SessionID != session.SID || !got.AuthTime.Equal(session.AuthTime) {
+		t.Errorf("PollDeviceAuthorization() = %+v, want alice logged in with session %s", got, session.SID)
+	}
+	if want := []string{oidc.ScopeOpenID, "calendar"}; !reflect.DeepEqual(got.Scopes, want) {
+		t.Errorf("PollDeviceAuthorization() scopes = %v, want the granted %v", got.Scopes, want)
+	}
+	//the device code and its user code are deleted once exchanged
+	assertList(t, s.backend, keyDeviceCodes, []string{})
+	assertList(t, s.backend, keyDeviceCodesByUserCode, []string{})
+}
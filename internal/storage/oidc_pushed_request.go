@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"time"
+)
+
+const (
+	//RequestURIPrefix is the prefix of the request_uri of the pushed authorization requests (RFC 9126 2.2)
+	RequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	//PushedRequestLifetime is how long the client has to send the user to the authorization endpoint
+	PushedRequestLifetime = 60 * time.Second
+)
+
+//ErrInvalidRequestURI is returned for the request_uri that are unknown, expired, already used or pushed by another client
+var ErrInvalidRequestURI = errors.New("the request_uri is invalid or has expired")
+
+//PushedRequest is an authorization request pushed by a client, waiting to be used at the authorization endpoint
+type PushedRequest struct {
+	RequestURI string
+	ClientID   string
+	//Params are the parameters of the authorization request
+	Params     url.Values
+	Expiration time.Time
+}
+
+//CreatePushedRequest stores the parameters of the authorization request pushed by the client
+func (s *Storage) CreatePushedRequest(clientID string, params url.Values) (*PushedRequest, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	p := &PushedRequest{
+		RequestURI: RequestURIPrefix + base64.RawURLEncoding.EncodeToString(id),
+		ClientID:   clientID,
+		Params:     params,
+		Expiration: time.Now().Add(PushedRequestLifetime),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//the pushed requests that were never used are deleted by DeleteExpired
+	if err := s.backend.Put(keyPushedRequests+p.RequestURI, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//UsePushedRequest returns the parameters of the authorization request pushed by the client, a request_uri can only be used once
+func (s *Storage) UsePushedRequest(requestURI, clientID string) (url.Values, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := keyPushedRequests + requestURI
+	p := &PushedRequest{}
+	if err := s.backend.Get(key, p); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrInvalidRequestURI
+		}
+		return nil, err
+	}
+	if p.ClientID != clientID {
+		return nil, ErrInvalidRequestURI
+	}
+	if err := s.backend.Delete(key); err != nil {
+		return nil, err
+	}
+	if time.Now().After(p.Expiration) {
+		return nil, ErrInvalidRequestURI
+	}
+	return p.Params, nil
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const keySigningKeys = "/oidc/signing-keys/"
+
+//DefaultSigningAlgorithm is the algorithm tokens are signed with, unless the client asks for another one
+const DefaultSigningAlgorithm = string(jose.RS256)
+
+//SigningAlgorithms are the algorithms there is always a signing key for
+var SigningAlgorithms = []string{DefaultSigningAlgorithm, string(jose.PS256), string(jose.ES256), string(jose.EdDSA)}
+
+//DefaultSigningKeyGracePeriod is how long a replaced signing key is still published in the JWKS,
+//so that the tokens it signed can still be verified
+const DefaultSigningKeyGracePeriod = 24 * time.Hour
+
+//SigningKey is a private key the OP signs tokens with
+type SigningKey struct {
+	//ID is the RFC 7638 thumbprint of the key, used as its `kid`
+	ID        string          `json:"id"`
+	Algorithm string          `json:"algorithm"`
+	Key       jose.JSONWebKey `json:"key"`
+	CreatedAt time.Time       `json:"createdAt"`
+	//RetiredAt is set once the key was replaced, it is then only used to verify tokens until the grace period ends
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+}
+
+type signingKeyListener struct {
+	ctx   context.Context
+	keyCh chan<- jose.SigningKey
+}
+
+//newSigningKey returns a signing key for the private key, with its thumbprint as kid
+func newSigningKey(alg string, key crypto.PrivateKey) (*SigningKey, error) {
+	jwk := jose.JSONWebKey{Key: key, Algorithm: alg, Use: "sig"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return &SigningKey{
+		ID:        jwk.KeyID,
+		Algorithm: alg,
+		Key:       jwk,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+//ParsePrivateKeys returns the private keys of the PEM blocks in data, in PKCS #1, PKCS #8 or SEC 1 form
+func ParsePrivateKeys(data []byte) ([]crypto.PrivateKey, error) {
+	var keys []crypto.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var (
+			key crypto.PrivateKey
+			err error
+		)
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no private key found")
+	}
+	return keys, nil
+}
+
+//signingAlgorithm returns the algorithm tokens are signed with for an imported key
+//RSA keys are used for RS256, PS256 keys are always generated
+func signingAlgorithm(key crypto.PrivateKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return string(jose.RS256), nil
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			return string(jose.ES256), nil
+		}
+		return "", fmt.Errorf("unsupported signing key curve %s, must be P-256", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return string(jose.EdDSA), nil
+	}
+	return "", fmt.Errorf("unsupported signing key type %T", key)
+}
+
+//generateSigningKey returns a new private key for the algorithm
+func generateSigningKey(alg string) (crypto.PrivateKey, error) {
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.RS256, jose.PS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jose.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.EdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+//SetSigningKeyGracePeriod sets how long replaced signing keys are still published
+func (s *Storage) SetSigningKeyGracePeriod(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.signingKeyGracePeriod = d
+}
+
+//ImportSigningKey makes the private key the current signing key, unless it is already known
+//known keys are left untouched, so that a key rotated since a previous start is not replaced again
+func (s *Storage) ImportSigningKey(key crypto.PrivateKey) error {
+	alg, err := signingAlgorithm(key)
+	if err != nil {
+		return err
+	}
+	sk, err := newSigningKey(alg, key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	err = s.backend.Get(keySigningKeys+sk.ID, &SigningKey{})
+	s.mu.Unlock()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return s.replaceSigningKey(sk)
+}
+
+//EnsureSigningKeys generates a signing key for each of the SigningAlgorithms there is none yet for
+func (s *Storage) EnsureSigningKeys() error {
+	for _, alg := range SigningAlgorithms {
+		s.mu.RLock()
+		_, err := s.currentSigningKey(alg)
+		s.mu.RUnlock()
+		if !errors.Is(err, ErrNotFound) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := s.RotateSigningKey(alg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//CurrentSigningKey returns the key tokens are currently signed with for the algorithm
+func (s *Storage) CurrentSigningKey(alg string) (*SigningKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.currentSigningKey(alg)
+}
+
+//RotateSigningKeys rotates the signing keys of all the SigningAlgorithms
+func (s *Storage) RotateSigningKeys() ([]*SigningKey, error) {
+	keys := make([]*SigningKey, 0, len(SigningAlgorithms))
+	for _, alg := range SigningAlgorithms {
+		key, err := s.RotateSigningKey(alg)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+//RotateSigningKey generates a new signing key for the algorithm and retires its current one
+func (s *Storage) RotateSigningKey(alg string) (*SigningKey, error) {
+	key, err := generateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := newSigningKey(alg, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.replaceSigningKey(sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+//replaceSigningKey makes sk the current signing key of its algorithm, retires the previous one,
+//deletes the keys whose grace period ended and hands sk to the signers of the OP
+func (s *Storage) replaceSigningKey(sk *SigningKey) error {
+	s.mu.Lock()
+	now := time.Now()
+	err := s.backend.Batch(func(b Backend) error {
+		keys, err := getAll[SigningKey](b, keySigningKeys)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			switch {
+			case k.RetiredAt == nil && k.Algorithm == sk.Algorithm:
+				k.RetiredAt = &now
+				if err := b.Put(keySigningKeys+k.ID, k); err != nil {
+					return err
+				}
+			case k.RetiredAt != nil && now.Sub(*k.RetiredAt) > s.signingKeyGracePeriod:
+				if err := b.Delete(keySigningKeys + k.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return b.Put(keySigningKeys+sk.ID, sk)
+	})
+	listeners := s.signingKeyListeners
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if sk.Algorithm != DefaultSigningAlgorithm {
+		return nil
+	}
+
+	for _, l := range listeners {
+		select {
+		case l.keyCh <- sk.joseSigningKey():
+		case <-l.ctx.Done():
+		}
+	}
+	return nil
+}
+
+//currentSigningKey returns the newest key of the algorithm that was not retired
+func (s *Storage) currentSigningKey(alg string) (*SigningKey, error) {
+	keys, err := getAll[SigningKey](s.backend, keySigningKeys)
+	if err != nil {
+		return nil, err
+	}
+	var current *SigningKey
+	for _, k := range keys {
+		if k.Algorithm == alg && k.RetiredAt == nil && (current == nil || k.CreatedAt.After(current.CreatedAt)) {
+			current = k
+		}
+	}
+	if current == nil {
+		return nil, ErrNotFound
+	}
+	return current, nil
+}
+
+//publishedSigningKeys returns the current signing keys and the retired keys still in their grace period, newest first
+func (s *Storage) publishedSigningKeys() ([]*SigningKey, error) {
+	keys, err := getAll[SigningKey](s.backend, keySigningKeys)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	published := make([]*SigningKey, 0, len(keys))
+	for _, k := range keys {
+		if k.RetiredAt == nil || now.Sub(*k.RetiredAt) <= s.signingKeyGracePeriod {
+			published = append(published, k)
+		}
+	}
+	sort.Slice(published, func(i, j int) bool {
+		return published[i].CreatedAt.After(published[j].CreatedAt)
+	})
+	return published, nil
+}
+
+func (k *SigningKey) joseSigningKey() jose.SigningKey {
+	return jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(k.Algorithm), //always tell the signer with algorithm to use
+		Key: jose.JSONWebKey{
+			KeyID: k.ID, //always give the key an id so, that it will include it in the token header as `kid` claim
+			Key:   k.Key.Key,
+		},
+	}
+}
+
+func (k *SigningKey) publicKey() jose.JSONWebKey {
+	return jose.JSONWebKey{
+		KeyID:     k.ID,
+		Algorithm: k.Algorithm,
+		Use:       "sig",
+		Key:       k.Key.Public().Key,
+	}
+}
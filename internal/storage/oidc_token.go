@@ -10,6 +10,8 @@ type Token struct {
 	Audience       []string
 	Expiration     time.Time
 	Scopes         []string
+	//Actor is set on the tokens issued by a token exchange with an actor token
+	Actor *TokenActor `json:",omitempty"`
 }
 
 type RefreshToken struct {
@@ -22,4 +24,6 @@ type RefreshToken struct {
 	ApplicationID string
 	Expiration    time.Time
 	Scopes        []string
+	//SessionID is the SID of the IdP session the user logged in with
+	SessionID string `json:",omitempty"`
 }
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+//TokenExchange is the policy of a client exchanging tokens (RFC 8693)
+type TokenExchange struct {
+	//Audience are the audiences and resources the client may exchange tokens for, all of them when it requests none
+	Audience []string `json:"audience,omitempty"`
+	//SubjectClients are the clients whose tokens the client may exchange, besides the tokens issued to or for itself
+	SubjectClients []string `json:"subjectClients,omitempty"`
+	//Impersonation allows exchanging a subject token without actor token, the new token is issued as the subject
+	Impersonation bool `json:"impersonation,omitempty"`
+	//Delegation allows exchanging a subject token with an actor token, the new token is issued to the subject with an act claim
+	Delegation bool `json:"delegation,omitempty"`
+	//ActorSubjects are the subjects whose tokens the client may present as actor token, besides the tokens issued to itself
+	ActorSubjects []string `json:"actorSubjects,omitempty"`
+}
+
+//TokenActor is the `act` claim of a delegated token, its nested actors are the prior actors
+type TokenActor struct {
+	Subject string      `json:"sub"`
+	Actor   *TokenActor `json:"act,omitempty"`
+}
+
+//TokenExchangeRequest implements the op.TokenRequest interface for the token exchange grant
+type TokenExchangeRequest struct {
+	ClientID string
+	Subject  string
+	Audience []string
+	Scopes   []string
+	Actor    *TokenActor
+}
+
+func (r *TokenExchangeRequest) GetSubject() string {
+	return r.Subject
+}
+
+func (r *TokenExchangeRequest) GetAudience() []string {
+	return r.Audience
+}
+
+func (r *TokenExchangeRequest) GetScopes() []string {
+	return r.Scopes
+}
+
+//AccessTokenByID returns the access token, unless it expired or was revoked
+func (s *Storage) AccessTokenByID(id string) (*Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token := &Token{}
+	if err := s.backend.Get(keyTokens+id, token); err != nil {
+		return nil, fmt.Errorf("token is invalid or has expired")
+	}
+	if time.Now().After(token.Expiration) {
+		return nil, fmt.Errorf("token is invalid or has expired")
+	}
+	return token, nil
+}
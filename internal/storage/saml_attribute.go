@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/crewjam/saml"
+)
+
+//UserField is a field of the user a SAML attribute mapping asserts
+type UserField string
+
+const (
+	UserFieldID        UserField = "id"
+	UserFieldUsername  UserField = "username"
+	UserFieldEmail     UserField = "email"
+	UserFieldFirstname UserField = "firstname"
+	UserFieldLastname  UserField = "lastname"
+	//UserFieldName is the first name and the last name of the user
+	UserFieldName   UserField = "name"
+	UserFieldGroups UserField = "groups"
+)
+
+//UserFields are all the fields of the user an attribute mapping can assert
+var UserFields = []UserField{UserFieldID, UserFieldUsername, UserFieldEmail, UserFieldFirstname, UserFieldLastname, UserFieldName, UserFieldGroups}
+
+const (
+	AttributeNameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	AttributeNameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	AttributeNameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+)
+
+//AttributeMapping asserts a field or an attribute of the user as an attribute of the SAML assertions of a service provider
+type AttributeMapping struct {
+	Name string `json:"name"`
+	//NameFormat is one of the AttributeNameFormat URNs
+	NameFormat   string `json:"nameFormat,omitempty"`
+	FriendlyName string `json:"friendlyName,omitempty"`
+	//Field is the field of the user asserted
+	Field UserField `json:"field,omitempty"`
+	//Attribute is the key of the attribute in User.Attributes, the attribute name by default
+	Attribute string `json:"attribute,omitempty"`
+	//Value is asserted instead of a field or an attribute when set
+	Value interface{} `json:"value,omitempty"`
+	//Join asserts the values of a multi-valued field or attribute as a single value joined with this separator,
+	//instead of one AttributeValue per value
+	Join string `json:"join,omitempty"`
+}
+
+//SAMLAttributes returns the attributes the service provider maps from the user,
+//the fields and attributes the user does not have are left out
+func (sp *ServiceProvider) SAMLAttributes(user *User) []saml.Attribute {
+	var attributes []saml.Attribute
+	for _, m := range sp.Attributes {
+		values := m.values(user)
+		if len(values) == 0 {
+			continue
+		}
+		if m.Join != "" {
+			values = []string{strings.Join(values, m.Join)}
+		}
+		attribute := saml.Attribute{
+			Name:         m.Name,
+			NameFormat:   m.NameFormat,
+			FriendlyName: m.FriendlyName,
+		}
+		for _, value := range values {
+			attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes
+}
+
+//values returns the values of the mapping for the user, an array is multi-valued
+func (m AttributeMapping) values(user *User) []string {
+	var value interface{}
+	switch {
+	case m.Value != nil:
+		value = m.Value
+	case m.Field != "":
+		value = user.field(m.Field)
+	default:
+		attribute := m.Attribute
+		if attribute == "" {
+			attribute = m.Name
+		}
+		value = user.Attributes[attribute]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func (u *User) field(field UserField) interface{} {
+	switch field {
+	case UserFieldID:
+		return u.ID
+	case UserFieldUsername:
+		return u.Username
+	case UserFieldEmail:
+		return u.Email
+	case UserFieldFirstname:
+		return u.Firstname
+	case UserFieldLastname:
+		return u.Lastname
+	case UserFieldName:
+		return strings.TrimSpace(u.Firstname + " " + u.Lastname)
+	case UserFieldGroups:
+		return u.Groups
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const keySAMLKeyPairs = "/saml/key-pairs/"
+
+//SAMLKeyPair is a private key and certificate the SAML IdP signs with
+type SAMLKeyPair struct {
+	//ID is the SHA-256 fingerprint of the certificate
+	ID string `json:"id"`
+	//Key is the PKCS #8 encoded private key
+	Key []byte `json:"key"`
+	//Certificate is the DER encoded certificate
+	Certificate []byte       `json:"certificate"`
+	State       SAMLKeyState `json:"state"`
+	CreatedAt   time.Time    `json:"createdAt"`
+}
+
+//SAMLKeyState is the state of a SAMLKeyPair during a rollover
+type SAMLKeyState string
+
+const (
+	//SAMLKeyCurrent is the key pair responses are signed with
+	SAMLKeyCurrent SAMLKeyState = "current"
+	//SAMLKeyNext is the key pair that will replace the current one, it is published in the metadata ahead of the rollover
+	SAMLKeyNext SAMLKeyState = "next"
+	//SAMLKeyRetired is a key pair that was replaced, it is kept so that it is not imported again
+	SAMLKeyRetired SAMLKeyState = "retired"
+)
+
+//SAMLKeyPairListener is called with the current and next (nil when there is none) key pairs after each change
+type SAMLKeyPairListener func(current, next *SAMLKeyPair)
+
+//NewSAMLKeyPair returns the key pair of the private key and its certificate
+//only RSA keys are supported by the XML signatures
+func NewSAMLKeyPair(key crypto.PrivateKey, cert *x509.Certificate) (*SAMLKeyPair, error) {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported SAML key type %T, an RSA key is required", key)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("the certificate does not match the private key")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &SAMLKeyPair{
+		ID:          hex.EncodeToString(fingerprint[:]),
+		Key:         der,
+		Certificate: cert.Raw,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+//GenerateSAMLKeyPair returns a new RSA key with a self-signed certificate for the host, valid for 10 years
+func GenerateSAMLKeyPair(host string) (*SAMLKeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"dev-identity-provider"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return NewSAMLKeyPair(key, cert)
+}
+
+//PrivateKey returns the parsed private key
+func (kp *SAMLKeyPair) PrivateKey() (crypto.PrivateKey, error) {
+	return x509.ParsePKCS8PrivateKey(kp.Key)
+}
+
+//X509Certificate returns the parsed certificate
+func (kp *SAMLKeyPair) X509Certificate() (*x509.Certificate, error) {
+	return x509.ParseCertificate(kp.Certificate)
+}
+
+//OnSAMLKeyPairChange registers a listener called after every change of the current or next SAML key pair
+func (s *Storage) OnSAMLKeyPairChange(l SAMLKeyPairListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samlKeyPairListeners = append(s.samlKeyPairListeners, l)
+}
+
+//SAMLKeyPairs returns the current and next SAML key pairs, next is nil outside of a rollover
+func (s *Storage) SAMLKeyPairs() (current, next *SAMLKeyPair, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return samlKeyPairs(s.backend)
+}
+
+//ImportSAMLKeyPair makes the key pair the current one, unless it is already known
+//known key pairs are left untouched, so that a key pair rolled over since a previous start is not replaced again
+func (s *Storage) ImportSAMLKeyPair(kp *SAMLKeyPair) error {
+	return s.updateSAMLKeyPairs(func(b Backend) error {
+		if err := b.Get(keySAMLKeyPairs+kp.ID, &SAMLKeyPair{}); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return promoteSAMLKeyPair(b, kp)
+	})
+}
+
+//EnsureSAMLKeyPair generates a self-signed key pair for the host when there is no current one yet
+func (s *Storage) EnsureSAMLKeyPair(host string) error {
+	current, _, err := s.SAMLKeyPairs()
+	if err != nil || current != nil {
+		return err
+	}
+	kp, err := GenerateSAMLKeyPair(host)
+	if err != nil {
+		return err
+	}
+	return s.updateSAMLKeyPairs(func(b Backend) error {
+		return promoteSAMLKeyPair(b, kp)
+	})
+}
+
+//PrepareSAMLKeyPair generates the next key pair for the host, replacing the previous next one if any
+func (s *Storage) PrepareSAMLKeyPair(host string) (*SAMLKeyPair, error) {
+	kp, err := GenerateSAMLKeyPair(host)
+	if err != nil {
+		return nil, err
+	}
+	kp.State = SAMLKeyNext
+	err = s.updateSAMLKeyPairs(func(b Backend) error {
+		_, next, err := samlKeyPairs(b)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			if err := b.Delete(keySAMLKeyPairs + next.ID); err != nil {
+				return err
+			}
+		}
+		return b.Put(keySAMLKeyPairs+kp.ID, kp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+//RolloverSAMLKeyPair makes the next key pair the current one, a key pair is generated for the host when there is no next one
+func (s *Storage) RolloverSAMLKeyPair(host string) (*SAMLKeyPair, error) {
+	_, next, err := s.SAMLKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		if next, err = GenerateSAMLKeyPair(host); err != nil {
+			return nil, err
+		}
+	}
+	err = s.updateSAMLKeyPairs(func(b Backend) error {
+		return promoteSAMLKeyPair(b, next)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+//updateSAMLKeyPairs runs fn in a batch and notifies the listeners of the resulting key pairs
+func (s *Storage) updateSAMLKeyPairs(fn func(b Backend) error) error {
+	s.mu.Lock()
+	var current, next *SAMLKeyPair
+	err := s.backend.Batch(func(b Backend) error {
+		if err := fn(b); err != nil {
+			return err
+		}
+		var err error
+		current, next, err = samlKeyPairs(b)
+		return err
+	})
+	listeners := s.samlKeyPairListeners
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		l(current, next)
+	}
+	return nil
+}
+
+//promoteSAMLKeyPair makes kp the current key pair and retires the previous one
+func promoteSAMLKeyPair(b Backend, kp *SAMLKeyPair) error {
+	current, _, err := samlKeyPairs(b)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		current.State = SAMLKeyRetired
+		if err := b.Put(keySAMLKeyPairs+current.ID, current); err != nil {
+			return err
+		}
+	}
+	kp.State = SAMLKeyCurrent
+	return b.Put(keySAMLKeyPairs+kp.ID, kp)
+}
+
+func samlKeyPairs(b Backend) (current, next *SAMLKeyPair, err error) {
+	kps, err := getAll[SAMLKeyPair](b, keySAMLKeyPairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, kp := range kps {
+		switch kp.State {
+		case SAMLKeyCurrent:
+			current = kp
+		case SAMLKeyNext:
+			next = kp
+		}
+	}
+	return current, next, nil
+}
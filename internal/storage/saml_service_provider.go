@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 
@@ -12,7 +13,12 @@ import (
 
 type ServiceProvider struct {
 	ID       string                 `json:"id,omitempty"`
-	Metadata *saml.EntityDescriptor `json:"-"`
+	Metadata *saml.EntityDescriptor `json:"metadata,omitempty"`
+	SCIM     *SCIMTarget            `json:"scim,omitempty"`
+	//Attributes are asserted instead of the default attributes when set
+	Attributes []AttributeMapping `json:"attributes,omitempty"`
+	//AllowUnsignedLogoutRequests accepts the LogoutRequests the service provider does not sign
+	AllowUnsignedLogoutRequests bool `json:"allowUnsignedLogoutRequests,omitempty"`
 }
 
 type ServiceProviderDetailed struct {
@@ -49,3 +55,51 @@ func NewMetadata(data []byte) (*saml.EntityDescriptor, error) {
 
 	return spMetadata, nil
 }
+
+//serviceProviderJSON is the stored form of a ServiceProvider, the metadata is kept as XML
+//since the saml.EntityDescriptor is only meant to be XML encoded
+type serviceProviderJSON struct {
+	ID       string      `json:"id,omitempty"`
+	Metadata string      `json:"metadata,omitempty"`
+	SCIM     *SCIMTarget `json:"scim,omitempty"`
+	//Attributes are asserted instead of the default attributes when set
+	Attributes []AttributeMapping `json:"attributes,omitempty"`
+
+	AllowUnsignedLogoutRequests bool `json:"allowUnsignedLogoutRequests,omitempty"`
+}
+
+func (sp ServiceProvider) MarshalJSON() ([]byte, error) {
+	v := serviceProviderJSON{
+		ID:                          sp.ID,
+		SCIM:                        sp.SCIM,
+		Attributes:                  sp.Attributes,
+		AllowUnsignedLogoutRequests: sp.AllowUnsignedLogoutRequests,
+	}
+	if sp.Metadata != nil {
+		b, err := xml.Marshal(sp.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		v.Metadata = string(b)
+	}
+	return json.Marshal(v)
+}
+
+func (sp *ServiceProvider) UnmarshalJSON(data []byte) error {
+	v := serviceProviderJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	sp.ID = v.ID
+	sp.SCIM = v.SCIM
+	sp.Attributes = v.Attributes
+	sp.AllowUnsignedLogoutRequests = v.AllowUnsignedLogoutRequests
+	sp.Metadata = nil
+	if v.Metadata != "" {
+		sp.Metadata = &saml.EntityDescriptor{}
+		if err := xml.Unmarshal([]byte(v.Metadata), sp.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
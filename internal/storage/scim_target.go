@@ -0,0 +1,13 @@
+package storage
+
+//SCIMTarget is the SCIM endpoint of a service provider or client that users are pushed to
+//the same way Okta or Azure AD provision users into applications
+type SCIMTarget struct {
+	//URL is the SCIM base URL of the target, the Users endpoint is at URL + "/Users"
+	URL string `json:"url,omitempty"`
+	//Token is sent as bearer token on every request
+	Token string `json:"token,omitempty"`
+}
+
+//UserListener is called after a user was put or deleted, u is nil for deletions
+type UserListener func(id string, u *User)
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	//SessionCookieName is the cookie of the IdP session, shared by the OIDC and SAML logins
+	SessionCookieName = "session"
+	//SessionLifetime is how long a user stays logged in to the IdP
+	SessionLifetime = time.Hour
+)
+
+//Session is the browser session of a user logged in to the IdP, both OIDC and SAML logins use it,
+//so that logging in once covers both protocols
+type Session struct {
+	//ID is the value of the session cookie, it must not be disclosed to anyone but the browser
+	ID     string
+	UserID string
+	//SID identifies the session to the OIDC clients in the sid claim of the ID tokens and in the logout notifications
+	SID string
+	//Index is the SessionIndex of the SAML assertions of the session
+	Index      string
+	AuthTime   time.Time
+	Expiration time.Time
+	//Clients are the OIDC clients the user logged in to with the session, they are notified when it ends
+	Clients []string `json:",omitempty"`
+	//ServiceProviders are the entity IDs of the SAML service providers the user logged in to with the session,
+	//they are sent a LogoutRequest when the user logs out of another one
+	ServiceProviders []string `json:",omitempty"`
+}
+
+//SessionListener is called after a session ended, with the OIDC clients the user logged in to with it
+type SessionListener func(session *Session, clients []*Client)
+
+//Cookie returns the cookie of the session, available to all the paths of the IdP
+func (s *Session) Cookie(secure bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    s.ID,
+		Expires:  s.Expiration,
+		HttpOnly: true,
+		Secure:   secure,
+		Path:     "/",
+	}
+}
+
+//ExpiredSessionCookie removes the cookie of the session from the browser
+func ExpiredSessionCookie(secure bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookieName,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+		Path:     "/",
+	}
+}
+
+type sessionIDKey struct{}
+
+//ContextWithSessionID returns a context asserting the SID of the session in the sid claim of the ID tokens created with it
+func ContextWithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+func sessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDKey{}).(string)
+	return sessionID
+}
+
+//CreateSession logs the user in with its username and password, and starts a new session
+//the session always gets a new ID, so that an ID planted in the browser before the login cannot be used after it
+//the previous session of the browser, if any, is carried over to the new ID when it is of the same user, which only authenticated again,
+//and ended otherwise
+func (s *Storage) CreateSession(username, password, previousID string) (*Session, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	index := make([]byte, 32)
+	if _, err := rand.Read(index); err != nil {
+		return nil, err
+	}
+	sid := make([]byte, 16)
+	if _, err := rand.Read(sid); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	user, err := s.checkUsernamePassword(username, password)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	now := time.Now()
+	session := &Session{
+		ID:         base64.RawURLEncoding.EncodeToString(id),
+		UserID:     user.ID,
+		SID:        hex.EncodeToString(sid),
+		Index:      hex.EncodeToString(index),
+		AuthTime:   now,
+		Expiration: now.Add(SessionLifetime),
+	}
+	var ended, replaced string
+	if previous, err := s.getSession(previousID); err == nil {
+		if previous.UserID == user.ID {
+			//the user stays logged in to the clients and service providers of the previous session
+			session.SID = previous.SID
+			session.Index = previous.Index
+			session.Clients = previous.Clients
+			session.ServiceProviders = previous.ServiceProviders
+			replaced = previous.ID
+		} else {
+			ended = previous.ID
+		}
+	}
+	err = s.backend.Batch(func(b Backend) error {
+		if replaced != "" {
+			//the previous session is not ended, its clients and service providers are not logged out
+			if err := b.Delete(keySessions + replaced); err != nil {
+				return err
+			}
+		}
+		return b.Put(keySessions+session.ID, session)
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if ended != "" {
+		if _, _, err := s.EndSession(ended); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+//SessionByID returns the session, unless it expired or its user was removed or disabled
+func (s *Storage) SessionByID(id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getSession(id)
+}
+
+//SessionFromRequest returns the session of the cookie of the request
+func (s *Storage) SessionFromRequest(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return s.SessionByID(cookie.Value)
+}
+
+//SessionBySID returns the session identified by the SID, which unlike its ID can be disclosed,
+//unless it expired or its user was removed or disabled
+func (s *Storage) SessionBySID(sid string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions, err := getAll[Session](s.backend, keySessions)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if session.SID == sid {
+			return s.getSession(session.ID)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+//Sessions returns the sessions that did not expire
+func (s *Storage) Sessions() ([]*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions, err := getAll[Session](s.backend, keySessions)
+	if err != nil {
+		return nil, err
+	}
+	valid := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		if _, err := s.getSession(session.ID); err == nil {
+			valid = append(valid, session)
+		}
+	}
+	return valid, nil
+}
+
+//DeleteSession logs the user of the session out of the IdP
+func (s *Storage) DeleteSession(id string) error {
+	_, _, err := s.EndSession(id)
+	return err
+}
+
+//EndSession logs the user of the session out of the IdP, and out of the OIDC clients the user logged in to with it:
+//their tokens of the user are deleted
+//it returns the ended session and its clients, which the session listeners are also called with
+func (s *Storage) EndSession(id string) (*Session, []*Client, error) {
+	s.mu.Lock()
+	session := &Session{}
+	var clients []*Client
+	err := s.backend.Batch(func(b Backend) error {
+		if err := b.Get(keySessions+id, session); err != nil {
+			return err
+		}
+		for _, clientID := range session.Clients {
+			if err := terminateTokens(b, session.UserID, clientID); err != nil {
+				return err
+			}
+			client := &Client{}
+			if err := b.Get(keyClients+clientID, client); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				return err
+			}
+			clients = append(clients, client)
+		}
+		return b.Delete(keySessions + id)
+	})
+	listeners := s.sessionListeners
+	s.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, l := range listeners {
+		l(session, clients)
+	}
+	return session, clients, nil
+}
+
+//OnSessionEnd registers a listener called after every ended session
+func (s *Storage) OnSessionEnd(l SessionListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessionListeners = append(s.sessionListeners, l)
+}
+
+//AuthorizeWithSession implements the `authenticate` interface of the login
+//it completes the login of the auth request with the user of the session
+func (s *Storage) AuthorizeWithSession(id string, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, err := s.getAuthRequest(id)
+	if err != nil {
+		return err
+	}
+	//the user id is set into the auth request so that you'll be able to get more information about the user after the login
+	request.UserID = session.UserID
+	request.SessionID = session.SID
+	request.AuthTime = session.AuthTime
+	//this boolean tells that the login is finished, the session was created after checking the password
+	request.PasswordChecked = true
+
+	stored := &Session{}
+	if err := s.backend.Get(keySessions+session.ID, stored); err != nil {
+		return err
+	}
+	return s.backend.Batch(func(b Backend) error {
+		if !containsString(stored.Clients, request.ApplicationID) {
+			stored.Clients = append(stored.Clients, request.ApplicationID)
+			if err := b.Put(keySessions+stored.ID, stored); err != nil {
+				return err
+			}
+		}
+		return b.Put(keyAuthRequests+request.ID, request)
+	})
+}
+
+//AddSessionServiceProvider records that the user logged in to the SAML service provider with the session
+func (s *Storage) AddSessionServiceProvider(id, entityID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := s.getSession(id)
+	if err != nil {
+		return err
+	}
+	if containsString(session.ServiceProviders, entityID) {
+		return nil
+	}
+	session.ServiceProviders = append(session.ServiceProviders, entityID)
+	return s.backend.Put(keySessions+session.ID, session)
+}
+
+func (s *Storage) getSession(id string) (*Session, error) {
+	session := &Session{}
+	if err := s.backend.Get(keySessions+id, session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expiration) {
+		return nil, ErrNotFound
+	}
+	user, err := s.getUser(session.UserID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("user %s is disabled: %w", user.ID, ErrNotFound)
+	}
+	return session, nil
+}
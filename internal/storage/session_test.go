@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newSessionStorage(t *testing.T) *Storage {
+	t.Helper()
+	s := NewStorage()
+	for _, u := range []*User{
+		{ID: "alice", Username: "alice", Password: "alice-password", Email: "alice@example.com"},
+		{ID: "bob", Username: "bob", Password: "bob-password", Email: "bob@example.com"},
+	} {
+		if err := s.PutUser(u.ID, u); err != nil {
+			t.Fatalf("PutUser() error = %v", err)
+		}
+	}
+	return s
+}
+
+func TestCreateSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		//carried is whether the clients and service providers of the previous session are carried over
+		carried bool
+		//ended is whether the previous session is ended, calling the session listeners
+		ended bool
+	}{
+		{name: "same user authenticates again", username: "alice", password: "alice-password", carried: true},
+		{name: "other user logs in", username: "bob", password: "bob-password", ended: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSessionStorage(t)
+			var endedSessions []string
+			s.OnSessionEnd(func(session *Session, clients []*Client) {
+				endedSessions = append(endedSessions, session.ID)
+			})
+
+			previous, err := s.CreateSession("alice", "alice-password", "")
+			if err != nil {
+				t.Fatalf("CreateSession() error = %v", err)
+			}
+			if err := s.AddSessionServiceProvider(previous.ID, "https://sp.example.com"); err != nil {
+				t.Fatalf("AddSessionServiceProvider() error = %v", err)
+			}
+
+			session, err := s.CreateSession(tt.username, tt.password, previous.ID)
+			if err != nil {
+				t.Fatalf("CreateSession() error = %v", err)
+			}
+			if session.ID == previous.ID {
+				t.Fatalf("CreateSession() kept the session ID %q of the previous session", previous.ID)
+			}
+			if _, err := s.SessionByID(previous.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("SessionByID(previous) error = %v, want ErrNotFound", err)
+			}
+			stored, err := s.SessionByID(session.ID)
+			if err != nil {
+				t.Fatalf("SessionByID() error = %v", err)
+			}
+
+			wantSPs := []string(nil)
+			if tt.carried {
+				wantSPs = []string{"https://sp.example.com"}
+			}
+			if !reflect.DeepEqual(stored.ServiceProviders, wantSPs) {
+				t.Errorf("ServiceProviders = %v, want %v", stored.ServiceProviders, wantSPs)
+			}
+			if sameIndex := stored.Index == previous.Index; sameIndex != tt.carried {
+				t.Errorf("Index = %q, previous Index = %q, want the same index %v", stored.Index, previous.Index, tt.carried)
+			}
+			if sameSID := stored.SID == previous.SID; sameSID != tt.carried {
+				t.Errorf("SID = %q, previous SID = %q, want the same SID %v", stored.SID, previous.SID, tt.carried)
+			}
+			if stored.SID == "" || stored.SID == stored.ID {
+				t.Errorf("SID = %q, want a value other than the session ID", stored.SID)
+			}
+			wantEnded := []string(nil)
+			if tt.ended {
+				wantEnded = []string{previous.ID}
+			}
+			if !reflect.DeepEqual(endedSessions, wantEnded) {
+				t.Errorf("ended sessions = %v, want %v", endedSessions, wantEnded)
+			}
+		})
+	}
+}
+
+func TestCreateSessionWrongPassword(t *testing.T) {
+	s := newSessionStorage(t)
+	previous, err := s.CreateSession("alice", "alice-password", "")
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	if _, err := s.CreateSession("alice", "wrong", previous.ID); err == nil {
+		t.Fatal("CreateSession() with a wrong password succeeded")
+	}
+	if _, err := s.SessionByID(previous.ID); err != nil {
+		t.Errorf("SessionByID(previous) error = %v, the failed login must keep the session", err)
+	}
+}
+
+func TestSessionBySID(t *testing.T) {
+	s := newSessionStorage(t)
+	session, err := s.CreateSession("alice", "alice-password", "")
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	got, err := s.SessionBySID(session.SID)
+	if err != nil {
+		t.Fatalf("SessionBySID() error = %v", err)
+	}
+	if got.ID != session.ID {
+		t.Errorf("SessionBySID() ID = %q, want %q", got.ID, session.ID)
+	}
+	if _, err := s.SessionBySID(session.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SessionBySID(ID) error = %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeleteSession(session.ID); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+	if _, err := s.SessionBySID(session.SID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SessionBySID() after DeleteSession() error = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteSession(session.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteSession() of an ended session error = %v, want ErrNotFound", err)
+	}
+}
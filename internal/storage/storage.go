@@ -2,8 +2,8 @@ package storage
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
@@ -29,38 +29,46 @@ var (
 	}
 )
 
+//keys of the entities in the Backend, each followed by the id of the entity
+const (
+	keyUsers            = "/users/"
+	keyGroups           = "/groups/"
+	keySessions         = "/sessions/"
+	keyClients          = "/oidc/clients/"
+	keyAuthRequests     = "/oidc/auth-requests/"
+	keyDeviceCodes      = "/oidc/device-codes/"
+	keyPushedRequests   = "/oidc/pushed-requests/"
+	keyScopes           = "/oidc/scopes/"
+	keyConsents         = "/oidc/consents/"
+	keyCodes            = "/oidc/codes/"
+	keyTokens           = "/oidc/tokens/"
+	keyRefreshTokens    = "/oidc/refresh-tokens/"
+	keyServiceProviders = "/saml/services/"
+	keyConfigIDs        = "/config/ids"
+)
+
 //Storage implements the op.Storage interface
-//typically you would implement this as a layer on top of your database
-//for simplicity this example keeps everything in-memory
+//it is a layer on top of a Backend, which either keeps everything in-memory or persists it on disk
 type Storage struct {
-	mu                         sync.RWMutex
-	authRequests               map[string]*AuthRequest
-	codes                      map[string]string
-	tokens                     map[string]*Token
-	clients                    map[string]*Client
-	users                      map[string]*User
-	services                   map[string]Service
-	serviceProviders           map[string]*ServiceProvider
-	serviceProvidersByEntityID map[string]*ServiceProvider
-	refreshTokens              map[string]*RefreshToken
-	signingKey                 signingKey
+	mu                    sync.RWMutex
+	backend               Backend
+	services              map[string]Service
+	signingKeyGracePeriod time.Duration
+	signingKeyListeners   []signingKeyListener
+	samlKeyPairListeners  []SAMLKeyPairListener
+	userListeners         []UserListener
+	sessionListeners      []SessionListener
 }
 
-type signingKey struct {
-	ID        string
-	Algorithm string
-	Key       *rsa.PrivateKey
+//NewStorage returns a Storage keeping everything in-memory
+func NewStorage() *Storage {
+	return NewStorageWithBackend(NewMemoryBackend())
 }
 
-func NewStorage() *Storage {
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
-	s := &Storage{
-		authRequests:  make(map[string]*AuthRequest),
-		codes:         make(map[string]string),
-		tokens:        make(map[string]*Token),
-		refreshTokens: make(map[string]*RefreshToken),
-		clients:       make(map[string]*Client),
-		users:         map[string]*User{},
+//NewStorageWithBackend returns a Storage keeping its users, clients, service providers, tokens and sessions in the backend
+func NewStorageWithBackend(backend Backend) *Storage {
+	return &Storage{
+		backend: backend,
 		services: map[string]Service{
 			"service": {
 				keys: map[string]*rsa.PublicKey{
@@ -68,158 +76,227 @@ func NewStorage() *Storage {
 				},
 			},
 		},
-		serviceProviders: map[string]*ServiceProvider{},
-		// Initialized from the serviceProviders.
-		serviceProvidersByEntityID: map[string]*ServiceProvider{},
-		signingKey: signingKey{
-			ID:        "id",
-			Algorithm: "RS256",
-			Key:       key,
-		},
-	}
-
-	for k, sp := range s.serviceProviders {
-		s.serviceProvidersByEntityID[sp.Metadata.EntityID] = s.serviceProviders[k]
+		signingKeyGracePeriod: DefaultSigningKeyGracePeriod,
 	}
+}
 
-	return s
+//Backend returns the backend of the storage, so that other components can persist their own data next to it
+func (s *Storage) Backend() Backend {
+	return s.backend
 }
 
 func (s *Storage) ListClients() ([]*Client, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	keys := make([]*Client, len(s.clients))
-	i := 0
-	for _, v := range s.clients {
-		keys[i] = v
-		i++
-	}
-	return keys, nil
+	return getAll[Client](s.backend, keyClients)
 }
 func (s *Storage) RegisterClient(id string, u *Client) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.clients[id] = u
-	return nil
+	return s.backend.Put(keyClients+id, u)
 }
 
 func (s *Storage) ListUsers() ([]*User, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	keys := make([]*User, len(s.users))
-	i := 0
-	for _, v := range s.users {
-		keys[i] = v
-		i++
-	}
-	return keys, nil
+	return getAll[User](s.backend, keyUsers)
 }
 func (s *Storage) GetUserByID(id string) (*User, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	u, ok := s.users[id]
-	if !ok {
-		return nil, os.ErrNotExist
-	}
-	return u, nil
+	return s.getUser(id)
 }
 func (s *Storage) DeleteUser(id string) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	err := s.backend.Batch(func(b Backend) error {
+		return deleteUser(b, id)
+	})
+	listeners := s.userListeners
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
-	delete(s.users, id)
+	for _, l := range listeners {
+		l(id, nil)
+	}
 	return nil
 }
 func (s *Storage) PutUser(id string, u *User) error {
+	s.mu.Lock()
+	err := s.backend.Batch(func(b Backend) error {
+		return putUser(b, id, u)
+	})
+	listeners := s.userListeners
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		l(id, u)
+	}
+	return nil
+}
+
+//OnUserChange registers a listener called after every PutUser and DeleteUser
+func (s *Storage) OnUserChange(l UserListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userListeners = append(s.userListeners, l)
+}
+
+//ListGroups returns the registered groups as well as the groups only referenced by name from users
+//groups only known through users get their name as ID
+func (s *Storage) ListGroups() ([]*Group, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	s.users[id] = u
-	return nil
+	return s.listGroups()
+}
+func (s *Storage) GetGroupByID(id string) (*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getGroupByID(id)
+}
+func (s *Storage) DeleteGroup(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, err := s.getGroupByID(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return s.backend.Batch(func(b Backend) error {
+		if err := b.Delete(keyGroups + id); err != nil {
+			return err
+		}
+		return updateGroupMembership(b, g.DisplayName, func(u *User, member bool) (string, bool) {
+			return "", false
+		})
+	})
+}
+
+//PutGroup stores the group with the given users as its only members, in a single batch
+//the users who were members under a previous display name lose it
+func (s *Storage) PutGroup(id string, g *Group, userIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := s.getGroupByID(id)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	members := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if _, err := s.getUser(userID); err != nil {
+			return fmt.Errorf("user %q not found", userID)
+		}
+		members[userID] = true
+	}
+	return s.backend.Batch(func(b Backend) error {
+		if old != nil && old.DisplayName != g.DisplayName {
+			err := updateGroupMembership(b, old.DisplayName, func(u *User, member bool) (string, bool) {
+				return "", false
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := updateGroupMembership(b, g.DisplayName, func(u *User, member bool) (string, bool) {
+			return g.DisplayName, members[u.ID]
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(keyGroups+id, g)
+	})
 }
 
 func (s *Storage) ListServiceProviders() ([]*ServiceProvider, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	keys := make([]*ServiceProvider, len(s.serviceProviders))
-	i := 0
-	for _, v := range s.serviceProviders {
-		keys[i] = v
-		i++
-	}
-	return keys, nil
+	return getAll[ServiceProvider](s.backend, keyServiceProviders)
 }
 func (s *Storage) GetServiceProviderByID(id string) (*ServiceProvider, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	u, ok := s.serviceProviders[id]
-	if !ok {
-		return nil, os.ErrNotExist
+	sp := &ServiceProvider{}
+	if err := s.backend.Get(keyServiceProviders+id, sp); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
 	}
-	return u, nil
+	return sp, nil
 }
 func (s *Storage) GetServiceProviderByEntityID(entityID string) (*ServiceProvider, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	u, ok := s.serviceProvidersByEntityID[entityID]
-	if !ok {
-		return nil, os.ErrNotExist
+	var id string
+	if err := s.backend.Get(indexKey(keyServiceProvidersByEntityID, entityID), &id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
 	}
-	return u, nil
+	sp := &ServiceProvider{}
+	if err := s.backend.Get(keyServiceProviders+id, sp); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return sp, nil
 }
 func (s *Storage) DeleteServiceProvider(id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	sp, ok := s.serviceProviders[id]
-	if ok {
-		delete(s.serviceProviders, id)
-		delete(s.serviceProvidersByEntityID, sp.Metadata.EntityID)
-	}
-	return nil
+	return s.backend.Batch(func(b Backend) error {
+		return deleteServiceProvider(b, id)
+	})
 }
 func (s *Storage) PutServiceProvider(id string, sp *ServiceProvider) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.serviceProviders[id] = sp
-	s.serviceProvidersByEntityID[sp.Metadata.EntityID] = sp
-	return nil
+	return s.backend.Batch(func(b Backend) error {
+		return putServiceProvider(b, id, sp)
+	})
 }
 
-//CheckUsernamePassword implements the `authenticate` interface of the login
-func (s *Storage) CheckUsernamePassword(username, password, id string) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	request, ok := s.authRequests[id]
-	if !ok {
-		return fmt.Errorf("request not found")
+//checkUsernamePassword returns the enabled user with the username and password
+//the users without a password, such as the ones provisioned over SCIM without one, cannot log in
+func (s *Storage) checkUsernamePassword(username, password string) (*User, error) {
+	if password == "" {
+		return nil, fmt.Errorf("username or password wrong")
+	}
+	user, err := userByUsername(s.backend, username)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("username or password wrong")
+		}
+		return nil, err
 	}
-
 	//for demonstration purposes we'll check on a static list with plain text password
 	//for real world scenarios, be sure to have the password hashed and salted (e.g. using bcrypt)
-	for _, user := range s.users {
-		if user.Username == username && user.Password == password {
-			//be sure to set user id into the auth request after the user was checked,
-			//so that you'll be able to get more information about the user after the login
-			request.UserID = user.ID
-
-			//you will have to change some state on the request to guide the user through possible multiple steps of the login process
-			//in this example we'll simply check the username / password and set a boolean to true
-			//therefore we will also just check this boolean if the request / login has been finished
-			request.passwordChecked = true
-			return nil
-		}
+	if user.Password != password || user.Disabled {
+		return nil, fmt.Errorf("username or password wrong")
 	}
-	return fmt.Errorf("username or password wrong")
+	return user, nil
 }
 
 //CreateAuthRequest implements the op.Storage interface
@@ -234,8 +311,10 @@ func (s *Storage) CreateAuthRequest(ctx context.Context, authReq *oidc.AuthReque
 	//you'll also have to create a unique id for the request (this might be done by your database; we'll use a uuid)
 	request.ID = uuid.NewString()
 
-	//and save it in your database (for demonstration purposed we will use a simple map)
-	s.authRequests[request.ID] = request
+	//and save it in your database
+	if err := s.backend.Put(keyAuthRequests+request.ID, request); err != nil {
+		return nil, err
+	}
 
 	//finally, return the request (which implements the AuthRequest interface of the OP
 	return request, nil
@@ -247,11 +326,7 @@ func (s *Storage) AuthRequestByID(ctx context.Context, id string) (op.AuthReques
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	request, ok := s.authRequests[id]
-	if !ok {
-		return nil, fmt.Errorf("request not found")
-	}
-	return request, nil
+	return s.getAuthRequest(id)
 }
 
 //AuthRequestByCode implements the op.Storage interface
@@ -261,16 +336,12 @@ func (s *Storage) AuthRequestByCode(ctx context.Context, code string) (op.AuthRe
 	defer s.mu.RUnlock()
 
 	//for this example we read the id by code and then get the request by id
-	requestID, ok := s.codes[code]
-	if !ok {
+	var requestID string
+	if err := s.backend.Get(keyCodes+code, &requestID); err != nil {
 		return nil, fmt.Errorf("code invalid or expired")
 	}
 
-	request, ok := s.authRequests[requestID]
-	if !ok {
-		return nil, fmt.Errorf("request not found")
-	}
-	return request, nil
+	return s.getAuthRequest(requestID)
 }
 
 //SaveAuthCode implements the op.Storage interface
@@ -281,8 +352,9 @@ func (s *Storage) SaveAuthCode(ctx context.Context, id string, code string) erro
 	defer s.mu.Unlock()
 
 	//for this example we'll just save the authRequestID to the code
-	s.codes[code] = id
-	return nil
+	return s.backend.Batch(func(b Backend) error {
+		return putCode(b, code, id)
+	})
 }
 
 //DeleteAuthRequest implements the op.Storage interface
@@ -294,14 +366,9 @@ func (s *Storage) DeleteAuthRequest(ctx context.Context, id string) error {
 	defer s.mu.Unlock()
 
 	//you can simply delete all reference to the auth request
-	delete(s.authRequests, id)
-	for code, requestID := range s.codes {
-		if id == requestID {
-			delete(s.codes, code)
-			return nil
-		}
-	}
-	return nil
+	return s.backend.Batch(func(b Backend) error {
+		return deleteAuthRequest(b, id)
+	})
 }
 
 //CreateAccessToken implements the op.Storage interface
@@ -311,15 +378,29 @@ func (s *Storage) CreateAccessToken(ctx context.Context, request op.TokenRequest
 	defer s.mu.Unlock()
 
 	var applicationID string
+	var actor *TokenActor
 	//if authenticated for an app (auth code / implicit flow) we must save the client_id to the token
-	authReq, ok := request.(*AuthRequest)
-	if ok {
-		applicationID = authReq.ApplicationID
-	}
-	token, err := s.accessToken(applicationID, "", request.GetSubject(), request.GetAudience(), request.GetScopes())
+	switch req := request.(type) {
+	case *AuthRequest:
+		applicationID = req.ApplicationID
+	case *ClientCredentialsRequest:
+		//the client_credentials tokens are issued to their client, which is also their subject
+		applicationID = req.ClientID
+	case *TokenExchangeRequest:
+		//the exchanged tokens are issued to the client exchanging them, on behalf of the subject
+		applicationID = req.ClientID
+		actor = req.Actor
+	}
+	token, err := accessToken(s.backend, applicationID, "", request.GetSubject(), request.GetAudience(), request.GetScopes())
 	if err != nil {
 		return "", time.Time{}, err
 	}
+	if actor != nil {
+		token.Actor = actor
+		if err := putToken(s.backend, token); err != nil {
+			return "", time.Time{}, err
+		}
+	}
 	return token.ID, token.Expiration, nil
 }
 
@@ -330,33 +411,36 @@ func (s *Storage) CreateAccessAndRefreshTokens(ctx context.Context, request op.T
 	defer s.mu.Unlock()
 
 	//get the information depending on the request type / implementation
-	applicationID, authTime, amr := getInfoFromRequest(request)
-
-	//if currentRefreshToken is empty (Code Flow) we will have to create a new refresh token
-	if currentRefreshToken == "" {
-		refreshTokenID := uuid.NewString()
-		accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
-		if err != nil {
-			return "", "", time.Time{}, err
+	applicationID, authTime, amr, sessionID := getInfoFromRequest(request)
+
+	var token *Token
+	err = s.backend.Batch(func(b Backend) error {
+		var err error
+		//if currentRefreshToken is empty (Code Flow) we will have to create a new refresh token
+		if currentRefreshToken == "" {
+			refreshTokenID := uuid.NewString()
+			token, err = accessToken(b, applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
+			if err != nil {
+				return err
+			}
+			newRefreshToken, err = createRefreshToken(b, token, amr, authTime, sessionID)
+			return err
 		}
-		refreshToken, err := s.createRefreshToken(accessToken, amr, authTime)
+
+		//if we get here, the currentRefreshToken was not empty, so the call is a refresh token request
+		//we therefore will have to check the currentRefreshToken and renew the refresh token
+		var refreshTokenID string
+		newRefreshToken, refreshTokenID, err = renewRefreshToken(b, currentRefreshToken)
 		if err != nil {
-			return "", "", time.Time{}, err
+			return err
 		}
-		return accessToken.ID, refreshToken, accessToken.Expiration, nil
-	}
-
-	//if we get here, the currentRefreshToken was not empty, so the call is a refresh token request
-	//we therefore will have to check the currentRefreshToken and renew the refresh token
-	refreshToken, refreshTokenID, err := s.renewRefreshToken(currentRefreshToken)
+		token, err = accessToken(b, applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
+		return err
+	})
 	if err != nil {
 		return "", "", time.Time{}, err
 	}
-	accessToken, err := s.accessToken(applicationID, refreshTokenID, request.GetSubject(), request.GetAudience(), request.GetScopes())
-	if err != nil {
-		return "", "", time.Time{}, err
-	}
-	return accessToken.ID, refreshToken, accessToken.Expiration, nil
+	return token.ID, newRefreshToken, token.Expiration, nil
 }
 
 //TokenRequestByRefreshToken implements the op.Storage interface
@@ -365,21 +449,58 @@ func (s *Storage) TokenRequestByRefreshToken(ctx context.Context, refreshToken s
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	token, ok := s.refreshTokens[refreshToken]
-	if !ok {
+	token := &RefreshToken{}
+	if err := s.backend.Get(keyRefreshTokens+refreshToken, token); err != nil {
 		return nil, fmt.Errorf("invalid refresh_token")
 	}
 	return RefreshTokenRequestFromBusiness(token), nil
 }
 
 //TerminateSession implements the op.Storage interface
-//it will be called after the user signed out, therefore the access and refresh token of the user of this client must be removed
+//it will be called after the user signed out, therefore the access and refresh tokens of the user of this client must be removed
 func (s *Storage) TerminateSession(ctx context.Context, userID string, clientID string) error {
-	for _, token := range s.tokens {
-		if token.ApplicationID == clientID && token.Subject == userID {
-			delete(s.tokens, token.ID)
-			delete(s.refreshTokens, token.RefreshTokenID)
-			return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backend.Batch(func(b Backend) error {
+		return terminateTokens(b, userID, clientID)
+	})
+}
+
+//terminateTokens deletes all the access and refresh tokens of the user issued to the client
+func terminateTokens(b Backend, userID, clientID string) error {
+	tokens, err := indexedTokens(b, indexKey(keyTokensByGrant, clientID, userID)+"/")
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := deleteToken(b, token); err != nil {
+			return err
+		}
+	}
+	prefix := indexKey(keyRefreshTokensByGrant, clientID, userID) + "/"
+	keys, err := b.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		var id string
+		if err := b.Get(prefix+k, &id); err != nil {
+			continue
+		}
+		token, err := refreshTokenByID(b, id)
+		if errors.Is(err, ErrNotFound) {
+			//the refresh token is gone, only its index entry was left behind
+			if err := b.Delete(prefix + k); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := deleteRefreshToken(b, token); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -388,19 +509,27 @@ func (s *Storage) TerminateSession(ctx context.Context, userID string, clientID
 //RevokeToken implements the op.Storage interface
 //it will be called after parsing and validation of the token revocation request
 func (s *Storage) RevokeToken(ctx context.Context, token string, userID string, clientID string) *oidc.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	//a single token was requested to be removed
-	accessToken, ok := s.tokens[token]
-	if ok {
+	accessToken := &Token{}
+	if err := s.backend.Get(keyTokens+token, accessToken); err == nil {
 		if accessToken.ApplicationID != clientID {
 			return oidc.ErrInvalidClient().WithDescription("token was not issued for this client")
 		}
 		//if it is an access token, just remove it
 		//you could also remove the corresponding refresh token if really necessary
-		delete(s.tokens, accessToken.ID)
+		err := s.backend.Batch(func(b Backend) error {
+			return deleteToken(b, accessToken)
+		})
+		if err != nil {
+			return oidc.ErrServerError().WithParent(err)
+		}
 		return nil
 	}
-	refreshToken, ok := s.refreshTokens[token]
-	if !ok {
+	refreshToken := &RefreshToken{}
+	if err := s.backend.Get(keyRefreshTokens+token, refreshToken); err != nil {
 		//if the token is neither an access nor a refresh token, just ignore it, the expected behaviour of
 		//being not valid (anymore) is achieved
 		return nil
@@ -409,12 +538,14 @@ func (s *Storage) RevokeToken(ctx context.Context, token string, userID string,
 		return oidc.ErrInvalidClient().WithDescription("token was not issued for this client")
 	}
 	//if it is a refresh token, you will have to remove the access token as well
-	delete(s.refreshTokens, refreshToken.ID)
-	for _, accessToken := range s.tokens {
-		if accessToken.RefreshTokenID == refreshToken.ID {
-			delete(s.tokens, accessToken.ID)
-			return nil
+	err := s.backend.Batch(func(b Backend) error {
+		if err := deleteRefreshToken(b, refreshToken); err != nil {
+			return err
 		}
+		return deleteAccessTokensOf(b, refreshToken.ID)
+	})
+	if err != nil {
+		return oidc.ErrServerError().WithParent(err)
 	}
 	return nil
 }
@@ -422,20 +553,27 @@ func (s *Storage) RevokeToken(ctx context.Context, token string, userID string,
 //GetSigningKey implements the op.Storage interface
 //it will be called when creating the OpenID Provider
 func (s *Storage) GetSigningKey(ctx context.Context, keyCh chan<- jose.SigningKey) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	key, err := s.currentSigningKey(DefaultSigningAlgorithm)
+	//the signer keeps listening on the channel, so that rotated keys can be handed to it
+	s.signingKeyListeners = append(s.signingKeyListeners, signingKeyListener{ctx: ctx, keyCh: keyCh})
+	s.mu.Unlock()
 
-	//in this example the signing key is a static rsa.PrivateKey and the algorithm used is RS256
-	//you would obviously have a more complex implementation and store / retrieve the key from your database as well
-	//
-	//the idea of the signing key channel is, that you can (with what ever mechanism) rotate your signing key and
-	//switch the key of the signer via this channel
-	keyCh <- jose.SigningKey{
-		Algorithm: jose.SignatureAlgorithm(s.signingKey.Algorithm), //always tell the signer with algorithm to use
-		Key: jose.JSONWebKey{
-			KeyID: s.signingKey.ID, //always give the key an id so, that it will include it in the token header as `kid` claim
-			Key:   s.signingKey.Key,
-		},
+	if err != nil {
+		//the signer reports that it has no key
+		keyCh <- jose.SigningKey{}
+	} else {
+		keyCh <- key.joseSigningKey()
+	}
+
+	<-ctx.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.signingKeyListeners {
+		if l.keyCh == keyCh {
+			s.signingKeyListeners = append(s.signingKeyListeners[:i], s.signingKeyListeners[i+1:]...)
+			break
+		}
 	}
 }
 
@@ -445,19 +583,17 @@ func (s *Storage) GetKeySet(ctx context.Context) (*jose.JSONWebKeySet, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	//as mentioned above, this example only has a single signing key without key rotation,
-	//so it will directly use its public key
-	//
-	//when using key rotation you typically would store the public keys alongside the private keys in your database
-	//and give both of them an expiration date, with the public key having a longer lifetime (e.g. rotate private key every
-	return &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
-		{
-			KeyID:     s.signingKey.ID,
-			Algorithm: s.signingKey.Algorithm,
-			Use:       oidc.KeyUseSignature,
-			Key:       &s.signingKey.Key.PublicKey,
-		}},
-	}, nil
+	//the retired keys are published until the end of their grace period,
+	//so that the tokens signed before a rotation can still be verified
+	keys, err := s.publishedSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	keySet := &jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, len(keys))}
+	for i, k := range keys {
+		keySet.Keys[i] = k.publicKey()
+	}
+	return keySet, nil
 }
 
 //GetClientByClientID implements the op.Storage interface
@@ -466,11 +602,7 @@ func (s *Storage) GetClientByClientID(ctx context.Context, clientID string) (op.
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	client, ok := s.clients[clientID]
-	if !ok {
-		return nil, fmt.Errorf("client not found")
-	}
-	return client, nil
+	return s.getClient(clientID)
 }
 
 //AuthorizeClientIDSecret implements the op.Storage interface
@@ -479,9 +611,9 @@ func (s *Storage) AuthorizeClientIDSecret(ctx context.Context, clientID, clientS
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	client, ok := s.clients[clientID]
-	if !ok {
-		return fmt.Errorf("client not found")
+	client, err := s.getClient(clientID)
+	if err != nil {
+		return err
 	}
 	//for this example we directly check the secret
 	//obviously you would not have the secret in plain text, but rather hashed and salted (e.g. using bcrypt)
@@ -494,20 +626,20 @@ func (s *Storage) AuthorizeClientIDSecret(ctx context.Context, clientID, clientS
 //SetUserinfoFromScopes implements the op.Storage interface
 //it will be called for the creation of an id_token, so we'll just pass it to the private function without any further check
 func (s *Storage) SetUserinfoFromScopes(ctx context.Context, userinfo oidc.UserInfoSetter, userID, clientID string, scopes []string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	return s.setUserinfo(ctx, userinfo, userID, clientID, scopes)
+	return s.setUserinfo(ctx, userinfo, userID, clientID, scopes, ClaimTargetIDToken)
 }
 
 //SetUserinfoFromToken implements the op.Storage interface
 //it will be called for the userinfo endpoint, so we read the token and pass the information from that to the private function
 func (s *Storage) SetUserinfoFromToken(ctx context.Context, userinfo oidc.UserInfoSetter, tokenID, subject, origin string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	token, ok := s.tokens[tokenID]
-	if !ok {
+	token := &Token{}
+	if err := s.backend.Get(keyTokens+tokenID, token); err != nil {
 		return fmt.Errorf("token is invalid or has expired")
 	}
 	//the userinfo endpoint should support CORS. If it's not possible to specify a specific origin in the CORS handler,
@@ -515,35 +647,47 @@ func (s *Storage) SetUserinfoFromToken(ctx context.Context, userinfo oidc.UserIn
 	//note that the origin can be empty (if called by a web client)
 	//
 	//if origin != "" {
-	//	client, ok := s.clients[token.ApplicationID]
-	//	if !ok {
-	//		return fmt.Errorf("client not found")
+	//	client, err := s.getClient(token.ApplicationID)
+	//	if err != nil {
+	//		return err
 	//	}
 	//	if err := checkAllowedOrigins(client.allowedOrigins, origin); err != nil {
 	//		return err
 	//	}
 	//}
-	return s.setUserinfo(ctx, userinfo, token.Subject, token.ApplicationID, token.Scopes)
+	return s.setUserinfo(ctx, userinfo, token.Subject, token.ApplicationID, token.Scopes, ClaimTargetUserinfo)
 }
 
 //SetIntrospectionFromToken implements the op.Storage interface
 //it will be called for the introspection endpoint, so we read the token and pass the information from that to the private function
 func (s *Storage) SetIntrospectionFromToken(ctx context.Context, introspection oidc.IntrospectionResponse, tokenID, subject, clientID string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	token, ok := s.tokens[tokenID]
-	if !ok {
+	token := &Token{}
+	if err := s.backend.Get(keyTokens+tokenID, token); err != nil {
 		return fmt.Errorf("token is invalid or has expired")
 	}
 	//check if the client is part of the requested audience
 	for _, aud := range token.Audience {
 		if aud == clientID {
+			//the tokens issued by a token exchange with an actor token tell who acts on behalf of their subject
+			if token.Actor != nil {
+				introspection.AppendClaims("act", token.Actor)
+			}
+			//the tokens of the client_credentials grant have no user, the client is their subject
+			if token.Subject == token.ApplicationID {
+				introspection.SetSubject(token.Subject)
+				introspection.SetScopes(token.Scopes)
+				introspection.SetClientID(token.ApplicationID)
+				return nil
+			}
 			//the introspection response only has to return a boolean (active) if the token is active
 			//this will automatically be done by the library if you don't return an error
 			//you can also return further information about the user / associated token
 			//e.g. the userinfo (equivalent to userinfo endpoint)
-			err := s.setUserinfo(ctx, introspection, subject, clientID, token.Scopes)
+			//the claims are mapped for the client the token was issued to
+			err := s.setUserinfo(ctx, introspection, subject, token.ApplicationID, token.Scopes, ClaimTargetAccessToken)
 			if err != nil {
 				return err
 			}
@@ -560,10 +704,14 @@ func (s *Storage) SetIntrospectionFromToken(ctx context.Context, introspection o
 //GetPrivateClaimsFromScopes implements the op.Storage interface
 //it will be called for the creation of a JWT access token to assert claims for custom scopes
 func (s *Storage) GetPrivateClaimsFromScopes(ctx context.Context, userID, clientID string, scopes []string) (claims map[string]interface{}, err error) {
-	for _, scope := range scopes {
-		switch scope {
-		case CustomScope:
-			claims = appendClaim(claims, CustomClaim, customClaim(clientID))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	//the tokens of the client_credentials grant have no user to map claims from
+	if user, err := s.getUser(userID); err == nil {
+		claims, err = s.mappedClaims(user, clientID, scopes, ClaimTargetAccessToken)
+		if err != nil {
+			return nil, err
 		}
 	}
 	return claims, nil
@@ -577,6 +725,16 @@ func (s *Storage) GetKeyByIDAndUserID(ctx context.Context, keyID, userID string)
 
 	service, ok := s.services[userID]
 	if !ok {
+		//for private_key_jwt client authentication, the userID is the client_id
+		if client, err := s.getClient(userID); err == nil {
+			for _, key := range client.Keys {
+				if key.KeyID == keyID {
+					key := key
+					return &key, nil
+				}
+			}
+			return nil, fmt.Errorf("key not found")
+		}
 		return nil, fmt.Errorf("user not found")
 	}
 	key, ok := service.keys[keyID]
@@ -592,10 +750,18 @@ func (s *Storage) GetKeyByIDAndUserID(ctx context.Context, keyID, userID string)
 
 //ValidateJWTProfileScopes implements the op.Storage interface
 //it will be called to validate the scopes of a JWT Profile Authorization Grant request
+//the service gets the openid scope and the scopes of the configuration it may request
 func (s *Storage) ValidateJWTProfileScopes(ctx context.Context, userID string, scopes []string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	allowed, err := s.allowedScopes(userID)
+	if err != nil {
+		return nil, err
+	}
 	allowedScopes := make([]string, 0)
 	for _, scope := range scopes {
-		if scope == oidc.ScopeOpenID {
+		if scope == oidc.ScopeOpenID || allowed[scope] {
 			allowedScopes = append(allowedScopes, scope)
 		}
 	}
@@ -607,15 +773,51 @@ func (s *Storage) Health(ctx context.Context) error {
 	return nil
 }
 
-//createRefreshToken will store a refresh_token in-memory based on the provided information
-func (s *Storage) createRefreshToken(accessToken *Token, amr []string, authTime time.Time) (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Storage) getUser(id string) (*User, error) {
+	u := &User{}
+	if err := s.backend.Get(keyUsers+id, u); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return u, nil
+}
 
+func (s *Storage) getClient(id string) (*Client, error) {
+	client := &Client{}
+	if err := s.backend.Get(keyClients+id, client); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("client not found")
+		}
+		return nil, err
+	}
+	scopes, err := s.allowedScopes(id)
+	if err != nil {
+		return nil, err
+	}
+	client.scopes = scopes
+	return client, nil
+}
+
+func (s *Storage) getAuthRequest(id string) (*AuthRequest, error) {
+	request := &AuthRequest{}
+	if err := s.backend.Get(keyAuthRequests+id, request); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("request not found")
+		}
+		return nil, err
+	}
+	return request, nil
+}
+
+//createRefreshToken will store a refresh_token based on the provided information
+func createRefreshToken(b Backend, accessToken *Token, amr []string, authTime time.Time, sessionID string) (string, error) {
 	token := &RefreshToken{
 		ID:            accessToken.RefreshTokenID,
 		Token:         accessToken.RefreshTokenID,
 		AuthTime:      authTime,
+		SessionID:     sessionID,
 		AMR:           amr,
 		ApplicationID: accessToken.ApplicationID,
 		UserID:        accessToken.Subject,
@@ -623,36 +825,65 @@ func (s *Storage) createRefreshToken(accessToken *Token, amr []string, authTime
 		Expiration:    time.Now().Add(5 * time.Hour),
 		Scopes:        accessToken.Scopes,
 	}
-	s.refreshTokens[token.ID] = token
+	if err := putRefreshToken(b, token); err != nil {
+		return "", err
+	}
 	return token.Token, nil
 }
 
 //renewRefreshToken checks the provided refresh_token and creates a new one based on the current
-func (s *Storage) renewRefreshToken(currentRefreshToken string) (string, string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	refreshToken, ok := s.refreshTokens[currentRefreshToken]
-	if !ok {
+func renewRefreshToken(b Backend, currentRefreshToken string) (string, string, error) {
+	refreshToken := &RefreshToken{}
+	if err := b.Get(keyRefreshTokens+currentRefreshToken, refreshToken); err != nil {
 		return "", "", fmt.Errorf("invalid refresh token")
 	}
 	//deletes the refresh token and all access tokens which were issued based on this refresh token
-	delete(s.refreshTokens, currentRefreshToken)
-	for _, token := range s.tokens {
-		if token.RefreshTokenID == currentRefreshToken {
-			delete(s.tokens, token.ID)
-			break
-		}
+	if err := deleteRefreshToken(b, refreshToken); err != nil {
+		return "", "", err
+	}
+	if err := deleteAccessTokensOf(b, refreshToken.ID); err != nil {
+		return "", "", err
 	}
 	//creates a new refresh token based on the current one
 	token := uuid.NewString()
 	refreshToken.Token = token
-	s.refreshTokens[token] = refreshToken
+	if err := putRefreshToken(b, refreshToken); err != nil {
+		return "", "", err
+	}
 	return token, refreshToken.ID, nil
 }
 
-//accessToken will store an access_token in-memory based on the provided information
-func (s *Storage) accessToken(applicationID, refreshTokenID, subject string, audience, scopes []string) (*Token, error) {
+//deleteRefreshTokenByID deletes the refresh token with the id, whatever its current token is
+func deleteRefreshTokenByID(b Backend, refreshTokenID string) error {
+	if refreshTokenID == "" {
+		return nil
+	}
+	t, err := refreshTokenByID(b, refreshTokenID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	return deleteRefreshToken(b, t)
+}
+
+//deleteAccessTokensOf deletes the access tokens issued based on the refresh token
+func deleteAccessTokensOf(b Backend, refreshTokenID string) error {
+	tokens, err := indexedTokens(b, indexKey(keyTokensByRefreshToken, refreshTokenID)+"/")
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := deleteToken(b, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//accessToken will store an access_token based on the provided information
+func accessToken(b Backend, applicationID, refreshTokenID, subject string, audience, scopes []string) (*Token, error) {
 	token := &Token{
 		ID:             uuid.NewString(),
 		ApplicationID:  applicationID,
@@ -662,16 +893,30 @@ func (s *Storage) accessToken(applicationID, refreshTokenID, subject string, aud
 		Expiration:     time.Now().Add(5 * time.Minute),
 		Scopes:         scopes,
 	}
-	s.tokens[token.ID] = token
+	if err := putToken(b, token); err != nil {
+		return nil, err
+	}
 	return token, nil
 }
 
 //setUserinfo sets the info based on the user, scopes and if necessary the clientID
-func (s *Storage) setUserinfo(ctx context.Context, userInfo oidc.UserInfoSetter, userID, clientID string, scopes []string) (err error) {
-	user, ok := s.users[userID]
-	if !ok {
+//the claims mapped from the user attributes are the ones of the target
+func (s *Storage) setUserinfo(ctx context.Context, userInfo oidc.UserInfoSetter, userID, clientID string, scopes []string, target ClaimTarget) (err error) {
+	user, err := s.getUser(userID)
+	if err != nil {
 		return fmt.Errorf("user not found")
 	}
+	claims, err := s.mappedClaims(user, clientID, scopes, target)
+	if err != nil {
+		return err
+	}
+	for claim, value := range claims {
+		userInfo.AppendClaims(claim, value)
+	}
+	//the ID tokens identify the IdP session for the front-channel and back-channel logouts
+	if sessionID := sessionIDFromContext(ctx); sessionID != "" && target == ClaimTargetIDToken {
+		userInfo.AppendClaims("sid", sessionID)
+	}
 	for _, scope := range scopes {
 		switch scope {
 		case oidc.ScopeOpenID:
@@ -684,33 +929,89 @@ func (s *Storage) setUserinfo(ctx context.Context, userInfo oidc.UserInfoSetter,
 			userInfo.SetFamilyName(user.Lastname)
 			userInfo.SetGivenName(user.Firstname)
 			// userInfo.SetLocale(user.PreferredLanguage)
-		case CustomScope:
-			//you can also have a custom scope and assert public or custom claims based on that
-			userInfo.AppendClaims(CustomClaim, customClaim(clientID))
 		}
 	}
 	return nil
 }
 
-//getInfoFromRequest returns the clientID, authTime and amr depending on the op.TokenRequest type / implementation
-func getInfoFromRequest(req op.TokenRequest) (clientID string, authTime time.Time, amr []string) {
+func (s *Storage) listGroups() ([]*Group, error) {
+	groups, err := getAll[Group](s.backend, keyGroups)
+	if err != nil {
+		return nil, err
+	}
+	users, err := getAll[User](s.backend, keyUsers)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		seen[g.DisplayName] = true
+	}
+	for _, u := range users {
+		for _, name := range u.Groups {
+			if !seen[name] {
+				seen[name] = true
+				groups = append(groups, &Group{ID: name, DisplayName: name})
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (s *Storage) getGroupByID(id string) (*Group, error) {
+	groups, err := s.listGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+//updateGroupMembership calls fn for every user with whether the user is currently a member of the group name
+//fn returns the group name the user should have and whether the user should be a member
+func updateGroupMembership(b Backend, name string, fn func(u *User, member bool) (string, bool)) error {
+	users, err := getAll[User](b, keyUsers)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		member := u.HasGroup(name)
+		newName, newMember := fn(u, member)
+		if member == newMember && (!member || newName == name) {
+			continue
+		}
+		groups := make([]string, 0, len(u.Groups)+1)
+		for _, g := range u.Groups {
+			if g != name {
+				groups = append(groups, g)
+			}
+		}
+		if newMember {
+			groups = append(groups, newName)
+		}
+		u.Groups = groups
+		if err := putUser(b, u.ID, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getInfoFromRequest returns the clientID, authTime, amr and sessionID depending on the op.TokenRequest type / implementation
+func getInfoFromRequest(req op.TokenRequest) (clientID string, authTime time.Time, amr []string, sessionID string) {
 	authReq, ok := req.(*AuthRequest) //Code Flow (with scope offline_access)
 	if ok {
-		return authReq.ApplicationID, authReq.authTime, authReq.GetAMR()
+		return authReq.ApplicationID, authReq.AuthTime, authReq.GetAMR(), authReq.SessionID
 	}
 	refreshReq, ok := req.(*RefreshTokenRequest) //Refresh Token Request
 	if ok {
-		return refreshReq.ApplicationID, refreshReq.AuthTime, refreshReq.AMR
-	}
-	return "", time.Time{}, nil
-}
-
-//customClaim demonstrates how to return custom claims based on provided information
-func customClaim(clientID string) map[string]interface{} {
-	return map[string]interface{}{
-		"client": clientID,
-		"other":  "stuff",
+		return refreshReq.ApplicationID, refreshReq.AuthTime, refreshReq.AMR, refreshReq.SessionID
 	}
+	return "", time.Time{}, nil, ""
 }
 
 func appendClaim(claims map[string]interface{}, claim string, value interface{}) map[string]interface{} {
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/crewjam/saml"
+	"github.com/zitadel/oidc/pkg/oidc"
+)
+
+//TestStorageReopen writes the runtime state through a Storage on a bolt backend,
+//and reads it back through a new Storage once the backend is reopened, as after a restart
+func TestStorageReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "idp.db")
+	b, err := OpenBoltBackend(path)
+	if err != nil {
+		t.Fatalf("OpenBoltBackend() error = %v", err)
+	}
+	s := NewStorageWithBackend(b)
+	if err := s.PutUser("alice", &User{ID: "alice", Username: "alice", Password: "alice-password"}); err != nil {
+		t.Fatalf("PutUser() error = %v", err)
+	}
+	sp := &ServiceProvider{ID: "sp", Metadata: &saml.EntityDescriptor{EntityID: "https://sp.example.com/metadata"}}
+	if err := s.PutServiceProvider(sp.ID, sp); err != nil {
+		t.Fatalf("PutServiceProvider() error = %v", err)
+	}
+
+	session, err := s.CreateSession("alice", "alice-password", "")
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	if err := s.AddSessionServiceProvider(session.ID, sp.Metadata.EntityID); err != nil {
+		t.Fatalf("AddSessionServiceProvider() error = %v", err)
+	}
+	pending, err := s.CreateAuthRequest(ctx, &oidc.AuthRequest{
+		ClientID:     "app",
+		RedirectURI:  "https://app.example.com/callback",
+		Scopes:       oidc.SpaceDelimitedArray{oidc.ScopeOpenID, oidc.ScopeOfflineAccess},
+		ResponseType: oidc.ResponseTypeCode,
+		State:        "state",
+	}, "")
+	if err != nil {
+		t.Fatalf("CreateAuthRequest() error = %v", err)
+	}
+	if err := s.SaveAuthCode(ctx, pending.GetID(), "code"); err != nil {
+		t.Fatalf("SaveAuthCode() error = %v", err)
+	}
+	authorized := &AuthRequest{ID: "authorized", ApplicationID: "app", UserID: "alice", Scopes: []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess}, AuthTime: session.AuthTime, SessionID: session.SID}
+	accessTokenID, refreshToken, _, err := s.CreateAccessAndRefreshTokens(ctx, authorized, "")
+	if err != nil {
+		t.Fatalf("CreateAccessAndRefreshTokens() error = %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	b, err = OpenBoltBackend(path)
+	if err != nil {
+		t.Fatalf("reopening bolt backend: %v", err)
+	}
+	defer b.Close()
+	s = NewStorageWithBackend(b)
+	if err := s.EnsureIndexes(); err != nil {
+		t.Fatalf("EnsureIndexes() error = %v", err)
+	}
+
+	gotSession, err := s.SessionByID(session.ID)
+	if err != nil {
+		t.Fatalf("SessionByID() after reopening error = %v", err)
+	}
+	if gotSession.SID != session.SID || !reflect.DeepEqual(gotSession.ServiceProviders, []string{sp.Metadata.EntityID}) {
+		t.Errorf("SessionByID() after reopening = %+v, want %+v", gotSession, session)
+	}
+
+	gotRequest, err := s.AuthRequestByCode(ctx, "code")
+	if err != nil {
+		t.Fatalf("AuthRequestByCode() after reopening error = %v", err)
+	}
+	if gotRequest.GetID() != pending.GetID() || gotRequest.GetState() != "state" || gotRequest.GetRedirectURI() != "https://app.example.com/callback" {
+		t.Errorf("AuthRequestByCode() after reopening = %+v, want %+v", gotRequest, pending)
+	}
+
+	refreshRequest, err := s.TokenRequestByRefreshToken(ctx, refreshToken)
+	if err != nil {
+		t.Fatalf("TokenRequestByRefreshToken() after reopening error = %v", err)
+	}
+	if refreshRequest.GetSubject() != "alice" || refreshRequest.GetClientID() != "app" || !reflect.DeepEqual(refreshRequest.GetScopes(), authorized.Scopes) {
+		t.Errorf("TokenRequestByRefreshToken() after reopening = %+v", refreshRequest)
+	}
+	if _, err := s.AccessTokenByID(accessTokenID); err != nil {
+		t.Errorf("AccessTokenByID() after reopening error = %v", err)
+	}
+
+	gotSP, err := s.GetServiceProviderByEntityID(sp.Metadata.EntityID)
+	if err != nil {
+		t.Fatalf("GetServiceProviderByEntityID() after reopening error = %v", err)
+	}
+	if gotSP.ID != sp.ID || gotSP.Metadata.EntityID != sp.Metadata.EntityID {
+		t.Errorf("GetServiceProviderByEntityID() after reopening = %+v, want %+v", gotSP, sp)
+	}
+
+	//the tokens created before the restart are still terminated through the indexes
+	if err := s.TerminateSession(ctx, "alice", "app"); err != nil {
+		t.Fatalf("TerminateSession() error = %v", err)
+	}
+	if _, err := s.TokenRequestByRefreshToken(ctx, refreshToken); err == nil {
+		t.Errorf("TokenRequestByRefreshToken() after TerminateSession() succeeded")
+	}
+}
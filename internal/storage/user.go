@@ -13,6 +13,10 @@ type User struct {
 	Groups        []string `json:"groups,omitempty"`
 	Email         string   `json:"email,omitempty"`
 	EmailVerified bool     `json:"emailVerified,omitempty"`
+	ExternalID    string   `json:"externalId,omitempty"`
+	Disabled      bool     `json:"disabled,omitempty"`
+	//Attributes are asserted as claims by the claim mappings of the scopes and clients
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
 	/*
 		PreferredLanguage language.Tag
 		CommonName        string   `json:"common_name,omitempty"`
@@ -22,6 +26,16 @@ type User struct {
 	*/
 }
 
+//HasGroup reports whether the user is a member of the group with the given display name
+func (u *User) HasGroup(name string) bool {
+	for _, g := range u.Groups {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
+
 type Service struct {
 	keys map[string]*rsa.PublicKey
 }
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+// deleteExpired deletes the expired tokens, auth requests, sessions and codes every interval,
+// so that a persistent backend does not grow without bound.
+func deleteExpired(stor *storage.Storage, every time.Duration) {
+	for {
+		if err := stor.DeleteExpired(); err != nil {
+			log.Println("error deleting expired entities:", err)
+		}
+		time.Sleep(every)
+	}
+}
@@ -1,21 +1,26 @@
 package server
 
 import (
+	"context"
+	"crypto"
+	"crypto/subtle"
 	_ "embed"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"runtime/debug"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/seriousben/dev-identity-provider/internal/config"
 	"github.com/seriousben/dev-identity-provider/internal/oidc"
 	"github.com/seriousben/dev-identity-provider/internal/saml"
+	"github.com/seriousben/dev-identity-provider/internal/scim"
 	"github.com/seriousben/dev-identity-provider/internal/storage"
 )
 
@@ -44,109 +49,279 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func syncStorage(basePath string, s *storage.Storage) error {
-	fmt.Println("Syncing storage")
+type options struct {
+	scimToken    string
+	adminToken   string
+	configSource config.Source
+	configWatch  bool
+	backend      storage.Backend
 
-	var config struct {
-		ServiceProviders []struct {
-			ID          string `json:"id,omitempty"`
-			MetadataURL string `json:"metadataUrl,omitempty"`
-		} `json:"service_providers"`
-		Users   []*storage.User `json:"users"`
-		Clients []struct {
-			ClientID     string   `json:"clientId,omitempty"`
-			ClientSecret string   `json:"clientSecret,omitempty"`
-			RedirectURIs []string `json:"redirectUris,omitempty"`
-		} `json:"clients"`
+	signingKeys           []crypto.PrivateKey
+	signingKeyRotation    time.Duration
+	signingKeyGracePeriod time.Duration
+
+	cryptoKeys [][]byte
+
+	samlKeyPair *storage.SAMLKeyPair
+}
+
+// Option configures the handler returned by New.
+type Option func(*options)
+
+// WithSCIMToken sets the bearer token SCIM clients must present.
+// Without it, the SCIM endpoint rejects every request.
+func WithSCIMToken(token string) Option {
+	return func(o *options) {
+		o.scimToken = token
 	}
+}
 
-	resp, err := http.Get(fmt.Sprintf("%s/config.json", basePath))
-	if err != nil {
-		return err
+// WithAdminToken sets the bearer token required by the endpoints rotating keys and managing consents.
+// Without it, those endpoints reject every request.
+func WithAdminToken(token string) Option {
+	return func(o *options) {
+		o.adminToken = token
 	}
+}
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
+// WithConfigSource sets where users, clients and service providers are loaded from.
+// Defaults to the public configuration repository at config.DefaultURL.
+func WithConfigSource(src config.Source) Option {
+	return func(o *options) {
+		o.configSource = src
 	}
+}
 
-	err = json.Unmarshal(b, &config)
-	if err != nil {
-		return err
+// WithConfigWatch reloads the configuration as soon as its files change.
+// Only local configuration sources can be watched.
+func WithConfigWatch() Option {
+	return func(o *options) {
+		o.configWatch = true
 	}
+}
 
-	for _, sp := range config.ServiceProviders {
-		spResp, err := http.Get(fmt.Sprintf("%s/%s", basePath, strings.TrimPrefix(sp.MetadataURL, "/")))
-		if err != nil {
-			return err
-		}
-		b, err = io.ReadAll(spResp.Body)
-		if err != nil {
-			return err
-		}
+// WithBackend sets where users, clients, tokens and sessions are stored.
+// Defaults to an in-memory backend losing everything on restart.
+func WithBackend(b storage.Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
 
-		meta, err := storage.NewMetadata(b)
-		if err != nil {
-			return err
-		}
+// WithSigningKeys sets the keys OIDC tokens are signed with, the last one of each algorithm being its current key.
+// Keys already known to the backend are left untouched. Without it, a key is generated on first start.
+func WithSigningKeys(keys ...crypto.PrivateKey) Option {
+	return func(o *options) {
+		o.signingKeys = keys
+	}
+}
 
-		if err := s.PutServiceProvider(sp.ID, &storage.ServiceProvider{
-			ID:       sp.ID,
-			Metadata: meta,
-		}); err != nil {
-			return err
-		}
+// WithSigningKeyRotation replaces each OIDC signing key once it is older than every,
+// the replaced keys are still published for the grace period. A zero every disables
+// the scheduled rotation, keys can still be rotated with POST /rotate-signing-key.
+func WithSigningKeyRotation(every, grace time.Duration) Option {
+	return func(o *options) {
+		o.signingKeyRotation = every
+		o.signingKeyGracePeriod = grace
 	}
+}
 
-	for i, u := range config.Users {
-		if err := s.PutUser(u.ID, config.Users[i]); err != nil {
-			return err
-		}
+// WithCryptoKeys sets the 32-byte keys OIDC codes and opaque access tokens are encrypted with, the last one being the current key.
+// Keys already known to the backend are left untouched, the replaced keys are still used to decrypt for storage.CryptoKeyGracePeriod.
+// Without it, a key is generated on first start.
+func WithCryptoKeys(keys ...[]byte) Option {
+	return func(o *options) {
+		o.cryptoKeys = keys
+	}
+}
+
+// WithSAMLKeyPair sets the key and certificate the SAML IdP signs with, unless the backend already knows them.
+// Without it, a self-signed certificate is generated on first start.
+func WithSAMLKeyPair(kp *storage.SAMLKeyPair) Option {
+	return func(o *options) {
+		o.samlKeyPair = kp
 	}
+}
 
-	for _, u := range config.Clients {
-		cl := storage.WebClient(u.ClientID, u.ClientSecret, u.RedirectURIs...)
-		if err := s.RegisterClient(cl.ID, cl); err != nil {
-			return err
+// New returns the handler of the identity provider, or the error preventing it from starting,
+// such as a configuration failing to load.
+func New(serverRemoteAddr string, opts ...Option) (http.Handler, error) {
+	o := &options{signingKeyGracePeriod: storage.DefaultSigningKeyGracePeriod}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.configSource == nil {
+		src, err := config.NewSource(config.DefaultURL)
+		if err != nil {
+			return nil, err
 		}
+		o.configSource = src
 	}
 
-	return nil
-}
+	if o.backend == nil {
+		o.backend = storage.NewMemoryBackend()
+	}
 
-func New(serverRemoteAddr string) http.Handler {
-	stor := storage.NewStorage()
+	stor := storage.NewStorageWithBackend(o.backend)
+	if err := stor.EnsureIndexes(); err != nil {
+		return nil, err
+	}
+	stor.SetSigningKeyGracePeriod(o.signingKeyGracePeriod)
+	for _, key := range o.signingKeys {
+		if err := stor.ImportSigningKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := stor.EnsureSigningKeys(); err != nil {
+		return nil, err
+	}
+	for _, key := range o.cryptoKeys {
+		if err := stor.ImportCryptoKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := stor.EnsureCryptoKey(); err != nil {
+		return nil, err
+	}
+	samlHost := serverRemoteAddr
+	if u, err := url.Parse(serverRemoteAddr); err == nil && u.Hostname() != "" {
+		samlHost = u.Hostname()
+	}
+	if o.samlKeyPair != nil {
+		if err := stor.ImportSAMLKeyPair(o.samlKeyPair); err != nil {
+			return nil, err
+		}
+	}
+	if err := stor.EnsureSAMLKeyPair(samlHost); err != nil {
+		return nil, err
+	}
+	if o.signingKeyRotation > 0 {
+		go rotateSigningKeys(stor, o.signingKeyRotation)
+	}
+	go deleteExpired(stor, time.Minute)
+	pusher := scim.NewPusher(stor)
+	stor.OnUserChange(pusher.UserChanged)
 
-	if err := syncStorage("https://raw.githubusercontent.com/seriousben/dev-identity-provider-config/main/", stor); err != nil {
-		panic(err)
+	syn := &syncer{
+		src:    o.configSource,
+		stor:   stor,
+		pusher: pusher,
+	}
+	if err := syn.sync(); err != nil {
+		return nil, err
 	}
 	go func() {
 		for {
 			// Reset/Sync config daily
 			time.Sleep(24 * time.Hour)
-			if err := syncStorage("https://raw.githubusercontent.com/seriousben/dev-identity-provider-config/main/", stor); err != nil {
+			if err := syn.sync(); err != nil {
 				fmt.Println("error syncing", err)
 			}
 		}
 	}()
+	if o.configWatch {
+		err := config.Watch(context.Background(), o.configSource, 300*time.Millisecond, func() {
+			if err := syn.sync(); err != nil {
+				log.Println("error reloading config, keeping previous config:", err)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("watching config: %w", err)
+		}
+		log.Println("Watching config", o.configSource)
+	}
 
 	oidcHandler := oidc.New(fmt.Sprintf("%s/oidc", serverRemoteAddr), stor)
 	samlHandler := saml.New(fmt.Sprintf("%s/saml2", serverRemoteAddr), stor)
+	scimHandler := scim.New(fmt.Sprintf("%s/scim/v2", serverRemoteAddr), stor, o.scimToken)
+	admin := adminAuthenticator(o.adminToken)
 	r := mux.NewRouter()
 	r.Use(loggingMiddleware)
 
 	r.PathPrefix("/oidc").Handler(http.StripPrefix("/oidc", oidcHandler))
 	r.PathPrefix("/saml2").Handler(http.StripPrefix("/saml2", samlHandler))
+	r.PathPrefix("/scim/v2").Handler(http.StripPrefix("/scim/v2", scimHandler))
 	r.Methods("sdf").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 	r.Path("/refresh-config").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
-		if err := syncStorage("https://raw.githubusercontent.com/seriousben/dev-identity-provider-config/main/", stor); err != nil {
+		if err := syn.sync(); err != nil {
 			log.Println("error", err)
 			fmt.Fprintf(w, `{"error": %q}`, err.Error())
 			return
 		}
 		w.Write([]byte(`{"success": "true"}`))
 	})
+	r.Path("/rotate-signing-key").Methods("POST").Handler(admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		keys, err := stor.RotateSigningKeys()
+		if err != nil {
+			log.Println("error", err)
+			fmt.Fprintf(w, `{"error": %q}`, err.Error())
+			return
+		}
+		kids := make(map[string]string, len(keys))
+		for _, key := range keys {
+			log.Println("Rotated", key.Algorithm, "signing key, new kid", key.ID)
+			kids[key.Algorithm] = key.ID
+		}
+		json.NewEncoder(w).Encode(kids)
+	}))
+	r.Path("/rotate-crypto-key").Methods("POST").Handler(admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		key, err := stor.RotateCryptoKey()
+		if err != nil {
+			log.Println("error", err)
+			fmt.Fprintf(w, `{"error": %q}`, err.Error())
+			return
+		}
+		log.Println("Rotated crypto key, new id", key.ID)
+		fmt.Fprintf(w, `{"id": %q}`, key.ID)
+	}))
+	r.Path("/prepare-saml-certificate").Methods("POST").Handler(admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		kp, err := stor.PrepareSAMLKeyPair(samlHost)
+		if err != nil {
+			log.Println("error", err)
+			fmt.Fprintf(w, `{"error": %q}`, err.Error())
+			return
+		}
+		log.Println("Publishing next SAML certificate", kp.ID)
+		fmt.Fprintf(w, `{"next": %q}`, kp.ID)
+	}))
+	r.Path("/rollover-saml-certificate").Methods("POST").Handler(admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		kp, err := stor.RolloverSAMLKeyPair(samlHost)
+		if err != nil {
+			log.Println("error", err)
+			fmt.Fprintf(w, `{"error": %q}`, err.Error())
+			return
+		}
+		log.Println("Rolled over SAML certificate, now signing with", kp.ID)
+		fmt.Fprintf(w, `{"current": %q}`, kp.ID)
+	}))
+	r.Path("/consents").Methods("GET").Handler(admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		consents, err := stor.Consents(r.URL.Query().Get("user"))
+		if err != nil {
+			log.Println("error", err)
+			fmt.Fprintf(w, `{"error": %q}`, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(consents)
+	}))
+	r.Path("/revoke-consent").Methods("POST").Handler(admin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		revoked, err := stor.RevokeConsent(r.FormValue("user"), r.FormValue("client"))
+		if err != nil {
+			log.Println("error", err)
+			fmt.Fprintf(w, `{"error": %q}`, err.Error())
+			return
+		}
+		for _, consent := range revoked {
+			log.Println("Revoked consent of", consent.UserID, "to", consent.ClientID)
+		}
+		fmt.Fprintf(w, `{"revoked": %d}`, len(revoked))
+	}))
 	r.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
 		users, err := stor.ListUsers()
 		if err != nil {
@@ -235,13 +410,45 @@ func New(serverRemoteAddr string) http.Handler {
 		}
 
 		v := map[string]interface{}{
-			"Clients":          clients,
+			"Clients":          indexClients(clients),
 			"Users":            users,
 			"ServiceProviders": spds,
+			"SCIMTargets":      pusher.Status(),
 			"Version":          version,
 		}
 		indextmpl.Execute(w, v)
 	}))
 
-	return r
+	return r, nil
+}
+
+// adminAuthenticator returns a middleware rejecting the requests without the admin bearer token.
+func adminAuthenticator(adminToken string) func(http.HandlerFunc) http.Handler {
+	return func(next http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				w.Header().Set("content-type", "application/json")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "invalid or missing bearer token"}`))
+				return
+			}
+			next(w, r)
+		})
+	}
+}
+
+// indexClients returns the clients shown on the index page, without the bearer tokens
+// of their SCIM targets, which are credentials of third parties.
+func indexClients(clients []*storage.Client) []*storage.Client {
+	views := make([]*storage.Client, len(clients))
+	for i, c := range clients {
+		view := *c
+		if view.SCIM != nil {
+			view.SCIM = &storage.SCIMTarget{URL: view.SCIM.URL}
+		}
+		views[i] = &view
+	}
+	return views
 }
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+// rotateSigningKeys replaces the signing key of each algorithm each time it gets older than every.
+// The age is taken from the keys themselves, so that restarts do not postpone the rotation.
+func rotateSigningKeys(stor *storage.Storage, every time.Duration) {
+	for {
+		wait := every
+		for _, alg := range storage.SigningAlgorithms {
+			key, err := stor.CurrentSigningKey(alg)
+			if err == nil {
+				if d := time.Until(key.CreatedAt.Add(every)); d > 0 {
+					if d < wait {
+						wait = d
+					}
+					continue
+				}
+			}
+			key, err = stor.RotateSigningKey(alg)
+			if err != nil {
+				log.Println("error rotating signing key:", err)
+				wait = time.Minute
+				continue
+			}
+			log.Println("Rotated", alg, "signing key, new kid", key.ID)
+		}
+		time.Sleep(wait)
+	}
+}
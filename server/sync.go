@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seriousben/dev-identity-provider/internal/config"
+	"github.com/seriousben/dev-identity-provider/internal/scim"
+	"github.com/seriousben/dev-identity-provider/internal/storage"
+)
+
+// syncer keeps the storage in sync with the configuration source.
+type syncer struct {
+	src    config.Source
+	stor   *storage.Storage
+	pusher *scim.Pusher
+
+	mu   sync.Mutex
+	last *storage.ConfigState
+}
+
+// sync loads the configuration and atomically applies it to the storage, removing the
+// entities deleted from the configuration. When the configuration cannot be loaded,
+// the storage is left untouched.
+func (s *syncer) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Println("Syncing storage from", s.src)
+
+	cfg, err := config.Load(s.src)
+	if err != nil {
+		return err
+	}
+
+	overridden, err := s.stor.ReplaceConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if len(overridden) > 0 {
+		log.Printf("config: users changed at runtime, e.g. through SCIM, overridden by the configuration=[%s]", strings.Join(overridden, ","))
+	}
+
+	if s.last != nil {
+		logConfigDiff(s.last, cfg)
+	}
+	s.last = cfg
+	s.pusher.Sync()
+	return nil
+}
+
+// logConfigDiff logs the users, clients and service providers added, removed or changed between two configurations.
+func logConfigDiff(before, after *storage.ConfigState) {
+	diff := func(kind string, before, after map[string]string) {
+		var added, removed, changed []string
+		for id, v := range after {
+			old, ok := before[id]
+			switch {
+			case !ok:
+				added = append(added, id)
+			case old != v:
+				changed = append(changed, id)
+			}
+		}
+		for id := range before {
+			if _, ok := after[id]; !ok {
+				removed = append(removed, id)
+			}
+		}
+		if len(added)+len(removed)+len(changed) == 0 {
+			return
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		sort.Strings(changed)
+		log.Printf("config: %s added=[%s] removed=[%s] changed=[%s]", kind,
+			strings.Join(added, ","), strings.Join(removed, ","), strings.Join(changed, ","))
+	}
+
+	diff("users", fingerprintUsers(before.Users), fingerprintUsers(after.Users))
+	diff("clients", fingerprintClients(before.Clients), fingerprintClients(after.Clients))
+	diff("service providers", fingerprintServiceProviders(before.ServiceProviders), fingerprintServiceProviders(after.ServiceProviders))
+}
+
+func fingerprintUsers(users []*storage.User) map[string]string {
+	rv := make(map[string]string, len(users))
+	for _, u := range users {
+		b, _ := json.Marshal(u)
+		rv[u.ID] = string(b)
+	}
+	return rv
+}
+
+func fingerprintClients(clients []*storage.Client) map[string]string {
+	rv := make(map[string]string, len(clients))
+	for _, c := range clients {
+		b, _ := json.Marshal(c)
+		rv[c.ID] = string(b)
+	}
+	return rv
+}
+
+func fingerprintServiceProviders(sps []*storage.ServiceProvider) map[string]string {
+	rv := make(map[string]string, len(sps))
+	for _, sp := range sps {
+		var buf bytes.Buffer
+		_ = json.NewEncoder(&buf).Encode(sp)
+		_ = xml.NewEncoder(&buf).Encode(sp.Metadata)
+		rv[sp.ID] = buf.String()
+	}
+	return rv
+}